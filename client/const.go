@@ -15,6 +15,9 @@ const (
 	maxIPCVersion = 1
 )
 
+// unixSocketPrefix marks an RPC address as the path of a Unix socket
+const unixSocketPrefix = "unix://"
+
 const (
 	handshakeCommand       = "handshake"
 	eventCommand           = "event"
@@ -35,7 +38,12 @@ const (
 	respondCommand         = "respond"
 	authCommand            = "auth"
 	statsCommand           = "stats"
+	selfCommand            = "self"
 	getCoordinateCommand   = "get-coordinate"
+	queryVersionsCommand   = "query-versions"
+	pauseCommand           = "pause"
+	resumeCommand          = "resume"
+	coordStreamCommand     = "coordinate-stream"
 )
 
 const (
@@ -49,6 +57,7 @@ const (
 	invalidQueryID        = "No pending queries matching ID"
 	authRequired          = "Authentication required"
 	invalidAuthToken      = "Invalid authentication token"
+	permissionDenied      = "Permission denied"
 )
 
 const (
@@ -107,9 +116,10 @@ type joinResponse struct {
 }
 
 type membersFilteredRequest struct {
-	Tags   map[string]string
-	Status string
-	Name   string
+	Tags          map[string]string
+	Status        string
+	Name          string
+	ChangedWithin time.Duration
 }
 
 type membersResponse struct {
@@ -128,6 +138,13 @@ type keyResponse struct {
 	NumResp  int
 }
 
+type versionsResponse struct {
+	Versions map[string]NodeVersion
+	Messages map[string]string
+	NumNodes int
+	NumResp  int
+}
+
 type monitorRequest struct {
 	LogLevel string
 }
@@ -200,6 +217,34 @@ type Member struct {
 	DelegateCur uint8 // Currently set Serf protocol
 }
 
+// NodeVersion is the version information reported by a single
+// member of the Serf cluster
+type NodeVersion struct {
+	Version     string // Build version of the Serf node
+	Protocol    uint8  // Currently set Serf protocol
+	ProtocolMin uint8  // Minimum supported Serf protocol
+	ProtocolMax uint8  // Maximum supported Serf protocol
+	GoVersion   string // Go runtime the node was built with
+}
+
+// Self describes the local agent: its member, the settings it is running
+// with, its versions, its network coordinate and its stats
+type Self struct {
+	Member   Member
+	Config   map[string]string // Agent settings, without secrets
+	Versions NodeVersion
+	Coord    coordinate.Coordinate
+	HasCoord bool // False if coordinates are disabled
+	Stats    map[string]map[string]string
+}
+
+// CoordinateUpdate is a refined network coordinate for a member of
+// the Serf cluster, as delivered by a coordinate stream
+type CoordinateUpdate struct {
+	Node  string
+	Coord coordinate.Coordinate
+}
+
 type memberEventRecord struct {
 	Event   string
 	Members []Member
@@ -1,13 +1,30 @@
 // Copyright (c) HashiCorp, Inc.
 // SPDX-License-Identifier: MPL-2.0
 
+// Package client implements a client for the RPC interface of a Serf
+// agent. It is what the serf CLI uses, and lets Go programs control a
+// remote agent without shelling out:
+//
+//	c, err := client.NewRPCClient("127.0.0.1:7373")
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//
+//	members, err := c.Members()
+//
+// Event streams and log monitors deliver to a channel until stopped with
+// Stop, using the handle returned when they were started.
 package client
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,12 +37,35 @@ import (
 const (
 	// This is the default IO timeout for the client
 	DefaultTimeout = 10 * time.Second
+
+	// CodecMsgpack and CodecJSON are the codecs the client can speak to
+	// the agent. Msgpack is the default and is faster, JSON is mostly
+	// useful to debug or to match clients written in other languages.
+	CodecMsgpack = "msgpack"
+	CodecJSON    = "json"
 )
 
 var (
 	clientClosed = fmt.Errorf("client closed")
 )
 
+// UnsupportedCommandError is returned when the agent does not recognize
+// the RPC command that was sent, which usually means the agent is older
+// than the client. The agent closes the connection after sending this
+// error, so a new client must be created to continue.
+type UnsupportedCommandError struct {
+	// Command is the name of the command the agent rejected. This may be
+	// empty for agents that don't report which command was unsupported.
+	Command string
+}
+
+func (e *UnsupportedCommandError) Error() string {
+	if e.Command == "" {
+		return unsupportedCommand
+	}
+	return fmt.Sprintf("%s: %s", unsupportedCommand, e.Command)
+}
+
 type seqCallback struct {
 	handler func(*responseHeader)
 }
@@ -44,7 +84,8 @@ type seqHandler interface {
 // Config is provided to ClientFromConfig to make
 // a new RPCClient from the given configuration
 type Config struct {
-	// Addr must be the RPC address to contact
+	// Addr must be the RPC address to contact, either a TCP address or
+	// the path of a Unix socket prefixed with unix://
 	Addr string
 
 	// If provided, the client will perform key based auth
@@ -53,6 +94,14 @@ type Config struct {
 	// If provided, overrides the DefaultTimeout used for
 	// IO deadlines
 	Timeout time.Duration
+
+	// If provided, selects the codec used on the connection,
+	// defaults to CodecMsgpack
+	Codec string
+
+	// If provided, the connection to the agent is made over TLS. For a
+	// Unix socket, ServerName must be set to verify the agent.
+	TLSConfig *tls.Config
 }
 
 // RPCClient is used to make requests to the Agent using an RPC mechanism.
@@ -62,11 +111,11 @@ type RPCClient struct {
 	seq uint64
 
 	timeout   time.Duration
-	conn      *net.TCPConn
+	conn      net.Conn
 	reader    *bufio.Reader
 	writer    *bufio.Writer
-	dec       *codec.Decoder
-	enc       *codec.Encoder
+	dec       rpcDecoder
+	enc       rpcEncoder
 	writeLock sync.Mutex
 
 	dispatch     map[uint64]seqHandler
@@ -77,13 +126,23 @@ type RPCClient struct {
 	shutdownLock sync.Mutex
 }
 
-// send is used to send an object using the MsgPack encoding. send
+// rpcDecoder and rpcEncoder are implemented by each codec the client
+// can speak.
+type rpcDecoder interface {
+	Decode(v interface{}) error
+}
+
+type rpcEncoder interface {
+	Encode(v interface{}) error
+}
+
+// send is used to send an object using the configured codec. send
 // is serialized to prevent write overlaps, while properly buffering.
 func (c *RPCClient) send(header *requestHeader, obj interface{}) error {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
 
-	if c.shutdown {
+	if c.IsClosed() {
 		return clientClosed
 	}
 
@@ -127,9 +186,26 @@ func ClientFromConfig(c *Config) (*RPCClient, error) {
 	if c.Timeout == 0 {
 		c.Timeout = DefaultTimeout
 	}
+	if c.Codec == "" {
+		c.Codec = CodecMsgpack
+	}
+	if c.Codec != CodecMsgpack && c.Codec != CodecJSON {
+		return nil, fmt.Errorf("Unsupported codec: %s", c.Codec)
+	}
 
 	// Try to dial to serf
-	conn, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	network, addr := "tcp", c.Addr
+	if strings.HasPrefix(addr, unixSocketPrefix) {
+		network, addr = "unix", strings.TrimPrefix(addr, unixSocketPrefix)
+	}
+	var conn net.Conn
+	var err error
+	if c.TLSConfig != nil {
+		dialer := &net.Dialer{Timeout: c.Timeout}
+		conn, err = tls.DialWithDialer(dialer, network, addr, c.TLSConfig)
+	} else {
+		conn, err = net.DialTimeout(network, addr, c.Timeout)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -138,16 +214,22 @@ func ClientFromConfig(c *Config) (*RPCClient, error) {
 	client := &RPCClient{
 		seq:        0,
 		timeout:    c.Timeout,
-		conn:       conn.(*net.TCPConn),
+		conn:       conn,
 		reader:     bufio.NewReader(conn),
 		writer:     bufio.NewWriter(conn),
 		dispatch:   make(map[uint64]seqHandler),
 		shutdownCh: make(chan struct{}),
 	}
-	client.dec = codec.NewDecoder(client.reader,
-		&codec.MsgpackHandle{RawToString: true, WriteExt: true})
-	client.enc = codec.NewEncoder(client.writer,
-		&codec.MsgpackHandle{RawToString: true, WriteExt: true})
+	// The agent detects the codec from the first message we send
+	if c.Codec == CodecJSON {
+		client.dec = json.NewDecoder(client.reader)
+		client.enc = json.NewEncoder(client.writer)
+	} else {
+		client.dec = codec.NewDecoder(client.reader,
+			&codec.MsgpackHandle{RawToString: true, WriteExt: true})
+		client.enc = codec.NewEncoder(client.writer,
+			&codec.MsgpackHandle{RawToString: true, WriteExt: true})
+	}
 	go client.listen()
 
 	// Do the initial handshake
@@ -170,7 +252,11 @@ func ClientFromConfig(c *Config) (*RPCClient, error) {
 // StreamHandle is an opaque handle passed to stop to stop streaming
 type StreamHandle uint64
 
+// IsClosed returns true once the client has been closed, either by Close
+// or because the connection to the agent was lost.
 func (c *RPCClient) IsClosed() bool {
+	c.shutdownLock.Lock()
+	defer c.shutdownLock.Unlock()
 	return c.shutdown
 }
 
@@ -247,14 +333,23 @@ func (c *RPCClient) Members() ([]Member, error) {
 // MembersFiltered returns a subset of members
 func (c *RPCClient) MembersFiltered(tags map[string]string, status string,
 	name string) ([]Member, error) {
+	return c.MembersChangedWithin(tags, status, name, 0)
+}
+
+// MembersChangedWithin returns the subset of members matching the given
+// filters whose status changed within the given window, as seen by the
+// agent. A window of zero disables the time filter.
+func (c *RPCClient) MembersChangedWithin(tags map[string]string, status string,
+	name string, window time.Duration) ([]Member, error) {
 	header := requestHeader{
 		Command: membersFilteredCommand,
 		Seq:     c.getSeq(),
 	}
 	req := membersFilteredRequest{
-		Tags:   tags,
-		Status: status,
-		Name:   name,
+		Tags:          tags,
+		Status:        status,
+		Name:          name,
+		ChangedWithin: window,
 	}
 	var resp membersResponse
 
@@ -285,6 +380,25 @@ func (c *RPCClient) Leave() error {
 	return c.genericRPC(&header, nil, nil)
 }
 
+// Pause is used to stop the agent from actively spreading gossip
+// without leaving the cluster
+func (c *RPCClient) Pause() error {
+	header := requestHeader{
+		Command: pauseCommand,
+		Seq:     c.getSeq(),
+	}
+	return c.genericRPC(&header, nil, nil)
+}
+
+// Resume is used to restart gossip on an agent after a Pause
+func (c *RPCClient) Resume() error {
+	header := requestHeader{
+		Command: resumeCommand,
+		Seq:     c.getSeq(),
+	}
+	return c.genericRPC(&header, nil, nil)
+}
+
 // UpdateTags will modify the tags on a running serf agent
 func (c *RPCClient) UpdateTags(tags map[string]string, delTags []string) error {
 	header := requestHeader{
@@ -373,6 +487,21 @@ func (c *RPCClient) ListKeys() (map[string]int, int, map[string]string, error) {
 	return resp.Keys, resp.NumNodes, resp.Messages, err
 }
 
+// QueryVersions asks every member of the cluster which versions it is
+// running. It returns the versions keyed by node name, the number of
+// nodes that were expected to respond, and any per-node error messages.
+func (c *RPCClient) QueryVersions() (map[string]NodeVersion, int, map[string]string, error) {
+	header := requestHeader{
+		Command: queryVersionsCommand,
+		Seq:     c.getSeq(),
+	}
+
+	resp := versionsResponse{}
+	err := c.genericRPC(&header, nil, &resp)
+
+	return resp.Versions, resp.NumNodes, resp.Messages, err
+}
+
 // Stats is used to get debugging state information
 func (c *RPCClient) Stats() (map[string]map[string]string, error) {
 	header := requestHeader{
@@ -385,6 +514,21 @@ func (c *RPCClient) Stats() (map[string]map[string]string, error) {
 	return resp, err
 }
 
+// Self is used to describe the agent in a single call, including its
+// config, versions, coordinate and stats
+func (c *RPCClient) Self() (*Self, error) {
+	header := requestHeader{
+		Command: selfCommand,
+		Seq:     c.getSeq(),
+	}
+	var resp Self
+
+	if err := c.genericRPC(&header, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // GetCoordinate is used to retrieve the cached coordinate of a node.
 func (c *RPCClient) GetCoordinate(node string) (*coordinate.Coordinate, error) {
 	header := requestHeader{
@@ -569,6 +713,86 @@ func (c *RPCClient) Stream(filter string, ch chan<- map[string]interface{}) (Str
 	}
 }
 
+type coordinateStreamHandler struct {
+	client   *RPCClient
+	closed   bool
+	init     bool
+	initCh   chan<- error
+	updateCh chan<- CoordinateUpdate
+	seq      uint64
+}
+
+func (ch *coordinateStreamHandler) Handle(resp *responseHeader) {
+	// Initialize on the first response
+	if !ch.init {
+		ch.init = true
+		ch.initCh <- strToError(resp.Error)
+		return
+	}
+
+	// Decode coordinate updates for all other responses
+	var rec CoordinateUpdate
+	if err := ch.client.dec.Decode(&rec); err != nil {
+		log.Printf("[ERR] Failed to decode coordinate update: %v", err)
+		ch.client.deregisterHandler(ch.seq)
+		return
+	}
+	select {
+	case ch.updateCh <- rec:
+	default:
+		log.Printf("[ERR] Dropping coordinate update! Stream channel full")
+	}
+}
+
+func (ch *coordinateStreamHandler) Cleanup() {
+	if !ch.closed {
+		if !ch.init {
+			ch.init = true
+			ch.initCh <- fmt.Errorf("Stream closed")
+		}
+		if ch.updateCh != nil {
+			close(ch.updateCh)
+		}
+		ch.closed = true
+	}
+}
+
+// CoordinateStream is used to subscribe to network coordinate updates
+// as the agent refines them. Updates are dropped if the channel is full.
+func (c *RPCClient) CoordinateStream(ch chan<- CoordinateUpdate) (StreamHandle, error) {
+	// Setup the request
+	seq := c.getSeq()
+	header := requestHeader{
+		Command: coordStreamCommand,
+		Seq:     seq,
+	}
+
+	// Create a coordinate stream handler
+	initCh := make(chan error, 1)
+	handler := &coordinateStreamHandler{
+		client:   c,
+		initCh:   initCh,
+		updateCh: ch,
+		seq:      seq,
+	}
+	c.handleSeq(seq, handler)
+
+	// Send the request
+	if err := c.send(&header, nil); err != nil {
+		c.deregisterHandler(seq)
+		return 0, err
+	}
+
+	// Wait for a response
+	select {
+	case err := <-initCh:
+		return StreamHandle(seq), err
+	case <-c.shutdownCh:
+		c.deregisterHandler(seq)
+		return 0, clientClosed
+	}
+}
+
 type queryHandler struct {
 	client *RPCClient
 	closed bool
@@ -745,6 +969,13 @@ func (c *RPCClient) genericRPC(header *requestHeader, req interface{}, resp inte
 		if respHeader.Error == authRequired {
 			goto SEND_ERR
 		}
+
+		// Same if the agent doesn't know this command, or our token
+		// isn't allowed to call it
+		if strings.HasPrefix(respHeader.Error, unsupportedCommand) ||
+			strings.HasPrefix(respHeader.Error, permissionDenied) {
+			goto SEND_ERR
+		}
 		if resp != nil {
 			err := c.dec.Decode(resp)
 			if err != nil {
@@ -774,6 +1005,10 @@ func (c *RPCClient) genericRPC(header *requestHeader, req interface{}, resp inte
 
 // strToError converts a string to an error if not blank
 func strToError(s string) error {
+	if strings.HasPrefix(s, unsupportedCommand) {
+		command := strings.TrimPrefix(s[len(unsupportedCommand):], ": ")
+		return &UnsupportedCommandError{Command: command}
+	}
 	if s != "" {
 		return fmt.Errorf(s)
 	}
@@ -835,7 +1070,7 @@ func (c *RPCClient) listen() {
 	var respHeader responseHeader
 	for {
 		if err := c.dec.Decode(&respHeader); err != nil {
-			if !c.shutdown {
+			if !c.IsClosed() {
 				log.Printf("[ERR] agent.client: Failed to decode response header: %v", err)
 			}
 			break
@@ -0,0 +1,188 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/cmd/serf/command/agent"
+	"github.com/hashicorp/serf/testutil"
+)
+
+func TestRPCClient_unsupportedCommand(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Rejecting an unknown command never touches the agent
+	ipc := agent.NewAgentIPC(nil, "", nil, l, testutil.TestWriter(t), agent.NewLogWriter(512), false, agent.IPCLimits{})
+	defer ipc.Shutdown()
+
+	client, err := NewRPCClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	// Ask for a response body, which the agent will never send
+	header := requestHeader{
+		Command: "bogus",
+		Seq:     client.getSeq(),
+	}
+	var resp membersResponse
+	err = client.genericRPC(&header, nil, &resp)
+
+	uerr, ok := err.(*UnsupportedCommandError)
+	if !ok {
+		t.Fatalf("bad: %#v", err)
+	}
+	if uerr.Command != "bogus" {
+		t.Fatalf("bad: %#v", uerr)
+	}
+	if err.Error() != "Unsupported command: bogus" {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Older agents don't report the command
+	if err := strToError(unsupportedCommand); err.(*UnsupportedCommandError).Command != "" {
+		t.Fatalf("bad: %#v", err)
+	}
+}
+
+func TestRPCClient_unixSocket(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "serf.sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ipc := agent.NewAgentIPC(nil, "", nil, l, testutil.TestWriter(t), agent.NewLogWriter(512), false, agent.IPCLimits{})
+	defer ipc.Shutdown()
+
+	// Several clients can share the socket at once
+	var clients []*RPCClient
+	for i := 0; i < 3; i++ {
+		client, err := NewRPCClient("unix://" + path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	for _, client := range clients {
+		header := requestHeader{
+			Command: "bogus",
+			Seq:     client.getSeq(),
+		}
+		if _, ok := client.genericRPC(&header, nil, nil).(*UnsupportedCommandError); !ok {
+			t.Fatalf("should reach the agent")
+		}
+	}
+}
+
+func TestRPCClient_tls(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	ca, cert, key := testutil.TLSFiles(t, td)
+
+	conf := agent.Config{RPCTLSCert: cert, RPCTLSKey: key, RPCTLSCA: ca}
+	serverTLS, err := conf.RPCTLSConfig()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l = tls.NewListener(l, serverTLS)
+	ipc := agent.NewAgentIPC(nil, "", nil, l, testutil.TestWriter(t), agent.NewLogWriter(512), false, agent.IPCLimits{})
+	defer ipc.Shutdown()
+
+	pem, err := ioutil.ReadFile(ca)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pem)
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	clientTLS := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{pair}}
+	client, err := ClientFromConfig(&Config{Addr: l.Addr().String(), TLSConfig: clientTLS})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client.Close()
+
+	// Without a client certificate, the agent refuses the connection
+	clientTLS = &tls.Config{RootCAs: roots}
+	if _, err := ClientFromConfig(&Config{Addr: l.Addr().String(), TLSConfig: clientTLS}); err == nil {
+		t.Fatalf("should fail without a client certificate")
+	}
+
+	// Plain connections never complete the handshake
+	if _, err := ClientFromConfig(&Config{Addr: l.Addr().String(), Timeout: 500 * time.Millisecond}); err == nil {
+		t.Fatalf("should fail without TLS")
+	}
+}
+
+func TestRPCClient_close(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ipc := agent.NewAgentIPC(nil, "", nil, l, testutil.TestWriter(t), agent.NewLogWriter(512), false, agent.IPCLimits{})
+	defer ipc.Shutdown()
+
+	client, err := NewRPCClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if client.IsClosed() {
+		t.Fatalf("should not be closed")
+	}
+
+	// Closing while the client is in use is safe
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for !client.IsClosed() {
+			header := requestHeader{Command: "bogus", Seq: client.getSeq()}
+			client.send(&header, nil)
+		}
+	}()
+	if err := client.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	<-doneCh
+
+	if !client.IsClosed() {
+		t.Fatalf("should be closed")
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := client.UserEvent("deploy", nil, false); err != clientClosed {
+		t.Fatalf("err: %v", err)
+	}
+}
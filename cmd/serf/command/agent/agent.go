@@ -10,12 +10,19 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/version"
 )
 
 // Agent starts and manages a Serf instance, adding some niceties
@@ -36,6 +43,39 @@ type Agent struct {
 	eventHandlerList  []EventHandler
 	eventHandlersLock sync.Mutex
 
+	// coordCh is used for Serf to deliver coordinate updates on
+	coordCh chan serf.CoordinateUpdate
+
+	// coordHandlers is the registered handlers for coordinate updates
+	coordHandlers     map[CoordinateHandler]struct{}
+	coordHandlerList  []CoordinateHandler
+	coordHandlersLock sync.Mutex
+
+	// eventStopCh stops the event loop and any replay of drained events
+	// during a shutdown, and eventWg waits for them to return. Events that
+	// were not replayed in time are kept in replayLeft so they can be
+	// drained again.
+	eventStopCh chan struct{}
+	eventWg     sync.WaitGroup
+	replayLeft  []serf.Event
+
+	// healthStopCh stops the health check loop, killing any check that is
+	// running, and healthWg waits for it to return. healthStopOnce lets
+	// Shutdown be tried again if Serf fails to shut down.
+	healthStopCh   chan struct{}
+	healthStopOnce sync.Once
+	healthWg       sync.WaitGroup
+
+	// eventCounts tracks how many events of each type we have received
+	eventCounts     map[string]uint64
+	eventCountsLock sync.Mutex
+
+	// queryCount and queryDuration sum up how long the queries we sent
+	// took to get their last response, for the metrics endpoint
+	queryCount     uint64
+	queryDuration  time.Duration
+	queryStatsLock sync.Mutex
+
 	// logger instance wraps the logOutput
 	logger *log.Logger
 
@@ -58,18 +98,30 @@ func Create(agentConf *Config, conf *serf.Config, logOutput io.Writer) (*Agent,
 	// Setup the underlying loggers
 	conf.MemberlistConfig.LogOutput = logOutput
 	conf.MemberlistConfig.EnableCompression = agentConf.EnableCompression
+	if !agentConf.EnableCompression {
+		conf.CompressionThreshold = 0
+	}
 	conf.LogOutput = logOutput
 
 	// Create a channel to listen for events from Serf
 	eventCh := make(chan serf.Event, 64)
 	conf.EventCh = eventCh
 
+	// Create a channel to listen for coordinate updates from Serf
+	coordCh := make(chan serf.CoordinateUpdate, 64)
+	conf.CoordinateUpdateCh = coordCh
+
 	// Setup the agent
 	agent := &Agent{
 		conf:          conf,
 		agentConf:     agentConf,
 		eventCh:       eventCh,
 		eventHandlers: make(map[EventHandler]struct{}),
+		eventStopCh:   make(chan struct{}),
+		healthStopCh:  make(chan struct{}),
+		coordCh:       coordCh,
+		coordHandlers: make(map[CoordinateHandler]struct{}),
+		eventCounts:   make(map[string]uint64),
 		logger:        log.New(logOutput, "", log.LstdFlags),
 		shutdownCh:    make(chan struct{}),
 	}
@@ -97,7 +149,18 @@ func Create(agentConf *Config, conf *serf.Config, logOutput io.Writer) (*Agent,
 func (a *Agent) Start() error {
 	a.logger.Printf("[INFO] agent: Serf agent starting")
 
+	// Pick up any events drained during the last shutdown
+	var drained []serf.Event
+	if a.agentConf.EventDrainFile != "" {
+		var err error
+		drained, err = loadDrainedEvents(a.agentConf.EventDrainFile)
+		if err != nil {
+			a.logger.Printf("[ERR] agent: %v", err)
+		}
+	}
+
 	// Create serf first
+	a.initHealthCheckTag()
 	serf, err := serf.Create(a.conf)
 	if err != nil {
 		return fmt.Errorf("Error creating Serf: %s", err)
@@ -105,7 +168,20 @@ func (a *Agent) Start() error {
 	a.serf = serf
 
 	// Start event loop
+	a.eventWg.Add(1)
 	go a.eventLoop()
+	go a.coordinateLoop()
+	if a.agentConf.HealthCheckScript != "" {
+		a.healthWg.Add(1)
+		go a.healthCheckLoop()
+	}
+	if a.agentConf.KeyRotateInterval > 0 {
+		go a.keyRotationLoop()
+	}
+	if len(drained) > 0 {
+		a.eventWg.Add(1)
+		go a.replayEvents(drained)
+	}
 	return nil
 }
 
@@ -133,11 +209,27 @@ func (a *Agent) Shutdown() error {
 		goto EXIT
 	}
 
+	// Stop the health check before Serf, so it doesn't set tags on a
+	// Serf that is shutting down
+	a.healthStopOnce.Do(func() { close(a.healthStopCh) })
+	a.healthWg.Wait()
+
 	a.logger.Println("[INFO] agent: requesting serf shutdown")
 	if err := a.serf.Shutdown(); err != nil {
 		return err
 	}
 
+	// Stop handling events. When draining we wait for the event loop, so
+	// that an event is either handled or drained but never both. This only
+	// happens once Serf is shut down, so it is never repeated.
+	close(a.eventStopCh)
+	if a.agentConf.EventDrainFile != "" {
+		a.eventWg.Wait()
+		if err := a.drainEvents(a.agentConf.EventDrainFile); err != nil {
+			a.logger.Printf("[ERR] agent: %v", err)
+		}
+	}
+
 EXIT:
 	a.logger.Println("[INFO] agent: shutdown complete")
 	a.shutdown = true
@@ -161,9 +253,11 @@ func (a *Agent) SerfConfig() *serf.Config {
 	return a.conf
 }
 
-// Join asks the Serf instance to join. See the Serf.Join function.
+// Join asks the Serf instance to join. See the Serf.Join function. Any
+// DNS SRV record names among the addresses are resolved to their targets.
 func (a *Agent) Join(addrs []string, replay bool) (n int, err error) {
 	a.logger.Printf("[INFO] agent: joining: %v replay: %v", addrs, replay)
+	addrs = expandSRVAddrs(addrs, a.logger)
 	ignoreOld := !replay
 	n, err = a.serf.Join(addrs, ignoreOld)
 	if n > 0 {
@@ -251,21 +345,87 @@ func (a *Agent) DeregisterEventHandler(eh EventHandler) {
 
 // eventLoop listens to events from Serf and fans out to event handlers
 func (a *Agent) eventLoop() {
+	defer a.eventWg.Done()
 	serfShutdownCh := a.serf.ShutdownCh()
 	for {
+		// Don't pick up another event once a shutdown has asked us to stop
+		select {
+		case <-a.eventStopCh:
+			return
+		default:
+		}
+
 		select {
 		case e := <-a.eventCh:
 			a.logger.Printf("[INFO] agent: Received event: %s", e.String())
+			typ := e.EventType().String()
+			a.eventCountsLock.Lock()
+			a.eventCounts[typ]++
+			a.eventCountsLock.Unlock()
+			metrics.SetGauge([]string{"agent", "event", "backlog"}, float32(len(a.eventCh)))
+
 			a.eventHandlersLock.Lock()
 			handlers := a.eventHandlerList
 			a.eventHandlersLock.Unlock()
+			start := time.Now()
 			for _, eh := range handlers {
 				eh.HandleEvent(e)
 			}
+			metrics.MeasureSinceWithLabels([]string{"agent", "event", "handle"}, start,
+				[]metrics.Label{{Name: "type", Value: typ}})
 
 		case <-serfShutdownCh:
+			// Shutdown waits for this loop, so it can't be called inline
 			a.logger.Printf("[WARN] agent: Serf shutdown detected, quitting")
-			a.Shutdown()
+			go a.Shutdown()
+			return
+
+		case <-a.eventStopCh:
+			return
+		}
+	}
+}
+
+// RegisterCoordinateHandler adds a handler to receive coordinate updates
+func (a *Agent) RegisterCoordinateHandler(ch CoordinateHandler) {
+	a.coordHandlersLock.Lock()
+	defer a.coordHandlersLock.Unlock()
+
+	a.coordHandlers[ch] = struct{}{}
+	a.coordHandlerList = nil
+	for ch := range a.coordHandlers {
+		a.coordHandlerList = append(a.coordHandlerList, ch)
+	}
+}
+
+// DeregisterCoordinateHandler removes a CoordinateHandler and prevents
+// more invocations
+func (a *Agent) DeregisterCoordinateHandler(ch CoordinateHandler) {
+	a.coordHandlersLock.Lock()
+	defer a.coordHandlersLock.Unlock()
+
+	delete(a.coordHandlers, ch)
+	a.coordHandlerList = nil
+	for ch := range a.coordHandlers {
+		a.coordHandlerList = append(a.coordHandlerList, ch)
+	}
+}
+
+// coordinateLoop listens to coordinate updates from Serf and fans out to
+// coordinate handlers
+func (a *Agent) coordinateLoop() {
+	serfShutdownCh := a.serf.ShutdownCh()
+	for {
+		select {
+		case update := <-a.coordCh:
+			a.coordHandlersLock.Lock()
+			handlers := a.coordHandlerList
+			a.coordHandlersLock.Unlock()
+			for _, ch := range handlers {
+				ch.HandleCoordinate(update)
+			}
+
+		case <-serfShutdownCh:
 			return
 
 		case <-a.shutdownCh:
@@ -274,6 +434,56 @@ func (a *Agent) eventLoop() {
 	}
 }
 
+// replayEvents delivers events drained during the last shutdown to the
+// event handlers, as if they had just been received from Serf. The drain
+// file is removed once every event has been handed to the event loop; from
+// then on any event that goes unhandled is drained again at shutdown.
+func (a *Agent) replayEvents(events []serf.Event) {
+	defer a.eventWg.Done()
+	a.logger.Printf("[INFO] agent: Replaying %d drained events", len(events))
+	for i, e := range events {
+		select {
+		case a.eventCh <- e:
+		case <-a.eventStopCh:
+			a.replayLeft = events[i:]
+			return
+		}
+	}
+
+	if err := os.Remove(a.agentConf.EventDrainFile); err != nil && !os.IsNotExist(err) {
+		a.logger.Printf("[ERR] agent: Failed to remove event drain file: %v", err)
+	}
+}
+
+// EventCounts returns a copy of the number of events received so far,
+// keyed by event type
+func (a *Agent) EventCounts() map[string]uint64 {
+	a.eventCountsLock.Lock()
+	defer a.eventCountsLock.Unlock()
+
+	counts := make(map[string]uint64, len(a.eventCounts))
+	for typ, n := range a.eventCounts {
+		counts[typ] = n
+	}
+	return counts
+}
+
+// observeQuery records how long a query took to get its last response
+func (a *Agent) observeQuery(d time.Duration) {
+	a.queryStatsLock.Lock()
+	defer a.queryStatsLock.Unlock()
+	a.queryCount++
+	a.queryDuration += d
+}
+
+// QueryDurations returns the number of queries that got responses, and
+// how long they took in total to get their last response
+func (a *Agent) QueryDurations() (uint64, time.Duration) {
+	a.queryStatsLock.Lock()
+	defer a.queryStatsLock.Unlock()
+	return a.queryCount, a.queryDuration
+}
+
 // InstallKey initiates a query to install a new key on all members
 func (a *Agent) InstallKey(key string) (*serf.KeyResponse, error) {
 	a.logger.Print("[INFO] agent: Initiating key installation")
@@ -302,9 +512,52 @@ func (a *Agent) ListKeys() (*serf.KeyResponse, error) {
 	return manager.ListKeys()
 }
 
+// QueryVersions sends a query to all members asking which versions
+// they are running
+func (a *Agent) QueryVersions() (*serf.VersionResponse, error) {
+	a.logger.Print("[INFO] agent: Initiating version query")
+	return a.serf.QueryVersions()
+}
+
+// Pause stops the agent from actively spreading gossip without leaving
+// the cluster. See serf.Serf.Pause for details.
+func (a *Agent) Pause() error {
+	a.logger.Print("[INFO] agent: Pausing gossip")
+	return a.serf.Pause()
+}
+
+// Resume restarts gossip after a Pause
+func (a *Agent) Resume() {
+	a.logger.Print("[INFO] agent: Resuming gossip")
+	a.serf.Resume()
+}
+
 // SetTags is used to update the tags. The agent will make sure to
-// persist tags if necessary before gossiping to the cluster.
+// persist tags if necessary before gossiping to the cluster. While a
+// health check is configured, its tag is kept as it is.
 func (a *Agent) SetTags(tags map[string]string) error {
+	if a.agentConf.HealthCheckScript != "" {
+		current, ok := a.serf.LocalMember().Tags[healthCheckTag]
+		if !ok {
+			current = statusUnhealthy
+		}
+		withHealth := make(map[string]string, len(tags)+1)
+		for k, v := range tags {
+			withHealth[k] = v
+		}
+		withHealth[healthCheckTag] = current
+		tags = withHealth
+	}
+	return a.setTags(tags)
+}
+
+// setTags updates the tags as given, see SetTags.
+func (a *Agent) setTags(tags map[string]string) error {
+	// Don't persist tags that Serf would refuse
+	if err := a.serf.ValidateTags(tags); err != nil {
+		return err
+	}
+
 	// Update the tags file if we have one
 	if a.agentConf.TagsFile != "" {
 		if err := a.writeTagsFile(tags); err != nil {
@@ -358,12 +611,14 @@ func (a *Agent) writeTagsFile(tags map[string]string) error {
 }
 
 // MarshalTags is a utility function which takes a map of tag key/value pairs
-// and returns the same tags as strings in 'key=value' format.
+// and returns the same tags as strings in 'key=value' format, sorted by
+// key so the output is stable.
 func MarshalTags(tags map[string]string) []string {
 	var result []string
 	for name, value := range tags {
 		result = append(result, fmt.Sprintf("%s=%s", name, value))
 	}
+	sort.Strings(result)
 	return result
 }
 
@@ -445,12 +700,67 @@ func (a *Agent) Stats() map[string]map[string]string {
 
 	output := map[string]map[string]string{
 		"agent": map[string]string{
-			"name": local.Name,
+			"name":    local.Name,
+			"version": version.GetHumanVersion(),
 		},
 		"runtime":        runtimeStats(),
 		"serf":           a.serf.Stats(),
+		"memberlist":     a.memberlistStats(),
 		"tags":           local.Tags,
 		"event_handlers": event_handlers,
 	}
 	return output
 }
+
+// memberlistStats reports the state of the gossip layer under Serf
+func (a *Agent) memberlistStats() map[string]string {
+	ml := a.serf.Memberlist()
+	local := ml.LocalNode()
+	return map[string]string{
+		"members":      strconv.Itoa(ml.NumMembers()),
+		"health_score": strconv.Itoa(ml.GetHealthScore()),
+		"bind":         net.JoinHostPort(a.conf.MemberlistConfig.BindAddr, strconv.Itoa(a.conf.MemberlistConfig.BindPort)),
+		"advertise":    local.Address(),
+		"protocol":     strconv.Itoa(int(local.PCur)),
+	}
+}
+
+// configStats reports the settings the agent is running with. Secrets are
+// left out, only whether encryption and RPC auth are enabled is reported.
+func (a *Agent) configStats() map[string]string {
+	conf := a.agentConf
+	ml := a.conf.MemberlistConfig
+	return map[string]string{
+		"node_name":           a.conf.NodeName,
+		"role":                conf.Role,
+		"bind":                net.JoinHostPort(ml.BindAddr, strconv.Itoa(ml.BindPort)),
+		"advertise":           conf.AdvertiseAddr,
+		"interface":           conf.Interface,
+		"discover":            conf.Discover,
+		"protocol":            strconv.Itoa(int(a.conf.ProtocolVersion)),
+		"profile":             conf.Profile,
+		"http_addr":           conf.HTTPAddr,
+		"rpc_auth":            strconv.FormatBool(conf.RPCAuthKey != "" || len(conf.RPCTokens) > 0),
+		"encrypt":             strconv.FormatBool(ml.Keyring != nil),
+		"keyring_file":        conf.KeyringFile,
+		"tags_file":           conf.TagsFile,
+		"snapshot_path":       conf.SnapshotPath,
+		"log_level":           conf.LogLevel,
+		"replay_on_join":      strconv.FormatBool(conf.ReplayOnJoin),
+		"disable_coordinates": strconv.FormatBool(a.conf.DisableCoordinates),
+		"start_join":          strings.Join(conf.StartJoin, ","),
+		"retry_join":          strings.Join(conf.RetryJoin, ","),
+	}
+}
+
+// versionStats reports the build and protocol versions of the agent, in the
+// same form as an answer to a version query.
+func (a *Agent) versionStats() serf.NodeVersion {
+	return serf.NodeVersion{
+		Version:     version.GetHumanVersion(),
+		Protocol:    a.conf.ProtocolVersion,
+		ProtocolMin: serf.ProtocolVersionMin,
+		ProtocolMax: serf.ProtocolVersionMax,
+		GoVersion:   runtime.Version(),
+	}
+}
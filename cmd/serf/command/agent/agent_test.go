@@ -10,10 +10,13 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/serf/serf"
 	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
 )
 
 func TestAgent_eventHandler(t *testing.T) {
@@ -178,6 +181,48 @@ func TestAgentTagsFile(t *testing.T) {
 	}
 }
 
+func TestAgentTagsFile_invalidTags(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	agentConfig := DefaultConfig()
+	agentConfig.TagsFile = filepath.Join(td, "tags.json")
+	serfConfig := serf.DefaultConfig()
+	serfConfig.MaxTags = 1
+	a1 := testAgentWithConfig(t, ip1, agentConfig, serfConfig, nil)
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer a1.Shutdown()
+
+	if err := a1.SetTags(map[string]string{"role": "web"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Tags Serf refuses don't make it into the tags file either
+	err = a1.SetTags(map[string]string{"role": "db", "dc": "east"})
+	if err == nil || !strings.Contains(err.Error(), "exceeds limit") {
+		t.Fatalf("err: %v", err)
+	}
+	raw, err := ioutil.ReadFile(agentConfig.TagsFile)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var tags map[string]string
+	if err := json.Unmarshal(raw, &tags); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(tags, map[string]string{"role": "web"}) {
+		t.Fatalf("bad: %#v", tags)
+	}
+}
+
 func TestAgentTagsFile_BadOptions(t *testing.T) {
 	agentConfig := DefaultConfig()
 	agentConfig.TagsFile = "/some/path"
@@ -205,6 +250,14 @@ func TestAgent_MarshalTags(t *testing.T) {
 	if !containsKey(tagPairs, "tag2=val2") {
 		t.Fatalf("bad: %v", tagPairs)
 	}
+
+	// The pairs are sorted by key
+	tags["a"] = "first"
+	tags["z"] = "last"
+	expected := []string{"a=first", "tag1=val1", "tag2=val2", "z=last"}
+	if tagPairs := MarshalTags(tags); !reflect.DeepEqual(tagPairs, expected) {
+		t.Fatalf("bad: %v", tagPairs)
+	}
 }
 
 func TestAgent_UnmarshalTags(t *testing.T) {
@@ -321,3 +374,146 @@ func TestAgentKeyringFile_NoKeys(t *testing.T) {
 		t.Fatalf("bad: %s", err)
 	}
 }
+
+// blockingEventHandler blocks on the first event it gets until released,
+// simulating a slow handler.
+type blockingEventHandler struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (h *blockingEventHandler) HandleEvent(e serf.Event) {
+	h.once.Do(func() {
+		close(h.started)
+		<-h.release
+	})
+}
+
+func TestAgent_drainEvents(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	drainFile := filepath.Join(td, "events")
+
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	agentConfig := DefaultConfig()
+	agentConfig.EventDrainFile = drainFile
+	a1 := testAgentWithConfig(t, ip1, agentConfig, serf.DefaultConfig(), nil)
+	handler := &blockingEventHandler{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	a1.RegisterEventHandler(handler)
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	<-handler.started
+
+	// With the handler stuck, user events pile up undelivered
+	for _, name := range []string{"deploy-1", "deploy-2", "deploy-3"} {
+		if err := a1.UserEvent(name, []byte("foo"), false); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	retry.Run(t, func(r *retry.R) {
+		if n := len(a1.eventCh); n != 3 {
+			r.Fatalf("bad: %d", n)
+		}
+	})
+
+	// Shutdown waits for the stuck handler, which then must not pick up
+	// any of the queued events
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- a1.Shutdown()
+	}()
+	select {
+	case <-a1.eventStopCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout")
+	}
+	close(handler.release)
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if counts := a1.EventCounts(); counts["user"] != 0 {
+		t.Fatalf("bad: %v", counts)
+	}
+	if _, err := os.Stat(drainFile); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The next start replays them and removes the file
+	a2 := testAgentWithConfig(t, ip1, agentConfig, serf.DefaultConfig(), nil)
+	defer a2.Shutdown()
+	replayed := new(MockEventHandler)
+	a2.RegisterEventHandler(replayed)
+	if err := a2.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	retry.Run(t, func(r *retry.R) {
+		replayed.Lock()
+		defer replayed.Unlock()
+
+		var names []string
+		for _, e := range replayed.Events {
+			if ue, ok := e.(serf.UserEvent); ok {
+				names = append(names, ue.Name)
+			}
+		}
+		if !reflect.DeepEqual(names, []string{"deploy-1", "deploy-2", "deploy-3"}) {
+			r.Fatalf("bad: %v", names)
+		}
+		if _, err := os.Stat(drainFile); !os.IsNotExist(err) {
+			r.Fatalf("drain file should be removed: %v", err)
+		}
+	})
+}
+
+func TestLoadDrainedEvents_dedup(t *testing.T) {
+	f, err := ioutil.TempFile("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	line := `{"Type":"user","LTime":4,"Name":"deploy","Payload":"Zm9v"}` + "\n"
+	resent := `{"Type":"user","LTime":4,"Name":"deploy","Payload":"Zm9v","Coalesce":true}` + "\n"
+	member := `{"Type":"member-leave","Members":[{"Name":"node1","Tags":null,"Status":3}]}` + "\n"
+	other := `{"Type":"member-leave","Members":[{"Name":"node2","Tags":null,"Status":3}]}` + "\n"
+	if _, err := f.WriteString(line + member + resent + other + member); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f.Close()
+
+	events, err := loadDrainedEvents(f.Name())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("bad: %#v", events)
+	}
+	ue, ok := events[0].(serf.UserEvent)
+	if !ok || ue.LTime != 4 || ue.Name != "deploy" || string(ue.Payload) != "foo" {
+		t.Fatalf("bad: %#v", events[0])
+	}
+
+	// Member events are all kept, even when they repeat
+	for i, name := range []string{"node1", "node2", "node1"} {
+		me, ok := events[i+1].(serf.MemberEvent)
+		if !ok || me.Type != serf.EventMemberLeave || me.Members[0].Name != name {
+			t.Fatalf("bad: %#v", events[i+1])
+		}
+	}
+
+	// The file is kept until the events have been replayed
+	if _, err := os.Stat(f.Name()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -4,6 +4,7 @@
 package agent
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
@@ -11,8 +12,8 @@ import (
 	"net"
 	"os"
 	"os/signal"
-	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -21,11 +22,13 @@ import (
 	"github.com/hashicorp/logutils"
 	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/version"
 	"github.com/mitchellh/cli"
 )
 
 const (
-	// gracefulTimeout controls how long we wait before forcefully terminating
+	// gracefulTimeout is the least we wait for a graceful leave before
+	// forcefully terminating
 	gracefulTimeout = 3 * time.Second
 
 	// minRetryInterval applies a lower bound to the join retry interval
@@ -35,6 +38,10 @@ const (
 	minBroadcastTimeout = time.Second
 )
 
+// hostname is used to name the node when no name is given. It is a
+// variable so that tests can simulate a missing or unusable hostname.
+var hostname = os.Hostname
+
 // Command is a Command implementation that runs a Serf agent.
 // The command will not end unless a shutdown message is sent on the
 // ShutdownCh. If two messages are sent on the ShutdownCh it will forcibly
@@ -44,8 +51,31 @@ type Command struct {
 	ShutdownCh    <-chan struct{}
 	args          []string
 	scriptHandler *ScriptEventHandler
+	pluginHandler *PluginEventHandler
 	logFilter     *logutils.LevelFilter
 	logger        *log.Logger
+
+	// handoff holds the sockets to pass to the next agent on a graceful
+	// restart, and is nil unless graceful restarts are enabled. restart
+	// is set when a new agent should be started once this one is down.
+	handoff *handoffListeners
+	restart bool
+
+	// mdns is the mDNS discovery layer, if -discover is set.
+	mdns *AgentMDNS
+
+	// logFile is the log file, if -log-file is set.
+	logFile *logFile
+
+	// serviceSignalCh delivers the signal matching a request from the
+	// Windows service control manager to stop the agent. It is nil when
+	// not running as a service.
+	serviceSignalCh <-chan os.Signal
+
+	// retryJoinAddrs are the addresses the retry join attempts, which can
+	// be changed by a reload while it is still running.
+	retryJoinLock  sync.Mutex
+	retryJoinAddrs []string
 }
 
 var _ cli.Command = &Command{}
@@ -57,8 +87,12 @@ func (c *Command) readConfig() *Config {
 	var configFiles []string
 	var tags []string
 	var retryInterval string
+	var retryMaxInterval string
 	var broadcastTimeout string
-	var disableCompression bool
+	var leaveTimeout string
+	var keyRotateInterval string
+	var versionCheckInterval string
+	var reachabilityCheckInterval string
 
 	cmdFlags := flag.NewFlagSet("agent", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
@@ -70,18 +104,51 @@ func (c *Command) readConfig() *Config {
 		"directory of json files to read")
 	cmdFlags.StringVar(&cmdConfig.EncryptKey, "encrypt", "", "encryption key")
 	cmdFlags.StringVar(&cmdConfig.KeyringFile, "keyring-file", "", "path to the keyring file")
+	cmdFlags.StringVar(&keyRotateInterval, "key-rotate-interval", "",
+		"interval to rotate the cluster encryption key at")
 	cmdFlags.Var((*AppendSliceValue)(&cmdConfig.EventHandlers), "event-handler",
 		"command to execute when events occur")
+	cmdFlags.Var((*AppendSliceValue)(&cmdConfig.EventPlugins), "event-plugin",
+		"long running command to send events to")
 	cmdFlags.Var((*AppendSliceValue)(&cmdConfig.StartJoin), "join",
 		"address of agent to join on startup")
 	cmdFlags.BoolVar(&cmdConfig.ReplayOnJoin, "replay", false,
 		"replay events for startup join")
+	cmdFlags.BoolVar(&cmdConfig.StartJoinWarnOnly, "join-warn-only", false,
+		"warn instead of exiting if the startup join fails")
 	cmdFlags.StringVar(&cmdConfig.LogLevel, "log-level", "", "log level")
+	cmdFlags.StringVar(&cmdConfig.LogFile, "log-file", "", "file to also write logs to")
+	cmdFlags.IntVar(&cmdConfig.LogRotateBytes, "log-rotate-bytes", 0,
+		"size in bytes at which the log file is rotated")
+	cmdFlags.IntVar(&cmdConfig.LogRotateMaxFiles, "log-rotate-max-files", 0,
+		"number of rotated log files to keep")
+	cmdFlags.BoolVar(&cmdConfig.LogJSON, "log-json", false, "output logs as JSON")
+	cmdFlags.StringVar(&cmdConfig.PidFile, "pid-file", "", "path to write the agent PID to")
 	cmdFlags.StringVar(&cmdConfig.NodeName, "node", "", "node name")
+	cmdFlags.BoolVar(&cmdConfig.RequireNodeName, "require-node-name", false,
+		"fail to start unless a node name is given")
+	cmdFlags.StringVar(&cmdConfig.NodeNameScheme, "node-name-scheme", "",
+		"how to pick a node name if none is given")
 	cmdFlags.IntVar(&cmdConfig.Protocol, "protocol", -1, "protocol version")
 	cmdFlags.StringVar(&cmdConfig.Role, "role", "", "role name")
 	cmdFlags.StringVar(&cmdConfig.RPCAddr, "rpc-addr", "",
 		"address to bind RPC listener to")
+	cmdFlags.Var((*AppendSliceValue)(&cmdConfig.RPCExtraAddrs), "rpc-extra-addr",
+		"another address to serve RPC on")
+	cmdFlags.BoolVar(&cmdConfig.RPCAuditLog, "rpc-audit-log", false,
+		"log every RPC request for auditing")
+	cmdFlags.StringVar(&cmdConfig.RPCTLSCert, "rpc-tls-cert", "",
+		"certificate to serve RPC over TLS with")
+	cmdFlags.StringVar(&cmdConfig.RPCTLSKey, "rpc-tls-key", "",
+		"private key to serve RPC over TLS with")
+	cmdFlags.StringVar(&cmdConfig.RPCTLSCA, "rpc-tls-ca", "",
+		"CA to verify RPC client certificates with")
+	cmdFlags.StringVar(&cmdConfig.HTTPAddr, "http-addr", "",
+		"address to bind HTTP API and metrics listener to")
+	cmdFlags.StringVar(&cmdConfig.StatsdAddr, "statsd-addr", "",
+		"address of a statsd instance to send metrics to")
+	cmdFlags.StringVar(&cmdConfig.StatsiteAddr, "statsite-addr", "",
+		"address of a statsite instance to send metrics to")
 	cmdFlags.StringVar(&cmdConfig.Profile, "profile", "", "timing profile to use (lan, wan, local)")
 	cmdFlags.StringVar(&cmdConfig.SnapshotPath, "snapshot", "", "path to the snapshot file")
 	cmdFlags.Var((*AppendSliceValue)(&tags), "tag",
@@ -91,27 +158,45 @@ func (c *Command) readConfig() *Config {
 	cmdFlags.StringVar(&cmdConfig.TagsFile, "tags-file", "", "tag persistence file")
 	cmdFlags.BoolVar(&cmdConfig.EnableSyslog, "syslog", false,
 		"enable logging to syslog facility")
+	cmdFlags.StringVar(&cmdConfig.SyslogFacility, "syslog-facility", "",
+		"syslog facility to log to")
 	cmdFlags.Var((*AppendSliceValue)(&cmdConfig.RetryJoin), "retry-join",
 		"address of agent to join on startup with retry")
+	cmdFlags.StringVar(&cmdConfig.RetryJoinURL, "retry-join-url", "",
+		"HTTP URL serving a seed list of agents to join with retry")
+	cmdFlags.BoolVar(&cmdConfig.RetryJoinPin, "retry-join-pin", false,
+		"resolve retry join hostnames once and retry against the pinned IPs")
 	cmdFlags.IntVar(&cmdConfig.RetryMaxAttempts, "retry-max", 0, "maximum retry join attempts")
 	cmdFlags.StringVar(&retryInterval, "retry-interval", "", "retry join interval")
+	cmdFlags.StringVar(&retryMaxInterval, "retry-max-interval", "",
+		"maximum retry join interval when backing off")
 	cmdFlags.BoolVar(&cmdConfig.RejoinAfterLeave, "rejoin", false,
 		"enable re-joining after a previous leave")
+	cmdFlags.BoolVar(&cmdConfig.LeaveOnTerm, "leave-on-terminate", false,
+		"gracefully leave the cluster on a TERM signal")
+	cmdFlags.BoolVar(&cmdConfig.SkipLeaveOnInt, "skip-leave-on-interrupt", false,
+		"shut down without leaving the cluster on an interrupt")
+	cmdFlags.StringVar(&leaveTimeout, "graceful-timeout", "",
+		"how long a graceful leave may take before shutting down anyway")
+	cmdFlags.BoolVar(&cmdConfig.GracefulRestart, "graceful-restart", false,
+		"hand off sockets to a new agent on USR2 instead of leaving")
 
 	cmdFlags.BoolVar(
-		&disableCompression,
+		&cmdConfig.DisableCompression,
 		"disable-compression",
 		false,
 		"disable message compression for broadcasting events",
 	)
 
 	cmdFlags.StringVar(&broadcastTimeout, "broadcast-timeout", "", "timeout for broadcast messages")
+	cmdFlags.StringVar(&versionCheckInterval, "version-check-interval", "",
+		"interval to check members for protocol version drift")
+	cmdFlags.StringVar(&reachabilityCheckInterval, "reachability-check-interval", "",
+		"interval to check for asymmetric connectivity")
 	if err := cmdFlags.Parse(c.args); err != nil {
 		return nil
 	}
 
-	cmdConfig.EnableCompression = !disableCompression
-
 	// Parse any command line tag values
 	tagValues, err := UnmarshalTags(tags)
 	if err != nil {
@@ -130,6 +215,16 @@ func (c *Command) readConfig() *Config {
 		cmdConfig.RetryInterval = dur
 	}
 
+	// Decode the retry max interval if given
+	if retryMaxInterval != "" {
+		dur, err := time.ParseDuration(retryMaxInterval)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error: %s", err))
+			return nil
+		}
+		cmdConfig.RetryMaxInterval = dur
+	}
+
 	// Decode the broadcast timeout if given
 	if broadcastTimeout != "" {
 		dur, err := time.ParseDuration(broadcastTimeout)
@@ -140,6 +235,46 @@ func (c *Command) readConfig() *Config {
 		cmdConfig.BroadcastTimeout = dur
 	}
 
+	// Decode the key rotation interval if given
+	if keyRotateInterval != "" {
+		dur, err := time.ParseDuration(keyRotateInterval)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error: %s", err))
+			return nil
+		}
+		cmdConfig.KeyRotateInterval = dur
+	}
+
+	// Decode the graceful leave timeout if given
+	if leaveTimeout != "" {
+		dur, err := time.ParseDuration(leaveTimeout)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error: %s", err))
+			return nil
+		}
+		cmdConfig.GracefulTimeout = dur
+	}
+
+	// Decode the version check interval if given
+	if versionCheckInterval != "" {
+		dur, err := time.ParseDuration(versionCheckInterval)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error: %s", err))
+			return nil
+		}
+		cmdConfig.VersionCheckInterval = dur
+	}
+
+	// Decode the reachability check interval if given
+	if reachabilityCheckInterval != "" {
+		dur, err := time.ParseDuration(reachabilityCheckInterval)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error: %s", err))
+			return nil
+		}
+		cmdConfig.ReachabilityCheckInterval = dur
+	}
+
 	config := DefaultConfig()
 	if len(configFiles) > 0 {
 		fileConfig, err := ReadConfigPaths(configFiles)
@@ -154,20 +289,68 @@ func (c *Command) readConfig() *Config {
 	config = MergeConfig(config, &cmdConfig)
 
 	if config.NodeName == "" {
-		hostname, err := os.Hostname()
-		if err != nil {
-			c.Ui.Error(fmt.Sprintf("Error determining hostname: %s", err))
+		if config.RequireNodeName {
+			c.Ui.Error("Error: A node name is required, set one with -node or 'node_name'")
 			return nil
 		}
-		config.NodeName = hostname
+
+		name, err := hostname()
+		if err != nil {
+			c.Ui.Output(fmt.Sprintf("Warning: Error determining hostname: %s", err))
+		}
+		if scheme := config.NodeNameScheme; scheme == nodeNameHostnameSuffix || scheme == nodeNameUUID {
+			generated, err := c.randomNodeName(config, name)
+			if err != nil {
+				c.Ui.Error(fmt.Sprintf("Error generating node name: %s", err))
+				return nil
+			}
+			config.NodeName = generated
+		} else if err == nil && usableHostname(name) {
+			config.NodeName = name
+		} else {
+			ifaces, err := net.Interfaces()
+			if err != nil {
+				c.Ui.Error(fmt.Sprintf("Error listing network interfaces: %s", err))
+				return nil
+			}
+			generated, err := generateNodeName(ifaces)
+			if err != nil {
+				c.Ui.Error(fmt.Sprintf("Error generating node name: %s", err))
+				return nil
+			}
+			c.Ui.Output(fmt.Sprintf("Warning: Hostname '%s' can't be used as a node name, using generated name '%s'",
+				name, generated))
+			config.NodeName = generated
+		}
 	}
 
-	eventScripts := config.EventScripts()
-	for _, script := range eventScripts {
-		if !script.Valid() {
-			c.Ui.Error(fmt.Sprintf("Invalid event script: %s", script.String()))
+	// Pick the address to bind to before the addresses are checked
+	if isAutoBind(config.BindAddr) {
+		iface, err := config.NetworkInterface()
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Invalid network interface: %s", err))
 			return nil
 		}
+		bindAddr, err := autoBindAddr(config.BindAddr, iface)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error detecting bind address: %s", err))
+			return nil
+		}
+		c.Ui.Output(fmt.Sprintf("Using private address '%s' to bind to", bindAddr))
+		config.BindAddr = bindAddr
+	}
+
+	if errs := ValidateConfig(config); len(errs) > 0 {
+		for _, err := range errs {
+			c.Ui.Error(err.Error())
+		}
+		return nil
+	}
+
+	// Check the RPC TLS files can be loaded before starting anything
+	if _, err := config.RPCTLSConfig(); err != nil {
+		c.Ui.Error(err.Error())
+		return nil
 	}
 
 	// Check for a valid interface
@@ -197,12 +380,130 @@ func (c *Command) readConfig() *Config {
 
 	// Check snapshot file is provided if we have RejoinAfterLeave
 	if config.RejoinAfterLeave && config.SnapshotPath == "" {
-		c.Ui.Output("Warning: 'RejoinAfterLeave' enabled without snapshot file")
+		c.Ui.Output("Warning: -rejoin has no effect without -snapshot, there are no known peers to rejoin")
 	}
 
 	return config
 }
 
+// profileMemberlistConfig returns the memberlist timing preset for a
+// profile: "lan" for machines in the same network, "wan" for links across
+// datacenters with higher latency, and "local" for agents on one host,
+// such as in tests. The name isn't case sensitive.
+func profileMemberlistConfig(profile string) (*memberlist.Config, error) {
+	switch strings.ToLower(profile) {
+	case "lan":
+		return memberlist.DefaultLANConfig(), nil
+	case "wan":
+		return memberlist.DefaultWANConfig(), nil
+	case "local":
+		return memberlist.DefaultLocalConfig(), nil
+	default:
+		return nil, fmt.Errorf("Unknown profile: %s. Valid profiles are lan, wan and local", profile)
+	}
+}
+
+// applyGossipTiming overrides the timing of a profile's memberlist config
+// with any gossip timing settings in the agent config, and checks that the
+// result is usable.
+func applyGossipTiming(config *Config, ml *memberlist.Config) error {
+	if config.GossipInterval < 0 || config.ProbeInterval < 0 || config.ProbeTimeout < 0 ||
+		config.PushPullInterval < 0 {
+		return fmt.Errorf("Gossip, probe and push/pull intervals and the probe timeout must be positive")
+	}
+	if config.SuspicionMult < 0 || config.RetransmitMult < 0 {
+		return fmt.Errorf("suspicion_mult and retransmit_mult can't be negative")
+	}
+
+	if config.GossipInterval != 0 {
+		ml.GossipInterval = config.GossipInterval
+	}
+	if config.ProbeInterval != 0 {
+		ml.ProbeInterval = config.ProbeInterval
+	}
+	if config.ProbeTimeout != 0 {
+		ml.ProbeTimeout = config.ProbeTimeout
+	}
+	if config.SuspicionMult != 0 {
+		ml.SuspicionMult = config.SuspicionMult
+	}
+	if config.RetransmitMult != 0 {
+		ml.RetransmitMult = config.RetransmitMult
+	}
+	if config.PushPullInterval != 0 {
+		ml.PushPullInterval = config.PushPullInterval
+	}
+	if config.DisableTCPPings {
+		ml.DisableTcpPings = true
+	}
+
+	// A probe has to time out before the next one starts
+	if ml.ProbeTimeout >= ml.ProbeInterval {
+		return fmt.Errorf("probe_timeout (%v) must be less than probe_interval (%v)",
+			ml.ProbeTimeout, ml.ProbeInterval)
+	}
+	return nil
+}
+
+// interfaceIP picks the address to bind to from those of an interface,
+// preferring the same family as an unspecified bind address, falling back
+// to the other. Self-assigned link-local addresses are never used. Returns
+// nil if there is no usable address.
+func interfaceIP(addrs []net.Addr, preferIPv6 bool) net.IP {
+	var fallback net.IP
+	for _, a := range addrs {
+		var ip net.IP
+		switch addr := a.(type) {
+		case *net.IPNet:
+			ip = addr.IP
+		case *net.IPAddr:
+			// Used on Windows, see https://github.com/golang/go/issues/5395
+			ip = addr.IP
+		default:
+			continue
+		}
+
+		if ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+			continue
+		}
+		if (ip.To4() == nil) == preferIPv6 {
+			return ip
+		}
+		if fallback == nil {
+			fallback = ip
+		}
+	}
+	return fallback
+}
+
+// randomNodeName picks the node name for the hostname-suffix and uuid
+// schemes. A name generated by an earlier run is reused if it was kept next
+// to the snapshot, otherwise a new one is generated and kept there.
+func (c *Command) randomNodeName(config *Config, host string) (string, error) {
+	path := nodeNamePath(config.SnapshotPath)
+	if path != "" {
+		name, err := loadNodeName(path)
+		if err != nil || name != "" {
+			return name, err
+		}
+	}
+
+	name, err := randomNodeName(config.NodeNameScheme, host)
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		c.Ui.Output(fmt.Sprintf("Warning: Generated node name '%s' will change on restart, "+
+			"set -snapshot to keep it", name))
+		return name, nil
+	}
+	if err := saveNodeName(path, name); err != nil {
+		return "", err
+	}
+	c.Ui.Output(fmt.Sprintf("Generated node name '%s', kept in %s", name, path))
+	return name, nil
+}
+
 // setupAgent is used to create the agent we use
 func (c *Command) setupAgent(config *Config, logOutput io.Writer) *Agent {
 	bindIP, bindPort, err := config.AddrParts(config.BindAddr)
@@ -223,49 +524,27 @@ func (c *Command) setupAgent(config *Config, logOutput io.Writer) *Agent {
 			return nil
 		}
 
-		// If there is no bind IP, pick an address
-		if bindIP == "0.0.0.0" {
-			found := false
-			for _, a := range addrs {
-				var addrIP net.IP
-				if runtime.GOOS == "windows" {
-					// Waiting for https://github.com/golang/go/issues/5395 to use IPNet only
-					addr, ok := a.(*net.IPAddr)
-					if !ok {
-						continue
-					}
-					addrIP = addr.IP
-				} else {
-					addr, ok := a.(*net.IPNet)
-					if !ok {
-						continue
-					}
-					addrIP = addr.IP
-				}
-
-				// Skip self-assigned IPs
-				if addrIP.IsLinkLocalUnicast() {
-					continue
-				}
-
-				// Found an IP
-				found = true
-				bindIP = addrIP.String()
-				c.Ui.Output(fmt.Sprintf("Using interface '%s' address '%s'",
-					config.Interface, bindIP))
+		if iface.Flags&net.FlagUp == 0 {
+			c.Ui.Output(fmt.Sprintf("Warning: Interface '%s' is down", config.Interface))
+		}
 
-				// Update the configuration
-				bindAddr := &net.TCPAddr{
-					IP:   net.ParseIP(bindIP),
-					Port: bindPort,
-				}
-				config.BindAddr = bindAddr.String()
-				break
-			}
-			if !found {
+		// If there is no bind IP, pick an address
+		if ip := net.ParseIP(bindIP); ip.IsUnspecified() {
+			addrIP := interfaceIP(addrs, ip.To4() == nil)
+			if addrIP == nil {
 				c.Ui.Error(fmt.Sprintf("Failed to find usable address for interface '%s'", config.Interface))
 				return nil
 			}
+			bindIP = addrIP.String()
+			c.Ui.Output(fmt.Sprintf("Using interface '%s' address '%s'",
+				config.Interface, bindIP))
+
+			// Update the configuration
+			bindAddr := &net.TCPAddr{
+				IP:   addrIP,
+				Port: bindPort,
+			}
+			config.BindAddr = bindAddr.String()
 
 		} else {
 			// If there is a bind IP, ensure it is available
@@ -291,7 +570,7 @@ func (c *Command) setupAgent(config *Config, logOutput io.Writer) *Agent {
 	var advertiseIP string
 	var advertisePort int
 	if config.AdvertiseAddr != "" {
-		advertiseIP, advertisePort, err = config.AddrParts(config.AdvertiseAddr)
+		advertiseIP, advertisePort, err = config.AdvertiseAddrParts()
 		if err != nil {
 			c.Ui.Error(fmt.Sprintf("Invalid advertise address: %s", err))
 			return nil
@@ -305,43 +584,102 @@ func (c *Command) setupAgent(config *Config, logOutput io.Writer) *Agent {
 	}
 
 	serfConfig := serf.DefaultConfig()
-	switch config.Profile {
-	case "lan":
-		serfConfig.MemberlistConfig = memberlist.DefaultLANConfig()
-	case "wan":
-		serfConfig.MemberlistConfig = memberlist.DefaultWANConfig()
-	case "local":
-		serfConfig.MemberlistConfig = memberlist.DefaultLocalConfig()
-	default:
-		c.Ui.Error(fmt.Sprintf("Unknown profile: %s", config.Profile))
+	serfConfig.MemberlistConfig, err = profileMemberlistConfig(config.Profile)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return nil
+	}
+	if err := applyGossipTiming(config, serfConfig.MemberlistConfig); err != nil {
+		c.Ui.Error(err.Error())
 		return nil
 	}
 
 	serfConfig.MemberlistConfig.BindAddr = bindIP
 	serfConfig.MemberlistConfig.BindPort = bindPort
+
+	// Own the gossip sockets if they may be handed off to the next agent,
+	// or were handed off to us by the previous one
+	if config.GracefulRestart || c.handoff != nil {
+		if c.handoff == nil {
+			tcpLn, udpLn, err := listenGossip(bindIP, bindPort)
+			if err != nil {
+				c.Ui.Error(err.Error())
+				return nil
+			}
+			c.handoff = &handoffListeners{gossipTCP: tcpLn, gossipUDP: udpLn}
+		}
+
+		// Memberlist only fills in a port picked by the OS for its own
+		// transport, so do it here in case port 0 was given
+		serfConfig.MemberlistConfig.BindPort = c.handoff.gossipTCP.Addr().(*net.TCPAddr).Port
+		transport, err := newListenerTransport(
+			c.handoff.gossipTCP, c.handoff.gossipUDP, log.New(logOutput, "", log.LstdFlags))
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Failed to start gossip transport: %v", err))
+			return nil
+		}
+		serfConfig.MemberlistConfig.Transport = transport
+	}
 	serfConfig.MemberlistConfig.AdvertiseAddr = advertiseIP
 	serfConfig.MemberlistConfig.AdvertisePort = advertisePort
 	serfConfig.MemberlistConfig.SecretKey = encryptKey
 	serfConfig.NodeName = config.NodeName
+	serfConfig.BuildVersion = version.GetHumanVersion()
 	serfConfig.Tags = config.Tags
+	serfConfig.MaxTags = config.MaxTags
 	serfConfig.SnapshotPath = config.SnapshotPath
+	if config.SnapshotCompactionThreshold != 0 {
+		serfConfig.SnapshotCompactionThreshold = config.SnapshotCompactionThreshold
+	}
+	serfConfig.SnapshotMinCompactionInterval = config.SnapshotMinCompactionInterval
+	serfConfig.SnapshotReplayLimit = config.SnapshotReplayLimit
 	serfConfig.ProtocolVersion = uint8(config.Protocol)
 	serfConfig.CoalescePeriod = 3 * time.Second
+	if config.CoalescePeriod != 0 {
+		serfConfig.CoalescePeriod = config.CoalescePeriod
+	}
 	serfConfig.QuiescentPeriod = time.Second
+	if config.QuiescentPeriod != 0 {
+		serfConfig.QuiescentPeriod = config.QuiescentPeriod
+	}
 	serfConfig.QueryResponseSizeLimit = config.QueryResponseSizeLimit
 	serfConfig.QuerySizeLimit = config.QuerySizeLimit
 	serfConfig.UserEventSizeLimit = config.UserEventSizeLimit
+	if config.CompressionThreshold != 0 {
+		serfConfig.CompressionThreshold = config.CompressionThreshold
+	}
+	if config.EventBuffer != 0 {
+		serfConfig.EventBuffer = config.EventBuffer
+	}
+	if config.QueryBuffer != 0 {
+		serfConfig.QueryBuffer = config.QueryBuffer
+	}
+	serfConfig.UserEventRateLimit = config.UserEventRateLimit
+	serfConfig.QueryRateLimit = config.QueryRateLimit
+	if config.RateLimitInterval != 0 {
+		serfConfig.RateLimitInterval = config.RateLimitInterval
+	}
 	serfConfig.UserCoalescePeriod = 3 * time.Second
+	if config.UserCoalescePeriod != 0 {
+		serfConfig.UserCoalescePeriod = config.UserCoalescePeriod
+	}
 	serfConfig.UserQuiescentPeriod = time.Second
+	if config.UserQuiescentPeriod != 0 {
+		serfConfig.UserQuiescentPeriod = config.UserQuiescentPeriod
+	}
 	if config.ReconnectInterval != 0 {
 		serfConfig.ReconnectInterval = config.ReconnectInterval
 	}
 	if config.ReconnectTimeout != 0 {
 		serfConfig.ReconnectTimeout = config.ReconnectTimeout
 	}
+	serfConfig.ReconnectMaxAttempts = config.ReconnectMaxAttempts
 	if config.TombstoneTimeout != 0 {
 		serfConfig.TombstoneTimeout = config.TombstoneTimeout
 	}
+	if config.ReapInterval != 0 {
+		serfConfig.ReapInterval = config.ReapInterval
+	}
 	serfConfig.EnableNameConflictResolution = !config.DisableNameResolution
 	if config.KeyringFile != "" {
 		serfConfig.KeyringFile = config.KeyringFile
@@ -350,6 +688,21 @@ func (c *Command) setupAgent(config *Config, logOutput io.Writer) *Agent {
 	if config.BroadcastTimeout != 0 {
 		serfConfig.BroadcastTimeout = config.BroadcastTimeout
 	}
+	serfConfig.LeaveBroadcastRepeat = config.LeaveBroadcastRepeat
+	if config.LeaveBroadcastInterval != 0 {
+		serfConfig.LeaveBroadcastInterval = config.LeaveBroadcastInterval
+	}
+	serfConfig.VersionCheckInterval = config.VersionCheckInterval
+	serfConfig.ReachabilityCheckInterval = config.ReachabilityCheckInterval
+	serfConfig.HealthScoreThreshold = config.HealthScoreThreshold
+	if config.HealthScoreDebounce != 0 {
+		serfConfig.HealthScoreDebounce = config.HealthScoreDebounce
+	}
+	serfConfig.PartitionFailureRatio = config.PartitionFailureRatio
+	if config.PartitionWindow != 0 {
+		serfConfig.PartitionWindow = config.PartitionWindow
+	}
+	serfConfig.ExpectedClusterSize = config.ExpectedClusterSize
 
 	// Start Serf
 	c.Ui.Output("Starting Serf agent...")
@@ -366,12 +719,17 @@ func (c *Command) setupLoggers(config *Config) (*GatedWriter, *logWriter, io.Wri
 	// Setup logging. First create the gated log writer, which will
 	// store logs until we're ready to show them. Then create the level
 	// filter, filtering logs of the specified level.
+	ui := c.Ui
+	if prefixed, ok := ui.(*cli.PrefixedUi); ok && config.LogJSON {
+		// Keep each JSON log line a valid object on its own
+		ui = prefixed.Ui
+	}
 	logGate := &GatedWriter{
-		Writer: &cli.UiWriter{Ui: c.Ui},
+		Writer: &cli.UiWriter{Ui: ui},
 	}
 
 	c.logFilter = LevelFilter()
-	c.logFilter.MinLevel = logutils.LogLevel(strings.ToUpper(config.LogLevel))
+	c.logFilter.MinLevel = ParseLogLevel(config.LogLevel)
 	c.logFilter.Writer = logGate
 	if !ValidateLevelFilter(c.logFilter.MinLevel, c.logFilter) {
 		c.Ui.Error(fmt.Sprintf(
@@ -391,6 +749,25 @@ func (c *Command) setupLoggers(config *Config) (*GatedWriter, *logWriter, io.Wri
 		syslog = &SyslogWrapper{l, c.logFilter}
 	}
 
+	// Check if a log file is enabled. It gets the same logs as the
+	// agent output.
+	if config.LogFile != "" {
+		l, err := newLogFile(config.LogFile, int64(config.LogRotateBytes),
+			config.LogRotateMaxFiles)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Log file setup failed: %v", err))
+			return nil, nil, nil
+		}
+		c.logFile = l
+		c.logFilter.Writer = io.MultiWriter(logGate, l)
+	}
+
+	// Convert the filtered logs to JSON if asked to. Syslog and the
+	// monitor command keep the plain format.
+	if config.LogJSON {
+		c.logFilter.Writer = &jsonLogWriter{c.logFilter.Writer}
+	}
+
 	// Create a log writer, and wrap a logOutput around it
 	logWriter := NewLogWriter(512)
 	var logOutput io.Writer
@@ -409,12 +786,23 @@ func (c *Command) setupLoggers(config *Config) (*GatedWriter, *logWriter, io.Wri
 func (c *Command) startAgent(config *Config, agent *Agent,
 	logWriter *logWriter, logOutput io.Writer) *AgentIPC {
 	// Add the script event handlers
-	c.scriptHandler = &ScriptEventHandler{
+	c.scriptHandler = NewScriptEventHandler(
+		func() serf.Member { return agent.Serf().LocalMember() },
+		config.EventScripts(),
+		log.New(logOutput, "", log.LstdFlags),
+		config.EventHandlerOutputRate)
+	c.scriptHandler.MaxConcurrency = config.EventHandlerConcurrency
+	c.scriptHandler.Timeout = config.EventHandlerTimeout
+	agent.RegisterEventHandler(c.scriptHandler)
+
+	// Add the event plugins, which are started on their first event
+	c.pluginHandler = &PluginEventHandler{
 		SelfFunc: func() serf.Member { return agent.Serf().LocalMember() },
-		Scripts:  config.EventScripts(),
+		Plugins:  config.EventPluginScripts(),
 		Logger:   log.New(logOutput, "", log.LstdFlags),
+		Timeout:  config.EventHandlerTimeout,
 	}
-	agent.RegisterEventHandler(c.scriptHandler)
+	agent.RegisterEventHandler(c.pluginHandler)
 
 	// Start the agent after the handler is registered
 	if err := agent.Start(); err != nil {
@@ -422,9 +810,10 @@ func (c *Command) startAgent(config *Config, agent *Agent,
 		return nil
 	}
 
-	// Parse the bind address information
-	bindIP, bindPort, err := config.AddrParts(config.BindAddr)
-	bindAddr := &net.TCPAddr{IP: net.ParseIP(bindIP), Port: bindPort}
+	// Parse the bind address information. The port is the one the agent
+	// is listening on, in case port 0 was given.
+	bindIP, _, err := config.AddrParts(config.BindAddr)
+	bindAddr := &net.TCPAddr{IP: net.ParseIP(bindIP), Port: agent.conf.MemberlistConfig.BindPort}
 
 	// Start the discovery layer
 	if config.Discover != "" {
@@ -434,37 +823,112 @@ func (c *Command) startAgent(config *Config, agent *Agent,
 		// Get the bind interface if any
 		iface, _ := config.NetworkInterface()
 
-		_, err := NewAgentMDNS(agent, logOutput, config.ReplayOnJoin,
+		c.mdns, err = NewAgentMDNS(agent, logOutput, config.ReplayOnJoin,
 			config.NodeName, config.Discover, iface, local.Addr, int(local.Port))
 		if err != nil {
 			c.Ui.Error(fmt.Sprintf("Error starting mDNS listener: %s", err))
 			return nil
+		}
+	}
 
+	// Setup the RPC listeners, using the ones handed off to us for the
+	// addresses they are listening on. Those left over are closed, since
+	// their addresses are no longer configured.
+	rpcAddrs := config.RPCAddrs()
+	var inherited, listeners []net.Listener
+	if c.handoff != nil {
+		inherited = c.handoff.rpc
+	}
+	used := make([]bool, len(inherited))
+	closeUnused := func() {
+		for i, ln := range inherited {
+			if !used[i] {
+				ln.Close()
+			}
+		}
+	}
+	closeListeners := func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+	for _, addr := range rpcAddrs {
+		var ln net.Listener
+		for i, in := range inherited {
+			if !used[i] && listenerHasAddr(in, addr) {
+				used[i] = true
+				ln = in
+				break
+			}
 		}
+		if ln == nil {
+			var err error
+			if ln, err = listenRPC(addr); err != nil {
+				c.Ui.Error(fmt.Sprintf("Error starting RPC listener: %s", err))
+				closeListeners()
+				closeUnused()
+				c.stopMDNS()
+				return nil
+			}
+		}
+		listeners = append(listeners, ln)
+	}
+	closeUnused()
+	if c.handoff != nil {
+		c.handoff.rpc = listeners
 	}
 
-	// Setup the RPC listener
-	rpcListener, err := net.Listen("tcp", config.RPCAddr)
+	// Serve over TLS if configured. Extra Unix socket listeners are left
+	// plain, as they can only be reached locally. The handoff keeps the
+	// plain listeners, since that is what a new agent inherits and wraps
+	// in turn.
+	tlsConfig, err := config.RPCTLSConfig()
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error starting RPC listener: %s", err))
+		closeListeners()
+		c.stopMDNS()
 		return nil
 	}
+	served := make([]net.Listener, len(listeners))
+	for i, ln := range listeners {
+		served[i] = ln
+		if config.RPCKeepAlive > 0 {
+			served[i] = &keepAliveListener{Listener: ln, period: config.RPCKeepAlive}
+		}
+		if tlsConfig != nil && (i == 0 || !strings.HasPrefix(rpcAddrs[i], unixSocketPrefix)) {
+			served[i] = tls.NewListener(served[i], tlsConfig)
+		}
+	}
+	rpcListener := newMultiListener(served)
 
 	// Start the IPC layer
 	c.Ui.Output("Starting Serf agent RPC...")
-	ipc := NewAgentIPC(agent, config.RPCAuthKey, rpcListener, logOutput, logWriter)
+	limits := IPCLimits{
+		MaxConns:     config.RPCMaxConns,
+		IdleTimeout:  config.RPCIdleTimeout,
+		ReadTimeout:  config.RPCReadTimeout,
+		WriteTimeout: config.RPCWriteTimeout,
+	}
+	ipc := NewAgentIPC(agent, config.RPCAuthKey, config.RPCTokens, rpcListener, logOutput, logWriter,
+		config.RPCAuditLog, limits)
 
 	c.Ui.Output("Serf agent running!")
 	c.Ui.Info(fmt.Sprintf("                  Node name: '%s'", config.NodeName))
 	c.Ui.Info(fmt.Sprintf("                  Bind addr: '%s'", bindAddr.String()))
 
 	if config.AdvertiseAddr != "" {
-		advertiseIP, advertisePort, _ := config.AddrParts(config.AdvertiseAddr)
+		advertiseIP, advertisePort, _ := config.AdvertiseAddrParts()
 		advertiseAddr := (&net.TCPAddr{IP: net.ParseIP(advertiseIP), Port: advertisePort}).String()
-		c.Ui.Info(fmt.Sprintf("Advertise addr: '%s'", advertiseAddr))
+		c.Ui.Info(fmt.Sprintf("             Advertise addr: '%s'", advertiseAddr))
 	}
 
-	c.Ui.Info(fmt.Sprintf("                   RPC addr: '%s'", config.RPCAddr))
+	for i, ln := range listeners {
+		rpcAddr := rpcAddrs[i]
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			rpcAddr = addr.String()
+		}
+		c.Ui.Info(fmt.Sprintf("                   RPC addr: '%s'", rpcAddr))
+	}
 	c.Ui.Info(fmt.Sprintf("                  Encrypted: %#v", agent.serf.EncryptionEnabled()))
 	c.Ui.Info(fmt.Sprintf("                   Snapshot: %v", config.SnapshotPath != ""))
 	c.Ui.Info(fmt.Sprintf("                    Profile: %s", config.Profile))
@@ -476,6 +940,30 @@ func (c *Command) startAgent(config *Config, agent *Agent,
 	return ipc
 }
 
+// startHTTP is used to start the optional HTTP listener
+func (c *Command) startHTTP(config *Config, agent *Agent, ipc *AgentIPC, logOutput io.Writer) *AgentHTTP {
+	httpListener, err := net.Listen("tcp", config.HTTPAddr)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error starting HTTP listener: %s", err))
+		return nil
+	}
+
+	c.Ui.Info(fmt.Sprintf("                  HTTP addr: '%s'", config.HTTPAddr))
+	return NewAgentHTTP(agent, ipc, config.RPCAuthKey, config.RPCTokens, httpListener, logOutput,
+		config.RPCAuditLog)
+}
+
+// stopMDNS shuts down the mDNS discovery layer, if it was started.
+func (c *Command) stopMDNS() {
+	if c.mdns == nil {
+		return
+	}
+	if err := c.mdns.Shutdown(); err != nil {
+		c.logger.Printf("[WARN] agent: Error shutting down mDNS: %v", err)
+	}
+	c.mdns = nil
+}
+
 // startupJoin is invoked to handle any joins specified to take place at start time
 func (c *Command) startupJoin(config *Config, agent *Agent) error {
 	if len(config.StartJoin) == 0 {
@@ -485,6 +973,10 @@ func (c *Command) startupJoin(config *Config, agent *Agent) error {
 	c.Ui.Output(fmt.Sprintf("Joining cluster...(replay: %v)", config.ReplayOnJoin))
 	n, err := agent.Join(config.StartJoin, config.ReplayOnJoin)
 	if err != nil {
+		if config.StartJoinWarnOnly {
+			c.Ui.Output(fmt.Sprintf("Warning: Failed to join cluster, continuing: %v", err))
+			return nil
+		}
 		return err
 	}
 
@@ -496,19 +988,51 @@ func (c *Command) startupJoin(config *Config, agent *Agent) error {
 // single successful join or RetryMaxAttempts is reached
 func (c *Command) retryJoin(config *Config, agent *Agent, errCh chan struct{}) {
 	// Quit fast if there is no nodes to join
-	if len(config.RetryJoin) == 0 {
+	if len(config.RetryJoin) == 0 && config.RetryJoinURL == "" {
 		return
 	}
+	c.setRetryJoinAddrs(config.RetryJoin)
+
+	var seeds *seedList
+	if config.RetryJoinURL != "" {
+		seeds = newSeedList(config.RetryJoinURL, c.logger)
+	}
+
+	var pinner *joinPinner
+	if config.RetryJoinPin {
+		pinner = newJoinPinner(config.RetryJoinResolveInterval, c.logger)
+	}
 
 	// Track the number of join attempts
 	attempt := 0
 	for {
+		addrs := c.getRetryJoinAddrs()
+		var fetched []string
+		if seeds != nil {
+			// Errors are logged by the seed list, which falls back to
+			// the last-known addresses
+			fetched, _ = seeds.Addresses()
+			addrs = append(addrs, fetched...)
+		}
+		if pinner != nil {
+			addrs = pinner.Addresses(addrs, time.Now())
+		}
+
 		// Try to perform the join
-		c.logger.Printf("[INFO] agent: Joining cluster...(replay: %v)", config.ReplayOnJoin)
-		n, err := agent.Join(config.RetryJoin, config.ReplayOnJoin)
-		if err == nil {
-			c.logger.Printf("[INFO] agent: Join completed. Synced with %d initial agents", n)
-			return
+		var err error
+		if len(addrs) == 0 {
+			err = fmt.Errorf("No addresses to join")
+		} else {
+			c.logger.Printf("[INFO] agent: Joining cluster...(replay: %v)", config.ReplayOnJoin)
+			var n int
+			n, err = agent.Join(addrs, config.ReplayOnJoin)
+			if err == nil {
+				c.logger.Printf("[INFO] agent: Join completed. Synced with %d initial agents", n)
+				if seeds != nil && config.RetryJoinURLInterval > 0 {
+					c.refreshSeedList(config, agent, seeds, fetched)
+				}
+				return
+			}
 		}
 
 		// Check if the maximum attempts has been exceeded
@@ -520,9 +1044,100 @@ func (c *Command) retryJoin(config *Config, agent *Agent, errCh chan struct{}) {
 		}
 
 		// Log the failure and sleep
-		c.logger.Printf("[WARN] agent: Join failed: %v, retrying in %v", err, config.RetryInterval)
-		time.Sleep(config.RetryInterval)
+		wait := retryJoinWait(config.RetryInterval, config.RetryMaxInterval, attempt)
+		c.logger.Printf("[WARN] agent: Join failed: %v, retrying in %v", err, wait)
+		time.Sleep(wait)
+	}
+}
+
+// refreshSeedList fetches the seed list again on every RetryJoinURLInterval
+// until the agent shuts down, and joins the addresses that weren't in the
+// list fetched before, so agents added to it later are joined too. An
+// address that can't be joined is tried again on the next refresh.
+func (c *Command) refreshSeedList(config *Config, agent *Agent, seeds *seedList, fetched []string) {
+	known := make(map[string]struct{}, len(fetched))
+	for _, addr := range fetched {
+		known[addr] = struct{}{}
+	}
+	for {
+		select {
+		case <-time.After(config.RetryJoinURLInterval):
+		case <-agent.ShutdownCh():
+			return
+		}
+
+		// Errors are logged by the seed list
+		addrs, err := seeds.Addresses()
+		if err != nil {
+			continue
+		}
+
+		// Forget the addresses that were dropped from the list, so they
+		// are joined again if they come back
+		current := make(map[string]struct{}, len(addrs))
+		var added []string
+		for _, addr := range addrs {
+			current[addr] = struct{}{}
+			if _, ok := known[addr]; !ok {
+				added = append(added, addr)
+			}
+		}
+		for addr := range known {
+			if _, ok := current[addr]; !ok {
+				delete(known, addr)
+			}
+		}
+		if len(added) == 0 {
+			continue
+		}
+
+		// Join the new addresses one at a time, so only the ones that
+		// worked are taken as known
+		c.logger.Printf("[INFO] agent: Joining %d new addresses from the seed list", len(added))
+		joined := 0
+		for _, addr := range added {
+			if _, err := agent.Join([]string{addr}, config.ReplayOnJoin); err != nil {
+				c.logger.Printf("[WARN] agent: Failed to join seed list address %s: %v", addr, err)
+				continue
+			}
+			known[addr] = struct{}{}
+			joined++
+		}
+		c.logger.Printf("[INFO] agent: Join completed. Synced with %d new agents", joined)
+	}
+}
+
+// setRetryJoinAddrs changes the addresses the retry join attempts.
+func (c *Command) setRetryJoinAddrs(addrs []string) {
+	c.retryJoinLock.Lock()
+	defer c.retryJoinLock.Unlock()
+	c.retryJoinAddrs = append([]string{}, addrs...)
+}
+
+// getRetryJoinAddrs returns a copy of the addresses the retry join
+// attempts.
+func (c *Command) getRetryJoinAddrs() []string {
+	c.retryJoinLock.Lock()
+	defer c.retryJoinLock.Unlock()
+	return append([]string{}, c.retryJoinAddrs...)
+}
+
+// retryJoinWait returns how long to wait after the given number of failed
+// retry join attempts. Without a max interval the wait is always interval,
+// otherwise it doubles with each attempt until it reaches max.
+func retryJoinWait(interval, max time.Duration, attempt int) time.Duration {
+	if max <= interval {
+		return interval
+	}
+
+	wait := interval
+	for i := 1; i < attempt && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
 	}
+	return wait
 }
 
 func (c *Command) Run(args []string) int {
@@ -540,11 +1155,23 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	// Report to the service control manager if running as a Windows service
+	serviceSignalCh, serviceDone, err := startService()
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+	defer serviceDone()
+	c.serviceSignalCh = serviceSignalCh
+
 	// Setup the log outputs
 	logGate, logWriter, logOutput := c.setupLoggers(config)
 	if logWriter == nil {
 		return 1
 	}
+	if c.logFile != nil {
+		defer c.logFile.Close()
+	}
 
 	/*
 		Setup telemetry
@@ -585,6 +1212,26 @@ func (c *Command) Run(args []string) int {
 		metrics.NewGlobal(metricsConf, inm)
 	}
 
+	// Pick up the sockets of the agent we are replacing, if any, and wait
+	// for it to stop. Only one of us may serve or write the snapshot at a
+	// time, and it drains any events it has not handled for us to replay.
+	inherited, parent, err := inheritedListeners()
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+	c.handoff = inherited
+	if parent != nil {
+		c.Ui.Output("Waiting for the agent handing off to stop...")
+		if err := parent.prepared(); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+	}
+
+	// Start a new agent once we have fully shut down, if requested
+	defer c.finishRestart()
+
 	// Setup serf
 	agent := c.setupAgent(config, logOutput)
 	if agent == nil {
@@ -598,6 +1245,45 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 	defer ipc.Shutdown()
+	defer c.stopMDNS()
+	defer c.pluginHandler.Shutdown()
+	defer c.scriptHandler.Shutdown()
+
+	// Write the PID file now that the agent is up
+	if config.PidFile != "" {
+		if err := writePidFile(config.PidFile); err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+		defer func() {
+			if err := removePidFile(config.PidFile); err != nil {
+				c.Ui.Error(err.Error())
+			}
+		}()
+	}
+
+	// Start the HTTP metrics endpoint if enabled
+	var httpServer *AgentHTTP
+	if config.HTTPAddr != "" {
+		httpServer = c.startHTTP(config, agent, ipc, logOutput)
+		if httpServer == nil {
+			return 1
+		}
+		defer httpServer.Shutdown()
+	}
+
+	// stop shuts down everything the deferred calls above do, without
+	// leaving, so a graceful restart can stop before the new agent serves
+	stop := func() {
+		if httpServer != nil {
+			httpServer.Shutdown()
+		}
+		c.pluginHandler.Shutdown()
+		c.scriptHandler.Shutdown()
+		c.stopMDNS()
+		ipc.Shutdown()
+		agent.Shutdown()
+	}
 
 	// Join startup nodes if specified
 	if err := c.startupJoin(config, agent); err != nil {
@@ -605,6 +1291,16 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
+	// Let the agent we are replacing know we took over. systemd already
+	// saw the agent as ready, and is passed our PID by the previous agent.
+	if parent != nil {
+		if err := parent.running(); err != nil {
+			c.Ui.Error(err.Error())
+		}
+	} else if err := sdNotify(sdReady); err != nil {
+		c.Ui.Error(err.Error())
+	}
+
 	// Enable log streaming
 	c.Ui.Info("")
 	c.Ui.Output("Log data will now stream in as it occurs:\n")
@@ -615,13 +1311,19 @@ func (c *Command) Run(args []string) int {
 	go c.retryJoin(config, agent, retryJoinCh)
 
 	// Wait for exit
-	return c.handleSignals(config, agent, retryJoinCh)
+	return c.handleSignals(config, agent, retryJoinCh, stop)
 }
 
 // handleSignals blocks until we get an exit-causing signal
-func (c *Command) handleSignals(config *Config, agent *Agent, retryJoin chan struct{}) int {
+func (c *Command) handleSignals(config *Config, agent *Agent, retryJoin chan struct{}, stop func()) int {
 	signalCh := make(chan os.Signal, 4)
 	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	if handoffSignal != nil {
+		signal.Notify(signalCh, handoffSignal)
+	}
+	if dumpSignal != nil {
+		signal.Notify(signalCh, dumpSignal)
+	}
 
 	// Wait for a signal
 WAIT:
@@ -631,6 +1333,8 @@ WAIT:
 		sig = s
 	case <-c.ShutdownCh:
 		sig = os.Interrupt
+	case s := <-c.serviceSignalCh:
+		sig = s
 	case <-retryJoin:
 		// Retry join failed!
 		return 1
@@ -642,20 +1346,39 @@ WAIT:
 
 	// Check if this is a SIGHUP
 	if sig == syscall.SIGHUP {
+		if err := sdNotify(sdReloading); err != nil {
+			c.Ui.Error(err.Error())
+		}
 		config = c.handleReload(config, agent)
+		if err := sdNotify(sdReady); err != nil {
+			c.Ui.Error(err.Error())
+		}
 		goto WAIT
 	}
 
-	// Check if we should do a graceful leave
-	graceful := false
-	if sig == os.Interrupt && !config.SkipLeaveOnInt {
-		graceful = true
-	} else if sig == syscall.SIGTERM && config.LeaveOnTerm {
-		graceful = true
+	// Check if this is a request for diagnostics
+	if dumpSignal != nil && sig == dumpSignal {
+		for _, line := range diagnostics(agent, config.SnapshotPath) {
+			c.logger.Printf("[INFO] agent: %s", line)
+		}
+		goto WAIT
+	}
+
+	// Check if this is a restart request
+	if handoffSignal != nil && sig == handoffSignal {
+		if c.handleRestart(agent, stop) {
+			return 0
+		}
+		goto WAIT
+	}
+
+	// Let systemd know we are on our way down
+	if err := sdNotify(sdStopping); err != nil {
+		c.Ui.Error(err.Error())
 	}
 
 	// Bail fast if not doing a graceful leave
-	if !graceful {
+	if !leaveOnSignal(sig, config) {
 		return 1
 	}
 
@@ -670,17 +1393,118 @@ WAIT:
 		close(gracefulCh)
 	}()
 
-	// Wait for leave or another signal
+	// Wait for leave or another signal, and shut down anyway if the leave
+	// takes too long
+	timeout := config.GracefulTimeout
+	if timeout == 0 {
+		timeout = gracefulLeaveTimeout(agent.SerfConfig())
+	}
 	select {
 	case <-signalCh:
 		return 1
-	case <-time.After(gracefulTimeout):
+	case <-time.After(timeout):
+		c.Ui.Error(fmt.Sprintf("Graceful leave didn't finish within %v, shutting down", timeout))
 		return 1
 	case <-gracefulCh:
 		return 0
 	}
 }
 
+// gracefulLeaveTimeout is how long to wait for a graceful leave. A leave
+// may wait up to the broadcast timeout for the leave intent to be sent,
+// again while it is repeated, and again for memberlist to leave, before
+// waiting for it to propagate, so the wait grows with the broadcast timeout.
+func gracefulLeaveTimeout(conf *serf.Config) time.Duration {
+	timeout := 2*conf.BroadcastTimeout + conf.LeavePropagateDelay
+	if conf.LeaveBroadcastRepeat > 0 {
+		timeout += conf.BroadcastTimeout
+	}
+	if timeout < gracefulTimeout {
+		return gracefulTimeout
+	}
+	return timeout
+}
+
+// leaveOnSignal checks if the agent should gracefully leave the cluster
+// before shutting down on the given signal. An interrupt leaves unless
+// SkipLeaveOnInt is set, and a TERM only leaves if LeaveOnTerm is set.
+func leaveOnSignal(sig os.Signal, config *Config) bool {
+	switch sig {
+	case os.Interrupt:
+		return !config.SkipLeaveOnInt
+	case syscall.SIGTERM:
+		return config.LeaveOnTerm
+	default:
+		return false
+	}
+}
+
+// handleRestart is invoked when we should restart the agent, e.g. USR2
+// after a new binary is installed. With graceful restarts, the sockets are
+// handed off to a new agent. Once it is prepared to take over, we stop
+// without leaving using the given function, and only then does the new
+// agent start serving, so peers never notice. If the sockets can't be
+// handed off, we leave and a new agent is started once we have shut down.
+// Returns true if this agent should stop.
+func (c *Command) handleRestart(agent *Agent, stop func()) bool {
+	c.Ui.Output("Restarting agent...")
+	if c.handoff != nil {
+		files, err := c.handoff.files()
+		if err == nil {
+			child, err := startHandoff(files)
+			if err != nil {
+				// Stay up rather than risk leaving the node down
+				c.Ui.Error(fmt.Sprintf("Failed to hand off to a new agent: %v", err))
+				return false
+			}
+
+			c.Ui.Output("Handing off to the new agent, shutting down without leaving")
+			stop()
+			if err := child.takeOver(); err != nil {
+				// We have already stopped, so all that is left is to start
+				// a new agent the usual way
+				c.Ui.Error(fmt.Sprintf("Failed to hand off to a new agent: %v", err))
+				c.restart = true
+				return true
+			}
+
+			// systemd has to follow the main PID over to the new agent
+			if err := sdNotify(fmt.Sprintf("MAINPID=%d", child.pid())); err != nil {
+				c.Ui.Error(err.Error())
+			}
+			c.Ui.Output("Handed off to the new agent")
+			return true
+		}
+		c.Ui.Error(fmt.Sprintf("Unable to hand off sockets: %v", err))
+	}
+
+	c.Ui.Output("Restarting with a leave and rejoin...")
+	if err := agent.Leave(); err != nil {
+		c.Ui.Error(fmt.Sprintf("Error: %s", err))
+	}
+	c.restart = true
+	return true
+}
+
+// finishRestart starts a new agent with the same arguments, if a restart
+// without a handoff was requested. It runs once this agent has shut down
+// and released its ports.
+func (c *Command) finishRestart() {
+	if !c.restart {
+		return
+	}
+	cmd := newAgentProcess()
+	if err := cmd.Start(); err != nil {
+		c.Ui.Error(fmt.Sprintf("Failed to start new agent: %v", err))
+		return
+	}
+
+	// systemd has to follow the main PID over to the new agent
+	if err := sdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid)); err != nil {
+		c.Ui.Error(err.Error())
+	}
+}
+
 // handleReload is invoked when we should reload our configs, e.g. SIGHUP
 func (c *Command) handleReload(config *Config, agent *Agent) *Config {
 	c.Ui.Output("Reloading configuration...")
@@ -691,7 +1515,7 @@ func (c *Command) handleReload(config *Config, agent *Agent) *Config {
 	}
 
 	// Change the log level
-	minLevel := logutils.LogLevel(strings.ToUpper(newConf.LogLevel))
+	minLevel := ParseLogLevel(newConf.LogLevel)
 	if ValidateLevelFilter(minLevel, c.logFilter) {
 		c.logFilter.SetMinLevel(minLevel)
 	} else {
@@ -705,6 +1529,11 @@ func (c *Command) handleReload(config *Config, agent *Agent) *Config {
 
 	// Change the event handlers
 	c.scriptHandler.UpdateScripts(newConf.EventScripts())
+	c.pluginHandler.UpdatePlugins(newConf.EventPluginScripts())
+
+	// Change the addresses of a retry join that is still running. Once
+	// joined, the cluster keeps track of its members itself.
+	c.setRetryJoinAddrs(newConf.RetryJoin)
 
 	// Update the tags in serf
 	if err := agent.SetTags(newConf.Tags); err != nil {
@@ -729,7 +1558,10 @@ Usage: serf agent [options]
 Options:
 
   -bind=0.0.0.0:7946       Address to bind network listeners to. To use an IPv6
-                           address, specify [::1] or [::1]:7946.
+                           address, specify [::1] or [::1]:7946. Use "auto", or
+                           "auto:7946", to bind to the private IPv4 address of
+                           the host, or of -iface if it is set. This fails if
+                           there are several to choose from.
   -iface                   Network interface to bind to. Can be used instead of
                            -bind if the interface is known but not the address.
                            If both are provided, then Serf verifies that the
@@ -751,33 +1583,98 @@ Options:
                            by Serf. As encryption keys are changed, the content of
                            this file is updated so that the same keys may be used
                            during later agent starts.
+  -key-rotate-interval=0s  When set, this agent replaces the encryption key of the
+                           whole cluster with a new one at this interval. Requires
+                           -keyring-file, and should only be set on one agent.
   -event-handler=foo       Script to execute when events occur. This can
                            be specified multiple times. See the event scripts
                            section below for more info.
+  -event-plugin=foo        Long running command to send events to as JSON on
+                           stdin, instead of starting a script for each event.
+                           This can be specified multiple times.
   -join=addr               An initial agent to join with. This flag can be
                            specified multiple times.
+  -join-warn-only          Warn instead of exiting if none of the -join
+                           agents can be joined.
   -log-level=info          Log level of the agent.
+  -log-file=/path/to/file  Also write the logs to this file, appending to it if it
+                           exists.
+  -log-rotate-bytes=0      Rotate the log file once it would grow beyond this many
+                           bytes. Defaults to 0, which never rotates.
+  -log-rotate-max-files=0  Number of rotated log files to keep. Defaults to 0,
+                           which keeps all of them.
+  -log-json                Output the logs, and write the log file, as one JSON
+                           object per line.
   -node=hostname           Name of this node. Must be unique in the cluster
+  -require-node-name       Fail to start unless a node name is given with -node
+                           or in a config file. Otherwise, the hostname is used,
+                           or a name generated from the network interface if the
+                           hostname is missing or unsuitable.
+  -node-name-scheme=hostname
+                           How to pick a node name if none is given: 'hostname',
+                           'hostname-suffix' to add a random suffix to the
+                           hostname, or 'uuid'. Generated names are kept next to
+                           the -snapshot file so they survive restarts.
+  -pid-file=/path/to/file  Write the PID of the agent to this file once it has
+                           started, removing it when the agent exits.
   -profile=[lan|wan|local] Profile is used to control the timing profiles used in Serf.
 						   The default if not provided is lan.
   -protocol=n              Serf protocol version to use. This defaults to
                            the latest version, but can be set back for upgrades.
+                           Run "serf version" to see the supported versions.
   -rejoin                  Ignores a previous leave and attempts to rejoin the cluster.
                            Only works if provided along with a snapshot file.
+  -leave-on-terminate      Gracefully leave the cluster on a TERM signal. By default
+                           the agent shuts down without leaving, and is seen as failed.
+  -skip-leave-on-interrupt Shut down without leaving the cluster on an interrupt. By
+                           default an interrupt gracefully leaves.
+  -graceful-timeout=0s     How long a graceful leave on a signal may take before the
+                           agent shuts down anyway. Defaults to a few multiples of
+                           the broadcast timeout.
+  -graceful-restart        On a USR2 signal, hands the gossip and RPC sockets off to a
+                           newly started agent and stops without leaving, so the
+                           restart is invisible to the cluster. Without it, USR2
+                           restarts the agent with a leave and rejoin.
   -retry-join=addr         An agent to join with. This flag be specified multiple times.
                            Does not exit on failure like -join, used to retry until success.
+  -retry-join-url=url      URL of an HTTP endpoint serving a list of addresses to
+                           join with retry, as JSON or one address per line. The
+                           list is fetched again on every attempt.
+  -retry-join-pin          Resolve the hostnames of the retry join addresses once
+                           and retry against the pinned IPs, rather than resolving
+                           again on every attempt.
   -retry-interval=30s      Sets the interval on which a node will attempt to retry joining
                            nodes provided by -retry-join. Defaults to 30s.
   -retry-max=0             Limits the number of retry events. Defaults to 0 for unlimited.
+  -retry-max-interval=0s   Backs off exponentially between retry joins, starting
+                           at -retry-interval and doubling up to this maximum.
   -disable-compression     Disable message compression for broadcasting events. Enabled by default.
   -role=foo                The role of this node, if any. This can be used
                            by event scripts to differentiate different types
                            of nodes that may be part of the same cluster.
                            '-role' is deprecated in favor of '-tag role=foo'.
-  -rpc-addr=127.0.0.1:7373 Address to bind the RPC listener.
+  -rpc-addr=127.0.0.1:7373 Address to bind the RPC listener. Use
+                           unix:///path/to/serf.sock to listen on a Unix
+                           socket instead.
+  -rpc-extra-addr=addr     Another address to serve the RPC interface on, in
+                           the same form as -rpc-addr. Can be specified multiple
+                           times. TLS only applies to TCP addresses given here.
+  -rpc-audit-log           Log the client address, command and outcome of
+                           every RPC request. Request bodies are not logged.
+  -rpc-tls-cert=cert.pem   Certificate to serve the RPC interface over TLS
+                           with. Requires -rpc-tls-key.
+  -rpc-tls-key=key.pem     Private key for the RPC TLS certificate.
+  -rpc-tls-ca=ca.pem       CA bundle to verify RPC clients with. If given,
+                           clients must present a certificate signed by it.
+  -http-addr=127.0.0.1:7374 Address to bind the HTTP listener, which serves
+                           a JSON API under "/v1/" and metrics in the
+                           Prometheus format at "/metrics". Disabled by
+                           default.
   -snapshot=path/to/file   The snapshot file is used to store alive nodes and
                            event information so that Serf can rejoin a cluster
                            and avoid event replay on restart.
+  -statsd-addr=addr:port   Address of a statsd instance to stream metrics to.
+  -statsite-addr=addr:port Address of a statsite instance to stream metrics to.
   -tag key=value           Tag can be specified multiple times to attach multiple
                            key/value tag pairs to the given node.
   -tags-file=/path/to/file The tags file is used to persist tag data. As an agent's
@@ -786,9 +1683,23 @@ Options:
                            is incompatible with the '-tag' option and requires there
                            be no tags in the agent configuration file, if given.
   -syslog                  When provided, logs will also be sent to syslog.
+  -syslog-facility=LOCAL0  Syslog facility to send logs to when -syslog is
+                           given. Defaults to LOCAL0.
   -broadcast-timeout=5s    Sets the broadcast timeout, which is the max time allowed for
                            responses to events including leave and force remove messages.
-                           Defaults to 5s.
+                           A graceful leave waits for a few multiples of it before
+                           giving up. Defaults to 5s.
+  -version-check-interval=0s
+                           When set, the cluster is periodically queried for the
+                           versions of all members, and a warning is logged for any
+                           member speaking a different protocol version than this
+                           agent. Disabled by default.
+  -reachability-check-interval=0s
+                           When set, this agent periodically pings every member,
+                           probing those that don't answer indirectly through
+                           other members, and logs a warning if some members can
+                           only be reached indirectly. This adds a ping per member
+                           on each check, so it is disabled by default.
 
 Event handlers:
 
@@ -808,6 +1719,10 @@ Event handlers:
   - The value can be in the format of "user:EVENT=SCRIPT", such as
     "user:deploy=deploy.sh". This means that Serf will only invoke this
     script in the case of user events named "deploy".
+
+  Any of these can start with "[json]" or "[msgpack]", such as
+  "[json]member-join=join.py", to give the script the whole event as a
+  single JSON or msgpack document on stdin instead of lines of text.
 `
 	return strings.TrimSpace(helpText)
 }
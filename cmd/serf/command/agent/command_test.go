@@ -5,13 +5,28 @@ package agent
 
 import (
 	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/client"
+	"github.com/hashicorp/serf/serf"
 	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
 	"github.com/mitchellh/cli"
 )
 
@@ -65,6 +80,581 @@ func TestCommandRun(t *testing.T) {
 	}
 }
 
+func TestCommandRun_pidFile(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	pidFile := filepath.Join(td, "serf.pid")
+
+	shutdownCh := make(chan struct{})
+	defer close(shutdownCh)
+
+	ui := cli.NewMockUi()
+	c := &Command{
+		ShutdownCh: shutdownCh,
+		Ui:         ui,
+	}
+
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	args := []string{
+		"-bind", ip1.String(),
+		"-rpc-addr", ip1.String() + ":0",
+		"-pid-file", pidFile,
+	}
+
+	resultCh := make(chan int)
+	go func() {
+		resultCh <- c.Run(args)
+	}()
+
+	retry.Run(t, func(r *retry.R) {
+		data, err := ioutil.ReadFile(pidFile)
+		if err != nil {
+			r.Fatalf("err: %v", err)
+		}
+		if string(data) != fmt.Sprintf("%d\n", os.Getpid()) {
+			r.Fatalf("bad: %q", data)
+		}
+	})
+
+	shutdownCh <- struct{}{}
+	select {
+	case code := <-resultCh:
+		if code != 0 {
+			t.Fatalf("bad code: %d %s", code, ui.ErrorWriter.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Fatalf("PID file should be removed: %v", err)
+	}
+}
+
+func TestCommandRun_joinWarnOnly(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	shutdownCh := make(chan struct{})
+	defer close(shutdownCh)
+
+	// The output is read while the agent runs, so set up the buffers first
+	ui := cli.NewMockUi()
+	c := &Command{
+		ShutdownCh: shutdownCh,
+		Ui:         ui,
+	}
+
+	args := []string{
+		"-bind", ip1.String(),
+		"-rpc-addr", ip1.String() + ":11111",
+		"-join", ip2.String(),
+		"-join-warn-only",
+	}
+
+	resultCh := make(chan int)
+	go func() {
+		resultCh <- c.Run(args)
+	}()
+
+	// The failed join shouldn't stop the agent
+	retry.Run(t, func(r *retry.R) {
+		if !strings.Contains(ui.OutputWriter.String(), "Failed to join cluster, continuing") {
+			r.Fatalf("bad: %s", ui.OutputWriter.String())
+		}
+	})
+	select {
+	case code := <-resultCh:
+		t.Fatalf("ended too soon, code %d: %s", code, ui.ErrorWriter.String())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	shutdownCh <- struct{}{}
+	select {
+	case code := <-resultCh:
+		if code != 0 {
+			t.Fatalf("bad code: %d", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestCommand_readConfig_nodeNameScheme(t *testing.T) {
+	defer func(fn func() (string, error)) { hostname = fn }(hostname)
+	hostname = func() (string, error) {
+		return "Web_1.Example.com", nil
+	}
+
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	snapshot := filepath.Join(td, "snapshot")
+
+	// A generated name is kept next to the snapshot
+	ui := new(cli.MockUi)
+	c := &Command{Ui: ui, args: []string{"-node-name-scheme=hostname-suffix", "-snapshot=" + snapshot}}
+	config := c.readConfig()
+	if config == nil {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+	if ok, _ := regexp.MatchString(`^web-1\.example\.com-[0-9a-f]{8}$`, config.NodeName); !ok {
+		t.Fatalf("bad: %s", config.NodeName)
+	}
+	data, err := ioutil.ReadFile(nodeNamePath(snapshot))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if strings.TrimSpace(string(data)) != config.NodeName {
+		t.Fatalf("bad: %s", data)
+	}
+
+	// The next run picks up the same name
+	ui = new(cli.MockUi)
+	c = &Command{Ui: ui, args: []string{"-node-name-scheme=hostname-suffix", "-snapshot=" + snapshot}}
+	if again := c.readConfig(); again == nil || again.NodeName != config.NodeName {
+		t.Fatalf("bad: %#v %s", again, ui.ErrorWriter.String())
+	}
+
+	// Without a snapshot the name can't be kept
+	ui = new(cli.MockUi)
+	c = &Command{Ui: ui, args: []string{"-node-name-scheme=uuid"}}
+	if config := c.readConfig(); config == nil || len(config.NodeName) != 36 {
+		t.Fatalf("bad: %#v %s", config, ui.ErrorWriter.String())
+	}
+	if !strings.Contains(ui.OutputWriter.String(), "will change on restart") {
+		t.Fatalf("bad: %s", ui.OutputWriter.String())
+	}
+
+	// The hostname is still used as is by default
+	ui = new(cli.MockUi)
+	c = &Command{Ui: ui, args: []string{"-snapshot=" + filepath.Join(td, "other")}}
+	if config := c.readConfig(); config == nil || config.NodeName != "Web_1.Example.com" {
+		t.Fatalf("bad: %#v %s", config, ui.ErrorWriter.String())
+	}
+
+	ui = new(cli.MockUi)
+	c = &Command{Ui: ui, args: []string{"-node-name-scheme=mac"}}
+	if config := c.readConfig(); config != nil {
+		t.Fatalf("bad: %#v", config)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "Unknown node name scheme") {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+}
+
+func TestCommand_readConfig_nodeName(t *testing.T) {
+	defer func(fn func() (string, error)) { hostname = fn }(hostname)
+	hostname = func() (string, error) {
+		return "", fmt.Errorf("no hostname")
+	}
+
+	// Without a usable hostname, a name is generated from the interfaces
+	ui := new(cli.MockUi)
+	c := &Command{Ui: ui}
+	config := c.readConfig()
+	if config == nil {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected, err := generateNodeName(ifaces)
+	if err != nil {
+		t.Skipf("no interface to generate a name from: %v", err)
+	}
+	if config.NodeName != expected {
+		t.Fatalf("bad: %s", config.NodeName)
+	}
+	if !strings.Contains(ui.OutputWriter.String(), "using generated name") {
+		t.Fatalf("bad: %s", ui.OutputWriter.String())
+	}
+
+	// Requiring a node name fails instead of generating one
+	ui = new(cli.MockUi)
+	c = &Command{Ui: ui, args: []string{"-require-node-name"}}
+	if config := c.readConfig(); config != nil {
+		t.Fatalf("bad: %#v", config)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "node name is required") {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+
+	// An explicit name satisfies the requirement
+	ui = new(cli.MockUi)
+	c = &Command{Ui: ui, args: []string{"-require-node-name", "-node", "web-1"}}
+	config = c.readConfig()
+	if config == nil {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+	if config.NodeName != "web-1" {
+		t.Fatalf("bad: %s", config.NodeName)
+	}
+}
+
+func TestCommand_readConfig_bindAuto(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var loopback string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+			break
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+
+	// The loopback interface has no private address to pick
+	ui := new(cli.MockUi)
+	c := &Command{Ui: ui, args: []string{"-node", "foo", "-bind", "auto:8000", "-iface", loopback}}
+	if config := c.readConfig(); config != nil {
+		t.Fatalf("bad: %#v", config)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "No private IPv4 address") {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+}
+
+func TestCommand_readConfig_protocol(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &Command{Ui: ui, args: []string{"-node", "foo"}}
+	config := c.readConfig()
+	if config == nil || config.Protocol != int(serf.ProtocolVersionMax) {
+		t.Fatalf("bad: %#v %s", config, ui.ErrorWriter.String())
+	}
+
+	min := fmt.Sprintf("%d", serf.ProtocolVersionMin)
+	ui = new(cli.MockUi)
+	c = &Command{Ui: ui, args: []string{"-node", "foo", "-protocol", min}}
+	config = c.readConfig()
+	if config == nil || config.Protocol != int(serf.ProtocolVersionMin) {
+		t.Fatalf("bad: %#v %s", config, ui.ErrorWriter.String())
+	}
+
+	for _, bad := range []uint8{serf.ProtocolVersionMin - 1, serf.ProtocolVersionMax + 1} {
+		ui = new(cli.MockUi)
+		c = &Command{Ui: ui, args: []string{"-node", "foo", "-protocol", fmt.Sprintf("%d", bad)}}
+		if config := c.readConfig(); config != nil {
+			t.Fatalf("protocol %d should fail", bad)
+		}
+		if !strings.Contains(ui.ErrorWriter.String(), "Unsupported protocol version") {
+			t.Fatalf("bad: %s", ui.ErrorWriter.String())
+		}
+	}
+}
+
+func TestCommand_readConfig_reap(t *testing.T) {
+	cases := []struct {
+		config string
+		ok     bool
+	}{
+		{`{"reconnect_timeout": "1h", "tombstone_timeout": "2h", "reap_interval": "5s"}`, true},
+		{`{"reconnect_interval": "-1s"}`, false},
+		{`{"reconnect_timeout": "-1h"}`, false},
+		{`{"tombstone_timeout": "-1h"}`, false},
+		{`{"reap_interval": "-5s"}`, false},
+		{`{"event_buffer": -1}`, false},
+		{`{"user_event_rate_limit": -1}`, false},
+		{`{"rate_limit_interval": "-1s"}`, false},
+	}
+	for _, tc := range cases {
+		f, err := ioutil.TempFile("", "serf")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(tc.config)
+		f.Close()
+
+		ui := cli.NewMockUi()
+		c := &Command{Ui: ui, args: []string{"-node", "foo", "-config-file", f.Name()}}
+		config := c.readConfig()
+		if (config != nil) != tc.ok {
+			t.Fatalf("%s: bad: %#v %s", tc.config, config, ui.ErrorWriter.String())
+		}
+		if !tc.ok && !strings.Contains(ui.ErrorWriter.String(), "can't be negative") {
+			t.Fatalf("%s: bad: %s", tc.config, ui.ErrorWriter.String())
+		}
+	}
+}
+
+func TestCommand_readConfig_sizeLimits(t *testing.T) {
+	cases := []struct {
+		config string
+		err    string
+	}{
+		{`{"query_size_limit": 2048, "query_response_size_limit": 2048, "user_event_size_limit": 9216}`, ""},
+		{`{"query_size_limit": -1}`, "must be positive"},
+		{`{"query_response_size_limit": -1}`, "must be positive"},
+		{`{"user_event_size_limit": -1}`, "must be positive"},
+		{`{"user_event_size_limit": 9217}`, "exceeds the maximum"},
+	}
+	for _, tc := range cases {
+		f, err := ioutil.TempFile("", "serf")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(tc.config)
+		f.Close()
+
+		ui := cli.NewMockUi()
+		c := &Command{Ui: ui, args: []string{"-node", "foo", "-config-file", f.Name()}}
+		config := c.readConfig()
+		if tc.err == "" {
+			if config == nil || config.UserEventSizeLimit != 9216 {
+				t.Fatalf("%s: bad: %#v %s", tc.config, config, ui.ErrorWriter.String())
+			}
+			continue
+		}
+		if config != nil || !strings.Contains(ui.ErrorWriter.String(), tc.err) {
+			t.Fatalf("%s: bad: %#v %s", tc.config, config, ui.ErrorWriter.String())
+		}
+	}
+}
+
+func TestCommand_readConfig_compression(t *testing.T) {
+	f, err := ioutil.TempFile("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"enable_compression": false}`)
+	f.Close()
+
+	cases := []struct {
+		args    []string
+		enabled bool
+	}{
+		{[]string{}, true},
+		{[]string{"-disable-compression"}, false},
+		{[]string{"-config-file", f.Name()}, false},
+	}
+	for _, tc := range cases {
+		ui := cli.NewMockUi()
+		c := &Command{Ui: ui, args: append([]string{"-node", "foo"}, tc.args...)}
+		config := c.readConfig()
+		if config == nil || config.EnableCompression != tc.enabled {
+			t.Fatalf("%v: bad: %#v %s", tc.args, config, ui.ErrorWriter.String())
+		}
+	}
+}
+
+func TestCommand_readConfig_encryptKey(t *testing.T) {
+	cases := []struct {
+		key string
+		ok  bool
+	}{
+		{"", true},
+		{"5K9OtfP7efFrNKe5WCQvXvnaXJ5cWP0SvXiwe0kkjM4=", true},
+		{"not base64!", false},
+		{base64.StdEncoding.EncodeToString([]byte("short")), false},
+	}
+
+	for _, tc := range cases {
+		ui := new(cli.MockUi)
+		c := &Command{Ui: ui, args: []string{"-node", "foo", "-encrypt", tc.key}}
+		config := c.readConfig()
+		if (config != nil) != tc.ok {
+			t.Fatalf("key %q bad: %s", tc.key, ui.ErrorWriter.String())
+		}
+		if !tc.ok && !strings.Contains(ui.ErrorWriter.String(), "serf keygen") {
+			t.Fatalf("key %q bad: %s", tc.key, ui.ErrorWriter.String())
+		}
+	}
+}
+
+func TestCommand_readConfig_metricsSinks(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &Command{Ui: ui, args: []string{"-node", "foo",
+		"-statsd-addr", "127.0.0.1:8125", "-statsite-addr", "127.0.0.1:8123"}}
+	config := c.readConfig()
+	if config == nil {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+	if config.StatsdAddr != "127.0.0.1:8125" || config.StatsiteAddr != "127.0.0.1:8123" {
+		t.Fatalf("bad: %#v", config)
+	}
+}
+
+func TestCommand_readConfig_rejoinWithoutSnapshot(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &Command{Ui: ui, args: []string{"-node", "foo", "-rejoin"}}
+	if config := c.readConfig(); config == nil || !config.RejoinAfterLeave {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+	if !strings.Contains(ui.OutputWriter.String(), "-rejoin has no effect without -snapshot") {
+		t.Fatalf("bad: %s", ui.OutputWriter.String())
+	}
+
+	ui = cli.NewMockUi()
+	c = &Command{Ui: ui, args: []string{"-node", "foo", "-rejoin", "-snapshot", "/tmp/serf.snap"}}
+	if config := c.readConfig(); config == nil {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+	if strings.Contains(ui.OutputWriter.String(), "-rejoin") {
+		t.Fatalf("bad: %s", ui.OutputWriter.String())
+	}
+}
+
+func TestCommand_readConfig_syslogFacility(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &Command{Ui: ui, args: []string{"-node", "foo", "-syslog", "-syslog-facility", "local3"}}
+	config := c.readConfig()
+	if config == nil {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+	if !config.EnableSyslog || config.SyslogFacility != "local3" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	ui = new(cli.MockUi)
+	c = &Command{Ui: ui, args: []string{"-node", "foo", "-syslog", "-syslog-facility", "bogus"}}
+	if config := c.readConfig(); config != nil {
+		t.Fatalf("should fail")
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "Invalid syslog facility") {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+
+	// The facility only matters once syslog is enabled
+	ui = new(cli.MockUi)
+	c = &Command{Ui: ui, args: []string{"-node", "foo", "-syslog-facility", "bogus"}}
+	if config := c.readConfig(); config == nil {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+}
+
+func TestCommand_readConfig_configFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`{
+		"node_name": "file-node",
+		"bind": "127.0.0.5:8000",
+		"rpc_addr": "127.0.0.5:8001",
+		"event_handlers": ["member-join=file.sh"]
+	}`)
+	f.Close()
+
+	// Flags take precedence, anything not given on the command line comes
+	// from the file, and event handlers from both are kept
+	ui := new(cli.MockUi)
+	c := &Command{Ui: ui, args: []string{
+		"-config-file", f.Name(),
+		"-node", "cli-node",
+		"-event-handler", "user=cli.sh",
+	}}
+	config := c.readConfig()
+	if config == nil {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+
+	if config.NodeName != "cli-node" {
+		t.Fatalf("bad: %s", config.NodeName)
+	}
+	if config.BindAddr != "127.0.0.5:8000" || config.RPCAddr != "127.0.0.5:8001" {
+		t.Fatalf("bad: %#v", config)
+	}
+	expected := []string{"member-join=file.sh", "user=cli.sh"}
+	if !reflect.DeepEqual(config.EventHandlers, expected) {
+		t.Fatalf("bad: %#v", config.EventHandlers)
+	}
+
+	// A missing file is reported
+	ui = new(cli.MockUi)
+	c = &Command{Ui: ui, args: []string{"-config-file", f.Name() + ".missing"}}
+	if config := c.readConfig(); config != nil {
+		t.Fatalf("bad: %#v", config)
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "Error reading") {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+}
+
+func TestCommand_handleReload(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1 := testAgent(t, ip1, nil)
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer a1.Shutdown()
+
+	f, err := ioutil.TempFile("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{
+		"node_name": "reload-node",
+		"log_level": "debug",
+		"event_handlers": ["user=reload.sh"],
+		"event_plugins": ["query=reload-plugin"],
+		"tags": {"role": "reloaded"},
+		"retry_join": ["127.0.0.1:7946"]
+	}`)
+	f.Close()
+
+	ui := cli.NewMockUi()
+	c := &Command{Ui: ui, args: []string{"-config-file", f.Name()}}
+	c.logFilter = LevelFilter()
+	c.scriptHandler = &ScriptEventHandler{}
+	c.pluginHandler = &PluginEventHandler{}
+	c.setRetryJoinAddrs([]string{"127.0.0.2:7946"})
+
+	config := c.handleReload(&Config{LogLevel: "INFO"}, a1)
+	if config.NodeName != "reload-node" {
+		t.Fatalf("bad: %#v %s", config, ui.ErrorWriter.String())
+	}
+	if c.logFilter.MinLevel != "DEBUG" {
+		t.Fatalf("bad: %v", c.logFilter.MinLevel)
+	}
+	if len(c.scriptHandler.newScripts) != 1 || c.scriptHandler.newScripts[0].Script != "reload.sh" {
+		t.Fatalf("bad: %#v", c.scriptHandler.newScripts)
+	}
+	if len(c.pluginHandler.newPlugins) != 1 || c.pluginHandler.newPlugins[0].Script != "reload-plugin" {
+		t.Fatalf("bad: %#v", c.pluginHandler.newPlugins)
+	}
+	if role := a1.Serf().LocalMember().Tags["role"]; role != "reloaded" {
+		t.Fatalf("bad: %v", role)
+	}
+	if addrs := c.getRetryJoinAddrs(); !reflect.DeepEqual(addrs, []string{"127.0.0.1:7946"}) {
+		t.Fatalf("bad: %v", addrs)
+	}
+
+	// A bad log level keeps the current one
+	f2, err := os.Create(f.Name())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f2.WriteString(`{"node_name": "reload-node", "log_level": "bogus"}`)
+	f2.Close()
+	config = c.handleReload(config, a1)
+	if c.logFilter.MinLevel != "DEBUG" || config.LogLevel != "debug" {
+		t.Fatalf("bad: %v %v", c.logFilter.MinLevel, config.LogLevel)
+	}
+}
+
 func TestCommandRun_rpc(t *testing.T) {
 	doneCh := make(chan struct{})
 	shutdownCh := make(chan struct{})
@@ -118,6 +708,71 @@ func TestCommandRun_rpc(t *testing.T) {
 	}
 }
 
+func TestCommandRun_rpcExtraAddrs(t *testing.T) {
+	doneCh := make(chan struct{})
+	shutdownCh := make(chan struct{})
+	defer func() {
+		close(shutdownCh)
+		<-doneCh
+	}()
+
+	c := &Command{
+		ShutdownCh: shutdownCh,
+		Ui:         new(cli.MockUi),
+	}
+
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	rpcAddrs := []string{
+		ip2.String() + ":11111",
+		unixSocketPrefix + filepath.Join(td, "serf.sock"),
+	}
+
+	args := []string{
+		"-bind", ip1.String(),
+		"-rpc-addr", rpcAddrs[0],
+		"-rpc-extra-addr", rpcAddrs[1],
+	}
+
+	go func() {
+		code := c.Run(args)
+		if code != 0 {
+			log.Printf("bad: %d", code)
+		}
+
+		close(doneCh)
+	}()
+
+	// The same agent answers on every address
+	for _, addr := range rpcAddrs {
+		retry.Run(t, func(r *retry.R) {
+			client, err := client.NewRPCClient(addr)
+			if err != nil {
+				r.Fatalf("err: %v", err)
+			}
+			defer client.Close()
+
+			members, err := client.Members()
+			if err != nil {
+				r.Fatalf("err: %v", err)
+			}
+			if len(members) != 1 {
+				r.Fatalf("bad: %#v", members)
+			}
+		})
+	}
+}
+
 func TestCommandRun_join(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -165,6 +820,148 @@ func TestCommandRun_join(t *testing.T) {
 	}
 }
 
+func TestCommandRun_ipv6(t *testing.T) {
+	// Pick free ports on the IPv6 loopback, skipping without IPv6
+	freePort := func() int {
+		l, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			t.Skipf("IPv6 not available: %v", err)
+		}
+		defer l.Close()
+		return l.Addr().(*net.TCPAddr).Port
+	}
+	gossipPort1, gossipPort2, rpcPort := freePort(), freePort(), freePort()
+
+	serfConfig := serf.DefaultConfig()
+	serfConfig.MemberlistConfig.BindPort = gossipPort1
+	a1 := testAgentWithConfig(t, net.ParseIP("::1"), DefaultConfig(), serfConfig, nil)
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer a1.Shutdown()
+
+	doneCh := make(chan struct{})
+	shutdownCh := make(chan struct{})
+	defer func() {
+		close(shutdownCh)
+		<-doneCh
+	}()
+
+	c := &Command{
+		ShutdownCh: shutdownCh,
+		Ui:         new(cli.MockUi),
+	}
+
+	rpcAddr := fmt.Sprintf("[::1]:%d", rpcPort)
+	args := []string{
+		"-node", "ipv6-node",
+		"-bind", fmt.Sprintf("[::1]:%d", gossipPort2),
+		"-rpc-addr", rpcAddr,
+		"-join", fmt.Sprintf("[::1]:%d", gossipPort1),
+	}
+
+	go func() {
+		code := c.Run(args)
+		if code != 0 {
+			log.Printf("bad: %d", code)
+		}
+
+		close(doneCh)
+	}()
+
+	retry.Run(t, func(r *retry.R) {
+		if n := len(a1.Serf().Members()); n != 2 {
+			r.Fatalf("bad: %d", n)
+		}
+	})
+
+	client, err := client.NewRPCClient(rpcAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	members, err := client.MembersFiltered(nil, "", "ipv6-node")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(members) != 1 || !members[0].Addr.Equal(net.ParseIP("::1")) ||
+		int(members[0].Port) != gossipPort2 {
+		t.Fatalf("bad: %#v", members)
+	}
+}
+
+func TestCommandRun_dynamicPorts(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	doneCh := make(chan struct{})
+	shutdownCh := make(chan struct{})
+	defer func() {
+		close(shutdownCh)
+		<-doneCh
+	}()
+
+	ui := cli.NewMockUi()
+	c := &Command{
+		ShutdownCh: shutdownCh,
+		Ui:         ui,
+	}
+
+	args := []string{
+		"-node", "dynamic",
+		"-bind", ip1.String() + ":0",
+		"-rpc-addr", ip1.String() + ":0",
+	}
+
+	go func() {
+		code := c.Run(args)
+		if code != 0 {
+			log.Printf("bad: %d", code)
+		}
+
+		close(doneCh)
+	}()
+
+	// The ports picked are shown at startup
+	addrRe := regexp.MustCompile(`(Bind|RPC) addr: '([^']+)'`)
+	var bindAddr, rpcAddr string
+	retry.Run(t, func(r *retry.R) {
+		matches := addrRe.FindAllStringSubmatch(ui.OutputWriter.String(), -1)
+		if len(matches) != 2 {
+			r.Fatalf("bad: %s", ui.OutputWriter.String())
+		}
+		bindAddr, rpcAddr = matches[0][2], matches[1][2]
+	})
+	for _, addr := range []string{bindAddr, rpcAddr} {
+		if _, port, err := net.SplitHostPort(addr); err != nil || port == "0" {
+			t.Fatalf("bad: %s %v", addr, err)
+		}
+	}
+
+	client, err := client.NewRPCClient(rpcAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	stats, err := client.Stats()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats["agent"]["rpc_addr"] != rpcAddr || stats["memberlist"]["bind"] != bindAddr {
+		t.Fatalf("bad: %v", stats)
+	}
+
+	members, err := client.Members()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(members) != 1 || fmt.Sprintf("%s:%d", members[0].Addr, members[0].Port) != bindAddr {
+		t.Fatalf("bad: %#v", members)
+	}
+}
+
 func TestCommandRun_joinFail(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -394,6 +1191,136 @@ func TestCommandRun_retry_join(t *testing.T) {
 	}
 }
 
+func TestCommandRun_retry_joinURL(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1, nil)
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer a1.Shutdown()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# seeds\n%s\n", a1.conf.MemberlistConfig.BindAddr)
+	}))
+	defer server.Close()
+
+	doneCh := make(chan struct{})
+	shutdownCh := make(chan struct{})
+	defer func() {
+		close(shutdownCh)
+		<-doneCh
+	}()
+
+	c := &Command{
+		ShutdownCh: shutdownCh,
+		Ui:         new(cli.MockUi),
+	}
+
+	args := []string{
+		"-bind", ip2.String(),
+		"-retry-join-url", server.URL,
+	}
+
+	go func() {
+		code := c.Run(args)
+		if code != 0 {
+			log.Printf("bad: %d", code)
+		}
+
+		close(doneCh)
+	}()
+
+	testutil.Yield()
+
+	if len(a1.Serf().Members()) != 2 {
+		t.Fatalf("bad: %#v", a1.Serf().Members())
+	}
+}
+
+func TestCommand_refreshSeedList(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	ip3, returnFn3 := testutil.TakeIP()
+	defer returnFn3()
+
+	// The third agent isn't started until it is in the seed list
+	agents := make([]*Agent, 3)
+	addrs := make([]string, 3)
+	for i, ip := range []net.IP{ip1, ip2, ip3} {
+		agents[i] = testAgent(t, ip, nil)
+		if i < 2 {
+			if err := agents[i].Start(); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		defer agents[i].Shutdown()
+		addrs[i] = agents[i].conf.NodeName + "/" + agents[i].conf.MemberlistConfig.BindAddr
+	}
+	a1 := agents[0]
+
+	var lock sync.Mutex
+	seedAddrs := []string{addrs[1]}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		fmt.Fprintln(w, strings.Join(seedAddrs, "\n"))
+	}))
+	defer server.Close()
+
+	c := &Command{logger: log.New(os.Stderr, "", log.LstdFlags)}
+	config := DefaultConfig()
+	config.RetryJoinURLInterval = 50 * time.Millisecond
+	seeds := newSeedList(server.URL, c.logger)
+	known, err := seeds.Addresses()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := a1.Join(known, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		c.refreshSeedList(config, a1, seeds, known)
+		close(doneCh)
+	}()
+
+	// An agent added to the seed list later is joined too, even if it
+	// can't be joined at first
+	lock.Lock()
+	seedAddrs = append(seedAddrs, addrs[2])
+	lock.Unlock()
+	time.Sleep(200 * time.Millisecond)
+	if n := len(a1.Serf().Members()); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+	if err := agents[2].Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	retry.Run(t, func(r *retry.R) {
+		if n := len(a1.Serf().Members()); n != 3 {
+			r.Fatalf("bad: %d", n)
+		}
+	})
+
+	// Refreshing stops once the agent shuts down
+	a1.Shutdown()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatalf("refresh did not stop")
+	}
+}
+
 func TestCommandRun_retry_joinFail(t *testing.T) {
 	shutdownCh := make(chan struct{})
 	defer close(shutdownCh)
@@ -421,3 +1348,189 @@ func TestCommandRun_retry_joinFail(t *testing.T) {
 		t.Fatal("should fail")
 	}
 }
+
+func TestLeaveOnSignal(t *testing.T) {
+	cases := []struct {
+		sig      os.Signal
+		config   Config
+		expected bool
+	}{
+		{os.Interrupt, Config{}, true},
+		{os.Interrupt, Config{SkipLeaveOnInt: true}, false},
+		{syscall.SIGTERM, Config{}, false},
+		{syscall.SIGTERM, Config{LeaveOnTerm: true}, true},
+		{syscall.SIGHUP, Config{LeaveOnTerm: true}, false},
+	}
+	for i, tc := range cases {
+		if out := leaveOnSignal(tc.sig, &tc.config); out != tc.expected {
+			t.Fatalf("case %d: expected %v, got %v", i, tc.expected, out)
+		}
+	}
+
+	// Both can be set from the command line
+	ui := new(cli.MockUi)
+	c := &Command{Ui: ui, args: []string{"-node", "foo", "-leave-on-terminate", "-skip-leave-on-interrupt"}}
+	config := c.readConfig()
+	if config == nil {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+	if !config.LeaveOnTerm || !config.SkipLeaveOnInt {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// So can the graceful leave deadline
+	c = &Command{Ui: ui, args: []string{"-node", "foo", "-graceful-timeout", "45s"}}
+	config = c.readConfig()
+	if config == nil {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+	if config.GracefulTimeout != 45*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+}
+
+func TestGracefulLeaveTimeout(t *testing.T) {
+	cases := []struct {
+		broadcast time.Duration
+		repeat    int
+		propagate time.Duration
+		expected  time.Duration
+	}{
+		{5 * time.Second, 0, time.Second, 11 * time.Second},
+		{5 * time.Second, 2, time.Second, 16 * time.Second},
+		{30 * time.Second, 0, 0, 60 * time.Second},
+		{time.Second, 0, 0, gracefulTimeout},
+	}
+	for i, tc := range cases {
+		conf := serf.DefaultConfig()
+		conf.BroadcastTimeout = tc.broadcast
+		conf.LeaveBroadcastRepeat = tc.repeat
+		conf.LeavePropagateDelay = tc.propagate
+		if out := gracefulLeaveTimeout(conf); out != tc.expected {
+			t.Fatalf("case %d: expected %v, got %v", i, tc.expected, out)
+		}
+	}
+}
+
+func TestRetryJoinWait(t *testing.T) {
+	cases := []struct {
+		interval, max time.Duration
+		attempt       int
+		expect        time.Duration
+	}{
+		// No backoff without a max interval above the interval
+		{30 * time.Second, 0, 1, 30 * time.Second},
+		{30 * time.Second, 0, 10, 30 * time.Second},
+		{30 * time.Second, 10 * time.Second, 5, 30 * time.Second},
+
+		// Doubling up to the max interval
+		{time.Second, time.Minute, 1, time.Second},
+		{time.Second, time.Minute, 2, 2 * time.Second},
+		{time.Second, time.Minute, 4, 8 * time.Second},
+		{time.Second, time.Minute, 7, time.Minute},
+		{time.Second, time.Minute, 1000, time.Minute},
+	}
+
+	for _, tc := range cases {
+		wait := retryJoinWait(tc.interval, tc.max, tc.attempt)
+		if wait != tc.expect {
+			t.Fatalf("interval %v max %v attempt %d: got %v, want %v",
+				tc.interval, tc.max, tc.attempt, wait, tc.expect)
+		}
+	}
+}
+
+func TestProfileMemberlistConfig(t *testing.T) {
+	cases := map[string]time.Duration{
+		"lan":   memberlist.DefaultLANConfig().ProbeInterval,
+		"WAN":   memberlist.DefaultWANConfig().ProbeInterval,
+		"local": memberlist.DefaultLocalConfig().ProbeInterval,
+	}
+	for profile, expected := range cases {
+		conf, err := profileMemberlistConfig(profile)
+		if err != nil {
+			t.Fatalf("%s: err: %v", profile, err)
+		}
+		if conf.ProbeInterval != expected {
+			t.Fatalf("%s: bad probe interval %v", profile, conf.ProbeInterval)
+		}
+	}
+
+	// Unknown profiles are caught before the agent starts
+	ui := new(cli.MockUi)
+	c := &Command{Ui: ui, args: []string{"-node", "foo", "-profile", "space"}}
+	if config := c.readConfig(); config != nil {
+		t.Fatalf("should fail")
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "Unknown profile: space") {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+}
+
+func TestApplyGossipTiming(t *testing.T) {
+	ml := memberlist.DefaultLANConfig()
+	config := &Config{
+		GossipInterval:   500 * time.Millisecond,
+		ProbeInterval:    2 * time.Second,
+		SuspicionMult:    6,
+		PushPullInterval: time.Minute,
+		DisableTCPPings:  true,
+	}
+	if err := applyGossipTiming(config, ml); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ml.GossipInterval != 500*time.Millisecond || ml.ProbeInterval != 2*time.Second ||
+		ml.SuspicionMult != 6 || ml.PushPullInterval != time.Minute || !ml.DisableTcpPings {
+		t.Fatalf("bad: %#v", ml)
+	}
+
+	// Unset settings keep the profile's value
+	lan := memberlist.DefaultLANConfig()
+	if ml.ProbeTimeout != lan.ProbeTimeout || ml.RetransmitMult != lan.RetransmitMult {
+		t.Fatalf("bad: %#v", ml)
+	}
+
+	bad := []*Config{
+		{GossipInterval: -time.Second},
+		{SuspicionMult: -1},
+		{PushPullInterval: -time.Second},
+		{ProbeTimeout: lan.ProbeInterval},
+		{ProbeInterval: 100 * time.Millisecond, ProbeTimeout: 200 * time.Millisecond},
+	}
+	for i, config := range bad {
+		if err := applyGossipTiming(config, memberlist.DefaultLANConfig()); err == nil {
+			t.Fatalf("case %d: should fail", i)
+		}
+	}
+}
+
+func TestInterfaceIP(t *testing.T) {
+	ipNet := func(s string) net.Addr {
+		return &net.IPNet{IP: net.ParseIP(s), Mask: net.CIDRMask(24, 32)}
+	}
+	cases := []struct {
+		addrs      []net.Addr
+		preferIPv6 bool
+		expected   string
+	}{
+		{[]net.Addr{ipNet("10.0.0.5")}, false, "10.0.0.5"},
+		{[]net.Addr{ipNet("fe80::1"), ipNet("2001:db8::5"), ipNet("10.0.0.5")}, false, "10.0.0.5"},
+		{[]net.Addr{ipNet("10.0.0.5"), ipNet("2001:db8::5")}, true, "2001:db8::5"},
+		{[]net.Addr{ipNet("fe80::1"), ipNet("2001:db8::5")}, false, "2001:db8::5"},
+		{[]net.Addr{&net.IPAddr{IP: net.ParseIP("10.0.0.6")}}, false, "10.0.0.6"},
+		{[]net.Addr{ipNet("169.254.1.1"), ipNet("fe80::1")}, false, ""},
+		{nil, false, ""},
+	}
+	for i, tc := range cases {
+		ip := interfaceIP(tc.addrs, tc.preferIPv6)
+		if tc.expected == "" {
+			if ip != nil {
+				t.Fatalf("case %d: expected no address, got %v", i, ip)
+			}
+			continue
+		}
+		if ip.String() != tc.expected {
+			t.Fatalf("case %d: expected %s, got %v", i, tc.expected, ip)
+		}
+	}
+}
@@ -4,14 +4,18 @@
 package agent
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -40,6 +44,8 @@ func DefaultConfig() *Config {
 		QuerySizeLimit:         1024,
 		UserEventSizeLimit:     512,
 		BroadcastTimeout:       5 * time.Second,
+		HealthCheckInterval:    10 * time.Second,
+		EnableCompression:      true,
 	}
 }
 
@@ -57,11 +63,25 @@ type Config struct {
 	Role               string `mapstructure:"role"`
 	DisableCoordinates bool   `mapstructure:"disable_coordinates"`
 
+	// RequireNodeName makes startup fail if NodeName is not set, rather
+	// than falling back to the hostname or a generated name.
+	RequireNodeName bool `mapstructure:"require_node_name"`
+
+	// NodeNameScheme is how a node name is picked if NodeName is not set:
+	// "hostname", "hostname-suffix" or "uuid". The generated names of the
+	// last two are kept next to the snapshot, so they stay the same across
+	// restarts. Defaults to "hostname".
+	NodeNameScheme string `mapstructure:"node_name_scheme"`
+
 	// Tags are used to attach key/value metadata to a node. They have
 	// replaced 'Role' as a more flexible meta data mechanism. For compatibility,
 	// the 'role' key is special, and is used for backwards compatibility.
 	Tags map[string]string `mapstructure:"tags"`
 
+	// MaxTags limits the number of tags the node may have, whether set at
+	// startup or changed while running. Zero means no limit.
+	MaxTags int `mapstructure:"max_tags"`
+
 	// TagsFile is the path to a file where Serf can store its tags. Tag
 	// persistence is desirable since tags may be set or deleted while the
 	// agent is running. Tags can be reloaded from this file on later starts.
@@ -70,7 +90,8 @@ type Config struct {
 	// BindAddr is the address that the Serf agent's communication ports
 	// will bind to. Serf will use this address to bind to for both TCP
 	// and UDP connections. If no port is present in the address, the default
-	// port will be used.
+	// port will be used. A host of "auto" picks the private address of this
+	// host, failing if there isn't exactly one.
 	BindAddr string `mapstructure:"bind"`
 
 	// AdvertiseAddr is the address that the Serf agent will advertise to
@@ -90,19 +111,100 @@ type Config struct {
 	// keyring will not be persisted to a file.
 	KeyringFile string `mapstructure:"keyring_file"`
 
+	// KeyRotateIntervalRaw is the string interval at which this agent
+	// replaces the encryption key of the whole cluster with a new one. It
+	// should only be set on one agent, and requires a KeyringFile. Zero
+	// disables rotation.
+	KeyRotateIntervalRaw string        `mapstructure:"key_rotate_interval"`
+	KeyRotateInterval    time.Duration `mapstructure:"-"`
+
 	// LogLevel is the level of the logs to output.
 	// This can be updated during a reload.
 	LogLevel string `mapstructure:"log_level"`
 
+	// LogFile is a file to also write the logs to. If LogRotateBytes is
+	// set, the file is rotated once it reaches that size, keeping up to
+	// LogRotateMaxFiles old files, or all of them if that is zero.
+	LogFile           string `mapstructure:"log_file"`
+	LogRotateBytes    int    `mapstructure:"log_rotate_bytes"`
+	LogRotateMaxFiles int    `mapstructure:"log_rotate_max_files"`
+
+	// LogJSON writes the agent output and log file as one JSON object per
+	// line instead of plain text.
+	LogJSON bool `mapstructure:"log_json"`
+
+	// PidFile is the path to write the PID of the agent to once it has
+	// started. The file is removed when the agent exits.
+	PidFile string `mapstructure:"pid_file"`
+
 	// RPCAddr is the address and port to listen on for the agent's RPC
 	// interface.
 	RPCAddr string `mapstructure:"rpc_addr"`
 
+	// RPCExtraAddrs are more addresses to serve the same RPC interface on,
+	// in the same forms as RPCAddr. TLS applies to the TCP addresses among
+	// them, while Unix sockets are served without it, so local tools can
+	// use a socket while remote ones use TLS.
+	RPCExtraAddrs []string `mapstructure:"rpc_extra_addrs"`
+
 	// RPCAuthKey is a key that can be set to optionally require that
 	// RPC's provide an authentication key. This is meant to be
 	// a very simple authentication control
 	RPCAuthKey string `mapstructure:"rpc_auth"`
 
+	// RPCTokens maps additional RPC auth tokens to the RPC commands they
+	// are allowed to call, such as "event" or "members". Clients using one
+	// of these tokens are denied any command that isn't listed. Clients
+	// using RPCAuthKey are still allowed to call any command.
+	RPCTokens map[string][]string `mapstructure:"rpc_tokens"`
+
+	// RPCAuditLog enables logging of every RPC request the agent receives,
+	// along with the client address and its outcome once it is handled:
+	// ok, error or denied. Request bodies are never logged, so keys and
+	// auth tokens are not exposed.
+	RPCAuditLog bool `mapstructure:"rpc_audit_log"`
+
+	// RPCTLSCert and RPCTLSKey are the paths of a PEM encoded certificate
+	// and private key. If set, the RPC interface is served over TLS.
+	RPCTLSCert string `mapstructure:"rpc_tls_cert"`
+	RPCTLSKey  string `mapstructure:"rpc_tls_key"`
+
+	// RPCTLSCA is the path of a PEM encoded CA bundle. If set along with
+	// RPCTLSCert, RPC clients must present a certificate signed by one of
+	// these CAs.
+	RPCTLSCA string `mapstructure:"rpc_tls_ca"`
+
+	// RPCMaxConns caps the number of RPC connections open at once. Clients
+	// connecting past the cap are disconnected straight away. If this is 0,
+	// there is no cap.
+	RPCMaxConns int `mapstructure:"rpc_max_conns"`
+
+	// RPCIdleTimeout is how long an RPC connection may go without sending a
+	// request before it is closed. Connections with an open stream, monitor
+	// or query are never idle. If this is 0, idle connections are kept.
+	RPCIdleTimeoutRaw string        `mapstructure:"rpc_idle_timeout"`
+	RPCIdleTimeout    time.Duration `mapstructure:"-"`
+
+	// RPCReadTimeout is how long a client may take to send the rest of a
+	// request once it has started, and RPCWriteTimeout how long it may take
+	// to read a response. A connection that misses either is closed. If
+	// these are 0, there is no deadline.
+	RPCReadTimeoutRaw  string        `mapstructure:"rpc_read_timeout"`
+	RPCReadTimeout     time.Duration `mapstructure:"-"`
+	RPCWriteTimeoutRaw string        `mapstructure:"rpc_write_timeout"`
+	RPCWriteTimeout    time.Duration `mapstructure:"-"`
+
+	// RPCKeepAlive is the TCP keepalive period of RPC connections, which
+	// reclaims connections to clients that went away without closing them.
+	// If this is 0, the system default is used.
+	RPCKeepAliveRaw string        `mapstructure:"rpc_keepalive"`
+	RPCKeepAlive    time.Duration `mapstructure:"-"`
+
+	// HTTPAddr is the address and port to listen on for the agent's HTTP
+	// interface, which serves a JSON API and metrics in the Prometheus
+	// format. If this is not set, the HTTP interface is disabled.
+	HTTPAddr string `mapstructure:"http_addr"`
+
 	// Protocol is the Serf protocol version to use.
 	Protocol int `mapstructure:"protocol"`
 
@@ -122,15 +224,57 @@ type Config struct {
 	// It's optimal to be relatively small, since it's going to be gossiped through the cluster.
 	UserEventSizeLimit int `mapstructure:"user_event_size_limit"`
 
+	// EventBuffer and QueryBuffer set how many Lamport times worth of
+	// recent user events and queries are remembered. User events this
+	// recent are replayed to nodes joining with -replay. Zero keeps
+	// Serf's default of 512.
+	EventBuffer int `mapstructure:"event_buffer"`
+	QueryBuffer int `mapstructure:"query_buffer"`
+
+	// UserEventRateLimit and QueryRateLimit cap how many user events and
+	// queries this agent handles in each RateLimitInterval. Anything over
+	// the limit is dropped locally, but still gossiped to the cluster.
+	// Zero disables the limit.
+	UserEventRateLimit   int           `mapstructure:"user_event_rate_limit"`
+	QueryRateLimit       int           `mapstructure:"query_rate_limit"`
+	RateLimitIntervalRaw string        `mapstructure:"rate_limit_interval"`
+	RateLimitInterval    time.Duration `mapstructure:"-"`
+
 	// StartJoin is a list of addresses to attempt to join when the
 	// agent starts. If Serf is unable to communicate with any of these
 	// addresses, then the agent will error and exit.
 	StartJoin []string `mapstructure:"start_join"`
 
+	// StartJoinWarnOnly logs a warning instead of exiting if none of the
+	// StartJoin addresses can be joined.
+	StartJoinWarnOnly bool `mapstructure:"start_join_warn_only"`
+
 	// EventHandlers is a list of event handlers that will be invoked.
 	// These can be updated during a reload.
 	EventHandlers []string `mapstructure:"event_handlers"`
 
+	// EventPlugins is a list of event plugins, in the same format as the
+	// event handlers. A plugin is started once and kept running, and is
+	// sent each event on stdin. These can be updated during a reload.
+	EventPlugins []string `mapstructure:"event_plugins"`
+
+	// EventHandlerOutputRate caps how many lines of event handler output
+	// are logged per second, across all handlers. Excess lines are dropped
+	// and periodically summarized. Zero means no limit.
+	EventHandlerOutputRate int `mapstructure:"event_handler_output_rate"`
+
+	// EventHandlerConcurrency caps how many event handlers run at once,
+	// across all handlers. When it is set, handlers run in the background
+	// rather than holding up the events behind them. Zero means handlers
+	// without their own concurrency run in turn, as each event arrives.
+	EventHandlerConcurrency int `mapstructure:"event_handler_concurrency"`
+
+	// EventHandlerTimeout is how long an event handler may run before it
+	// is killed, for handlers without their own timeout. Zero means no
+	// limit.
+	EventHandlerTimeoutRaw string        `mapstructure:"event_handler_timeout"`
+	EventHandlerTimeout    time.Duration `mapstructure:"-"`
+
 	// Profile is used to select a timing profile for Serf. The supported choices
 	// are "wan", "lan", and "local". The default is "lan"
 	Profile string `mapstructure:"profile"`
@@ -140,6 +284,27 @@ type Config struct {
 	// re-joining a cluster on failure and avoids old message replay.
 	SnapshotPath string `mapstructure:"snapshot_path"`
 
+	// SnapshotCompactionThreshold is the minimum size in bytes the snapshot
+	// file reaches before it is compacted. Busy clusters may want to raise
+	// this to compact less often.
+	SnapshotCompactionThreshold int `mapstructure:"snapshot_compaction_threshold"`
+
+	// SnapshotMinCompactionIntervalRaw is the string minimum interval between
+	// snapshot compactions. This guards against compacting over and over when
+	// the write volume is high.
+	SnapshotMinCompactionIntervalRaw string        `mapstructure:"snapshot_min_compaction_interval"`
+	SnapshotMinCompactionInterval    time.Duration `mapstructure:"-"`
+
+	// SnapshotReplayLimit bounds how many members from the snapshot are
+	// used to rejoin the cluster on startup, preferring the most recently
+	// seen ones. Zero means no limit.
+	SnapshotReplayLimit int `mapstructure:"snapshot_replay_limit"`
+
+	// EventDrainFile is the path of a file that any events not yet handled
+	// when the agent shuts down are written to. They are replayed to the
+	// event handlers on the next start, and the file is removed.
+	EventDrainFile string `mapstructure:"event_drain_file"`
+
 	// LeaveOnTerm controls if Serf does a graceful leave when receiving
 	// the TERM signal. Defaults false. This can be changed on reload.
 	LeaveOnTerm bool `mapstructure:"leave_on_terminate"`
@@ -148,6 +313,19 @@ type Config struct {
 	// the INT signal. Defaults false. This can be changed on reload.
 	SkipLeaveOnInt bool `mapstructure:"skip_leave_on_interrupt"`
 
+	// GracefulTimeoutRaw is how long a graceful leave on a signal may take
+	// before the agent gives up and shuts down anyway. If not set, a wait
+	// based on the broadcast timeout is used.
+	GracefulTimeoutRaw string        `mapstructure:"graceful_timeout"`
+	GracefulTimeout    time.Duration `mapstructure:"-"`
+
+	// GracefulRestart makes the agent own its gossip sockets, so that on
+	// a USR2 signal it can hand them and the RPC listener off to a newly
+	// started agent, which starts serving once this one has stopped
+	// without leaving. Peers never see the node go away. Without it, USR2
+	// restarts the agent with a leave and rejoin.
+	GracefulRestart bool `mapstructure:"graceful_restart"`
+
 	// Discover is used to setup an mDNS Discovery name. When this is set, the
 	// agent will setup an mDNS responder and periodically run an mDNS query
 	// to look for peers. For peers on a network that supports multicast, this
@@ -171,11 +349,22 @@ type Config struct {
 	ReconnectTimeoutRaw string        `mapstructure:"reconnect_timeout"`
 	ReconnectTimeout    time.Duration `mapstructure:"-"`
 
+	// ReconnectMaxAttempts is how many times we attempt to connect to a
+	// failed node before we stop trying. The node is still only removed
+	// once the reconnect timeout passes. If this is 0, there is no limit.
+	ReconnectMaxAttempts int `mapstructure:"reconnect_max_attempts"`
+
 	// TombstoneTimeoutRaw is the string tombstone timeout. This timeout controls
 	// for how long we remember a left node before removing it from the cluster.
 	TombstoneTimeoutRaw string        `mapstructure:"tombstone_timeout"`
 	TombstoneTimeout    time.Duration `mapstructure:"-"`
 
+	// ReapIntervalRaw is the string reap interval. This interval controls
+	// how often failed and left nodes are checked against their timeouts,
+	// so it bounds how late they are removed.
+	ReapIntervalRaw string        `mapstructure:"reap_interval"`
+	ReapInterval    time.Duration `mapstructure:"-"`
+
 	// By default Serf will attempt to resolve name conflicts. This is done by
 	// determining which node the majority believe to be the proper node, and
 	// by having the minority node shutdown. If you want to disable this behavior,
@@ -195,6 +384,26 @@ type Config struct {
 	// succeeds or RetryMaxAttempts is reached.
 	RetryJoin []string `mapstructure:"retry_join"`
 
+	// RetryJoinURL is an HTTP endpoint serving a seed list of addresses
+	// to join, as a JSON list or one address per line. It is fetched on
+	// every retry join attempt and used alongside RetryJoin. If a fetch
+	// fails, the last list that was fetched successfully is used.
+	RetryJoinURL string `mapstructure:"retry_join_url"`
+
+	// RetryJoinURLIntervalRaw is the string interval at which the seed
+	// list is fetched again once the agent has joined, joining any
+	// addresses added to it since. Zero only fetches it while joining.
+	RetryJoinURLIntervalRaw string        `mapstructure:"retry_join_url_interval"`
+	RetryJoinURLInterval    time.Duration `mapstructure:"-"`
+
+	// RetryJoinPin resolves the hostnames in the retry join addresses once
+	// and pins the resulting IPs, so that every attempt goes to the same set
+	// of IPs even if DNS rotates between them. If RetryJoinResolveIntervalRaw
+	// is set, the pinned IPs are resolved again on that interval.
+	RetryJoinPin                bool          `mapstructure:"retry_join_pin"`
+	RetryJoinResolveIntervalRaw string        `mapstructure:"retry_join_resolve_interval"`
+	RetryJoinResolveInterval    time.Duration `mapstructure:"-"`
+
 	// RetryMaxAttempts is used to limit the maximum attempts made
 	// by RetryJoin to reach other nodes. If this is 0, then no limit
 	// is imposed, and Serf will continue to try forever. Defaults to 0.
@@ -206,6 +415,12 @@ type Config struct {
 	RetryIntervalRaw string        `mapstructure:"retry_interval"`
 	RetryInterval    time.Duration `mapstructure:"-"`
 
+	// RetryMaxIntervalRaw enables exponential backoff for RetryJoin. The
+	// wait after each failed attempt starts at RetryInterval and doubles
+	// up to this maximum. If this is 0, RetryInterval is used throughout.
+	RetryMaxIntervalRaw string        `mapstructure:"retry_max_interval"`
+	RetryMaxInterval    time.Duration `mapstructure:"-"`
+
 	// RejoinAfterLeave controls our interaction with the snapshot file.
 	// When set to false (default), a leave causes a Serf to not rejoin
 	// the cluster until an explicit join is received. If this is set to
@@ -217,6 +432,18 @@ type Config struct {
 	// by `github.com/hashicorp/memberlist` when broadcasting events.
 	EnableCompression bool `mapstructure:"enable_compression"`
 
+	// DisableCompression is set when compression was explicitly turned
+	// off, by the -disable-compression flag or by setting
+	// enable_compression to false, so that merging with a config that
+	// doesn't mention compression keeps it off.
+	DisableCompression bool `mapstructure:"-"`
+
+	// CompressionThreshold is the size in bytes above which user events and
+	// push/pull state syncs are compressed by Serf itself, when speaking
+	// protocol version 6 or newer. Zero uses Serf's default. Turning off
+	// compression turns this off as well.
+	CompressionThreshold int `mapstructure:"compression_threshold"`
+
 	// StatsiteAddr is the address of a statsite instance. If provided,
 	// metrics will be streamed to that instance.
 	StatsiteAddr string `mapstructure:"statsite_addr"`
@@ -231,17 +458,108 @@ type Config struct {
 	BroadcastTimeoutRaw string        `mapstructure:"broadcast_timeout"`
 	BroadcastTimeout    time.Duration `mapstructure:"-"`
 
+	// LeaveBroadcastRepeat is how many extra times the leave intent is
+	// broadcast during a graceful leave, waiting LeaveBroadcastIntervalRaw
+	// before each one. This helps peers on a lossy network see the leave.
+	LeaveBroadcastRepeat      int           `mapstructure:"leave_broadcast_repeat"`
+	LeaveBroadcastIntervalRaw string        `mapstructure:"leave_broadcast_interval"`
+	LeaveBroadcastInterval    time.Duration `mapstructure:"-"`
+
+	// CoalescePeriodRaw and QuiescentPeriodRaw control how member events
+	// are batched before they reach the event handlers. Events are held
+	// until none arrive for QuiescentPeriodRaw, or for at most
+	// CoalescePeriodRaw, and are then delivered as one event per type.
+	CoalescePeriodRaw  string        `mapstructure:"coalesce_period"`
+	CoalescePeriod     time.Duration `mapstructure:"-"`
+	QuiescentPeriodRaw string        `mapstructure:"quiescent_period"`
+	QuiescentPeriod    time.Duration `mapstructure:"-"`
+
+	// UserCoalescePeriodRaw and UserQuiescentPeriodRaw do the same for
+	// user events sent with coalescing, keeping only the latest event of
+	// each name.
+	UserCoalescePeriodRaw  string        `mapstructure:"user_coalesce_period"`
+	UserCoalescePeriod     time.Duration `mapstructure:"-"`
+	UserQuiescentPeriodRaw string        `mapstructure:"user_quiescent_period"`
+	UserQuiescentPeriod    time.Duration `mapstructure:"-"`
+
+	// The gossip timing settings override those of the Profile. Any left
+	// unset keep the profile's value.
+	GossipIntervalRaw string        `mapstructure:"gossip_interval"`
+	GossipInterval    time.Duration `mapstructure:"-"`
+	ProbeIntervalRaw  string        `mapstructure:"probe_interval"`
+	ProbeInterval     time.Duration `mapstructure:"-"`
+	ProbeTimeoutRaw   string        `mapstructure:"probe_timeout"`
+	ProbeTimeout      time.Duration `mapstructure:"-"`
+	SuspicionMult     int           `mapstructure:"suspicion_mult"`
+	RetransmitMult    int           `mapstructure:"retransmit_mult"`
+
+	// PushPullIntervalRaw is the string interval of the full state syncs
+	// done over TCP with a random member. Zero keeps the profile's value.
+	PushPullIntervalRaw string        `mapstructure:"push_pull_interval"`
+	PushPullInterval    time.Duration `mapstructure:"-"`
+
+	// DisableTCPPings turns off the TCP ping sent to a member that didn't
+	// answer a UDP probe, before it is suspected of having failed.
+	DisableTCPPings bool `mapstructure:"disable_tcp_pings"`
+
+	// VersionCheckIntervalRaw is the string interval at which the cluster is
+	// queried for member versions, warning about any member that speaks a
+	// different protocol version. Zero disables the check.
+	VersionCheckIntervalRaw string        `mapstructure:"version_check_interval"`
+	VersionCheckInterval    time.Duration `mapstructure:"-"`
+
+	// ReachabilityCheckIntervalRaw is the string interval at which every
+	// member is pinged directly, warning if some of them can only be
+	// reached indirectly. Zero disables the check.
+	ReachabilityCheckIntervalRaw string        `mapstructure:"reachability_check_interval"`
+	ReachabilityCheckInterval    time.Duration `mapstructure:"-"`
+
+	// HealthScoreThreshold is the health score at which a "health" event is
+	// delivered to the event handlers, with a second one once the score
+	// recovers. HealthScoreDebounceRaw is how long the score must stay past
+	// the threshold before the event fires. A threshold of zero disables
+	// health events.
+	HealthScoreThreshold   int           `mapstructure:"health_score_threshold"`
+	HealthScoreDebounceRaw string        `mapstructure:"health_score_debounce"`
+	HealthScoreDebounce    time.Duration `mapstructure:"-"`
+
+	// PartitionFailureRatio is the fraction of the members that must fail
+	// within PartitionWindowRaw for a "partition" event to be delivered to
+	// the event handlers, with a second one once fewer than that are still
+	// failed. ExpectedClusterSize is the number of members the cluster
+	// should have, and when set a "partition" event is also delivered when
+	// no more than half of them are alive, and once more than half are
+	// again. Zero disables each of them.
+	PartitionFailureRatio float64       `mapstructure:"partition_failure_ratio"`
+	PartitionWindowRaw    string        `mapstructure:"partition_window"`
+	PartitionWindow       time.Duration `mapstructure:"-"`
+	ExpectedClusterSize   int           `mapstructure:"expected_cluster_size"`
+
+	// HealthCheckScript is a script run every HealthCheckIntervalRaw to
+	// check the health of the services on this node. Its result is kept
+	// in the reserved "status" tag, and a "health-check" user event is
+	// sent each time it changes.
+	HealthCheckScript      string        `mapstructure:"health_check_script"`
+	HealthCheckIntervalRaw string        `mapstructure:"health_check_interval"`
+	HealthCheckInterval    time.Duration `mapstructure:"-"`
+
 	// ValidateNodeNames controls whether nodenames only
 	// contain alphanumeric, dashes and '.'characters
 	// and sets maximum length to 128 characters
 	ValidateNodeNames bool `mapstructure:"validate_node_names"`
 }
 
-// BindAddrParts returns the parts of the BindAddr that should be
-// used to configure Serf.
+// AddrParts returns the IP and port of an address that should be used to
+// configure Serf, using DefaultBindPort if there is no port. IPv6 addresses
+// with a port must be in brackets, as in "[::1]:7946".
 func (c *Config) AddrParts(address string) (string, int, error) {
 	checkAddr := address
 
+	// A bare IPv6 address has colons that would be taken for a port
+	if ip := net.ParseIP(address); ip != nil {
+		checkAddr = net.JoinHostPort(address, strconv.Itoa(DefaultBindPort))
+	}
+
 START:
 	_, _, err := net.SplitHostPort(checkAddr)
 	if ae, ok := err.(*net.AddrError); ok && ae.Err == "missing port in address" {
@@ -261,11 +579,74 @@ START:
 	return addr.IP.String(), addr.Port, nil
 }
 
+// AdvertiseAddrParts returns the IP and port to advertise to the cluster.
+// Without a port in AdvertiseAddr the bind port is used, since that is
+// where the agent is listening when the address is only translated, as
+// behind NAT.
+func (c *Config) AdvertiseAddrParts() (string, int, error) {
+	ip, port, err := c.AddrParts(c.AdvertiseAddr)
+	if err != nil {
+		return "", 0, err
+	}
+	if net.ParseIP(ip).IsUnspecified() {
+		return "", 0, fmt.Errorf("Can't advertise unspecified address %s", ip)
+	}
+
+	if _, _, err := net.SplitHostPort(c.AdvertiseAddr); err != nil {
+		_, bindPort, err := c.AddrParts(c.BindAddr)
+		if err != nil {
+			return "", 0, err
+		}
+		port = bindPort
+	}
+	return ip, port, nil
+}
+
 // EncryptBytes returns the encryption key configured.
 func (c *Config) EncryptBytes() ([]byte, error) {
 	return base64.StdEncoding.DecodeString(c.EncryptKey)
 }
 
+// RPCAddrs returns all the addresses the RPC interface is served on,
+// starting with RPCAddr.
+func (c *Config) RPCAddrs() []string {
+	return append([]string{c.RPCAddr}, c.RPCExtraAddrs...)
+}
+
+// RPCTLSConfig returns the TLS configuration for the RPC listener, or nil
+// if the RPC interface is not served over TLS.
+func (c *Config) RPCTLSConfig() (*tls.Config, error) {
+	if c.RPCTLSCert == "" && c.RPCTLSKey == "" && c.RPCTLSCA == "" {
+		return nil, nil
+	}
+	if c.RPCTLSCert == "" || c.RPCTLSKey == "" {
+		return nil, fmt.Errorf("Both a certificate and a key are required for RPC TLS")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.RPCTLSCert, c.RPCTLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load RPC TLS certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.RPCTLSCA != "" {
+		pem, err := ioutil.ReadFile(c.RPCTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read RPC TLS CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in RPC TLS CA %s", c.RPCTLSCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
 // EventScripts returns the list of EventScripts associated with this
 // configuration and specified by the "event_handlers" configuration.
 func (c *Config) EventScripts() []EventScript {
@@ -277,6 +658,16 @@ func (c *Config) EventScripts() []EventScript {
 	return result
 }
 
+// EventPluginScripts returns the event plugins configured, parsed the same
+// way as the event handlers.
+func (c *Config) EventPluginScripts() []EventScript {
+	result := make([]EventScript, 0, len(c.EventPlugins))
+	for _, v := range c.EventPlugins {
+		result = append(result, ParseEventScript(v)...)
+	}
+	return result
+}
+
 // Networkinterface is used to get the associated network
 // interface from the configured value
 func (c *Config) NetworkInterface() (*net.Interface, error) {
@@ -311,6 +702,14 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		return nil, err
 	}
 
+	// A missing enable_compression leaves the default alone, an explicit
+	// false turns compression off
+	for _, key := range md.Keys {
+		if key == "enable_compression" && !result.EnableCompression {
+			result.DisableCompression = true
+		}
+	}
+
 	// Decode the time values
 	if result.ReconnectIntervalRaw != "" {
 		dur, err := time.ParseDuration(result.ReconnectIntervalRaw)
@@ -336,6 +735,14 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		result.TombstoneTimeout = dur
 	}
 
+	if result.ReapIntervalRaw != "" {
+		dur, err := time.ParseDuration(result.ReapIntervalRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.ReapInterval = dur
+	}
+
 	if result.RetryIntervalRaw != "" {
 		dur, err := time.ParseDuration(result.RetryIntervalRaw)
 		if err != nil {
@@ -344,6 +751,14 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		result.RetryInterval = dur
 	}
 
+	if result.RetryMaxIntervalRaw != "" {
+		dur, err := time.ParseDuration(result.RetryMaxIntervalRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.RetryMaxInterval = dur
+	}
+
 	if result.BroadcastTimeoutRaw != "" {
 		dur, err := time.ParseDuration(result.BroadcastTimeoutRaw)
 		if err != nil {
@@ -352,6 +767,206 @@ func DecodeConfig(r io.Reader) (*Config, error) {
 		result.BroadcastTimeout = dur
 	}
 
+	if result.GracefulTimeoutRaw != "" {
+		dur, err := time.ParseDuration(result.GracefulTimeoutRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.GracefulTimeout = dur
+	}
+
+	if result.LeaveBroadcastIntervalRaw != "" {
+		dur, err := time.ParseDuration(result.LeaveBroadcastIntervalRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.LeaveBroadcastInterval = dur
+	}
+
+	if result.RateLimitIntervalRaw != "" {
+		dur, err := time.ParseDuration(result.RateLimitIntervalRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.RateLimitInterval = dur
+	}
+
+	if result.CoalescePeriodRaw != "" {
+		dur, err := time.ParseDuration(result.CoalescePeriodRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.CoalescePeriod = dur
+	}
+
+	if result.QuiescentPeriodRaw != "" {
+		dur, err := time.ParseDuration(result.QuiescentPeriodRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.QuiescentPeriod = dur
+	}
+
+	if result.UserCoalescePeriodRaw != "" {
+		dur, err := time.ParseDuration(result.UserCoalescePeriodRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.UserCoalescePeriod = dur
+	}
+
+	if result.UserQuiescentPeriodRaw != "" {
+		dur, err := time.ParseDuration(result.UserQuiescentPeriodRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.UserQuiescentPeriod = dur
+	}
+
+	if result.GossipIntervalRaw != "" {
+		dur, err := time.ParseDuration(result.GossipIntervalRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.GossipInterval = dur
+	}
+
+	if result.ProbeIntervalRaw != "" {
+		dur, err := time.ParseDuration(result.ProbeIntervalRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.ProbeInterval = dur
+	}
+
+	if result.ProbeTimeoutRaw != "" {
+		dur, err := time.ParseDuration(result.ProbeTimeoutRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.ProbeTimeout = dur
+	}
+
+	if result.PushPullIntervalRaw != "" {
+		dur, err := time.ParseDuration(result.PushPullIntervalRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.PushPullInterval = dur
+	}
+
+	if result.RetryJoinURLIntervalRaw != "" {
+		dur, err := time.ParseDuration(result.RetryJoinURLIntervalRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.RetryJoinURLInterval = dur
+	}
+
+	if result.RetryJoinResolveIntervalRaw != "" {
+		dur, err := time.ParseDuration(result.RetryJoinResolveIntervalRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.RetryJoinResolveInterval = dur
+	}
+
+	if result.VersionCheckIntervalRaw != "" {
+		dur, err := time.ParseDuration(result.VersionCheckIntervalRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.VersionCheckInterval = dur
+	}
+
+	if result.ReachabilityCheckIntervalRaw != "" {
+		dur, err := time.ParseDuration(result.ReachabilityCheckIntervalRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.ReachabilityCheckInterval = dur
+	}
+
+	if result.KeyRotateIntervalRaw != "" {
+		dur, err := time.ParseDuration(result.KeyRotateIntervalRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.KeyRotateInterval = dur
+	}
+
+	if result.RPCIdleTimeoutRaw != "" {
+		dur, err := time.ParseDuration(result.RPCIdleTimeoutRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.RPCIdleTimeout = dur
+	}
+
+	if result.RPCReadTimeoutRaw != "" {
+		dur, err := time.ParseDuration(result.RPCReadTimeoutRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.RPCReadTimeout = dur
+	}
+
+	if result.RPCWriteTimeoutRaw != "" {
+		dur, err := time.ParseDuration(result.RPCWriteTimeoutRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.RPCWriteTimeout = dur
+	}
+
+	if result.RPCKeepAliveRaw != "" {
+		dur, err := time.ParseDuration(result.RPCKeepAliveRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.RPCKeepAlive = dur
+	}
+
+	if result.EventHandlerTimeoutRaw != "" {
+		dur, err := time.ParseDuration(result.EventHandlerTimeoutRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.EventHandlerTimeout = dur
+	}
+
+	if result.PartitionWindowRaw != "" {
+		dur, err := time.ParseDuration(result.PartitionWindowRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.PartitionWindow = dur
+	}
+
+	if result.HealthCheckIntervalRaw != "" {
+		dur, err := time.ParseDuration(result.HealthCheckIntervalRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.HealthCheckInterval = dur
+	}
+
+	if result.HealthScoreDebounceRaw != "" {
+		dur, err := time.ParseDuration(result.HealthScoreDebounceRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.HealthScoreDebounce = dur
+	}
+
+	if result.SnapshotMinCompactionIntervalRaw != "" {
+		dur, err := time.ParseDuration(result.SnapshotMinCompactionIntervalRaw)
+		if err != nil {
+			return nil, err
+		}
+		result.SnapshotMinCompactionInterval = dur
+	}
+
 	return &result, nil
 }
 
@@ -374,6 +989,15 @@ func MergeConfig(a, b *Config) *Config {
 	if b.NodeName != "" {
 		result.NodeName = b.NodeName
 	}
+	if b.EventDrainFile != "" {
+		result.EventDrainFile = b.EventDrainFile
+	}
+	if b.RequireNodeName {
+		result.RequireNodeName = true
+	}
+	if b.NodeNameScheme != "" {
+		result.NodeNameScheme = b.NodeNameScheme
+	}
 	if b.Role != "" {
 		result.Role = b.Role
 	}
@@ -400,6 +1024,21 @@ func MergeConfig(a, b *Config) *Config {
 	if b.LogLevel != "" {
 		result.LogLevel = b.LogLevel
 	}
+	if b.LogFile != "" {
+		result.LogFile = b.LogFile
+	}
+	if b.LogRotateBytes != 0 {
+		result.LogRotateBytes = b.LogRotateBytes
+	}
+	if b.PidFile != "" {
+		result.PidFile = b.PidFile
+	}
+	if b.LogRotateMaxFiles != 0 {
+		result.LogRotateMaxFiles = b.LogRotateMaxFiles
+	}
+	if b.LogJSON {
+		result.LogJSON = true
+	}
 	if b.Protocol > 0 {
 		result.Protocol = b.Protocol
 	}
@@ -409,21 +1048,77 @@ func MergeConfig(a, b *Config) *Config {
 	if b.RPCAuthKey != "" {
 		result.RPCAuthKey = b.RPCAuthKey
 	}
+	if b.RPCTokens != nil {
+		if result.RPCTokens == nil {
+			result.RPCTokens = make(map[string][]string)
+		}
+		for token, methods := range b.RPCTokens {
+			result.RPCTokens[token] = methods
+		}
+	}
+	if b.RPCAuditLog {
+		result.RPCAuditLog = true
+	}
+	if b.RPCTLSCert != "" {
+		result.RPCTLSCert = b.RPCTLSCert
+	}
+	if b.RPCTLSKey != "" {
+		result.RPCTLSKey = b.RPCTLSKey
+	}
+	if b.RPCTLSCA != "" {
+		result.RPCTLSCA = b.RPCTLSCA
+	}
+	if b.RPCMaxConns != 0 {
+		result.RPCMaxConns = b.RPCMaxConns
+	}
+	if b.RPCIdleTimeout != 0 {
+		result.RPCIdleTimeout = b.RPCIdleTimeout
+	}
+	if b.RPCReadTimeout != 0 {
+		result.RPCReadTimeout = b.RPCReadTimeout
+	}
+	if b.RPCWriteTimeout != 0 {
+		result.RPCWriteTimeout = b.RPCWriteTimeout
+	}
+	if b.RPCKeepAlive != 0 {
+		result.RPCKeepAlive = b.RPCKeepAlive
+	}
+	if b.HTTPAddr != "" {
+		result.HTTPAddr = b.HTTPAddr
+	}
 	if b.ReplayOnJoin != false {
 		result.ReplayOnJoin = b.ReplayOnJoin
 	}
+	if b.StartJoinWarnOnly == true {
+		result.StartJoinWarnOnly = true
+	}
 	if b.Profile != "" {
 		result.Profile = b.Profile
 	}
 	if b.SnapshotPath != "" {
 		result.SnapshotPath = b.SnapshotPath
 	}
+	if b.SnapshotCompactionThreshold != 0 {
+		result.SnapshotCompactionThreshold = b.SnapshotCompactionThreshold
+	}
+	if b.SnapshotMinCompactionInterval != 0 {
+		result.SnapshotMinCompactionInterval = b.SnapshotMinCompactionInterval
+	}
+	if b.SnapshotReplayLimit != 0 {
+		result.SnapshotReplayLimit = b.SnapshotReplayLimit
+	}
 	if b.LeaveOnTerm == true {
 		result.LeaveOnTerm = true
 	}
 	if b.SkipLeaveOnInt == true {
 		result.SkipLeaveOnInt = true
 	}
+	if b.GracefulTimeout != 0 {
+		result.GracefulTimeout = b.GracefulTimeout
+	}
+	if b.GracefulRestart == true {
+		result.GracefulRestart = true
+	}
 	if b.Discover != "" {
 		result.Discover = b.Discover
 	}
@@ -436,12 +1131,21 @@ func MergeConfig(a, b *Config) *Config {
 	if b.ReconnectTimeout != 0 {
 		result.ReconnectTimeout = b.ReconnectTimeout
 	}
+	if b.ReconnectMaxAttempts != 0 {
+		result.ReconnectMaxAttempts = b.ReconnectMaxAttempts
+	}
 	if b.TombstoneTimeout != 0 {
 		result.TombstoneTimeout = b.TombstoneTimeout
 	}
+	if b.ReapInterval != 0 {
+		result.ReapInterval = b.ReapInterval
+	}
 	if b.DisableNameResolution {
 		result.DisableNameResolution = true
 	}
+	if b.MaxTags != 0 {
+		result.MaxTags = b.MaxTags
+	}
 	if b.TagsFile != "" {
 		result.TagsFile = b.TagsFile
 	}
@@ -451,12 +1155,27 @@ func MergeConfig(a, b *Config) *Config {
 	if b.EnableSyslog {
 		result.EnableSyslog = true
 	}
+	if b.RetryJoinURL != "" {
+		result.RetryJoinURL = b.RetryJoinURL
+	}
+	if b.RetryJoinURLInterval != 0 {
+		result.RetryJoinURLInterval = b.RetryJoinURLInterval
+	}
+	if b.RetryJoinPin {
+		result.RetryJoinPin = true
+	}
+	if b.RetryJoinResolveInterval != 0 {
+		result.RetryJoinResolveInterval = b.RetryJoinResolveInterval
+	}
 	if b.RetryMaxAttempts != 0 {
 		result.RetryMaxAttempts = b.RetryMaxAttempts
 	}
 	if b.RetryInterval != 0 {
 		result.RetryInterval = b.RetryInterval
 	}
+	if b.RetryMaxInterval != 0 {
+		result.RetryMaxInterval = b.RetryMaxInterval
+	}
 	if b.RejoinAfterLeave {
 		result.RejoinAfterLeave = true
 	}
@@ -478,21 +1197,134 @@ func MergeConfig(a, b *Config) *Config {
 	if b.UserEventSizeLimit != 0 {
 		result.UserEventSizeLimit = b.UserEventSizeLimit
 	}
+	if b.EventBuffer != 0 {
+		result.EventBuffer = b.EventBuffer
+	}
+	if b.QueryBuffer != 0 {
+		result.QueryBuffer = b.QueryBuffer
+	}
+	if b.UserEventRateLimit != 0 {
+		result.UserEventRateLimit = b.UserEventRateLimit
+	}
+	if b.QueryRateLimit != 0 {
+		result.QueryRateLimit = b.QueryRateLimit
+	}
+	if b.RateLimitInterval != 0 {
+		result.RateLimitInterval = b.RateLimitInterval
+	}
 	if b.BroadcastTimeout != 0 {
 		result.BroadcastTimeout = b.BroadcastTimeout
 	}
-	result.EnableCompression = b.EnableCompression
+	if b.LeaveBroadcastRepeat != 0 {
+		result.LeaveBroadcastRepeat = b.LeaveBroadcastRepeat
+	}
+	if b.LeaveBroadcastInterval != 0 {
+		result.LeaveBroadcastInterval = b.LeaveBroadcastInterval
+	}
+	if b.CoalescePeriod != 0 {
+		result.CoalescePeriod = b.CoalescePeriod
+	}
+	if b.QuiescentPeriod != 0 {
+		result.QuiescentPeriod = b.QuiescentPeriod
+	}
+	if b.UserCoalescePeriod != 0 {
+		result.UserCoalescePeriod = b.UserCoalescePeriod
+	}
+	if b.UserQuiescentPeriod != 0 {
+		result.UserQuiescentPeriod = b.UserQuiescentPeriod
+	}
+	if b.GossipInterval != 0 {
+		result.GossipInterval = b.GossipInterval
+	}
+	if b.ProbeInterval != 0 {
+		result.ProbeInterval = b.ProbeInterval
+	}
+	if b.ProbeTimeout != 0 {
+		result.ProbeTimeout = b.ProbeTimeout
+	}
+	if b.SuspicionMult != 0 {
+		result.SuspicionMult = b.SuspicionMult
+	}
+	if b.RetransmitMult != 0 {
+		result.RetransmitMult = b.RetransmitMult
+	}
+	if b.PushPullInterval != 0 {
+		result.PushPullInterval = b.PushPullInterval
+	}
+	if b.DisableTCPPings {
+		result.DisableTCPPings = true
+	}
+	if b.EventHandlerOutputRate != 0 {
+		result.EventHandlerOutputRate = b.EventHandlerOutputRate
+	}
+	if b.EventHandlerConcurrency != 0 {
+		result.EventHandlerConcurrency = b.EventHandlerConcurrency
+	}
+	if b.EventHandlerTimeout != 0 {
+		result.EventHandlerTimeout = b.EventHandlerTimeout
+	}
+	if b.VersionCheckInterval != 0 {
+		result.VersionCheckInterval = b.VersionCheckInterval
+	}
+	if b.ReachabilityCheckInterval != 0 {
+		result.ReachabilityCheckInterval = b.ReachabilityCheckInterval
+	}
+	if b.HealthScoreThreshold != 0 {
+		result.HealthScoreThreshold = b.HealthScoreThreshold
+	}
+	if b.PartitionFailureRatio != 0 {
+		result.PartitionFailureRatio = b.PartitionFailureRatio
+	}
+	if b.PartitionWindow != 0 {
+		result.PartitionWindow = b.PartitionWindow
+	}
+	if b.ExpectedClusterSize != 0 {
+		result.ExpectedClusterSize = b.ExpectedClusterSize
+	}
+	if b.HealthScoreDebounce != 0 {
+		result.HealthScoreDebounce = b.HealthScoreDebounce
+	}
+	if b.KeyRotateInterval != 0 {
+		result.KeyRotateInterval = b.KeyRotateInterval
+	}
+	if b.HealthCheckScript != "" {
+		result.HealthCheckScript = b.HealthCheckScript
+	}
+	if b.HealthCheckInterval != 0 {
+		result.HealthCheckInterval = b.HealthCheckInterval
+	}
+	if b.EnableCompression {
+		result.EnableCompression = true
+		result.DisableCompression = false
+	}
+	if b.DisableCompression {
+		result.EnableCompression = false
+		result.DisableCompression = true
+	}
+	if b.CompressionThreshold != 0 {
+		result.CompressionThreshold = b.CompressionThreshold
+	}
 
 	// Copy the event handlers
 	result.EventHandlers = make([]string, 0, len(a.EventHandlers)+len(b.EventHandlers))
 	result.EventHandlers = append(result.EventHandlers, a.EventHandlers...)
 	result.EventHandlers = append(result.EventHandlers, b.EventHandlers...)
 
+	// Copy the event plugins
+	result.EventPlugins = make([]string, 0, len(a.EventPlugins)+len(b.EventPlugins))
+	result.EventPlugins = append(result.EventPlugins, a.EventPlugins...)
+	result.EventPlugins = append(result.EventPlugins, b.EventPlugins...)
+
 	// Copy the start join addresses
 	result.StartJoin = make([]string, 0, len(a.StartJoin)+len(b.StartJoin))
 	result.StartJoin = append(result.StartJoin, a.StartJoin...)
 	result.StartJoin = append(result.StartJoin, b.StartJoin...)
 
+	// Copy the extra RPC addresses
+	result.RPCExtraAddrs = make([]string, 0, len(a.RPCExtraAddrs)+len(b.RPCExtraAddrs))
+	result.RPCExtraAddrs = append(result.RPCExtraAddrs, a.RPCExtraAddrs...)
+	result.RPCExtraAddrs = append(result.RPCExtraAddrs, b.RPCExtraAddrs...)
+
 	// Copy the retry join addresses
 	result.RetryJoin = make([]string, 0, len(a.RetryJoin)+len(b.RetryJoin))
 	result.RetryJoin = append(result.RetryJoin, a.RetryJoin...)
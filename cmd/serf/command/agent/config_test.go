@@ -5,6 +5,7 @@ package agent
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"io/ioutil"
 	"os"
@@ -12,8 +13,40 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/hashicorp/serf/testutil"
 )
 
+func TestConfigAdvertiseAddrParts(t *testing.T) {
+	testCases := []struct {
+		Bind      string
+		Advertise string
+		IP        string
+		Port      int
+		Error     bool
+	}{
+		{"0.0.0.0", "1.2.3.4:5678", "1.2.3.4", 5678, false},
+		{"0.0.0.0:8000", "1.2.3.4", "1.2.3.4", 8000, false},
+		{"0.0.0.0", "1.2.3.4", "1.2.3.4", DefaultBindPort, false},
+		{"0.0.0.0", "[2001:db8::1]:5678", "2001:db8::1", 5678, false},
+		{"0.0.0.0", "0.0.0.0:5678", "", 0, true},
+		{"0.0.0.0", "[::]", "", 0, true},
+	}
+
+	for _, tc := range testCases {
+		c := &Config{BindAddr: tc.Bind, AdvertiseAddr: tc.Advertise}
+		ip, port, err := c.AdvertiseAddrParts()
+		if tc.Error != (err != nil) {
+			t.Errorf("%s: Bad error: %v", tc.Advertise, err)
+			continue
+		}
+
+		if tc.IP != ip || tc.Port != port {
+			t.Errorf("%s: Got %s %d", tc.Advertise, ip, port)
+		}
+	}
+}
+
 func TestConfigBindAddrParts(t *testing.T) {
 	testCases := []struct {
 		Value string
@@ -23,6 +56,12 @@ func TestConfigBindAddrParts(t *testing.T) {
 	}{
 		{"0.0.0.0", "0.0.0.0", DefaultBindPort, false},
 		{"0.0.0.0:1234", "0.0.0.0", 1234, false},
+		{"::1", "::1", DefaultBindPort, false},
+		{"[::1]", "::1", DefaultBindPort, false},
+		{"[::1]:1234", "::1", 1234, false},
+		{"[::]:1234", "::", 1234, false},
+		{"2001:db8::1", "2001:db8::1", DefaultBindPort, false},
+		{"::1:1234:", "", 0, true},
 	}
 
 	for _, tc := range testCases {
@@ -73,6 +112,54 @@ func TestConfigEncryptBytes(t *testing.T) {
 	}
 }
 
+func TestConfigRPCTLSConfig(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	ca, cert, key := testutil.TLSFiles(t, td)
+
+	// Without any files, RPC isn't served over TLS
+	c := &Config{}
+	tlsConfig, err := c.RPCTLSConfig()
+	if err != nil || tlsConfig != nil {
+		t.Fatalf("bad: %#v %v", tlsConfig, err)
+	}
+
+	c = &Config{RPCTLSCert: cert, RPCTLSKey: key}
+	tlsConfig, err = c.RPCTLSConfig()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(tlsConfig.Certificates) != 1 || tlsConfig.ClientAuth != tls.NoClientCert {
+		t.Fatalf("bad: %#v", tlsConfig)
+	}
+
+	// A CA turns on client certificate verification
+	c.RPCTLSCA = ca
+	tlsConfig, err = c.RPCTLSConfig()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if tlsConfig.ClientCAs == nil || tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("bad: %#v", tlsConfig)
+	}
+
+	bad := []*Config{
+		{RPCTLSCert: cert},
+		{RPCTLSCA: ca},
+		{RPCTLSCert: cert, RPCTLSKey: ca},
+		{RPCTLSCert: cert, RPCTLSKey: key, RPCTLSCA: key},
+		{RPCTLSCert: cert, RPCTLSKey: key, RPCTLSCA: filepath.Join(td, "missing.pem")},
+	}
+	for _, c := range bad {
+		if _, err := c.RPCTLSConfig(); err == nil {
+			t.Fatalf("should fail: %#v", c)
+		}
+	}
+}
+
 func TestConfigEventScripts(t *testing.T) {
 	c := &Config{
 		EventHandlers: []string{
@@ -87,8 +174,8 @@ func TestConfigEventScripts(t *testing.T) {
 	}
 
 	expected := []EventScript{
-		{EventFilter{"*", ""}, "foo.sh"},
-		{EventFilter{"bar", ""}, "blah.sh"},
+		{EventFilter: EventFilter{"*", ""}, Script: "foo.sh"},
+		{EventFilter: EventFilter{"bar", ""}, Script: "blah.sh"},
 	}
 
 	if !reflect.DeepEqual(result, expected) {
@@ -227,7 +314,7 @@ func TestDecodeConfig(t *testing.T) {
 	}
 
 	// Reconnect intervals
-	input = `{"reconnect_interval": "15s", "reconnect_timeout": "48h"}`
+	input = `{"reconnect_interval": "15s", "reconnect_timeout": "48h", "reconnect_max_attempts": 10}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
 	if err != nil {
 		t.Fatalf("err: %v", err)
@@ -237,7 +324,7 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
-	if config.ReconnectTimeout != 48*time.Hour {
+	if config.ReconnectTimeout != 48*time.Hour || config.ReconnectMaxAttempts != 10 {
 		t.Fatalf("bad: %#v", config)
 	}
 
@@ -274,6 +361,17 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
+	// Reap interval
+	input = `{"reap_interval": "5s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.ReapInterval != 5*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
 	// Syslog
 	input = `{"enable_syslog": true, "syslog_facility": "LOCAL4"}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
@@ -314,6 +412,39 @@ func TestDecodeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 
+	// Key rotation
+	input = `{"key_rotate_interval": "720h"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.KeyRotateInterval != 720*time.Hour {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Health check
+	input = `{"health_check_script": "check.sh", "health_check_interval": "30s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.HealthCheckScript != "check.sh" || config.HealthCheckInterval != 30*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Graceful timeout
+	input = `{"graceful_timeout": "30s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.GracefulTimeout != 30*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
 	// Retry configs
 	input = `{"retry_join": ["127.0.0.1", "127.0.0.2"]}`
 	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
@@ -369,6 +500,358 @@ func TestDecodeConfig(t *testing.T) {
 	if config.QueryResponseSizeLimit != 123 || config.QuerySizeLimit != 456 {
 		t.Fatalf("bad: %#v", config)
 	}
+
+	// Push/pull and TCP pings
+	input = `{"push_pull_interval": "1m", "disable_tcp_pings": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.PushPullInterval != time.Minute || !config.DisableTCPPings {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Compression
+	input = `{"enable_compression": false}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.EnableCompression || !config.DisableCompression {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	input = `{"compression_threshold": 1024}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.CompressionThreshold != 1024 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// PID file
+	input = `{"pid_file": "/var/run/serf.pid"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.PidFile != "/var/run/serf.pid" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Event and query buffers
+	input = `{"event_buffer": 1024, "query_buffer": 256}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.EventBuffer != 1024 || config.QueryBuffer != 256 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Rate limits
+	input = `{"user_event_rate_limit": 10, "query_rate_limit": 5, "rate_limit_interval": "10s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.UserEventRateLimit != 10 || config.QueryRateLimit != 5 ||
+		config.RateLimitInterval != 10*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Snapshot compaction
+	input = `{"snapshot_compaction_threshold": 4096, "snapshot_min_compaction_interval": "1m", "snapshot_replay_limit": 100}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.SnapshotCompactionThreshold != 4096 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	if config.SnapshotMinCompactionInterval != time.Minute {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	if config.SnapshotReplayLimit != 100 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// RPC tokens
+	input = `{"rpc_tokens": {"deploy": ["event"], "ops": ["members", "stats"]}}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expectedTokens := map[string][]string{
+		"deploy": []string{"event"},
+		"ops":    []string{"members", "stats"},
+	}
+	if !reflect.DeepEqual(config.RPCTokens, expectedTokens) {
+		t.Fatalf("bad: %#v", config.RPCTokens)
+	}
+
+	// Tag limit
+	input = `{"max_tags": 16}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.MaxTags != 16 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Health events
+	input = `{"health_score_threshold": 4, "health_score_debounce": "10s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.HealthScoreThreshold != 4 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	if config.HealthScoreDebounce != 10*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Leave broadcast repeats
+	input = `{"leave_broadcast_repeat": 3, "leave_broadcast_interval": "250ms"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.LeaveBroadcastRepeat != 3 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	if config.LeaveBroadcastInterval != 250*time.Millisecond {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Member event coalescing
+	input = `{"coalesce_period": "10s", "quiescent_period": "2s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.CoalescePeriod != 10*time.Second || config.QuiescentPeriod != 2*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Gossip timing
+	input = `{"gossip_interval": "100ms", "probe_interval": "2s", "probe_timeout": "1s",
+		"suspicion_mult": 6, "retransmit_mult": 5}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.GossipInterval != 100*time.Millisecond || config.ProbeInterval != 2*time.Second ||
+		config.ProbeTimeout != time.Second || config.SuspicionMult != 6 || config.RetransmitMult != 5 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// User event coalescing
+	input = `{"user_coalesce_period": "5s", "user_quiescent_period": "500ms"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.UserCoalescePeriod != 5*time.Second || config.UserQuiescentPeriod != 500*time.Millisecond {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Version drift check
+	input = `{"version_check_interval": "5m"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.VersionCheckInterval != 5*time.Minute {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Event drain file
+	input = `{"event_drain_file": "/tmp/serf-events"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.EventDrainFile != "/tmp/serf-events" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Seed list URL
+	input = `{"retry_join_url": "http://seeds.example.com/serf", "retry_join_url_interval": "5m"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.RetryJoinURL != "http://seeds.example.com/serf" {
+		t.Fatalf("bad: %#v", config)
+	}
+	if config.RetryJoinURLInterval != 5*time.Minute {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Pinned join addresses
+	input = `{"retry_join_pin": true, "retry_join_resolve_interval": "1h"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !config.RetryJoinPin {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	if config.RetryJoinResolveInterval != time.Hour {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Reachability check
+	input = `{"reachability_check_interval": "1m"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.ReachabilityCheckInterval != time.Minute {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Event handler output rate
+	input = `{"event_handler_output_rate": 50}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.EventHandlerOutputRate != 50 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Partition events
+	input = `{"partition_failure_ratio": 0.4, "partition_window": "1m", "expected_cluster_size": 5}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.PartitionFailureRatio != 0.4 || config.PartitionWindow != time.Minute || config.ExpectedClusterSize != 5 {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Event handler limits
+	input = `{"event_handler_concurrency": 4, "event_handler_timeout": "30s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.EventHandlerConcurrency != 4 || config.EventHandlerTimeout != 30*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Node name scheme
+	input = `{"node_name_scheme": "hostname-suffix"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.NodeNameScheme != nodeNameHostnameSuffix {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// RPC connection limits
+	input = `{"rpc_max_conns": 64, "rpc_idle_timeout": "5m", "rpc_read_timeout": "10s",
+		"rpc_write_timeout": "15s", "rpc_keepalive": "30s"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.RPCMaxConns != 64 || config.RPCIdleTimeout != 5*time.Minute ||
+		config.RPCReadTimeout != 10*time.Second || config.RPCWriteTimeout != 15*time.Second ||
+		config.RPCKeepAlive != 30*time.Second {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Graceful restart
+	input = `{"graceful_restart": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !config.GracefulRestart {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Start join warn only
+	input = `{"start_join_warn_only": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !config.StartJoinWarnOnly {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Retry max interval
+	input = `{"retry_max_interval": "5m"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.RetryMaxInterval != 5*time.Minute {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// RPC TLS
+	input = `{"rpc_tls_cert": "cert.pem", "rpc_tls_key": "key.pem", "rpc_tls_ca": "ca.pem"}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.RPCTLSCert != "cert.pem" || config.RPCTLSKey != "key.pem" || config.RPCTLSCA != "ca.pem" {
+		t.Fatalf("bad: %#v", config)
+	}
+
+	// Log file
+	input = `{"log_file": "/var/log/serf.log", "log_rotate_bytes": 1024, "log_rotate_max_files": 3, "log_json": true}`
+	config, err = DecodeConfig(bytes.NewReader([]byte(input)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.LogFile != "/var/log/serf.log" || config.LogRotateBytes != 1024 ||
+		config.LogRotateMaxFiles != 3 || !config.LogJSON {
+		t.Fatalf("bad: %#v", config)
+	}
 }
 
 func TestDecodeConfig_unknownDirective(t *testing.T) {
@@ -386,6 +869,7 @@ func TestMergeConfig(t *testing.T) {
 		Protocol:      7,
 		EventHandlers: []string{"foo"},
 		StartJoin:     []string{"foo"},
+		RPCExtraAddrs: []string{"foo"},
 		ReplayOnJoin:  true,
 		RetryJoin:     []string{"zab"},
 	}
@@ -397,6 +881,7 @@ func TestMergeConfig(t *testing.T) {
 		EncryptKey:             "foo",
 		EventHandlers:          []string{"bar"},
 		StartJoin:              []string{"bar"},
+		RPCExtraAddrs:          []string{"bar"},
 		LeaveOnTerm:            true,
 		SkipLeaveOnInt:         true,
 		Discover:               "tubez",
@@ -414,8 +899,17 @@ func TestMergeConfig(t *testing.T) {
 		StatsiteAddr:           "127.0.0.1:8125",
 		QueryResponseSizeLimit: 123,
 		QuerySizeLimit:         456,
+		UserEventRateLimit:     10,
+		QueryRateLimit:         5,
+		RateLimitInterval:      10 * time.Second,
 		BroadcastTimeout:       20 * time.Second,
+		GracefulTimeout:        time.Minute,
+		EventHandlerTimeout:    5 * time.Second,
+		RPCMaxConns:            64,
+		RPCIdleTimeout:         5 * time.Minute,
 		EnableCompression:      true,
+		CompressionThreshold:   1024,
+		CoalescePeriod:         10 * time.Second,
 	}
 
 	c := MergeConfig(a, b)
@@ -509,6 +1003,10 @@ func TestMergeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", c)
 	}
 
+	if !reflect.DeepEqual(c.RPCExtraAddrs, expected) {
+		t.Fatalf("bad: %#v", c)
+	}
+
 	expected = []string{"zab", "zip"}
 	if !reflect.DeepEqual(c.RetryJoin, expected) {
 		t.Fatalf("bad: %#v", c)
@@ -518,11 +1016,31 @@ func TestMergeConfig(t *testing.T) {
 		t.Fatalf("bad: %#v", c)
 	}
 
+	if c.UserEventRateLimit != 10 || c.QueryRateLimit != 5 || c.RateLimitInterval != 10*time.Second {
+		t.Fatalf("bad: %#v", c)
+	}
+
 	if c.BroadcastTimeout != 20*time.Second {
 		t.Fatalf("bad: %#v", c)
 	}
 
-	if !c.EnableCompression {
+	if c.GracefulTimeout != time.Minute {
+		t.Fatalf("bad: %#v", c)
+	}
+
+	if c.EventHandlerTimeout != 5*time.Second {
+		t.Fatalf("bad: %#v", c)
+	}
+
+	if c.RPCMaxConns != 64 || c.RPCIdleTimeout != 5*time.Minute {
+		t.Fatalf("bad: %#v", c)
+	}
+
+	if c.CoalescePeriod != 10*time.Second {
+		t.Fatalf("bad: %#v", c)
+	}
+
+	if !c.EnableCompression || c.CompressionThreshold != 1024 {
 		t.Fatalf("bad: %#v", c)
 	}
 }
@@ -588,3 +1106,48 @@ func TestReadConfigPaths_dir(t *testing.T) {
 		t.Fatalf("bad: %#v", config)
 	}
 }
+
+func TestReadConfigPaths_dirMerge(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	files := map[string]string{
+		"b.json": `{"node_name": "bar", "start_join": ["10.0.0.2"], "event_handlers": ["b.sh"], "event_plugins": ["b-plugin"]}`,
+		"a.json": `{"node_name": "foo", "start_join": ["10.0.0.1"], "retry_join": ["10.0.0.3"]}`,
+		"c.json": `{"event_handlers": ["c.sh"], "event_plugins": ["c-plugin"], "retry_join": ["10.0.0.4"]}`,
+	}
+	for name, body := range files {
+		if err := ioutil.WriteFile(filepath.Join(td, name), []byte(body), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// A directory ending in .json, shouldn't be read
+	if err := os.Mkdir(filepath.Join(td, "d.json"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	config, err := ReadConfigPaths([]string{td})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if config.NodeName != "bar" {
+		t.Fatalf("bad: %#v", config)
+	}
+	if !reflect.DeepEqual(config.StartJoin, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Fatalf("bad: %#v", config.StartJoin)
+	}
+	if !reflect.DeepEqual(config.RetryJoin, []string{"10.0.0.3", "10.0.0.4"}) {
+		t.Fatalf("bad: %#v", config.RetryJoin)
+	}
+	if !reflect.DeepEqual(config.EventHandlers, []string{"b.sh", "c.sh"}) {
+		t.Fatalf("bad: %#v", config.EventHandlers)
+	}
+	if !reflect.DeepEqual(config.EventPlugins, []string{"b-plugin", "c-plugin"}) {
+		t.Fatalf("bad: %#v", config.EventPlugins)
+	}
+}
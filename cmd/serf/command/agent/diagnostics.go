@@ -0,0 +1,61 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// diagnostics returns a snapshot of the agent's state, one log line per
+// entry, for dumping when dumpSignal is received. It only takes short
+// lived locks, so it can be used while the agent is misbehaving.
+func diagnostics(agent *Agent, snapshotPath string) []string {
+	stats := agent.Stats()
+	lines := []string{
+		fmt.Sprintf("Diagnostics for %s (version %s)",
+			stats["agent"]["name"], stats["agent"]["version"]),
+	}
+	for _, section := range []string{"runtime", "serf", "memberlist"} {
+		lines = append(lines, fmt.Sprintf("%s: %s", section, formatStats(stats[section])))
+	}
+	lines = append(lines, "snapshot: "+snapshotStatus(snapshotPath))
+
+	members := agent.Serf().Members()
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	for _, m := range members {
+		addr := net.JoinHostPort(m.Addr.String(), strconv.Itoa(int(m.Port)))
+		lines = append(lines, fmt.Sprintf("member: %s %s %s %s",
+			m.Name, addr, m.Status, formatStats(m.Tags)))
+	}
+	return lines
+}
+
+// formatStats formats a stats or tags map as sorted key=value pairs.
+func formatStats(stats map[string]string) string {
+	pairs := make([]string, 0, len(stats))
+	for k, v := range stats {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// snapshotStatus describes the snapshot file, if there is one.
+func snapshotStatus(path string) string {
+	if path == "" {
+		return "disabled"
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Sprintf("%s (%v)", path, err)
+	}
+	return fmt.Sprintf("%s size=%d modified=%s", path, info.Size(),
+		info.ModTime().Format(time.RFC3339))
+}
@@ -0,0 +1,68 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/serf/testutil"
+)
+
+func TestDiagnostics(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1 := testAgent(t, ip1, nil)
+	defer a1.Shutdown()
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	lines := diagnostics(a1, filepath.Join(td, "missing"))
+	dump := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"Diagnostics for " + ip1.String(),
+		"runtime: ",
+		"goroutines=",
+		"intent_queue=",
+		"member_time=",
+		"snapshot: " + filepath.Join(td, "missing") + " (",
+		"member: " + ip1.String() + " " + ip1.String() + ":",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Fatalf("missing %q in:\n%s", want, dump)
+		}
+	}
+	if !strings.Contains(lines[len(lines)-1], " alive") {
+		t.Fatalf("bad: %q", lines[len(lines)-1])
+	}
+}
+
+func TestSnapshotStatus(t *testing.T) {
+	if s := snapshotStatus(""); s != "disabled" {
+		t.Fatalf("bad: %q", s)
+	}
+
+	f, err := ioutil.TempFile("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("alive: foo 127.0.0.1:7946\n")
+	f.Close()
+
+	if s := snapshotStatus(f.Name()); !strings.HasPrefix(s, f.Name()+" size=26 modified=") {
+		t.Fatalf("bad: %q", s)
+	}
+}
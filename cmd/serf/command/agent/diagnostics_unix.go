@@ -0,0 +1,15 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpSignal logs a diagnostic snapshot of the agent.
+var dumpSignal os.Signal = syscall.SIGUSR1
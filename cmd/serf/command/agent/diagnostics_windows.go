@@ -0,0 +1,13 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build windows
+// +build windows
+
+package agent
+
+import "os"
+
+// dumpSignal is nil as Windows has no spare signal to request a
+// diagnostic snapshot with.
+var dumpSignal os.Signal
@@ -0,0 +1,83 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// eventDocument is the structured form of an event handed to event
+// plugins, and to event scripts that ask for it. Unlike the environment
+// and stdin lines given to scripts, it keeps tags and payloads intact
+// whatever characters they hold. Payloads are base64 encoded when
+// marshaled as JSON, and are raw bytes in msgpack.
+type eventDocument struct {
+	Event   string           `json:"event" codec:"event"`
+	Name    string           `json:"name,omitempty" codec:"name,omitempty"`
+	LTime   uint64           `json:"ltime,omitempty" codec:"ltime,omitempty"`
+	Payload []byte           `json:"payload,omitempty" codec:"payload,omitempty"`
+	Members []memberDocument `json:"members,omitempty" codec:"members,omitempty"`
+
+	// Set for health events only
+	Score     int  `json:"score,omitempty" codec:"score,omitempty"`
+	Threshold int  `json:"threshold,omitempty" codec:"threshold,omitempty"`
+	Degraded  bool `json:"degraded,omitempty" codec:"degraded,omitempty"`
+
+	// Set for partition events only
+	Partitioned bool `json:"partitioned,omitempty" codec:"partitioned,omitempty"`
+	QuorumLost  bool `json:"quorum_lost,omitempty" codec:"quorum_lost,omitempty"`
+	Alive       int  `json:"alive,omitempty" codec:"alive,omitempty"`
+	Failed      int  `json:"failed,omitempty" codec:"failed,omitempty"`
+	Expected    int  `json:"expected,omitempty" codec:"expected,omitempty"`
+}
+
+// memberDocument is a member of a member event in an eventDocument.
+type memberDocument struct {
+	Name   string            `json:"name" codec:"name"`
+	Addr   string            `json:"addr" codec:"addr"`
+	Port   uint16            `json:"port" codec:"port"`
+	Tags   map[string]string `json:"tags" codec:"tags"`
+	Status string            `json:"status" codec:"status"`
+}
+
+// newEventDocument converts an event into its structured form.
+func newEventDocument(event serf.Event) (*eventDocument, error) {
+	doc := &eventDocument{Event: event.EventType().String()}
+	switch e := event.(type) {
+	case serf.MemberEvent:
+		doc.Members = make([]memberDocument, 0, len(e.Members))
+		for _, m := range e.Members {
+			doc.Members = append(doc.Members, memberDocument{
+				Name:   m.Name,
+				Addr:   m.Addr.String(),
+				Port:   m.Port,
+				Tags:   m.Tags,
+				Status: m.Status.String(),
+			})
+		}
+	case serf.UserEvent:
+		doc.Name = e.Name
+		doc.LTime = uint64(e.LTime)
+		doc.Payload = e.Payload
+	case *serf.Query:
+		doc.Name = e.Name
+		doc.LTime = uint64(e.LTime)
+		doc.Payload = e.Payload
+	case serf.HealthEvent:
+		doc.Score = e.Score
+		doc.Threshold = e.Threshold
+		doc.Degraded = e.Degraded
+	case serf.PartitionEvent:
+		doc.Partitioned = e.Partitioned
+		doc.QuorumLost = e.QuorumLost
+		doc.Alive = e.Alive
+		doc.Failed = e.Failed
+		doc.Expected = e.Expected
+	default:
+		return nil, fmt.Errorf("Unknown event type: %s", event.EventType().String())
+	}
+	return doc, nil
+}
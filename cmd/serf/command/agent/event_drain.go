@@ -0,0 +1,165 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// eventDrainSizeLimit bounds the size of the event drain file. Events
+	// past the limit are dropped with a warning.
+	eventDrainSizeLimit = 1024 * 1024
+)
+
+// drainedEvent is the form in which an undelivered event is written to
+// the event drain file, one JSON object per line.
+type drainedEvent struct {
+	Type     string
+	Members  []serf.Member    `json:",omitempty"`
+	LTime    serf.LamportTime `json:",omitempty"`
+	Name     string           `json:",omitempty"`
+	Payload  []byte           `json:",omitempty"`
+	Coalesce bool             `json:",omitempty"`
+}
+
+// key identifies a user event for de-duplication by its name and Lamport
+// time. Member events have no Lamport time, and two of them for the same
+// members can be distinct changes, so they are never de-duplicated.
+func (d *drainedEvent) key() (string, bool) {
+	if d.Type != "user" {
+		return "", false
+	}
+	return fmt.Sprintf("%s/%d", d.Name, d.LTime), true
+}
+
+// drainEvents writes any events still waiting to be handled to the event
+// drain file, so they can be replayed on the next start. This includes
+// events from the last drain that were not replayed yet. Queries can't be
+// answered after a restart, so they are dropped.
+func (a *Agent) drainEvents(path string) error {
+	var buf bytes.Buffer
+	var drained, dropped int
+	pending := a.replayLeft
+	for {
+		var e serf.Event
+		select {
+		case e = <-a.eventCh:
+		default:
+			if len(pending) == 0 {
+				goto WRITE
+			}
+			e, pending = pending[0], pending[1:]
+		}
+
+		var rec drainedEvent
+		switch ev := e.(type) {
+		case serf.MemberEvent:
+			rec = drainedEvent{Type: ev.String(), Members: ev.Members}
+		case serf.UserEvent:
+			rec = drainedEvent{
+				Type:     ev.EventType().String(),
+				LTime:    ev.LTime,
+				Name:     ev.Name,
+				Payload:  ev.Payload,
+				Coalesce: ev.Coalesce,
+			}
+		default:
+			dropped++
+			continue
+		}
+
+		line, err := json.Marshal(&rec)
+		if err != nil {
+			return fmt.Errorf("Failed to encode event: %v", err)
+		}
+		if buf.Len()+len(line)+1 > eventDrainSizeLimit {
+			dropped++
+			continue
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		drained++
+	}
+
+WRITE:
+	if dropped > 0 {
+		a.logger.Printf("[WARN] agent: Dropped %d undelivered events that could not be drained", dropped)
+	}
+	if drained == 0 {
+		// Don't leave a stale file around to be replayed again
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed to remove event drain file: %v", err)
+		}
+		return nil
+	}
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("Failed to write event drain file: %v", err)
+	}
+	a.logger.Printf("[INFO] agent: Drained %d undelivered events to %s", drained, path)
+	return nil
+}
+
+// loadDrainedEvents reads the events from an event drain file. The file is
+// left in place until the events have been replayed. User events that
+// appear more than once in the file are only returned once.
+func loadDrainedEvents(path string) ([]serf.Event, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read event drain file: %v", err)
+	}
+
+	var events []serf.Event
+	seen := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(nil, eventDrainSizeLimit)
+	for scanner.Scan() {
+		var rec drainedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("Failed to decode drained event: %v", err)
+		}
+		if key, ok := rec.key(); ok {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+		}
+
+		switch rec.Type {
+		case "member-join":
+			events = append(events, serf.MemberEvent{Type: serf.EventMemberJoin, Members: rec.Members})
+		case "member-leave":
+			events = append(events, serf.MemberEvent{Type: serf.EventMemberLeave, Members: rec.Members})
+		case "member-failed":
+			events = append(events, serf.MemberEvent{Type: serf.EventMemberFailed, Members: rec.Members})
+		case "member-update":
+			events = append(events, serf.MemberEvent{Type: serf.EventMemberUpdate, Members: rec.Members})
+		case "member-reap":
+			events = append(events, serf.MemberEvent{Type: serf.EventMemberReap, Members: rec.Members})
+		case "user":
+			events = append(events, serf.UserEvent{
+				LTime:    rec.LTime,
+				Name:     rec.Name,
+				Payload:  rec.Payload,
+				Coalesce: rec.Coalesce,
+			})
+		default:
+			return nil, fmt.Errorf("Unknown drained event type: %s", rec.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read event drain file: %v", err)
+	}
+	return events, nil
+}
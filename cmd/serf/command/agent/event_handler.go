@@ -7,9 +7,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/serf/serf"
 )
 
@@ -18,14 +21,88 @@ type EventHandler interface {
 	HandleEvent(serf.Event)
 }
 
+// CoordinateHandler is a handler that is notified when the network
+// coordinate of a node is refined.
+type CoordinateHandler interface {
+	HandleCoordinate(serf.CoordinateUpdate)
+}
+
 // ScriptEventHandler invokes scripts for the events that it receives.
 type ScriptEventHandler struct {
 	SelfFunc func() serf.Member
 	Scripts  []EventScript
 	Logger   *log.Logger
 
+	// outputLimiter caps the rate at which script output is logged, and
+	// is nil when there is no limit. See NewScriptEventHandler.
+	outputLimiter *outputLimiter
+
+	// MaxConcurrency caps how many scripts run at once, across all
+	// scripts. When it is set, every script runs in the background, so a
+	// slow one doesn't hold up the events behind it. Zero means scripts
+	// without their own concurrency run in turn, as each event arrives.
+	MaxConcurrency int
+
+	// Timeout is how long a script may run before it is killed, for
+	// scripts without their own timeout. Zero means no limit.
+	Timeout time.Duration
+
 	scriptLock sync.Mutex
 	newScripts []EventScript
+
+	// runLock guards the queues of the scripts running in the background,
+	// and slots holds a value for each of them running under the
+	// MaxConcurrency limit.
+	runLock sync.Mutex
+	runners map[string]*scriptRunner
+	slots   chan struct{}
+
+	// stopCh is closed on Shutdown, which stops the runners and kills the
+	// scripts still running, and running tracks the runners to wait for.
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	running  sync.WaitGroup
+}
+
+// scriptRunner queues the invocations of a script running in the
+// background, and runs them in order, up to limit at once.
+type scriptRunner struct {
+	script  string
+	limit   int
+	running int
+	queue   []scriptInvocation
+}
+
+// scriptInvocation is an event waiting for a script to be invoked.
+type scriptInvocation struct {
+	script EventScript
+	self   serf.Member
+	event  serf.Event
+}
+
+// warnQueued is used to warn about a script falling behind. A warning is
+// logged each time this many more invocations of it are waiting.
+const warnQueued = 100
+
+// NewScriptEventHandler returns a ScriptEventHandler that logs at most
+// outputRate lines of script output per second, across all scripts. An
+// outputRate of zero means no limit. Shutdown must be called once the
+// handler is no longer used.
+func NewScriptEventHandler(selfFunc func() serf.Member, scripts []EventScript,
+	logger *log.Logger, outputRate int) *ScriptEventHandler {
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	h := &ScriptEventHandler{
+		SelfFunc: selfFunc,
+		Scripts:  scripts,
+		Logger:   logger,
+		stopCh:   make(chan struct{}),
+	}
+	if outputRate > 0 {
+		h.outputLimiter = newOutputLimiter(outputRate, logger)
+	}
+	return h
 }
 
 func (h *ScriptEventHandler) HandleEvent(e serf.Event) {
@@ -47,10 +124,112 @@ func (h *ScriptEventHandler) HandleEvent(e serf.Event) {
 			continue
 		}
 
-		err := invokeEventScript(h.Logger, script.Script, self, e)
-		if err != nil {
-			h.Logger.Printf("[ERR] agent: Error invoking script '%s': %s",
-				script.Script, err)
+		inv := scriptInvocation{script: script, self: self, event: e}
+		if h.MaxConcurrency == 0 && script.Concurrency == 0 {
+			h.invoke(inv)
+		} else {
+			h.enqueue(inv)
+		}
+	}
+}
+
+// invoke runs a script for an event, and logs any error.
+func (h *ScriptEventHandler) invoke(inv scriptInvocation) {
+	script := inv.script
+	timeout := script.Timeout
+	if timeout == 0 {
+		timeout = h.Timeout
+	}
+	err := invokeEventScript(h.Logger, h.outputLimiter, script.Script, script.Format,
+		timeout, h.stopCh, inv.self, inv.event)
+	if err != nil {
+		h.Logger.Printf("[ERR] agent: Error invoking script '%s': %s",
+			script.Script, err)
+	}
+}
+
+// enqueue queues an invocation of a script to run in the background, and
+// starts another runner for the script if it is under its limit. Nothing
+// is queued once the handler is shut down.
+func (h *ScriptEventHandler) enqueue(inv scriptInvocation) {
+	h.runLock.Lock()
+	defer h.runLock.Unlock()
+
+	select {
+	case <-h.stopCh:
+		return
+	default:
+	}
+
+	if h.runners == nil {
+		h.runners = make(map[string]*scriptRunner)
+	}
+	if h.MaxConcurrency > 0 && h.slots == nil {
+		h.slots = make(chan struct{}, h.MaxConcurrency)
+	}
+
+	name := inv.script.Script
+	r, ok := h.runners[name]
+	if !ok {
+		r = &scriptRunner{script: name}
+		h.runners[name] = r
+	}
+	r.limit = inv.script.Concurrency
+	if r.limit == 0 {
+		r.limit = 1
+	}
+
+	r.queue = append(r.queue, inv)
+	metrics.SetGauge([]string{"agent", "invoke", name, "queued"}, float32(len(r.queue)))
+	if len(r.queue)%warnQueued == 0 {
+		h.Logger.Printf("[WARN] agent: Script '%s' falling behind, %d invocations queued",
+			name, len(r.queue))
+	}
+
+	if r.running < r.limit {
+		r.running++
+		h.running.Add(1)
+		go h.run(r)
+	}
+}
+
+// run invokes the queued invocations of a script until there are none
+// left, waiting for a slot under the MaxConcurrency limit for each one.
+// The invocations still queued are dropped once the handler is shut down.
+func (h *ScriptEventHandler) run(r *scriptRunner) {
+	defer h.running.Done()
+	for {
+		h.runLock.Lock()
+		select {
+		case <-h.stopCh:
+			r.queue = nil
+		default:
+		}
+		if len(r.queue) == 0 {
+			r.running--
+			if r.running == 0 {
+				delete(h.runners, r.script)
+			}
+			h.runLock.Unlock()
+			return
+		}
+		inv := r.queue[0]
+		r.queue[0] = scriptInvocation{}
+		r.queue = r.queue[1:]
+		metrics.SetGauge([]string{"agent", "invoke", r.script, "queued"}, float32(len(r.queue)))
+		slots := h.slots
+		h.runLock.Unlock()
+
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-h.stopCh:
+				continue
+			}
+		}
+		h.invoke(inv)
+		if slots != nil {
+			<-slots
 		}
 	}
 }
@@ -63,6 +242,22 @@ func (h *ScriptEventHandler) UpdateScripts(scripts []EventScript) {
 	h.newScripts = scripts
 }
 
+// Shutdown stops the scripts running in the background, killing those
+// still running and dropping the invocations queued, and waits for them.
+// It also stops summarizing the script output dropped by the output rate
+// limit. It is safe to call more than once.
+func (h *ScriptEventHandler) Shutdown() {
+	h.stopOnce.Do(func() {
+		if h.stopCh != nil {
+			close(h.stopCh)
+		}
+	})
+	h.running.Wait()
+	if h.outputLimiter != nil {
+		h.outputLimiter.stop()
+	}
+}
+
 // EventFilter is used to filter which events are processed
 type EventFilter struct {
 	Event string
@@ -115,6 +310,8 @@ func (s *EventFilter) Valid() bool {
 	case "member-reap":
 	case "user":
 	case "query":
+	case "health":
+	case "partition":
 	case "*":
 	default:
 		return false
@@ -122,24 +319,90 @@ func (s *EventFilter) Valid() bool {
 	return true
 }
 
+const (
+	// formatJSON and formatMsgpack are the formats an event script can be
+	// given the whole event in on stdin, rather than as lines of text.
+	formatJSON    = "json"
+	formatMsgpack = "msgpack"
+)
+
 // EventScript is a single event script that will be executed in the
 // case of an event, and is configured from the command-line or from
 // a configuration file.
 type EventScript struct {
 	EventFilter
 	Script string
+
+	// Format is empty to give the script the event as lines of text on
+	// stdin, or formatJSON or formatMsgpack to give it an eventDocument.
+	Format string
+
+	// Timeout is how long the script may run before it is killed. Zero
+	// means the handler's timeout applies.
+	Timeout time.Duration
+
+	// Concurrency is how many invocations of the script may run at once.
+	// When it is set, the script runs in the background. Zero means the
+	// script runs one at a time, in the background only if the handler
+	// has a concurrency limit.
+	Concurrency int
+
+	// badOption is an option of the script that couldn't be parsed, which
+	// makes it invalid.
+	badOption string
+}
+
+// Valid checks if this is a valid agent event script.
+func (s *EventScript) Valid() bool {
+	switch s.Format {
+	case "", formatJSON, formatMsgpack:
+	default:
+		return false
+	}
+	if s.badOption != "" || s.Timeout < 0 || s.Concurrency < 0 {
+		return false
+	}
+	return s.EventFilter.Valid()
 }
 
 func (s *EventScript) String() string {
+	var options []string
+	if s.Format != "" {
+		options = append(options, fmt.Sprintf("with %s on stdin", s.Format))
+	}
+	if s.Timeout != 0 {
+		options = append(options, fmt.Sprintf("timing out after %v", s.Timeout))
+	}
+	if s.Concurrency != 0 {
+		options = append(options, fmt.Sprintf("running %d at once", s.Concurrency))
+	}
+	if s.badOption != "" {
+		options = append(options, fmt.Sprintf("with bad option '%s'", s.badOption))
+	}
+	var suffix string
+	if len(options) > 0 {
+		suffix = " " + strings.Join(options, ", ")
+	}
 	if s.Name != "" {
-		return fmt.Sprintf("Event '%s:%s' invoking '%s'", s.Event, s.Name, s.Script)
+		return fmt.Sprintf("Event '%s:%s' invoking '%s'%s", s.Event, s.Name, s.Script, suffix)
 	}
-	return fmt.Sprintf("Event '%s' invoking '%s'", s.Event, s.Script)
+	return fmt.Sprintf("Event '%s' invoking '%s'%s", s.Event, s.Script, suffix)
 }
 
 // ParseEventScript takes a string in the format of "type=script" and
-// parses it into an EventScript struct, if it can.
+// parses it into an EventScript struct, if it can. The string can start
+// with options in brackets, separated by commas: a stdin format, a
+// "timeout=" duration and a "concurrency=" count, as in
+// "[json,timeout=30s]type=script".
 func ParseEventScript(v string) []EventScript {
+	var options EventScript
+	if strings.HasPrefix(v, "[") {
+		if end := strings.IndexByte(v, ']'); end > 0 {
+			options = parseScriptOptions(v[1:end])
+			v = v[end+1:]
+		}
+	}
+
 	var filter, script string
 	parts := strings.SplitN(v, "=", 2)
 	if len(parts) == 1 {
@@ -152,15 +415,54 @@ func ParseEventScript(v string) []EventScript {
 	filters := ParseEventFilter(filter)
 	results := make([]EventScript, 0, len(filters))
 	for _, filt := range filters {
-		result := EventScript{
-			EventFilter: filt,
-			Script:      script,
-		}
+		result := options
+		result.EventFilter = filt
+		result.Script = script
 		results = append(results, result)
 	}
 	return results
 }
 
+// parseScriptOptions parses the bracketed options of an event script.
+// The first option that can't be parsed is kept, so the script is invalid.
+func parseScriptOptions(v string) EventScript {
+	var result EventScript
+	bad := func(option string) {
+		if result.badOption == "" {
+			result.badOption = option
+		}
+	}
+	for _, option := range strings.Split(v, ",") {
+		option = strings.TrimSpace(option)
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) == 1 {
+			if result.Format != "" {
+				bad(option)
+			}
+			result.Format = strings.ToLower(option)
+			continue
+		}
+
+		switch strings.ToLower(parts[0]) {
+		case "timeout":
+			dur, err := time.ParseDuration(parts[1])
+			if err != nil {
+				bad(option)
+			}
+			result.Timeout = dur
+		case "concurrency":
+			n, err := strconv.Atoi(parts[1])
+			if err != nil {
+				bad(option)
+			}
+			result.Concurrency = n
+		default:
+			bad(option)
+		}
+	}
+	return result
+}
+
 // ParseEventFilter a string with the event type filters and
 // parses it into a series of EventFilters if it can.
 func ParseEventFilter(v string) []EventFilter {
@@ -175,6 +477,8 @@ func ParseEventFilter(v string) []EventFilter {
 		var result EventFilter
 		var name string
 
+		// Allow a space after the commas, as in "member-join, member-leave"
+		event = strings.TrimSpace(event)
 		if strings.HasPrefix(event, "user:") {
 			name = event[len("user:"):]
 			event = "user"
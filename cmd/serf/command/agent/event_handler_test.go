@@ -4,13 +4,22 @@
 package agent
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil/retry"
 )
 
 const eventScript = `#!/bin/sh
@@ -209,55 +218,65 @@ func TestEventScriptInvoke(t *testing.T) {
 		invoke bool
 	}{
 		{
-			EventScript{EventFilter{"*", ""}, "script.sh"},
+			EventScript{EventFilter: EventFilter{"*", ""}, Script: "script.sh"},
 			serf.MemberEvent{},
 			true,
 		},
 		{
-			EventScript{EventFilter{"user", ""}, "script.sh"},
+			EventScript{EventFilter: EventFilter{"user", ""}, Script: "script.sh"},
 			serf.MemberEvent{},
 			false,
 		},
 		{
-			EventScript{EventFilter{"user", "deploy"}, "script.sh"},
+			EventScript{EventFilter: EventFilter{"user", "deploy"}, Script: "script.sh"},
 			serf.UserEvent{Name: "deploy"},
 			true,
 		},
 		{
-			EventScript{EventFilter{"user", "deploy"}, "script.sh"},
+			EventScript{EventFilter: EventFilter{"user", "deploy"}, Script: "script.sh"},
 			serf.UserEvent{Name: "restart"},
 			false,
 		},
 		{
-			EventScript{EventFilter{"member-join", ""}, "script.sh"},
+			EventScript{EventFilter: EventFilter{"member-join", ""}, Script: "script.sh"},
 			serf.MemberEvent{Type: serf.EventMemberJoin},
 			true,
 		},
 		{
-			EventScript{EventFilter{"member-join", ""}, "script.sh"},
+			EventScript{EventFilter: EventFilter{"member-join", ""}, Script: "script.sh"},
 			serf.MemberEvent{Type: serf.EventMemberLeave},
 			false,
 		},
 		{
-			EventScript{EventFilter{"member-reap", ""}, "script.sh"},
+			EventScript{EventFilter: EventFilter{"member-reap", ""}, Script: "script.sh"},
 			serf.MemberEvent{Type: serf.EventMemberReap},
 			true,
 		},
 		{
-			EventScript{EventFilter{"query", "deploy"}, "script.sh"},
+			EventScript{EventFilter: EventFilter{"query", "deploy"}, Script: "script.sh"},
 			&serf.Query{Name: "deploy"},
 			true,
 		},
 		{
-			EventScript{EventFilter{"query", "uptime"}, "script.sh"},
+			EventScript{EventFilter: EventFilter{"query", "uptime"}, Script: "script.sh"},
 			&serf.Query{Name: "deploy"},
 			false,
 		},
 		{
-			EventScript{EventFilter{"query", ""}, "script.sh"},
+			EventScript{EventFilter: EventFilter{"query", ""}, Script: "script.sh"},
 			&serf.Query{Name: "deploy"},
 			true,
 		},
+		{
+			EventScript{EventFilter: EventFilter{"partition", ""}, Script: "script.sh"},
+			serf.PartitionEvent{Partitioned: true},
+			true,
+		},
+		{
+			EventScript{EventFilter: EventFilter{"partition", ""}, Script: "script.sh"},
+			serf.HealthEvent{},
+			false,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -283,6 +302,7 @@ func TestEventScriptValid(t *testing.T) {
 		{"member", false},
 		{"query", true},
 		{"Query", false},
+		{"partition", true},
 		{"*", true},
 	}
 
@@ -292,6 +312,77 @@ func TestEventScriptValid(t *testing.T) {
 			t.Errorf("bad: %#v", tc)
 		}
 	}
+
+	for format, valid := range map[string]bool{"json": true, "msgpack": true, "yaml": false} {
+		script := EventScript{EventFilter: EventFilter{Event: "*"}, Format: format}
+		if script.Valid() != valid {
+			t.Errorf("bad: %s", format)
+		}
+	}
+
+	options := map[string]bool{
+		"[timeout=5s,concurrency=3]": true,
+		"[timeout=soon]":             false,
+		"[timeout=-1s]":              false,
+		"[concurrency=many]":         false,
+		"[concurrency=-1]":           false,
+		"[json,msgpack]":             false,
+		"[retries=2]":                false,
+	}
+	for option, valid := range options {
+		script := ParseEventScript(option + "script.sh")[0]
+		if script.Valid() != valid {
+			t.Errorf("bad: %s", script.String())
+		}
+	}
+}
+
+func TestScriptEventHandler_format(t *testing.T) {
+	event := serf.MemberEvent{
+		Type: serf.EventMemberJoin,
+		Members: []serf.Member{{
+			Name:   "foo",
+			Addr:   net.ParseIP("1.2.3.4"),
+			Port:   7946,
+			Tags:   map[string]string{"role": "web\tserver", "a=b": "c,d"},
+			Status: serf.StatusAlive,
+		}},
+	}
+
+	for _, format := range []string{"json", "msgpack"} {
+		out, err := ioutil.TempFile("", "serf")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out.Close()
+		defer os.Remove(out.Name())
+
+		h := &ScriptEventHandler{
+			SelfFunc: func() serf.Member { return serf.Member{Name: "ourname"} },
+			Scripts:  ParseEventScript(fmt.Sprintf("[%s]member-join=cat >%s", format, out.Name())),
+		}
+		h.HandleEvent(event)
+
+		data, err := ioutil.ReadFile(out.Name())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var doc eventDocument
+		if format == "json" {
+			err = json.Unmarshal(data, &doc)
+		} else {
+			err = codec.NewDecoderBytes(data, &codec.MsgpackHandle{}).Decode(&doc)
+		}
+		if err != nil {
+			t.Fatalf("%s: err: %v %q", format, err, data)
+		}
+
+		m := doc.Members[0]
+		if doc.Event != "member-join" || m.Name != "foo" || m.Addr != "1.2.3.4" || m.Port != 7946 ||
+			m.Status != "alive" || m.Tags["role"] != "web\tserver" || m.Tags["a=b"] != "c,d" {
+			t.Fatalf("%s: bad: %#v", format, doc)
+		}
+	}
 }
 
 func TestParseEventScript(t *testing.T) {
@@ -303,51 +394,78 @@ func TestParseEventScript(t *testing.T) {
 		{
 			"script.sh",
 			false,
-			[]EventScript{{EventFilter{"*", ""}, "script.sh"}},
+			[]EventScript{{EventFilter: EventFilter{"*", ""}, Script: "script.sh"}},
 		},
 
 		{
 			"member-join=script.sh",
 			false,
-			[]EventScript{{EventFilter{"member-join", ""}, "script.sh"}},
+			[]EventScript{{EventFilter: EventFilter{"member-join", ""}, Script: "script.sh"}},
 		},
 
 		{
 			"foo,bar=script.sh",
 			false,
 			[]EventScript{
-				{EventFilter{"foo", ""}, "script.sh"},
-				{EventFilter{"bar", ""}, "script.sh"},
+				{EventFilter: EventFilter{"foo", ""}, Script: "script.sh"},
+				{EventFilter: EventFilter{"bar", ""}, Script: "script.sh"},
 			},
 		},
 
 		{
 			"user:deploy=script.sh",
 			false,
-			[]EventScript{{EventFilter{"user", "deploy"}, "script.sh"}},
+			[]EventScript{{EventFilter: EventFilter{"user", "deploy"}, Script: "script.sh"}},
 		},
 
 		{
 			"foo,user:blah,bar,query:tubez=script.sh",
 			false,
 			[]EventScript{
-				{EventFilter{"foo", ""}, "script.sh"},
-				{EventFilter{"user", "blah"}, "script.sh"},
-				{EventFilter{"bar", ""}, "script.sh"},
-				{EventFilter{"query", "tubez"}, "script.sh"},
+				{EventFilter: EventFilter{"foo", ""}, Script: "script.sh"},
+				{EventFilter: EventFilter{"user", "blah"}, Script: "script.sh"},
+				{EventFilter: EventFilter{"bar", ""}, Script: "script.sh"},
+				{EventFilter: EventFilter{"query", "tubez"}, Script: "script.sh"},
 			},
 		},
 
 		{
 			"query:load=script.sh",
 			false,
-			[]EventScript{{EventFilter{"query", "load"}, "script.sh"}},
+			[]EventScript{{EventFilter: EventFilter{"query", "load"}, Script: "script.sh"}},
 		},
 
 		{
 			"query=script.sh",
 			false,
-			[]EventScript{{EventFilter{"query", ""}, "script.sh"}},
+			[]EventScript{{EventFilter: EventFilter{"query", ""}, Script: "script.sh"}},
+		},
+
+		{
+			"[json]member-join,user:deploy=script.sh",
+			false,
+			[]EventScript{
+				{EventFilter: EventFilter{"member-join", ""}, Script: "script.sh", Format: "json"},
+				{EventFilter: EventFilter{"user", "deploy"}, Script: "script.sh", Format: "json"},
+			},
+		},
+
+		{
+			"[MsgPack]script.sh",
+			false,
+			[]EventScript{{EventFilter: EventFilter{"*", ""}, Script: "script.sh", Format: "msgpack"}},
+		},
+
+		{
+			"[json, timeout=30s, concurrency=2]user:deploy=script.sh",
+			false,
+			[]EventScript{{
+				EventFilter: EventFilter{"user", "deploy"},
+				Script:      "script.sh",
+				Format:      "json",
+				Timeout:     30 * time.Second,
+				Concurrency: 2,
+			}},
 		},
 	}
 
@@ -377,6 +495,18 @@ func TestParseEventScript(t *testing.T) {
 			if r.Script != expected.Script {
 				t.Errorf("Scripts not equal: %s %s", r.Script, expected.Script)
 			}
+
+			if r.Format != expected.Format {
+				t.Errorf("Formats not equal: %s %s", r.Format, expected.Format)
+			}
+
+			if r.Timeout != expected.Timeout {
+				t.Errorf("Timeouts not equal: %v %v", r.Timeout, expected.Timeout)
+			}
+
+			if r.Concurrency != expected.Concurrency {
+				t.Errorf("Concurrencies not equal: %d %d", r.Concurrency, expected.Concurrency)
+			}
 		}
 	}
 }
@@ -427,6 +557,14 @@ func TestParseEventFilter(t *testing.T) {
 			"query:load",
 			[]EventFilter{EventFilter{"query", "load"}},
 		},
+
+		{
+			"member-join, user:deploy",
+			[]EventFilter{
+				EventFilter{"member-join", ""},
+				EventFilter{"user", "deploy"},
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -454,3 +592,180 @@ func TestParseEventFilter(t *testing.T) {
 		}
 	}
 }
+
+func TestInvokeEventScript_truncatedOutput(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", log.LstdFlags)
+
+	script := fmt.Sprintf("head -c %d /dev/zero", maxBufSize*2)
+	err := invokeEventScript(logger, nil, script, "", 0, nil, serf.Member{}, serf.MemberEvent{Type: serf.EventMemberJoin})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := fmt.Sprintf("generated %d bytes of output, truncated to %d", maxBufSize*2, maxBufSize)
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatalf("bad: %s", buf.String())
+	}
+}
+
+func TestInvokeEventScript_timeout(t *testing.T) {
+	if runtime.GOOS == windows {
+		t.Skip("test script uses sh")
+	}
+
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", log.LstdFlags)
+
+	start := time.Now()
+	err := invokeEventScript(logger, nil, "sleep 5", "", 50*time.Millisecond, nil, serf.Member{}, serf.MemberEvent{Type: serf.EventMemberJoin})
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("took too long: %v", d)
+	}
+	if !strings.Contains(buf.String(), "killed") {
+		t.Fatalf("bad: %s", buf.String())
+	}
+}
+
+func TestScriptEventHandler_background(t *testing.T) {
+	if runtime.GOOS == windows {
+		t.Skip("test script uses sh")
+	}
+
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	results := filepath.Join(td, "results")
+
+	// A slow script doesn't hold up the events, nor the other scripts,
+	// which each see the events in order
+	h := &ScriptEventHandler{
+		SelfFunc:       func() serf.Member { return serf.Member{} },
+		Logger:         log.New(ioutil.Discard, "", 0),
+		MaxConcurrency: 4,
+		Scripts: append(
+			ParseEventScript("[timeout=100ms]sleep 5"),
+			ParseEventScript("echo $SERF_USER_LTIME >> "+results)...,
+		),
+	}
+	start := time.Now()
+	for i := 1; i <= 5; i++ {
+		h.HandleEvent(serf.UserEvent{LTime: serf.LamportTime(i), Name: "deploy"})
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("events held up for %v", d)
+	}
+
+	retry.Run(t, func(r *retry.R) {
+		data, _ := ioutil.ReadFile(results)
+		if string(data) != "1\n2\n3\n4\n5\n" {
+			r.Fatalf("bad: %q", data)
+		}
+	})
+}
+
+func TestScriptEventHandler_maxConcurrency(t *testing.T) {
+	if runtime.GOOS == windows {
+		t.Skip("test script uses sh")
+	}
+
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	results := filepath.Join(td, "results")
+
+	// The script may run twice at once, but only one script may run at a
+	// time across the handler, so its runs don't overlap
+	script := fmt.Sprintf("echo start >> %s; sleep 0.1; echo end >> %s", results, results)
+	h := &ScriptEventHandler{
+		SelfFunc:       func() serf.Member { return serf.Member{} },
+		Logger:         log.New(ioutil.Discard, "", 0),
+		MaxConcurrency: 1,
+		Scripts:        ParseEventScript("[concurrency=2]" + script),
+	}
+	for i := 0; i < 3; i++ {
+		h.HandleEvent(serf.UserEvent{Name: "deploy"})
+	}
+
+	retry.Run(t, func(r *retry.R) {
+		data, _ := ioutil.ReadFile(results)
+		if string(data) != strings.Repeat("start\nend\n", 3) {
+			r.Fatalf("bad: %q", data)
+		}
+	})
+}
+
+func TestScriptEventHandler_shutdown(t *testing.T) {
+	if runtime.GOOS == windows {
+		t.Skip("test script uses sh")
+	}
+
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	results := filepath.Join(td, "results")
+
+	// Shutting down kills the running script and drops the queued ones
+	h := NewScriptEventHandler(func() serf.Member { return serf.Member{} },
+		ParseEventScript("echo start >> "+results+"; sleep 5"),
+		log.New(ioutil.Discard, "", 0), 0)
+	h.MaxConcurrency = 1
+	for i := 0; i < 3; i++ {
+		h.HandleEvent(serf.UserEvent{Name: "deploy"})
+	}
+	retry.Run(t, func(r *retry.R) {
+		if _, err := os.Stat(results); err != nil {
+			r.Fatalf("err: %v", err)
+		}
+	})
+
+	start := time.Now()
+	h.Shutdown()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("shutdown took %v", d)
+	}
+	h.HandleEvent(serf.UserEvent{Name: "deploy"})
+	time.Sleep(100 * time.Millisecond)
+	data, _ := ioutil.ReadFile(results)
+	if string(data) != "start\n" {
+		t.Fatalf("bad: %q", data)
+	}
+}
+
+func TestInvokeEventScript_partition(t *testing.T) {
+	if runtime.GOOS == windows {
+		t.Skip("test script uses sh")
+	}
+
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	results := filepath.Join(td, "results")
+
+	logger := log.New(ioutil.Discard, "", 0)
+	script := "echo $SERF_EVENT $SERF_PARTITIONED $SERF_QUORUM_LOST $SERF_ALIVE_MEMBERS " +
+		"$SERF_FAILED_MEMBERS $SERF_EXPECTED_MEMBERS > " + results
+	event := serf.PartitionEvent{Partitioned: true, QuorumLost: true, Alive: 2, Failed: 4, Expected: 5}
+	if err := invokeEventScript(logger, nil, script, "", 0, nil, serf.Member{}, event); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(data) != "partition true true 2 4 5\n" {
+		t.Fatalf("bad: %q", data)
+	}
+}
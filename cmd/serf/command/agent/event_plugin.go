@@ -0,0 +1,337 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// pluginStopTimeout is how long a plugin has to exit once its stdin
+	// is closed before it is killed.
+	pluginStopTimeout = 5 * time.Second
+)
+
+// pluginResponse is the reply a plugin writes for each event it is sent.
+// Response is sent back as the answer to a query, and Error is logged.
+type pluginResponse struct {
+	Response []byte `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// PluginEventHandler sends the events it receives to long running plugin
+// processes, which avoids starting a shell for every event. A plugin is
+// started on the first event it is interested in. It is then sent each
+// event as an eventDocument in JSON on a line of its stdin, and must write
+// a pluginResponse in JSON on a line of its stdout before it is sent the
+// next one. A plugin that exits or breaks the protocol is restarted.
+type PluginEventHandler struct {
+	SelfFunc func() serf.Member
+	Plugins  []EventScript
+	Logger   *log.Logger
+
+	// Timeout is how long a plugin may take to reply to an event before it
+	// is killed, for plugins without their own timeout. Zero means no
+	// limit.
+	Timeout time.Duration
+
+	lock       sync.Mutex
+	newPlugins []EventScript
+	procs      map[string]*pluginProcess
+	shutdown   bool
+}
+
+func (h *PluginEventHandler) HandleEvent(e serf.Event) {
+	// Swap in the new plugins if any, and stop the ones no longer used
+	h.lock.Lock()
+	if h.shutdown {
+		h.lock.Unlock()
+		return
+	}
+	var unused []*pluginProcess
+	if h.newPlugins != nil {
+		h.Plugins = h.newPlugins
+		h.newPlugins = nil
+		unused = h.removeUnused()
+	}
+	plugins := h.Plugins
+	if h.Logger == nil {
+		h.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	h.lock.Unlock()
+
+	for _, proc := range unused {
+		proc.stop()
+	}
+
+	var doc *eventDocument
+	sent := make(map[string]bool)
+	for _, plugin := range plugins {
+		// A plugin matching several filters only gets the event once
+		if !plugin.Invoke(e) || sent[plugin.Script] {
+			continue
+		}
+		sent[plugin.Script] = true
+
+		if doc == nil {
+			var err error
+			if doc, err = newEventDocument(e); err != nil {
+				h.Logger.Printf("[ERR] agent: %s", err)
+				return
+			}
+		}
+
+		timeout := plugin.Timeout
+		if timeout == 0 {
+			timeout = h.Timeout
+		}
+		resp, err := h.send(plugin.Script, timeout, doc)
+		if err != nil {
+			h.Logger.Printf("[ERR] agent: Error sending event to plugin '%s': %s",
+				plugin.Script, err)
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+		if resp.Error != "" {
+			h.Logger.Printf("[ERR] agent: Plugin '%s' failed to handle event '%s': %s",
+				plugin.Script, e.String(), resp.Error)
+		}
+
+		// If this is a query and we have a response, respond
+		if query, ok := e.(*serf.Query); ok && len(resp.Response) > 0 {
+			if err := query.Respond(resp.Response); err != nil {
+				h.Logger.Printf("[WARN] agent: Failed to respond to query '%s': %s",
+					e.String(), err)
+			}
+		}
+	}
+}
+
+// send hands an event to the plugin running command, starting it if it
+// isn't running. A plugin that fails is stopped. If it had been running
+// for earlier events it may have just exited, so the event is retried
+// once with a new plugin, unless it timed out handling the event. Returns
+// a nil response once shut down.
+func (h *PluginEventHandler) send(command string, timeout time.Duration, doc *eventDocument) (*pluginResponse, error) {
+	for attempt := 0; ; attempt++ {
+		h.lock.Lock()
+		if h.shutdown {
+			h.lock.Unlock()
+			return nil, nil
+		}
+		proc, running := h.procs[command]
+		h.lock.Unlock()
+
+		// The plugin is started without the lock held, so a slow start
+		// doesn't hold up shutting down or the other plugins. The lock is
+		// only taken again to register it, unless another one was
+		// registered in the meantime.
+		if !running {
+			started, err := startPlugin(h.Logger, command, h.SelfFunc())
+			if err != nil {
+				return nil, err
+			}
+			h.lock.Lock()
+			shutdown := h.shutdown
+			other, raced := h.procs[command]
+			if !shutdown && !raced {
+				if h.procs == nil {
+					h.procs = make(map[string]*pluginProcess)
+				}
+				h.procs[command] = started
+			}
+			h.lock.Unlock()
+
+			if shutdown || raced {
+				started.stop()
+			}
+			if shutdown {
+				return nil, nil
+			}
+			proc = started
+			if raced {
+				proc = other
+			}
+		}
+
+		resp, err := proc.handle(doc, timeout)
+		if err == nil {
+			return resp, nil
+		}
+
+		h.lock.Lock()
+		if h.procs[command] == proc {
+			delete(h.procs, command)
+		}
+		h.lock.Unlock()
+		proc.stop()
+		if !running || attempt > 0 || proc.timedOut {
+			return nil, err
+		}
+	}
+}
+
+// removeUnused removes the plugins that are no longer configured, and
+// returns them so they can be stopped. The lock must be held.
+func (h *PluginEventHandler) removeUnused() []*pluginProcess {
+	used := make(map[string]bool)
+	for _, plugin := range h.Plugins {
+		used[plugin.Script] = true
+	}
+
+	var unused []*pluginProcess
+	for command, proc := range h.procs {
+		if !used[command] {
+			unused = append(unused, proc)
+			delete(h.procs, command)
+		}
+	}
+	return unused
+}
+
+// UpdatePlugins is used to safely update the plugins we send events to.
+// Plugins that are no longer configured are stopped on the next event.
+func (h *PluginEventHandler) UpdatePlugins(plugins []EventScript) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.newPlugins = plugins
+}
+
+// Shutdown stops all the plugins. No more events are sent once it is
+// called.
+func (h *PluginEventHandler) Shutdown() {
+	h.lock.Lock()
+	h.shutdown = true
+	procs := h.procs
+	h.procs = nil
+	h.lock.Unlock()
+
+	for _, proc := range procs {
+		proc.stop()
+	}
+}
+
+// pluginProcess is a running plugin.
+type pluginProcess struct {
+	command string
+	logger  *log.Logger
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	enc     *json.Encoder
+	dec     *json.Decoder
+	stopped sync.Once
+
+	// timedOut is set if the plugin was killed for taking too long to
+	// reply to an event.
+	timedOut bool
+}
+
+// startPlugin starts the plugin running command. The plugin's stderr is
+// logged as it is written.
+func startPlugin(logger *log.Logger, command string, self serf.Member) (*pluginProcess, error) {
+	cmd := shellCommand(command)
+	cmd.Env = append(os.Environ(), "SERF_SELF_NAME="+self.Name)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	logger.Printf("[INFO] agent: Started event plugin '%s'", command)
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			logger.Printf("[DEBUG] agent: Plugin '%s' output: %s", command, scanner.Text())
+		}
+	}()
+
+	return &pluginProcess{
+		command: command,
+		logger:  logger,
+		cmd:     cmd,
+		stdin:   stdin,
+		enc:     json.NewEncoder(stdin),
+		dec:     json.NewDecoder(bufio.NewReader(stdout)),
+	}, nil
+}
+
+// handle sends an event to the plugin and waits for its response. If the
+// plugin takes longer than the timeout, it is killed so that a new one is
+// started for the next event.
+func (p *pluginProcess) handle(doc *eventDocument, timeout time.Duration) (*pluginResponse, error) {
+	defer metrics.MeasureSinceWithLabels([]string{"agent", "plugin", p.command}, time.Now(), nil)
+
+	// Start a timer to warn about slow plugins
+	slowTimer := time.AfterFunc(warnSlow, func() {
+		p.logger.Printf("[WARN] agent: Plugin '%s' slow, response exceeding %v",
+			p.command, warnSlow)
+	})
+	defer slowTimer.Stop()
+
+	// Children of the plugin may hold its output open after it is killed,
+	// so don't wait for the response once it has timed out
+	var resp pluginResponse
+	killed, err := waitOrKill(p.cmd, func() error {
+		if err := p.enc.Encode(doc); err != nil {
+			return err
+		}
+		return p.dec.Decode(&resp)
+	}, timeout, nil)
+	if killed {
+		p.timedOut = true
+		metrics.IncrCounter([]string{"agent", "plugin", p.command, "timeout"}, 1)
+		p.logger.Printf("[WARN] agent: Plugin '%s' killed, response exceeding %v",
+			p.command, timeout)
+		return nil, fmt.Errorf("Timed out after %v", timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// stop asks the plugin to exit by closing its stdin, and kills it if it
+// doesn't exit in time.
+func (p *pluginProcess) stop() {
+	p.stopped.Do(func() {
+		p.stdin.Close()
+
+		exitCh := make(chan error, 1)
+		go func() {
+			exitCh <- p.cmd.Wait()
+		}()
+		select {
+		case <-exitCh:
+		case <-time.After(pluginStopTimeout):
+			p.logger.Printf("[WARN] agent: Plugin '%s' didn't exit, killing it", p.command)
+			p.cmd.Process.Kill()
+			<-exitCh
+		}
+		p.logger.Printf("[INFO] agent: Stopped event plugin '%s'", p.command)
+	})
+}
@@ -0,0 +1,210 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
+)
+
+// pluginScript records every event it is sent, and answers queries with
+// "pong", which is cG9uZw== in base64.
+const pluginScript = `#!/bin/sh
+RESULT_FILE="%s"
+echo started $SERF_SELF_NAME >>${RESULT_FILE}
+while read -r line; do
+	printf '%%s\n' "$line" >>${RESULT_FILE}
+	case "$line" in
+	*'"event":"query"'*) echo '{"response":"cG9uZw=="}' ;;
+	*'"event":"user"'*) echo '{"error":"no users here"}' ;;
+	*) echo '{}' ;;
+	esac
+done
+`
+
+// testPluginEvents returns the events the plugin recorded in results.
+func testPluginEvents(t *testing.T, results string) (int, []eventDocument) {
+	data, err := ioutil.ReadFile(results)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var starts int
+	var docs []eventDocument
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if strings.HasPrefix(line, "started ") {
+			starts++
+			continue
+		}
+		var doc eventDocument
+		if err := json.Unmarshal([]byte(line), &doc); err != nil {
+			t.Fatalf("err: %v %q", err, line)
+		}
+		docs = append(docs, doc)
+	}
+	return starts, docs
+}
+
+func TestPluginEventHandler(t *testing.T) {
+	script, results := testEventScript(t, pluginScript)
+	defer os.Remove(script)
+	defer os.Remove(results)
+
+	h := &PluginEventHandler{
+		SelfFunc: func() serf.Member { return serf.Member{Name: "ourname"} },
+		Plugins: append(ParseEventScript("member-join,user="+script),
+			ParseEventScript("member-leave=true")...),
+	}
+	defer h.Shutdown()
+
+	h.HandleEvent(serf.MemberEvent{
+		Type: serf.EventMemberJoin,
+		Members: []serf.Member{{
+			Name:   "foo",
+			Addr:   net.ParseIP("1.2.3.4"),
+			Port:   7946,
+			Tags:   map[string]string{"role": "web\tserver", "a=b": "c,d"},
+			Status: serf.StatusAlive,
+		}},
+	})
+	h.HandleEvent(serf.UserEvent{LTime: 7, Name: "deploy", Payload: []byte("v1\n\tv2")})
+	h.HandleEvent(serf.MemberEvent{Type: serf.EventMemberFailed})
+
+	starts, docs := testPluginEvents(t, results)
+	if starts != 1 || len(docs) != 2 {
+		t.Fatalf("bad: %d %#v", starts, docs)
+	}
+	m := docs[0].Members[0]
+	if docs[0].Event != "member-join" || m.Name != "foo" || m.Addr != "1.2.3.4" ||
+		m.Port != 7946 || m.Status != "alive" ||
+		m.Tags["role"] != "web\tserver" || m.Tags["a=b"] != "c,d" {
+		t.Fatalf("bad: %#v", docs[0])
+	}
+	if docs[1].Event != "user" || docs[1].Name != "deploy" || docs[1].LTime != 7 ||
+		string(docs[1].Payload) != "v1\n\tv2" {
+		t.Fatalf("bad: %#v", docs[1])
+	}
+
+	// The plugin is started again if it goes away, without losing the event
+	h.lock.Lock()
+	proc := h.procs[script]
+	h.lock.Unlock()
+	proc.stop()
+	h.HandleEvent(serf.UserEvent{LTime: 8, Name: "deploy"})
+	if starts, docs = testPluginEvents(t, results); starts != 2 || len(docs) != 3 {
+		t.Fatalf("bad: %d %#v", starts, docs)
+	}
+
+	// Plugins that are no longer configured are stopped
+	h.UpdatePlugins(ParseEventScript("member-leave=true"))
+	h.HandleEvent(serf.UserEvent{LTime: 9, Name: "deploy"})
+	h.lock.Lock()
+	_, ok := h.procs[script]
+	h.lock.Unlock()
+	if ok {
+		t.Fatalf("plugin should be stopped")
+	}
+	if _, docs = testPluginEvents(t, results); len(docs) != 3 {
+		t.Fatalf("bad: %#v", docs)
+	}
+}
+
+// slowPluginScript never replies to a user event.
+const slowPluginScript = `#!/bin/sh
+RESULT_FILE="%s"
+echo started $SERF_SELF_NAME >>${RESULT_FILE}
+while read -r line; do
+	printf '%%s\n' "$line" >>${RESULT_FILE}
+	case "$line" in
+	*'"event":"user"'*) sleep 10 ;;
+	*) echo '{}' ;;
+	esac
+done
+`
+
+func TestPluginEventHandler_timeout(t *testing.T) {
+	script, results := testEventScript(t, slowPluginScript)
+	defer os.Remove(script)
+	defer os.Remove(results)
+
+	h := &PluginEventHandler{
+		SelfFunc: func() serf.Member { return serf.Member{Name: "ourname"} },
+		Plugins: append(ParseEventScript("[timeout=200ms]user="+script),
+			ParseEventScript("member-join="+script)...),
+		Timeout: time.Minute,
+	}
+	defer h.Shutdown()
+
+	// The plugin's own timeout applies, and the event isn't sent again
+	start := time.Now()
+	h.HandleEvent(serf.UserEvent{LTime: 7, Name: "deploy"})
+	if d := time.Since(start); d > 10*time.Second {
+		t.Fatalf("plugin should have timed out: %v", d)
+	}
+	h.lock.Lock()
+	_, ok := h.procs[script]
+	h.lock.Unlock()
+	if ok {
+		t.Fatalf("plugin should be stopped")
+	}
+
+	// The next event starts it again
+	h.HandleEvent(serf.MemberEvent{Type: serf.EventMemberJoin})
+	starts, docs := testPluginEvents(t, results)
+	if starts != 2 || len(docs) != 2 || docs[0].Event != "user" || docs[1].Event != "member-join" {
+		t.Fatalf("bad: %d %#v", starts, docs)
+	}
+}
+
+func TestPluginEventHandler_query(t *testing.T) {
+	script, results := testEventScript(t, pluginScript)
+	defer os.Remove(script)
+	defer os.Remove(results)
+
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1 := testAgent(t, ip1, nil)
+	defer a1.Shutdown()
+
+	h := &PluginEventHandler{
+		SelfFunc: func() serf.Member { return a1.Serf().LocalMember() },
+		Plugins:  ParseEventScript("query:ping=" + script),
+	}
+	defer h.Shutdown()
+	a1.RegisterEventHandler(h)
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resp, err := a1.Query("ping", []byte("hello"), &serf.QueryParam{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case r := <-resp.ResponseCh():
+		if string(r.Payload) != "pong" {
+			t.Fatalf("bad: %q", r.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no response")
+	}
+
+	retry.Run(t, func(r *retry.R) {
+		_, docs := testPluginEvents(t, results)
+		if len(docs) != 1 || docs[0].Name != "ping" || string(docs[0].Payload) != "hello" {
+			r.Fatalf("bad: %#v", docs)
+		}
+	})
+}
@@ -0,0 +1,321 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	// handoffEnv is set in the environment of an agent started by a
+	// graceful restart, telling it to use the inherited sockets. Its value
+	// is the number of RPC listeners passed.
+	handoffEnv = "SERF_HANDOFF"
+
+	// handoffTimeout is how long we wait for the new agent to report each
+	// step of the handoff before giving up on it.
+	handoffTimeout = 30 * time.Second
+)
+
+// handoffListeners are the sockets passed from an agent to its
+// replacement during a graceful restart. They are passed as inherited
+// file descriptors, in the order gossip TCP, gossip UDP, the RPC listeners
+// in the order of their addresses, followed by the pipes of the handoff
+// protocol: one the new agent reports its progress on, and one telling it
+// the old agent has stopped.
+type handoffListeners struct {
+	gossipTCP *net.TCPListener
+	gossipUDP *net.UDPConn
+	rpc       []net.Listener
+}
+
+// files returns duplicates of the sockets, suitable to pass to a child
+// process. The caller should close them once the child has started.
+func (h *handoffListeners) files() ([]*os.File, error) {
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	tcp, err := h.gossipTCP.File()
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, tcp)
+
+	udp, err := h.gossipUDP.File()
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	files = append(files, udp)
+
+	for _, ln := range h.rpc {
+		var rpc *os.File
+		switch rpcLn := ln.(type) {
+		case *net.TCPListener:
+			rpc, err = rpcLn.File()
+		case *net.UnixListener:
+			// The socket file must outlive this agent for the new one to use
+			rpcLn.SetUnlinkOnClose(false)
+			rpc, err = rpcLn.File()
+		default:
+			closeAll()
+			return nil, fmt.Errorf("RPC listener can't be handed off")
+		}
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, rpc)
+	}
+	return files, nil
+}
+
+// closeRPC closes the RPC listeners.
+func (h *handoffListeners) closeRPC() {
+	for _, ln := range h.rpc {
+		ln.Close()
+	}
+}
+
+// handoffListenersFromFiles rebuilds the sockets from the files created
+// by handoffListeners.files.
+func handoffListenersFromFiles(files []*os.File) (*handoffListeners, error) {
+	// The sockets are created from duplicates, so the files can always go
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if len(files) < 3 {
+		return nil, fmt.Errorf("Expected at least 3 inherited sockets, got %d", len(files))
+	}
+
+	tcp, err := net.FileListener(files[0])
+	if err != nil {
+		return nil, fmt.Errorf("Failed to inherit gossip TCP listener: %v", err)
+	}
+	udp, err := net.FilePacketConn(files[1])
+	if err != nil {
+		tcp.Close()
+		return nil, fmt.Errorf("Failed to inherit gossip UDP listener: %v", err)
+	}
+	h := &handoffListeners{}
+	for _, f := range files[2:] {
+		rpc, err := net.FileListener(f)
+		if err != nil {
+			tcp.Close()
+			udp.Close()
+			h.closeRPC()
+			return nil, fmt.Errorf("Failed to inherit RPC listener: %v", err)
+		}
+		h.rpc = append(h.rpc, rpc)
+	}
+
+	tcpOK, udpOK := false, false
+	h.gossipTCP, tcpOK = tcp.(*net.TCPListener)
+	h.gossipUDP, udpOK = udp.(*net.UDPConn)
+	if !tcpOK || !udpOK {
+		tcp.Close()
+		udp.Close()
+		h.closeRPC()
+		return nil, fmt.Errorf("Inherited gossip sockets are not TCP and UDP")
+	}
+	return h, nil
+}
+
+// inheritedListeners returns the sockets handed off by a previous agent,
+// along with the previous agent, or nil if this agent was not started by a
+// graceful restart.
+func inheritedListeners() (*handoffListeners, *handoffParent, error) {
+	env := os.Getenv(handoffEnv)
+	if env == "" {
+		return nil, nil, nil
+	}
+	os.Unsetenv(handoffEnv)
+
+	numRPC, err := strconv.Atoi(env)
+	if err != nil || numRPC < 1 {
+		return nil, nil, fmt.Errorf("Invalid %s: %q", handoffEnv, env)
+	}
+	files := []*os.File{
+		os.NewFile(3, "gossip-tcp"),
+		os.NewFile(4, "gossip-udp"),
+	}
+	for i := 0; i < numRPC; i++ {
+		files = append(files, os.NewFile(uintptr(5+i), "rpc"))
+	}
+	parent := &handoffParent{
+		status:  os.NewFile(uintptr(5+numRPC), "handoff-status"),
+		proceed: os.NewFile(uintptr(6+numRPC), "handoff-proceed"),
+	}
+
+	h, err := handoffListenersFromFiles(files)
+	if err != nil {
+		parent.close()
+		return nil, nil, err
+	}
+	return h, parent, nil
+}
+
+// handoffParent is the agent that handed its sockets off to us. We must not
+// serve anything, or read any of its files, until it has stopped.
+type handoffParent struct {
+	status  *os.File
+	proceed *os.File
+}
+
+// prepared tells the previous agent that we are ready to take over, and
+// waits until it has stopped serving. It fails if the previous agent exits
+// or gives up on the handoff instead.
+func (p *handoffParent) prepared() error {
+	if _, err := p.status.Write([]byte{1}); err != nil {
+		p.close()
+		return fmt.Errorf("Failed to report handoff: %v", err)
+	}
+
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(p.proceed, buf)
+	p.proceed.Close()
+	if err != nil {
+		p.status.Close()
+		return fmt.Errorf("Agent handing off to us did not stop")
+	}
+	return nil
+}
+
+// running tells the previous agent that we are serving, which completes
+// the handoff.
+func (p *handoffParent) running() error {
+	defer p.status.Close()
+	if _, err := p.status.Write([]byte{1}); err != nil {
+		return fmt.Errorf("Failed to report handoff: %v", err)
+	}
+	return nil
+}
+
+func (p *handoffParent) close() {
+	p.status.Close()
+	p.proceed.Close()
+}
+
+// handoffChild is a new agent we are handing our sockets off to.
+type handoffChild struct {
+	cmd     *exec.Cmd
+	status  *os.File
+	proceed *os.File
+}
+
+// startHandoff starts a new agent process with the same arguments, passing
+// it the socket files from handoffListeners.files, and waits until it is
+// prepared to take over. The files are closed. The new agent does not
+// serve anything until takeOver is called, so the caller can stop first.
+func startHandoff(files []*os.File) (*handoffChild, error) {
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	statusR, statusW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create handoff pipe: %v", err)
+	}
+	proceedR, proceedW, err := os.Pipe()
+	if err != nil {
+		statusR.Close()
+		statusW.Close()
+		return nil, fmt.Errorf("Failed to create handoff pipe: %v", err)
+	}
+
+	cmd := newAgentProcess()
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", handoffEnv, len(files)-2))
+	cmd.ExtraFiles = append(files, statusW, proceedR)
+	err = cmd.Start()
+	statusW.Close()
+	proceedR.Close()
+	if err != nil {
+		statusR.Close()
+		proceedW.Close()
+		return nil, fmt.Errorf("Failed to start new agent: %v", err)
+	}
+
+	h := &handoffChild{cmd: cmd, status: statusR, proceed: proceedW}
+	if err := h.wait("prepared"); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// takeOver tells the new agent that we have stopped serving, and waits
+// until it reports that it is running. The new agent is killed if it
+// doesn't.
+func (h *handoffChild) takeOver() error {
+	_, err := h.proceed.Write([]byte{1})
+	h.proceed.Close()
+	if err != nil {
+		h.kill()
+		return fmt.Errorf("New agent exited before it was running")
+	}
+	return h.wait("running")
+}
+
+// pid is the process ID of the new agent.
+func (h *handoffChild) pid() int {
+	return h.cmd.Process.Pid
+}
+
+// wait waits for the new agent to report the next step of the handoff,
+// killing it if it exits or takes too long.
+func (h *handoffChild) wait(step string) error {
+	doneCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := io.ReadFull(h.status, buf)
+		doneCh <- err
+	}()
+
+	select {
+	case err := <-doneCh:
+		if err == nil {
+			return nil
+		}
+		h.kill()
+		return fmt.Errorf("New agent exited before it was %s", step)
+	case <-time.After(handoffTimeout):
+		h.kill()
+		return fmt.Errorf("New agent not %s after %v", step, handoffTimeout)
+	}
+}
+
+// kill stops the new agent and gives up on the handoff.
+func (h *handoffChild) kill() {
+	h.cmd.Process.Kill()
+	h.cmd.Wait()
+	h.status.Close()
+	h.proceed.Close()
+}
+
+// newAgentProcess returns a command to start a new agent with the same
+// binary and arguments as this one, sharing our output.
+func newAgentProcess() *exec.Cmd {
+	path, err := os.Executable()
+	if err != nil {
+		path = os.Args[0]
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
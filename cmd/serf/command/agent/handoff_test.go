@@ -0,0 +1,216 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
+)
+
+// testHandoffAgent starts an agent on the given gossip sockets, the way
+// the command does when graceful restarts are enabled.
+func testHandoffAgent(t *testing.T, ip net.IP, h *handoffListeners, snapshot string) *Agent {
+	transport, err := newListenerTransport(h.gossipTCP, h.gossipUDP,
+		log.New(testutil.TestWriter(t), "", log.LstdFlags))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serfConfig := serf.DefaultConfig()
+	serfConfig.MemberlistConfig.Transport = transport
+	serfConfig.MemberlistConfig.BindPort = h.gossipTCP.Addr().(*net.TCPAddr).Port
+	serfConfig.SnapshotPath = snapshot
+
+	a := testAgentWithConfig(t, ip, DefaultConfig(), serfConfig, nil)
+	if err := a.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return a
+}
+
+func TestAgent_handoffPreservesMembership(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	snapshot := filepath.Join(td, "snapshot")
+
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	tcpLn, udpLn, err := listenGossip(ip1.String(), 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	port := tcpLn.Addr().(*net.TCPAddr).Port
+	rpcLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h := &handoffListeners{gossipTCP: tcpLn, gossipUDP: udpLn, rpc: []net.Listener{rpcLn}}
+
+	a1 := testHandoffAgent(t, ip1, h, snapshot)
+	defer a1.Shutdown()
+
+	handler := new(MockEventHandler)
+	a2 := testAgent(t, ip2, nil)
+	a2.RegisterEventHandler(handler)
+	if err := a2.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer a2.Shutdown()
+
+	addr := net.JoinHostPort(ip1.String(), strconv.Itoa(port))
+	if _, err := a2.Join([]string{a1.conf.NodeName + "/" + addr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	retry.Run(t, func(r *retry.R) {
+		if n := len(a1.Serf().Members()); n != 2 {
+			r.Fatalf("bad: %d", n)
+		}
+	})
+
+	// Hand the sockets off the way a new process inherits them. The old
+	// agent stops without leaving before the new one starts, which then
+	// rejoins from the snapshot on its own.
+	files, err := h.files()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	inherited, err := handoffListenersFromFiles(files)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer inherited.closeRPC()
+	if len(inherited.rpc) != 1 || inherited.rpc[0].Addr().String() != rpcLn.Addr().String() {
+		t.Fatalf("bad: %v", inherited.rpc)
+	}
+
+	if err := a1.Shutdown(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	rpcLn.Close()
+	a3 := testHandoffAgent(t, ip1, inherited, snapshot)
+	defer a3.Shutdown()
+
+	// The new agent sees the cluster, and the peer never saw the node go
+	// away across several probe intervals
+	retry.Run(t, func(r *retry.R) {
+		members := a3.Serf().Members()
+		if len(members) != 2 {
+			r.Fatalf("bad: %#v", members)
+		}
+		for _, m := range members {
+			if m.Status != serf.StatusAlive {
+				r.Fatalf("bad: %#v", m)
+			}
+		}
+	})
+	time.Sleep(time.Second)
+
+	for _, m := range a2.Serf().Members() {
+		if m.Status != serf.StatusAlive {
+			t.Fatalf("bad: %#v", m)
+		}
+	}
+
+	handler.Lock()
+	defer handler.Unlock()
+	for _, e := range handler.Events {
+		me, ok := e.(serf.MemberEvent)
+		if !ok {
+			continue
+		}
+		if me.Type != serf.EventMemberJoin {
+			t.Fatalf("bad: %v", me)
+		}
+	}
+}
+
+func TestHandoffParent_notStopped(t *testing.T) {
+	statusR, statusW, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer statusR.Close()
+	proceedR, proceedW, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	parent := &handoffParent{status: statusW, proceed: proceedR}
+
+	// The previous agent gives up on the handoff once we are prepared
+	go func() {
+		buf := make([]byte, 1)
+		statusR.Read(buf)
+		proceedW.Close()
+	}()
+	if err := parent.prepared(); err == nil {
+		t.Fatalf("should have failed")
+	}
+}
+
+func TestHandoffListeners_unixRPC(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "serf.sock")
+
+	tcpLn, udpLn, err := listenGossip("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer tcpLn.Close()
+	defer udpLn.Close()
+	rpcLn, err := listenRPC(unixSocketPrefix + path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	extraLn, err := listenRPC("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer extraLn.Close()
+	h := &handoffListeners{gossipTCP: tcpLn, gossipUDP: udpLn, rpc: []net.Listener{rpcLn, extraLn}}
+
+	files, err := h.files()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	inherited, err := handoffListenersFromFiles(files)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer inherited.gossipTCP.Close()
+	defer inherited.gossipUDP.Close()
+	defer inherited.closeRPC()
+
+	// Every RPC listener is passed on, in order
+	if len(inherited.rpc) != 2 || inherited.rpc[1].Addr().String() != extraLn.Addr().String() {
+		t.Fatalf("bad: %v", inherited.rpc)
+	}
+
+	// Closing the old listener leaves the socket for the new agent
+	rpcLn.Close()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,231 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	// udpPacketBufSize is the largest gossip packet we read, matching
+	// the memberlist network transport.
+	udpPacketBufSize = 65536
+
+	// udpRecvBufSize is the receive buffer we ask the kernel for.
+	udpRecvBufSize = 2 * 1024 * 1024
+)
+
+// listenerTransport is a memberlist transport running on gossip sockets
+// owned by the agent, instead of sockets opened by memberlist itself. This
+// lets the agent pass the sockets on to a new process during a graceful
+// restart. It wraps the memberlist network transport: what arrives on our
+// sockets is ingested into it, and only reading from and writing to the
+// sockets is done here.
+type listenerTransport struct {
+	*memberlist.NetTransport
+
+	tcpLn    *net.TCPListener
+	udpLn    *net.UDPConn
+	logger   *log.Logger
+	wg       sync.WaitGroup
+	shutdown int32
+}
+
+var _ memberlist.NodeAwareTransport = (*listenerTransport)(nil)
+
+// listenGossip opens the TCP and UDP gossip sockets on the given address.
+// If port is zero, the UDP socket uses the port picked for TCP.
+func listenGossip(ip string, port int) (*net.TCPListener, *net.UDPConn, error) {
+	tcpLn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(ip), Port: port})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to start TCP listener on %q port %d: %v", ip, port, err)
+	}
+	port = tcpLn.Addr().(*net.TCPAddr).Port
+
+	udpLn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip), Port: port})
+	if err != nil {
+		tcpLn.Close()
+		return nil, nil, fmt.Errorf("Failed to start UDP listener on %q port %d: %v", ip, port, err)
+	}
+	return tcpLn, udpLn, nil
+}
+
+// newListenerTransport starts a transport on the given gossip sockets. The
+// transport takes ownership of the sockets and closes them on Shutdown.
+func newListenerTransport(tcpLn *net.TCPListener, udpLn *net.UDPConn, logger *log.Logger) (*listenerTransport, error) {
+	// The network transport always opens sockets of its own. Nothing is
+	// ever sent to these, as we advertise and send from ours instead.
+	nt, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+		BindAddrs: []string{"127.0.0.1"},
+		Logger:    logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t := &listenerTransport{
+		NetTransport: nt,
+		tcpLn:        tcpLn,
+		udpLn:        udpLn,
+		logger:       logger,
+	}
+
+	// Ask for a large receive buffer, halving it until the kernel agrees
+	for size := udpRecvBufSize; size > 0; size /= 2 {
+		if err := udpLn.SetReadBuffer(size); err == nil {
+			break
+		}
+	}
+
+	t.wg.Add(2)
+	go t.tcpListen()
+	go t.udpListen()
+	return t, nil
+}
+
+// FinalAdvertiseAddr is used by memberlist to pick the address to
+// advertise. Without an explicit address, the listener address is used,
+// or a private address of this host if bound to all interfaces.
+func (t *listenerTransport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error) {
+	if ip != "" {
+		return t.NetTransport.FinalAdvertiseAddr(ip, port)
+	}
+
+	local := t.tcpLn.Addr().(*net.TCPAddr)
+	if !local.IP.IsUnspecified() {
+		return local.IP, local.Port, nil
+	}
+
+	addr, err := privateIP()
+	if err != nil {
+		return nil, 0, err
+	}
+	return addr, local.Port, nil
+}
+
+// privateIP returns the first private IPv4 address of this host. On hosts
+// without one, such as IPv6-only hosts, the first global IPv6 address is
+// used instead.
+func privateIP() (net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get interface addresses: %v", err)
+	}
+
+	var ipv6 net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() == nil {
+			if ipv6 == nil && ipNet.IP.IsGlobalUnicast() {
+				ipv6 = ipNet.IP
+			}
+			continue
+		}
+		if isPrivateIPv4(ipNet.IP) {
+			return ipNet.IP.To4(), nil
+		}
+	}
+	if ipv6 != nil {
+		return ipv6, nil
+	}
+	return nil, fmt.Errorf("No private IP address found, and explicit IP not provided")
+}
+
+func (t *listenerTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	return t.WriteToAddress(b, memberlist.Address{Addr: addr})
+}
+
+func (t *listenerTransport) WriteToAddress(b []byte, a memberlist.Address) (time.Time, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", a.Addr)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = t.udpLn.WriteTo(b, udpAddr)
+	return time.Now(), err
+}
+
+func (t *listenerTransport) Shutdown() error {
+	atomic.StoreInt32(&t.shutdown, 1)
+	t.tcpLn.Close()
+	t.udpLn.Close()
+	t.wg.Wait()
+	return t.NetTransport.Shutdown()
+}
+
+// tcpListen accepts incoming stream connections until shutdown, backing
+// off on errors so a persistent failure does not spin.
+func (t *listenerTransport) tcpListen() {
+	defer t.wg.Done()
+
+	var delay time.Duration
+	for {
+		conn, err := t.tcpLn.AcceptTCP()
+		if err != nil {
+			if atomic.LoadInt32(&t.shutdown) == 1 {
+				return
+			}
+
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			t.logger.Printf("[ERR] agent: Error accepting gossip TCP connection: %v", err)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		t.IngestStream(conn)
+	}
+}
+
+// udpListen reads incoming gossip packets until shutdown. The network
+// transport copies each packet as it is ingested, so one buffer is reused.
+func (t *listenerTransport) udpListen() {
+	defer t.wg.Done()
+	buf := make([]byte, udpPacketBufSize)
+	for {
+		n, addr, err := t.udpLn.ReadFrom(buf)
+		ts := time.Now()
+		if err != nil {
+			if atomic.LoadInt32(&t.shutdown) == 1 {
+				return
+			}
+			t.logger.Printf("[ERR] agent: Error reading gossip UDP packet: %v", err)
+			continue
+		}
+		if n < 1 {
+			continue
+		}
+
+		packet := &packetConn{r: bytes.NewReader(buf[:n])}
+		if err := t.IngestPacket(packet, addr, ts, false); err != nil {
+			t.logger.Printf("[ERR] agent: Error ingesting gossip UDP packet: %v", err)
+		}
+	}
+}
+
+// packetConn presents a packet read from our UDP socket as the connection
+// the network transport ingests packets from. Only Read is used.
+type packetConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (c *packetConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
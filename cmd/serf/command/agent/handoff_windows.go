@@ -0,0 +1,13 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build windows
+// +build windows
+
+package agent
+
+import "os"
+
+// handoffSignal is nil as sockets can't be inherited on Windows, so
+// graceful restarts are not available.
+var handoffSignal os.Signal
@@ -0,0 +1,119 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/armon/circbuf"
+)
+
+const (
+	// healthCheckTag is the tag the result of the health check is kept in.
+	// It is reserved while a health check is configured.
+	healthCheckTag = "status"
+
+	// healthCheckEvent is the user event sent each time the result of the
+	// health check changes, with a payload of the node name and new status.
+	healthCheckEvent = "health-check"
+
+	// statusHealthy and statusUnhealthy are the values of the health check
+	// tag. Nodes start out unhealthy until the first check passes.
+	statusHealthy   = "healthy"
+	statusUnhealthy = "unhealthy"
+)
+
+// initHealthCheckTag marks the node unhealthy before it joins, if a health
+// check is configured, so it isn't used before the first check passes.
+func (a *Agent) initHealthCheckTag() {
+	if a.agentConf.HealthCheckScript == "" {
+		return
+	}
+	tags := make(map[string]string, len(a.conf.Tags)+1)
+	for k, v := range a.conf.Tags {
+		tags[k] = v
+	}
+	tags[healthCheckTag] = statusUnhealthy
+	a.conf.Tags = tags
+}
+
+// healthCheckLoop runs the health check script on an interval until the
+// agent shuts down. A script that exits with 0 within the interval passes,
+// and anything else fails. The health check tag is set from the result,
+// and a user event is sent each time it changes.
+func (a *Agent) healthCheckLoop() {
+	defer a.healthWg.Done()
+	script := a.agentConf.HealthCheckScript
+	interval := a.agentConf.HealthCheckInterval
+	last := statusUnhealthy
+	for {
+		status := statusHealthy
+		err := a.runHealthCheck(script, interval)
+		select {
+		case <-a.healthStopCh:
+			return
+		default:
+		}
+		if err != nil {
+			a.logger.Printf("[WARN] agent: Health check failed: %v", err)
+			status = statusUnhealthy
+		}
+
+		if err := a.setHealthCheckTag(status); err != nil {
+			a.logger.Printf("[ERR] agent: Failed to set health check tag: %v", err)
+		}
+		if status != last {
+			a.logger.Printf("[INFO] agent: Health check status changed from %s to %s", last, status)
+			payload := []byte(a.conf.NodeName + " " + status)
+			a.UserEvent(healthCheckEvent, payload, false)
+			last = status
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-a.healthStopCh:
+			return
+		}
+	}
+}
+
+// runHealthCheck runs the health check script, killing it if it runs for
+// longer than timeout or the agent shuts down. The output of a failing
+// script is in the error.
+func (a *Agent) runHealthCheck(script string, timeout time.Duration) error {
+	output, _ := circbuf.NewBuffer(maxBufSize)
+	cmd := shellCommand(script)
+	cmd.Env = append(os.Environ(), "SERF_SELF_NAME="+a.conf.NodeName)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	killed, err := waitScript(cmd, timeout, a.healthStopCh)
+	if killed {
+		return fmt.Errorf("Script '%s' timed out after %v", script, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("Script '%s' %v: %s", script, err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// setHealthCheckTag sets the health check tag to status, unless it is set
+// already. It is checked every time, so the tag can't be lost for long.
+func (a *Agent) setHealthCheckTag(status string) error {
+	tags := a.serf.LocalMember().Tags
+	if tags[healthCheckTag] == status {
+		return nil
+	}
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+	tags[healthCheckTag] = status
+	return a.setTags(tags)
+}
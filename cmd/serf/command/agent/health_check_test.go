@@ -0,0 +1,136 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
+)
+
+func TestAgent_healthCheck(t *testing.T) {
+	if runtime.GOOS == windows {
+		t.Skip("health check script uses sh")
+	}
+
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	okFile := filepath.Join(td, "ok")
+
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	agentConfig := DefaultConfig()
+	agentConfig.HealthCheckScript = "test -f " + okFile
+	agentConfig.HealthCheckInterval = 50 * time.Millisecond
+
+	handler := new(MockEventHandler)
+	a := testAgentWithConfig(t, ip1, agentConfig, serf.DefaultConfig(), nil)
+	a.RegisterEventHandler(handler)
+	if err := a.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer a.Shutdown()
+
+	waitStatus := func(status string) {
+		retry.Run(t, func(r *retry.R) {
+			if s := a.Serf().LocalMember().Tags[healthCheckTag]; s != status {
+				r.Fatalf("bad: %s", s)
+			}
+		})
+	}
+	waitStatus(statusUnhealthy)
+
+	// Passing checks mark the node healthy and send an event
+	if err := ioutil.WriteFile(okFile, nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitStatus(statusHealthy)
+	retry.Run(t, func(r *retry.R) {
+		handler.Lock()
+		defer handler.Unlock()
+		for _, e := range handler.Events {
+			ue, ok := e.(serf.UserEvent)
+			if ok && ue.Name == healthCheckEvent && string(ue.Payload) == ip1.String()+" healthy" {
+				return
+			}
+		}
+		r.Fatalf("no health check event: %v", handler.Events)
+	})
+
+	// Replacing the tags keeps the health check tag
+	if err := a.SetTags(map[string]string{"role": "web"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tags := a.Serf().LocalMember().Tags
+	if tags[healthCheckTag] != statusHealthy || tags["role"] != "web" {
+		t.Fatalf("bad: %v", tags)
+	}
+
+	os.Remove(okFile)
+	waitStatus(statusUnhealthy)
+}
+
+func TestAgent_runHealthCheck(t *testing.T) {
+	if runtime.GOOS == windows {
+		t.Skip("health check script uses sh")
+	}
+
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+	a := testAgent(t, ip1, nil)
+
+	if err := a.runHealthCheck("exit 0", time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err := a.runHealthCheck("echo broken; exit 2", time.Second)
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("err: %v", err)
+	}
+	err = a.runHealthCheck("sleep 5", 50*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestAgent_healthCheck_shutdown(t *testing.T) {
+	if runtime.GOOS == windows {
+		t.Skip("health check script uses sh")
+	}
+
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	agentConfig := DefaultConfig()
+	agentConfig.HealthCheckScript = "sleep 10"
+	agentConfig.HealthCheckInterval = time.Minute
+
+	a := testAgentWithConfig(t, ip1, agentConfig, serf.DefaultConfig(), nil)
+	if err := a.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Shutting down kills the running check and waits for the loop
+	doneCh := make(chan struct{})
+	go func() {
+		a.Shutdown()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("shutdown blocked on the health check")
+	}
+}
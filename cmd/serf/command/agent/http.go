@@ -0,0 +1,354 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	// metricsContentType is the content type of the Prometheus text
+	// exposition format served by the metrics endpoint.
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// httpTokenHeader carries the RPC auth key on HTTP API requests.
+	httpTokenHeader = "X-Serf-Token"
+
+	// httpMaxPayload bounds the size of a user event payload read from an
+	// HTTP request. Serf enforces the real, smaller limit on the event.
+	httpMaxPayload = 1024 * 1024
+)
+
+// AgentHTTP is an optional HTTP server run alongside the agent. It is
+// disabled unless an HTTP address is configured. It serves a JSON API
+// under "/v1/" for tools that can't speak the RPC protocol, and the
+// "/metrics" endpoint in the Prometheus text exposition format so the
+// agent can be scraped without going through the RPC layer.
+type AgentHTTP struct {
+	agent      *Agent
+	ipc        *AgentIPC
+	authKey    string
+	authTokens map[string][]string
+	auditLog   bool
+	listener   net.Listener
+	logger     *log.Logger
+	server     *http.Server
+}
+
+// NewAgentHTTP is used to create a new Agent HTTP server listening on the
+// given listener. If an auth key or tokens are given, API requests must
+// send one of them in the X-Serf-Token header, the same as RPC clients
+// must authenticate, and a token only allows the RPC commands it lists.
+// The RPC server, if given, is used to report RPC metrics.
+func NewAgentHTTP(agent *Agent, ipc *AgentIPC, authKey string, authTokens map[string][]string,
+	listener net.Listener, logOutput io.Writer, auditLog bool) *AgentHTTP {
+	if logOutput == nil {
+		logOutput = os.Stderr
+	}
+	h := &AgentHTTP{
+		agent:      agent,
+		ipc:        ipc,
+		authKey:    authKey,
+		authTokens: authTokens,
+		auditLog:   auditLog,
+		listener:   listener,
+		logger:     log.New(logOutput, "", log.LstdFlags),
+	}
+
+	// Each API endpoint is allowed by the token of the RPC command it
+	// stands in for
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", h.handleMetrics)
+	mux.HandleFunc("/v1/members", h.wrap(http.MethodGet, membersCommand, h.handleMembers))
+	mux.HandleFunc("/v1/event/", h.wrap(http.MethodPut, eventCommand, h.handleEvent))
+	mux.HandleFunc("/v1/join", h.wrap(http.MethodPut, joinCommand, h.handleJoin))
+	mux.HandleFunc("/v1/agent/self", h.wrap(http.MethodGet, selfCommand, h.handleSelf))
+	h.server = &http.Server{
+		Handler:  mux,
+		ErrorLog: h.logger,
+	}
+
+	go h.serve()
+	return h
+}
+
+// Shutdown is used to shutdown the HTTP server
+func (h *AgentHTTP) Shutdown() {
+	h.server.Close()
+}
+
+// serve is a long running routine that serves HTTP requests
+func (h *AgentHTTP) serve() {
+	err := h.server.Serve(h.listener)
+	if err != nil && err != http.ErrServerClosed {
+		h.logger.Printf("[ERR] agent.http: Failed to serve: %v", err)
+	}
+}
+
+// httpError is returned by API handlers to respond with a status code
+// other than an internal server error
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+// wrap checks the method and auth token of an API request before calling
+// the handler, and encodes whatever it returns as JSON.
+func (h *AgentHTTP) wrap(method, command string,
+	handler func(req *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != method {
+			resp.Header().Set("Allow", method)
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if msg := h.authorize(req, command); msg != "" {
+			h.audit(req, command, "denied")
+			http.Error(resp, msg, http.StatusForbidden)
+			return
+		}
+		h.audit(req, command, "allowed")
+
+		obj, err := handler(req)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if herr, ok := err.(*httpError); ok {
+				code = herr.code
+			} else {
+				h.logger.Printf("[ERR] agent.http: Request for %s failed: %v", req.URL.Path, err)
+			}
+			http.Error(resp, err.Error(), code)
+			return
+		}
+		if obj == nil {
+			return
+		}
+
+		resp.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(resp).Encode(obj); err != nil {
+			h.logger.Printf("[ERR] agent.http: Failed to encode response: %v", err)
+		}
+	}
+}
+
+// handleMembers lists the members known to the agent
+func (h *AgentHTTP) handleMembers(req *http.Request) (interface{}, error) {
+	raw := h.agent.Serf().Members()
+	members := make([]Member, 0, len(raw))
+	for _, m := range raw {
+		members = append(members, newMember(m))
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members, nil
+}
+
+// handleEvent fires a user event named by the rest of the path, with the
+// request body as its payload. Events are coalesced unless the coalesce
+// parameter is false, as with the serf event command.
+func (h *AgentHTTP) handleEvent(req *http.Request) (interface{}, error) {
+	name := strings.TrimPrefix(req.URL.Path, "/v1/event/")
+	if name == "" {
+		return nil, &httpError{http.StatusBadRequest, "Missing event name"}
+	}
+
+	coalesce := true
+	if v := req.URL.Query().Get("coalesce"); v != "" {
+		var err error
+		if coalesce, err = strconv.ParseBool(v); err != nil {
+			return nil, &httpError{http.StatusBadRequest, fmt.Sprintf("Invalid coalesce value: %s", v)}
+		}
+	}
+
+	payload, err := ioutil.ReadAll(io.LimitReader(req.Body, httpMaxPayload+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > httpMaxPayload {
+		return nil, &httpError{http.StatusRequestEntityTooLarge, "Event payload too large"}
+	}
+
+	if err := h.agent.UserEvent(name, payload, coalesce); err != nil {
+		return nil, &httpError{http.StatusBadRequest, err.Error()}
+	}
+	return nil, nil
+}
+
+// handleJoin joins the agent to the addresses given in the address
+// parameters, replaying past user events if the replay parameter is true.
+func (h *AgentHTTP) handleJoin(req *http.Request) (interface{}, error) {
+	query := req.URL.Query()
+	addrs := query["address"]
+	if len(addrs) == 0 {
+		return nil, &httpError{http.StatusBadRequest, "At least one address is required"}
+	}
+
+	var replay bool
+	if v := query.Get("replay"); v != "" {
+		var err error
+		if replay, err = strconv.ParseBool(v); err != nil {
+			return nil, &httpError{http.StatusBadRequest, fmt.Sprintf("Invalid replay value: %s", v)}
+		}
+	}
+
+	n, err := h.agent.Join(addrs, replay)
+	if n == 0 && err != nil {
+		return nil, err
+	}
+	return struct{ NumJoined int }{n}, nil
+}
+
+// authorize checks the auth token of an API request the same way the RPC
+// server checks the token of a client, returning why the request is denied,
+// or an empty string if it is allowed.
+func (h *AgentHTTP) authorize(req *http.Request, command string) string {
+	if h.authKey == "" && len(h.authTokens) == 0 {
+		return ""
+	}
+
+	token := req.Header.Get(httpTokenHeader)
+	if methods, ok := h.authTokens[token]; ok && token != "" {
+		for _, method := range methods {
+			if method == command {
+				return ""
+			}
+		}
+		h.logger.Printf("[WARN] agent.http: Request from %s is not allowed to call '%s'",
+			req.RemoteAddr, command)
+		return fmt.Sprintf("%s: token is not allowed to call '%s'", permissionDenied, command)
+	}
+	if h.authKey != "" && keyMatches(token, h.authKey) {
+		return ""
+	}
+	h.logger.Printf("[WARN] agent.http: Request for %s with an invalid auth token from %s",
+		req.URL.Path, req.RemoteAddr)
+	return invalidAuthToken
+}
+
+// audit logs an API request and whether it was allowed, if audit logging
+// is enabled, in the same form as RPC requests are logged
+func (h *AgentHTTP) audit(req *http.Request, command, outcome string) {
+	if !h.auditLog {
+		return
+	}
+	h.logger.Printf("[INFO] agent.http: audit: client=%s command=%s outcome=%s",
+		req.RemoteAddr, command, outcome)
+}
+
+// handleSelf describes the local member along with the agent's config,
+// versions, coordinate and stats, in the same form as the self RPC command.
+func (h *AgentHTTP) handleSelf(req *http.Request) (interface{}, error) {
+	return newSelfResponse(h.agent), nil
+}
+
+// handleMetrics writes out the agent's gauges and counters in the
+// Prometheus text exposition format
+func (h *AgentHTTP) handleMetrics(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp.Header().Set("Content-Type", metricsContentType)
+	buf := bufio.NewWriter(resp)
+	h.writeMetrics(buf)
+	if err := buf.Flush(); err != nil {
+		h.logger.Printf("[ERR] agent.http: Failed to write metrics: %v", err)
+	}
+}
+
+// writeMetrics renders every metric we expose to the given writer
+func (h *AgentHTTP) writeMetrics(w io.Writer) {
+	s := h.agent.Serf()
+	stats := s.Stats()
+
+	// Count the members by status, always reporting every status
+	statuses := []serf.MemberStatus{
+		serf.StatusAlive,
+		serf.StatusLeaving,
+		serf.StatusLeft,
+		serf.StatusFailed,
+	}
+	byStatus := make(map[serf.MemberStatus]int)
+	for _, m := range s.Members() {
+		byStatus[m.Status]++
+	}
+	writeMetricHeader(w, "serf_members", "gauge", "Number of known members by status.")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "serf_members{status=%q} %d\n", status.String(), byStatus[status])
+	}
+
+	writeMetricHeader(w, "serf_health_score", "gauge",
+		"Local health score, lower is healthier.")
+	fmt.Fprintf(w, "serf_health_score %s\n", statNumber(stats, "health_score"))
+
+	writeMetricHeader(w, "serf_queue_depth", "gauge", "Number of queued broadcasts by queue.")
+	for _, queue := range []string{"intent", "event", "query"} {
+		fmt.Fprintf(w, "serf_queue_depth{queue=%q} %s\n", queue, statNumber(stats, queue+"_queue"))
+	}
+
+	writeMetricHeader(w, "serf_lamport_time", "gauge", "Current Lamport time by clock.")
+	for _, clock := range []string{"member", "event", "query"} {
+		fmt.Fprintf(w, "serf_lamport_time{clock=%q} %s\n", clock, statNumber(stats, clock+"_time"))
+	}
+
+	// Report the event counts in a stable order
+	counts := h.agent.EventCounts()
+	types := make([]string, 0, len(counts))
+	for typ := range counts {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	writeMetricHeader(w, "serf_agent_events_total", "counter",
+		"Number of events received by the agent by type.")
+	for _, typ := range types {
+		fmt.Fprintf(w, "serf_agent_events_total{type=%q} %d\n", typ, counts[typ])
+	}
+
+	count, total := h.agent.QueryDurations()
+	writeMetricHeader(w, "serf_query_duration_seconds", "summary",
+		"Time queries sent by the agent took to get their last response.")
+	fmt.Fprintf(w, "serf_query_duration_seconds_sum %s\n",
+		strconv.FormatFloat(total.Seconds(), 'f', -1, 64))
+	fmt.Fprintf(w, "serf_query_duration_seconds_count %d\n", count)
+
+	if h.ipc != nil {
+		writeMetricHeader(w, "serf_agent_rpc_clients", "gauge", "Number of connected RPC clients.")
+		fmt.Fprintf(w, "serf_agent_rpc_clients %d\n", h.ipc.NumClients())
+		writeMetricHeader(w, "serf_agent_rpc_commands_total", "counter",
+			"Number of RPC commands handled by the agent.")
+		fmt.Fprintf(w, "serf_agent_rpc_commands_total %d\n", h.ipc.NumCommands())
+	}
+}
+
+// writeMetricHeader writes the HELP and TYPE lines that precede a metric
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// statNumber looks up a numeric value in the Serf stats, falling back
+// to zero if it is missing or malformed
+func statNumber(stats map[string]string, key string) string {
+	if _, err := strconv.ParseUint(stats[key], 10, 64); err != nil {
+		return "0"
+	}
+	return stats[key]
+}
@@ -0,0 +1,370 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
+)
+
+func TestAgentHTTP_metrics(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1 := testAgent(t, ip1, nil)
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.Yield()
+	a1.observeQuery(time.Second)
+	a1.observeQuery(500 * time.Millisecond)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h := NewAgentHTTP(a1, nil, "", nil, l, testutil.TestWriter(t), false)
+	defer h.Shutdown()
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("bad: %s", resp.Header.Get("Content-Type"))
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Every line must be a comment or a valid sample
+	commentRe := regexp.MustCompile(`^# (HELP|TYPE) [a-zA-Z_:][a-zA-Z0-9_:]* .+$`)
+	sampleRe := regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*(\{[a-zA-Z_][a-zA-Z0-9_]*="[^"]*"\})? [0-9]+(\.[0-9]+)?$`)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	for _, line := range lines {
+		if !commentRe.MatchString(line) && !sampleRe.MatchString(line) {
+			t.Fatalf("invalid exposition line: %q", line)
+		}
+	}
+
+	expected := []string{
+		`serf_members{status="alive"} 1`,
+		`serf_members{status="failed"} 0`,
+		`serf_agent_events_total{type="member-join"} 1`,
+		"# TYPE serf_health_score gauge",
+		`serf_queue_depth{queue="intent"} `,
+		"serf_query_duration_seconds_sum 1.5\n",
+		"serf_query_duration_seconds_count 2\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Fatalf("missing %q in: %s", e, body)
+		}
+	}
+}
+
+func TestAgentHTTP_api(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1, nil)
+	defer a1.Shutdown()
+	handler := new(MockEventHandler)
+	a1.RegisterEventHandler(handler)
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	a2 := testAgent(t, ip2, nil)
+	defer a2.Shutdown()
+	if err := a2.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h := NewAgentHTTP(a1, nil, "", nil, l, testutil.TestWriter(t), false)
+	defer h.Shutdown()
+	base := "http://" + l.Addr().String()
+
+	do := func(method, path string, body string, out interface{}) int {
+		req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer resp.Body.Close()
+		if out != nil && resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var join struct{ NumJoined int }
+	if code := do("PUT", "/v1/join?address="+a2.conf.NodeName+"/"+ip2.String(), "", &join); code != http.StatusOK {
+		t.Fatalf("bad: %d", code)
+	}
+	if join.NumJoined != 1 {
+		t.Fatalf("bad: %#v", join)
+	}
+	if code := do("PUT", "/v1/join", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("bad: %d", code)
+	}
+
+	retry.Run(t, func(r *retry.R) {
+		var members []Member
+		if code := do("GET", "/v1/members", "", &members); code != http.StatusOK {
+			r.Fatalf("bad: %d", code)
+		}
+		if len(members) != 2 || members[0].Status != "alive" || members[1].Status != "alive" {
+			r.Fatalf("bad: %#v", members)
+		}
+	})
+
+	var self selfResponse
+	if code := do("GET", "/v1/agent/self", "", &self); code != http.StatusOK {
+		t.Fatalf("bad: %d", code)
+	}
+	if self.Member.Name != a1.conf.NodeName || self.Stats["agent"]["name"] != a1.conf.NodeName {
+		t.Fatalf("bad: %#v", self)
+	}
+	if self.Config["node_name"] != a1.conf.NodeName || self.Versions.Version == "" {
+		t.Fatalf("bad: %#v", self)
+	}
+
+	if code := do("PUT", "/v1/event/deploy?coalesce=false", "v1.2", nil); code != http.StatusOK {
+		t.Fatalf("bad: %d", code)
+	}
+	retry.Run(t, func(r *retry.R) {
+		handler.Lock()
+		defer handler.Unlock()
+		for _, e := range handler.Events {
+			if ue, ok := e.(serf.UserEvent); ok && ue.Name == "deploy" &&
+				string(ue.Payload) == "v1.2" && !ue.Coalesce {
+				return
+			}
+		}
+		r.Fatalf("missing event: %#v", handler.Events)
+	})
+
+	bad := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"PUT", "/v1/event/", http.StatusBadRequest},
+		{"PUT", "/v1/event/deploy?coalesce=maybe", http.StatusBadRequest},
+		{"GET", "/v1/event/deploy", http.StatusMethodNotAllowed},
+		{"POST", "/v1/members", http.StatusMethodNotAllowed},
+	}
+	for _, tc := range bad {
+		if code := do(tc.method, tc.path, "", nil); code != tc.code {
+			t.Fatalf("%s %s bad: %d", tc.method, tc.path, code)
+		}
+	}
+}
+
+func TestAgentHTTP_auth(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1 := testAgent(t, ip1, nil)
+	defer a1.Shutdown()
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h := NewAgentHTTP(a1, nil, "foobar", nil, l, testutil.TestWriter(t), false)
+	defer h.Shutdown()
+	base := "http://" + l.Addr().String()
+
+	for token, expect := range map[string]int{
+		"":       http.StatusForbidden,
+		"foo":    http.StatusForbidden,
+		"foobar": http.StatusOK,
+	} {
+		req, err := http.NewRequest("GET", base+"/v1/members", nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if token != "" {
+			req.Header.Set(httpTokenHeader, token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expect {
+			t.Fatalf("token %q bad: %d", token, resp.StatusCode)
+		}
+	}
+
+	// Metrics stay open to scrapers
+	resp, err := http.Get(base + "/metrics")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+}
+
+// syncBuffer is a buffer that can be written to from several goroutines
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestAgentHTTP_authTokens(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a1 := testAgent(t, ip1, nil)
+	defer a1.Shutdown()
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	logs := new(syncBuffer)
+	tokens := map[string][]string{"reader": {membersCommand}}
+	h := NewAgentHTTP(a1, nil, "", tokens, l, logs, true)
+	defer h.Shutdown()
+	base := "http://" + l.Addr().String()
+
+	// With only tokens configured, requests still need one, and a token
+	// only allows the commands it lists
+	cases := []struct {
+		method string
+		path   string
+		token  string
+		expect int
+	}{
+		{"GET", "/v1/members", "", http.StatusForbidden},
+		{"GET", "/v1/members", "nope", http.StatusForbidden},
+		{"GET", "/v1/members", "reader", http.StatusOK},
+		{"GET", "/v1/agent/self", "reader", http.StatusForbidden},
+		{"PUT", "/v1/event/deploy", "reader", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		req, err := http.NewRequest(tc.method, base+tc.path, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if tc.token != "" {
+			req.Header.Set(httpTokenHeader, tc.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.expect {
+			t.Fatalf("%s %s with %q bad: %d", tc.method, tc.path, tc.token, resp.StatusCode)
+		}
+	}
+
+	for _, line := range []string{"command=members outcome=allowed", "command=self outcome=denied"} {
+		if !strings.Contains(logs.String(), line) {
+			t.Fatalf("missing %q: %s", line, logs.String())
+		}
+	}
+}
+
+func TestAgentHTTP_metricsRPC(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	client, a1, ipc := testRPCClient(t, ip1)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := client.Members(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h := NewAgentHTTP(a1, ipc, "", nil, l, testutil.TestWriter(t), false)
+	defer h.Shutdown()
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The handshake and the members call were both handled
+	for _, e := range []string{
+		"serf_agent_rpc_clients 1\n",
+		"serf_agent_rpc_commands_total 2\n",
+	} {
+		if !strings.Contains(string(body), e) {
+			t.Fatalf("missing %q in: %s", e, body)
+		}
+	}
+}
@@ -4,6 +4,7 @@
 package agent
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/armon/circbuf"
 	"github.com/armon/go-metrics"
+	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/hashicorp/serf/serf"
 )
 
@@ -42,21 +44,20 @@ var sanitizeTagRegexp = regexp.MustCompile(`[^A-Z0-9_]`)
 //
 // In all events, data is passed in via stdin to facilitate piping. See
 // the various stdin functions below for more information.
-func invokeEventScript(logger *log.Logger, script string, self serf.Member, event serf.Event) error {
+//
+// If format is formatJSON or formatMsgpack, stdin instead holds the whole
+// event as an eventDocument in that format.
+//
+// The output of the script is logged at the rate allowed by limiter,
+// which may be nil to log all of it. If timeout is set, a script still
+// running after it is killed, and its output is discarded. The same goes
+// for a script still running once stopCh is closed, if it isn't nil.
+func invokeEventScript(logger *log.Logger, limiter *outputLimiter, script, format string,
+	timeout time.Duration, stopCh <-chan struct{}, self serf.Member, event serf.Event) error {
 	defer metrics.MeasureSinceWithLabels([]string{"agent", "invoke", script}, time.Now(), nil)
 	output, _ := circbuf.NewBuffer(maxBufSize)
 
-	// Determine the shell invocation based on OS
-	var shell, flag string
-	if runtime.GOOS == windows {
-		shell = "cmd"
-		flag = "/C"
-	} else {
-		shell = "/bin/sh"
-		flag = "-c"
-	}
-
-	cmd := exec.Command(shell, flag, script)
+	cmd := shellCommand(script)
 	cmd.Env = append(os.Environ(),
 		"SERF_EVENT="+event.EventType().String(),
 		"SERF_SELF_NAME="+self.Name,
@@ -81,20 +82,41 @@ func invokeEventScript(logger *log.Logger, script string, self serf.Member, even
 		return err
 	}
 
+	var writeStdin func()
 	switch e := event.(type) {
 	case serf.MemberEvent:
-		go memberEventStdin(logger, stdin, &e)
+		writeStdin = func() { memberEventStdin(logger, stdin, &e) }
 	case serf.UserEvent:
 		cmd.Env = append(cmd.Env, "SERF_USER_EVENT="+e.Name)
 		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_USER_LTIME=%d", e.LTime))
-		go streamPayload(logger, stdin, e.Payload)
+		writeStdin = func() { streamPayload(logger, stdin, e.Payload) }
 	case *serf.Query:
 		cmd.Env = append(cmd.Env, "SERF_QUERY_NAME="+e.Name)
 		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_QUERY_LTIME=%d", e.LTime))
-		go streamPayload(logger, stdin, e.Payload)
+		writeStdin = func() { streamPayload(logger, stdin, e.Payload) }
+	case serf.HealthEvent:
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_HEALTH_SCORE=%d", e.Score))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_HEALTH_THRESHOLD=%d", e.Threshold))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_HEALTH_DEGRADED=%t", e.Degraded))
+		writeStdin = func() { streamPayload(logger, stdin, nil) }
+	case serf.PartitionEvent:
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_PARTITIONED=%t", e.Partitioned))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_QUORUM_LOST=%t", e.QuorumLost))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_ALIVE_MEMBERS=%d", e.Alive))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_FAILED_MEMBERS=%d", e.Failed))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SERF_EXPECTED_MEMBERS=%d", e.Expected))
+		writeStdin = func() { streamPayload(logger, stdin, nil) }
 	default:
 		return fmt.Errorf("Unknown event type: %s", event.EventType().String())
 	}
+	if format != "" {
+		doc, err := newEventDocument(event)
+		if err != nil {
+			return err
+		}
+		writeStdin = func() { documentStdin(logger, stdin, doc, format) }
+	}
+	go writeStdin()
 
 	// Start a timer to warn about slow handlers
 	slowTimer := time.AfterFunc(warnSlow, func() {
@@ -106,16 +128,27 @@ func invokeEventScript(logger *log.Logger, script string, self serf.Member, even
 		return err
 	}
 
-	// Warn if buffer is overritten
+	killed, err := waitScript(cmd, timeout, stopCh)
+	slowTimer.Stop()
+	if killed {
+		select {
+		case <-stopCh:
+			return fmt.Errorf("Killed on shutdown")
+		default:
+		}
+		metrics.IncrCounter([]string{"agent", "invoke", script, "timeout"}, 1)
+		logger.Printf("[WARN] agent: Script '%s' killed, execution exceeding %v",
+			script, timeout)
+		return fmt.Errorf("Timed out after %v", timeout)
+	}
+
+	// Warn if buffer is overwritten. This can only be known once the
+	// script has exited and all of its output has been collected.
 	if output.TotalWritten() > output.Size() {
 		logger.Printf("[WARN] agent: Script '%s' generated %d bytes of output, truncated to %d",
 			script, output.TotalWritten(), output.Size())
 	}
-
-	err = cmd.Wait()
-	slowTimer.Stop()
-	logger.Printf("[DEBUG] agent: Event '%s' script output: %s",
-		event.EventType().String(), output.String())
+	logScriptOutput(logger, limiter, event.EventType().String(), output.String())
 	if err != nil {
 		return err
 	}
@@ -131,6 +164,50 @@ func invokeEventScript(logger *log.Logger, script string, self serf.Member, even
 	return nil
 }
 
+// shellCommand returns a command running script through the shell of
+// this OS.
+func shellCommand(script string) *exec.Cmd {
+	if runtime.GOOS == windows {
+		return exec.Command("cmd", "/C", script)
+	}
+	return exec.Command("/bin/sh", "-c", script)
+}
+
+// waitScript waits for a started script to exit, killing it if it is still
+// running after timeout or once stopCh is closed. A zero timeout or a nil
+// stopCh never kills it. Children of the script may hold its output open
+// after it is killed, so they are not waited for. killed is true if the
+// script was killed before it exited.
+func waitScript(cmd *exec.Cmd, timeout time.Duration, stopCh <-chan struct{}) (killed bool, err error) {
+	return waitOrKill(cmd, cmd.Wait, timeout, stopCh)
+}
+
+// waitOrKill calls wait, and kills the started cmd if wait hasn't returned
+// after timeout or once stopCh is closed, the same way as waitScript. wait
+// is given up on once the command is killed.
+func waitOrKill(cmd *exec.Cmd, wait func() error, timeout time.Duration,
+	stopCh <-chan struct{}) (killed bool, err error) {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- wait()
+	}()
+
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	select {
+	case err := <-errCh:
+		return false, err
+	case <-timeoutCh:
+	case <-stopCh:
+	}
+	cmd.Process.Kill()
+	return true, nil
+}
+
 // eventClean cleans a value to be a parameter in an event line.
 func eventClean(v string) string {
 	v = strings.Replace(v, "\t", "\\t", -1)
@@ -149,11 +226,7 @@ func memberEventStdin(logger *log.Logger, stdin io.WriteCloser, e *serf.MemberEv
 	defer stdin.Close()
 	for _, member := range e.Members {
 		// Format the tags as tag1=v1,tag2=v2,...
-		var tagPairs []string
-		for name, value := range member.Tags {
-			tagPairs = append(tagPairs, fmt.Sprintf("%s=%s", name, value))
-		}
-		tags := strings.Join(tagPairs, ",")
+		tags := strings.Join(MarshalTags(member.Tags), ",")
 
 		// Send the entire line
 		_, err := stdin.Write([]byte(fmt.Sprintf(
@@ -168,6 +241,25 @@ func memberEventStdin(logger *log.Logger, stdin io.WriteCloser, e *serf.MemberEv
 	}
 }
 
+// Sends an event on stdin as a single eventDocument, encoded in the given
+// format.
+func documentStdin(logger *log.Logger, stdin io.WriteCloser, doc *eventDocument, format string) {
+	defer stdin.Close()
+
+	var err error
+	switch format {
+	case formatJSON:
+		err = json.NewEncoder(stdin).Encode(doc)
+	case formatMsgpack:
+		err = codec.NewEncoder(stdin, &codec.MsgpackHandle{WriteExt: true}).Encode(doc)
+	default:
+		err = fmt.Errorf("Unknown format: %s", format)
+	}
+	if err != nil {
+		logger.Printf("[ERR] Error writing event: %s", err)
+	}
+}
+
 // Sends data on stdin for an event. The stdin simply contains the
 // payload (if any).
 // Most shells read implementations need a newline, force it to be there
@@ -15,7 +15,8 @@ package agent
  The system is fairly simple, each client opens a TCP connection to the
  agent. The connection is initialized with a handshake which establishes
  the protocol version being used. This is to allow for future changes to
- the protocol.
+ the protocol. Messages are encoded with msgpack by default, or with JSON
+ if the client's first message is a JSON object.
 
  Once initialized, clients send commands and wait for responses. Certain
  commands will cause the client to subscribe to events, and those will be
@@ -26,6 +27,7 @@ package agent
 
 import (
 	"bufio"
+	"crypto/subtle"
 	"fmt"
 	"io"
 	"log"
@@ -38,8 +40,6 @@ import (
 	"time"
 
 	"github.com/armon/go-metrics"
-	"github.com/hashicorp/go-msgpack/codec"
-	"github.com/hashicorp/logutils"
 	"github.com/hashicorp/serf/coordinate"
 	"github.com/hashicorp/serf/serf"
 )
@@ -69,7 +69,12 @@ const (
 	respondCommand         = "respond"
 	authCommand            = "auth"
 	statsCommand           = "stats"
+	selfCommand            = "self"
 	getCoordinateCommand   = "get-coordinate"
+	queryVersionsCommand   = "query-versions"
+	pauseCommand           = "pause"
+	resumeCommand          = "resume"
+	coordStreamCommand     = "coordinate-stream"
 )
 
 const (
@@ -83,8 +88,17 @@ const (
 	invalidQueryID        = "No pending queries matching ID"
 	authRequired          = "Authentication required"
 	invalidAuthToken      = "Invalid authentication token"
+	permissionDenied      = "Permission denied"
 )
 
+// errUnsupportedCommand is returned by handleRequest to close the
+// connection of a client that sent a command we don't recognize
+var errUnsupportedCommand = fmt.Errorf(unsupportedCommand)
+
+// errPermissionDenied is returned by handleRequest to close the connection
+// of a client that sent a command its token does not allow
+var errPermissionDenied = fmt.Errorf(permissionDenied)
+
 const (
 	queryRecordAck      = "ack"
 	queryRecordResponse = "response"
@@ -120,6 +134,22 @@ type coordinateResponse struct {
 	Ok    bool
 }
 
+// selfResponse describes the local agent in a single response, so a health
+// checker doesn't need to make several calls
+type selfResponse struct {
+	Member   Member
+	Config   map[string]string
+	Versions serf.NodeVersion
+	Coord    coordinate.Coordinate
+	HasCoord bool
+	Stats    map[string]map[string]string
+}
+
+type coordinateUpdateRecord struct {
+	Node  string
+	Coord coordinate.Coordinate
+}
+
 type eventRequest struct {
 	Name     string
 	Payload  []byte
@@ -141,9 +171,10 @@ type joinResponse struct {
 }
 
 type membersFilteredRequest struct {
-	Tags   map[string]string
-	Status string
-	Name   string
+	Tags          map[string]string
+	Status        string
+	Name          string
+	ChangedWithin time.Duration
 }
 
 type membersResponse struct {
@@ -162,6 +193,13 @@ type keyResponse struct {
 	NumResp  int
 }
 
+type versionsResponse struct {
+	Versions map[string]serf.NodeVersion
+	Messages map[string]string
+	NumNodes int
+	NumResp  int
+}
+
 type monitorRequest struct {
 	LogLevel string
 }
@@ -220,6 +258,22 @@ type queryEventRecord struct {
 	Payload []byte
 }
 
+type healthEventRecord struct {
+	Event     string
+	Score     int
+	Threshold int
+	Degraded  bool
+}
+
+type partitionEventRecord struct {
+	Event       string
+	Partitioned bool
+	QuorumLost  bool
+	Alive       int
+	Failed      int
+	Expected    int
+}
+
 type Member struct {
 	Name        string
 	Addr        net.IP
@@ -234,21 +288,59 @@ type Member struct {
 	DelegateCur uint8
 }
 
+// newMember converts a Serf member into the form sent to clients
+func newMember(m serf.Member) Member {
+	return Member{
+		Name:        m.Name,
+		Addr:        m.Addr,
+		Port:        m.Port,
+		Tags:        m.Tags,
+		Status:      m.Status.String(),
+		ProtocolMin: m.ProtocolMin,
+		ProtocolMax: m.ProtocolMax,
+		ProtocolCur: m.ProtocolCur,
+		DelegateMin: m.DelegateMin,
+		DelegateMax: m.DelegateMax,
+		DelegateCur: m.DelegateCur,
+	}
+}
+
 type memberEventRecord struct {
 	Event   string
 	Members []Member
 }
 
+// IPCLimits bounds the RPC connections of an AgentIPC, so connections that
+// leaked or went half-open are reclaimed. The zero value sets no bounds.
+type IPCLimits struct {
+	// MaxConns is the number of connections that may be open at once
+	MaxConns int
+
+	// IdleTimeout is how long a connection without any streams may go
+	// without sending a request
+	IdleTimeout time.Duration
+
+	// ReadTimeout is how long reading a request may take once its header
+	// arrived, and WriteTimeout how long writing a response may take
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
 type AgentIPC struct {
 	sync.Mutex
-	agent     *Agent
-	authKey   string
-	clients   map[string]*IPCClient
-	listener  net.Listener
-	logger    *log.Logger
-	logWriter *logWriter
-	stop      uint32
-	stopCh    chan struct{}
+	agent      *Agent
+	authKey    string
+	authTokens map[string][]string
+	auditLog   bool
+	limits     IPCLimits
+	clients    map[string]*IPCClient
+	clientID   uint64 // Used to name clients without an address
+	commands   uint64 // Number of commands handled, for metrics
+	listener   net.Listener
+	logger     *log.Logger
+	logWriter  *logWriter
+	stop       uint32
+	stopCh     chan struct{}
 }
 
 type IPCClient struct {
@@ -257,25 +349,78 @@ type IPCClient struct {
 	conn         net.Conn
 	reader       *bufio.Reader
 	writer       *bufio.Writer
-	dec          *codec.Decoder
-	enc          *codec.Encoder
+	dec          ipcDecoder
+	enc          ipcEncoder
 	writeLock    sync.Mutex
+	writeTimeout time.Duration
 	version      int32 // From the handshake, 0 before
 	logStreamer  *logStream
 	eventStreams map[uint64]*eventStream
+	coordStreams map[uint64]*coordinateStream
 
 	pendingQueries map[uint64]*serf.Query
 	queryLock      sync.Mutex
 
+	// queries counts the queries whose responses are still being streamed,
+	// streaming is set while any other stream is open, and reading is set
+	// while the body of a request is being read under the read timeout. A
+	// query can end outside the goroutine reading requests, so they are
+	// kept under a lock along with the read deadline.
+	deadlineLock sync.Mutex
+	queries      int
+	streaming    bool
+	reading      bool
+
 	didAuth bool // Did we get an auth token yet?
+
+	// auditSeq is the sequence number of the request being audited, and
+	// auditErr is set if an error was sent in response to it. Both are
+	// protected by the writeLock.
+	auditSeq uint64
+	auditErr bool
+
+	// allowedCommands is set when authenticating with a restricted token,
+	// and is nil if all commands are allowed
+	allowedCommands map[string]struct{}
 }
 
-// send is used to send an object using the MsgPack encoding. send
+// send is used to send an object using the client's codec. send
 // is serialized to prevent write overlaps, while properly buffering.
 func (c *IPCClient) Send(header *responseHeader, obj interface{}) error {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
 
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	if header.Seq == c.auditSeq && header.Error != "" {
+		c.auditErr = true
+	}
+	err := c.send(header, obj)
+	if isTimeout(err) {
+		// The client isn't reading, and the response is cut off anyway
+		c.conn.Close()
+	}
+	return err
+}
+
+// auditRequest starts tracking the responses to a request for auditing.
+func (c *IPCClient) auditRequest(seq uint64) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.auditSeq = seq
+	c.auditErr = false
+}
+
+// auditFailed returns if an error was sent in response to the request
+// being audited.
+func (c *IPCClient) auditFailed() bool {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.auditErr
+}
+
+func (c *IPCClient) send(header *responseHeader, obj interface{}) error {
 	if err := c.enc.Encode(header); err != nil {
 		return err
 	}
@@ -294,7 +439,7 @@ func (c *IPCClient) Send(header *responseHeader, obj interface{}) error {
 }
 
 func (c *IPCClient) String() string {
-	return fmt.Sprintf("ipc.client: %v", c.conn.RemoteAddr())
+	return fmt.Sprintf("ipc.client: %v", c.name)
 }
 
 // nextQueryID safely generates a new query ID
@@ -329,19 +474,23 @@ func (c *IPCClient) RegisterQuery(q *serf.Query) uint64 {
 }
 
 // NewAgentIPC is used to create a new Agent IPC handler
-func NewAgentIPC(agent *Agent, authKey string, listener net.Listener,
-	logOutput io.Writer, logWriter *logWriter) *AgentIPC {
+func NewAgentIPC(agent *Agent, authKey string, authTokens map[string][]string,
+	listener net.Listener, logOutput io.Writer, logWriter *logWriter, auditLog bool,
+	limits IPCLimits) *AgentIPC {
 	if logOutput == nil {
 		logOutput = os.Stderr
 	}
 	ipc := &AgentIPC{
-		agent:     agent,
-		authKey:   authKey,
-		clients:   make(map[string]*IPCClient),
-		listener:  listener,
-		logger:    log.New(logOutput, "", log.LstdFlags),
-		logWriter: logWriter,
-		stopCh:    make(chan struct{}),
+		agent:      agent,
+		authKey:    authKey,
+		authTokens: authTokens,
+		auditLog:   auditLog,
+		limits:     limits,
+		clients:    make(map[string]*IPCClient),
+		listener:   listener,
+		logger:     log.New(logOutput, "", log.LstdFlags),
+		logWriter:  logWriter,
+		stopCh:     make(chan struct{}),
 	}
 	go ipc.listen()
 	return ipc
@@ -381,35 +530,55 @@ func (i *AgentIPC) listen() {
 			i.logger.Printf("[ERR] agent.ipc: Failed to accept client: %v", err)
 			continue
 		}
-		i.logger.Printf("[INFO] agent.ipc: Accepted client: %v", conn.RemoteAddr())
+		// Clients on a Unix socket have no address of their own, so they
+		// are numbered to keep them apart
+		name := conn.RemoteAddr().String()
+		if name == "" {
+			name = fmt.Sprintf("%s#%d", conn.LocalAddr(), atomic.AddUint64(&i.clientID, 1))
+		}
+		i.logger.Printf("[INFO] agent.ipc: Accepted client: %v", name)
 		metrics.IncrCounterWithLabels([]string{"agent", "ipc", "accept"}, 1, nil)
 
 		// Wrap the connection in a client
 		client := &IPCClient{
-			name:           conn.RemoteAddr().String(),
+			name:           name,
 			conn:           conn,
 			reader:         bufio.NewReader(conn),
 			writer:         bufio.NewWriter(conn),
+			writeTimeout:   i.limits.WriteTimeout,
 			eventStreams:   make(map[uint64]*eventStream),
+			coordStreams:   make(map[uint64]*coordinateStream),
 			pendingQueries: make(map[uint64]*serf.Query),
 		}
-		client.dec = codec.NewDecoder(client.reader,
-			&codec.MsgpackHandle{RawToString: true, WriteExt: true})
-		client.enc = codec.NewEncoder(client.writer,
-			&codec.MsgpackHandle{RawToString: true, WriteExt: true})
-
-		// Register the client
+		// Register the client, unless there are too many already
 		i.Lock()
-		if !i.isStopped() {
+		if i.isStopped() {
+			conn.Close()
+		} else if max := i.limits.MaxConns; max > 0 && len(i.clients) >= max {
+			i.logger.Printf("[WARN] agent.ipc: Rejecting client %v, already at the limit of %d clients",
+				name, max)
+			metrics.IncrCounterWithLabels([]string{"agent", "ipc", "rejected"}, 1, nil)
+			conn.Close()
+		} else {
 			i.clients[client.name] = client
 			go i.handleClient(client)
-		} else {
-			conn.Close()
 		}
 		i.Unlock()
 	}
 }
 
+// NumClients returns the number of connected RPC clients
+func (i *AgentIPC) NumClients() int {
+	i.Lock()
+	defer i.Unlock()
+	return len(i.clients)
+}
+
+// NumCommands returns the number of RPC commands handled since start
+func (i *AgentIPC) NumCommands() uint64 {
+	return atomic.LoadUint64(&i.commands)
+}
+
 // deregisterClient is called to cleanup after a client disconnects
 func (i *AgentIPC) deregisterClient(client *IPCClient) {
 	// Close the socket
@@ -431,16 +600,37 @@ func (i *AgentIPC) deregisterClient(client *IPCClient) {
 		i.agent.DeregisterEventHandler(es)
 		es.Stop()
 	}
+
+	// Remove from coordinate handlers
+	for _, cs := range client.coordStreams {
+		i.agent.DeregisterCoordinateHandler(cs)
+		cs.Stop()
+	}
 }
 
 // handleClient is a long running routine that handles a single client
 func (i *AgentIPC) handleClient(client *IPCClient) {
 	defer i.deregisterClient(client)
+	i.armIdleTimeout(client)
+	if err := client.setupCodec(); err != nil {
+		if isTimeout(err) {
+			i.logger.Printf("[INFO] agent.ipc: Closing idle client %v", client.name)
+		} else if err != io.EOF && !i.isStopped() {
+			i.logger.Printf("[ERR] agent.ipc: failed to read from client: %v", err)
+		}
+		return
+	}
+
 	var reqHeader requestHeader
 	for {
-		// Decode the header
+		// Decode the header, closing the connection if none comes before
+		// the idle timeout. The rest of the request has to follow within
+		// the read timeout.
+		i.armIdleTimeout(client)
 		if err := client.dec.Decode(&reqHeader); err != nil {
-			if !i.isStopped() {
+			if isTimeout(err) {
+				i.logger.Printf("[INFO] agent.ipc: Closing idle client %v", client.name)
+			} else if !i.isStopped() {
 				// The second part of this if is to block socket
 				// errors from Windows which appear to happen every
 				// time there is an EOF.
@@ -450,15 +640,71 @@ func (i *AgentIPC) handleClient(client *IPCClient) {
 			}
 			return
 		}
+		i.armReadTimeout(client)
 
 		// Evaluate the command
 		if err := i.handleRequest(client, &reqHeader); err != nil {
-			i.logger.Printf("[ERR] agent.ipc: Failed to evaluate request: %v", err)
+			if err != errUnsupportedCommand && err != errPermissionDenied {
+				i.logger.Printf("[ERR] agent.ipc: Failed to evaluate request: %v", err)
+			}
 			return
 		}
 	}
 }
 
+// armIdleTimeout sets the read deadline of a client to the idle timeout, or
+// clears it while the client has a stream or query open. It is called from
+// the goroutine reading requests, which owns the streams of the client.
+func (i *AgentIPC) armIdleTimeout(client *IPCClient) {
+	client.deadlineLock.Lock()
+	defer client.deadlineLock.Unlock()
+
+	client.reading = false
+	client.streaming = client.logStreamer != nil || len(client.eventStreams) > 0 ||
+		len(client.coordStreams) > 0
+
+	var deadline time.Time
+	if i.limits.IdleTimeout > 0 && !client.streaming && client.queries == 0 {
+		deadline = time.Now().Add(i.limits.IdleTimeout)
+	}
+	client.conn.SetReadDeadline(deadline)
+}
+
+// armReadTimeout sets the read deadline of a client to the read timeout, once
+// the header of a request has been read, so the rest of it has to follow in
+// time.
+func (i *AgentIPC) armReadTimeout(client *IPCClient) {
+	client.deadlineLock.Lock()
+	defer client.deadlineLock.Unlock()
+
+	client.reading = true
+	var deadline time.Time
+	if i.limits.ReadTimeout > 0 {
+		deadline = time.Now().Add(i.limits.ReadTimeout)
+	}
+	client.conn.SetReadDeadline(deadline)
+}
+
+// queryDone is called once the responses to a query have been streamed, and
+// arms the idle timeout if nothing else is open, since the goroutine reading
+// requests may be blocked without a deadline. A request being read keeps its
+// read timeout, and the idle timeout is armed after it.
+func (i *AgentIPC) queryDone(client *IPCClient) {
+	client.deadlineLock.Lock()
+	defer client.deadlineLock.Unlock()
+
+	client.queries--
+	if i.limits.IdleTimeout > 0 && !client.streaming && !client.reading && client.queries == 0 {
+		client.conn.SetReadDeadline(time.Now().Add(i.limits.IdleTimeout))
+	}
+}
+
+// isTimeout checks if err is from a connection deadline passing
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
 // handleRequest is used to evaluate a single client command
 func (i *AgentIPC) handleRequest(client *IPCClient, reqHeader *requestHeader) error {
 	// Look for a command field
@@ -467,21 +713,64 @@ func (i *AgentIPC) handleRequest(client *IPCClient, reqHeader *requestHeader) er
 
 	// Ensure the handshake is performed before other commands
 	if command != handshakeCommand && client.version == 0 {
+		i.audit(client, command, "denied")
 		respHeader := responseHeader{Seq: seq, Error: handshakeRequired}
 		client.Send(&respHeader, nil)
 		return fmt.Errorf(handshakeRequired)
 	}
 	metrics.IncrCounterWithLabels([]string{"agent", "ipc", "command"}, 1, nil)
+	atomic.AddUint64(&i.commands, 1)
 
 	// Ensure the client has authenticated after the handshake if necessary
-	if i.authKey != "" && !client.didAuth && command != authCommand && command != handshakeCommand {
+	authEnabled := i.authKey != "" || len(i.authTokens) > 0
+	if authEnabled && !client.didAuth && command != authCommand && command != handshakeCommand {
 		i.logger.Printf("[WARN] agent.ipc: Client sending commands before auth")
+		i.audit(client, command, "denied")
 		respHeader := responseHeader{Seq: seq, Error: authRequired}
 		client.Send(&respHeader, nil)
 		return nil
 	}
 
-	// Dispatch command specific handlers
+	// Ensure the token the client authenticated with allows this command
+	if client.allowedCommands != nil && command != authCommand && command != handshakeCommand {
+		if _, ok := client.allowedCommands[command]; !ok {
+			i.logger.Printf("[WARN] agent.ipc: Client %s is not allowed to call '%s'",
+				client.name, command)
+			i.audit(client, command, "denied")
+
+			// The request body is left unread, so we have to close the
+			// connection after letting the client know
+			respHeader := responseHeader{
+				Seq:   seq,
+				Error: fmt.Sprintf("%s: token is not allowed to call '%s'", permissionDenied, command),
+			}
+			client.Send(&respHeader, nil)
+			return errPermissionDenied
+		}
+	}
+
+	// Audit the request once it has been handled, so the real outcome is
+	// logged. The outcome of an auth attempt is whether it succeeded.
+	if !i.auditLog {
+		return i.dispatch(client, command, seq)
+	}
+	client.auditRequest(seq)
+	err := i.dispatch(client, command, seq)
+	switch {
+	case command == authCommand && client.didAuth:
+		i.audit(client, command, "allowed")
+	case command == authCommand:
+		i.audit(client, command, "denied")
+	case err != nil || client.auditFailed():
+		i.audit(client, command, "error")
+	default:
+		i.audit(client, command, "ok")
+	}
+	return err
+}
+
+// dispatch calls the handler for a command.
+func (i *AgentIPC) dispatch(client *IPCClient, command string, seq uint64) error {
 	switch command {
 	case handshakeCommand:
 		return i.handleHandshake(client, seq)
@@ -501,6 +790,9 @@ func (i *AgentIPC) handleRequest(client *IPCClient, reqHeader *requestHeader) er
 	case monitorCommand:
 		return i.handleMonitor(client, seq)
 
+	case coordStreamCommand:
+		return i.handleCoordinateStream(client, seq)
+
 	case stopCommand:
 		return i.handleStop(client, seq)
 
@@ -537,14 +829,44 @@ func (i *AgentIPC) handleRequest(client *IPCClient, reqHeader *requestHeader) er
 	case statsCommand:
 		return i.handleStats(client, seq)
 
+	case selfCommand:
+		return i.handleSelf(client, seq)
+
 	case getCoordinateCommand:
 		return i.handleGetCoordinate(client, seq)
 
+	case queryVersionsCommand:
+		return i.handleQueryVersions(client, seq)
+
+	case pauseCommand:
+		return i.handlePause(client, seq)
+
+	case resumeCommand:
+		return i.handleResume(client, seq)
+
 	default:
-		respHeader := responseHeader{Seq: seq, Error: unsupportedCommand}
+		// We can't tell if a request body follows, so the connection
+		// has to be closed after letting the client know
+		i.logger.Printf("[DEBUG] agent.ipc: Unsupported command '%s' from client %s",
+			command, client.name)
+		respHeader := responseHeader{
+			Seq:   seq,
+			Error: fmt.Sprintf("%s: %s", unsupportedCommand, command),
+		}
 		client.Send(&respHeader, nil)
-		return fmt.Errorf("command '%s' not recognized", command)
+		return errUnsupportedCommand
+	}
+}
+
+// audit logs an RPC request if audit logging is enabled. Only the command
+// name is logged, never the request body, so that secrets such as
+// encryption keys and auth tokens don't end up in the logs.
+func (i *AgentIPC) audit(client *IPCClient, command, outcome string) {
+	if !i.auditLog {
+		return
 	}
+	i.logger.Printf("[INFO] agent.ipc: audit: client=%s command=%s outcome=%s",
+		client.name, command, outcome)
 }
 
 func (i *AgentIPC) handleHandshake(client *IPCClient, seq uint64) error {
@@ -560,6 +882,8 @@ func (i *AgentIPC) handleHandshake(client *IPCClient, seq uint64) error {
 
 	// Check the version
 	if req.Version < MinIPCVersion || req.Version > MaxIPCVersion {
+		i.logger.Printf("[WARN] agent.ipc: Client %s requested unsupported IPC version %d (supported %d-%d)",
+			client.name, req.Version, MinIPCVersion, MaxIPCVersion)
 		resp.Error = unsupportedIPCVersion
 	} else if client.version != 0 {
 		resp.Error = duplicateHandshake
@@ -580,15 +904,30 @@ func (i *AgentIPC) handleAuth(client *IPCClient, seq uint64) error {
 		Error: "",
 	}
 
-	// Check the token matches
-	if req.AuthKey == i.authKey {
+	// Check the token matches, either the full access key or one of the
+	// tokens restricted to a set of commands
+	if methods, ok := i.authTokens[req.AuthKey]; ok && req.AuthKey != "" {
 		client.didAuth = true
+		client.allowedCommands = make(map[string]struct{}, len(methods))
+		for _, method := range methods {
+			client.allowedCommands[method] = struct{}{}
+		}
+	} else if keyMatches(req.AuthKey, i.authKey) && (i.authKey != "" || len(i.authTokens) == 0) {
+		client.didAuth = true
+		client.allowedCommands = nil
 	} else {
+		i.logger.Printf("[WARN] agent.ipc: Client %s sent an invalid auth token", client.name)
 		resp.Error = invalidAuthToken
 	}
 	return client.Send(&resp, nil)
 }
 
+// keyMatches compares an auth key in constant time, so the time taken to
+// reject a guess doesn't reveal how much of it was right.
+func keyMatches(given, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
 func (i *AgentIPC) handleEvent(client *IPCClient, seq uint64) error {
 	var req eventRequest
 	if err := client.dec.Decode(&req); err != nil {
@@ -659,27 +998,25 @@ func (i *AgentIPC) handleMembers(client *IPCClient, command string, seq uint64)
 		if err != nil {
 			return fmt.Errorf("decode failed: %v", err)
 		}
-		raw, err = i.filterMembers(raw, req.Tags, req.Status, req.Name)
+		var times map[string]time.Time
+		if req.ChangedWithin > 0 {
+			times = serf.MemberStatusTimes()
+		}
+		raw, err = i.filterMembers(raw, req.Tags, req.Status, req.Name,
+			req.ChangedWithin, times)
 		if err != nil {
-			return err
+			// Report bad filters back to the client instead of
+			// dropping the connection
+			header := responseHeader{
+				Seq:   seq,
+				Error: errToString(err),
+			}
+			return client.Send(&header, &membersResponse{})
 		}
 	}
 
 	for _, m := range raw {
-		sm := Member{
-			Name:        m.Name,
-			Addr:        m.Addr,
-			Port:        m.Port,
-			Tags:        m.Tags,
-			Status:      m.Status.String(),
-			ProtocolMin: m.ProtocolMin,
-			ProtocolMax: m.ProtocolMax,
-			ProtocolCur: m.ProtocolCur,
-			DelegateMin: m.DelegateMin,
-			DelegateMax: m.DelegateMax,
-			DelegateCur: m.DelegateCur,
-		}
-		members = append(members, sm)
+		members = append(members, newMember(m))
 	}
 
 	header := responseHeader{
@@ -692,31 +1029,37 @@ func (i *AgentIPC) handleMembers(client *IPCClient, command string, seq uint64)
 	return client.Send(&header, &resp)
 }
 
+// filterMembers returns the members that match all of the given filters.
+// If changedWithin is set, only members whose status changed within that
+// window are returned, using the status change times in times.
 func (i *AgentIPC) filterMembers(members []serf.Member, tags map[string]string,
-	status string, name string) ([]serf.Member, error) {
+	status string, name string, changedWithin time.Duration,
+	times map[string]time.Time) ([]serf.Member, error) {
 
 	result := make([]serf.Member, 0, len(members))
 
-	// Pre-compile all the regular expressions
+	// Pre-compile all the regular expressions. Each is grouped before it
+	// is anchored, so alternations like "alive|failed" match in full.
 	tagsRe := make(map[string]*regexp.Regexp)
 	for tag, expr := range tags {
-		re, err := regexp.Compile(fmt.Sprintf("^%s$", expr))
+		re, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", expr))
 		if err != nil {
-			return nil, fmt.Errorf("Failed to compile regex: %v", err)
+			return nil, fmt.Errorf("Invalid regex for tag '%s' filter: %v", tag, err)
 		}
 		tagsRe[tag] = re
 	}
 
-	statusRe, err := regexp.Compile(fmt.Sprintf("^%s$", status))
+	statusRe, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", status))
 	if err != nil {
-		return nil, fmt.Errorf("Failed to compile regex: %v", err)
+		return nil, fmt.Errorf("Invalid regex for status filter: %v", err)
 	}
 
-	nameRe, err := regexp.Compile(fmt.Sprintf("^%s$", name))
+	nameRe, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", name))
 	if err != nil {
-		return nil, fmt.Errorf("Failed to compile regex: %v", err)
+		return nil, fmt.Errorf("Invalid regex for name filter: %v", err)
 	}
 
+	now := time.Now()
 OUTER:
 	for _, m := range members {
 		// Check if tags were passed, and if they match
@@ -736,6 +1079,14 @@ OUTER:
 			continue
 		}
 
+		// Check if the status changed recently enough
+		if changedWithin > 0 {
+			changed, ok := times[m.Name]
+			if !ok || now.Sub(changed) > changedWithin {
+				continue
+			}
+		}
+
 		// Made it past the filters!
 		result = append(result, m)
 	}
@@ -809,6 +1160,23 @@ func (i *AgentIPC) handleRemoveKey(client *IPCClient, seq uint64) error {
 	return client.Send(&header, &resp)
 }
 
+func (i *AgentIPC) handleQueryVersions(client *IPCClient, seq uint64) error {
+	queryResp, err := i.agent.QueryVersions()
+
+	header := responseHeader{
+		Seq:   seq,
+		Error: errToString(err),
+	}
+	resp := versionsResponse{
+		Versions: queryResp.Versions,
+		Messages: queryResp.Messages,
+		NumNodes: queryResp.NumNodes,
+		NumResp:  queryResp.NumResp,
+	}
+
+	return client.Send(&header, &resp)
+}
+
 func (i *AgentIPC) handleListKeys(client *IPCClient, seq uint64) error {
 	queryResp, err := i.agent.ListKeys()
 
@@ -866,6 +1234,31 @@ SEND:
 	return client.Send(&resp, nil)
 }
 
+func (i *AgentIPC) handleCoordinateStream(client *IPCClient, seq uint64) error {
+	var cs *coordinateStream
+	resp := responseHeader{
+		Seq:   seq,
+		Error: "",
+	}
+
+	// Check if there is an existing stream
+	if _, ok := client.coordStreams[seq]; ok {
+		resp.Error = streamExists
+		goto SEND
+	}
+
+	// Create a coordinate streamer
+	cs = newCoordinateStream(client, seq, i.logger)
+	client.coordStreams[seq] = cs
+
+	// Register with the agent. Defer so that we can respond before
+	// registration, avoids any possible race condition
+	defer i.agent.RegisterCoordinateHandler(cs)
+
+SEND:
+	return client.Send(&resp, nil)
+}
+
 func (i *AgentIPC) handleMonitor(client *IPCClient, seq uint64) error {
 	var req monitorRequest
 	if err := client.dec.Decode(&req); err != nil {
@@ -877,12 +1270,9 @@ func (i *AgentIPC) handleMonitor(client *IPCClient, seq uint64) error {
 		Error: "",
 	}
 
-	// Upper case the log level
-	req.LogLevel = strings.ToUpper(req.LogLevel)
-
 	// Create a level filter
 	filter := LevelFilter()
-	filter.MinLevel = logutils.LogLevel(req.LogLevel)
+	filter.MinLevel = ParseLogLevel(req.LogLevel)
 	if !ValidateLevelFilter(filter.MinLevel, filter) {
 		resp.Error = fmt.Sprintf("Unknown log level: %s", filter.MinLevel)
 		goto SEND
@@ -925,6 +1315,13 @@ func (i *AgentIPC) handleStop(client *IPCClient, seq uint64) error {
 		delete(client.eventStreams, req.Stop)
 	}
 
+	// Remove a coordinate stream if any
+	if cs, ok := client.coordStreams[req.Stop]; ok {
+		i.agent.DeregisterCoordinateHandler(cs)
+		cs.Stop()
+		delete(client.coordStreams, req.Stop)
+	}
+
 	// Always succeed
 	resp := responseHeader{Seq: seq, Error: ""}
 	return client.Send(&resp, nil)
@@ -950,6 +1347,18 @@ func (i *AgentIPC) handleLeave(client *IPCClient, seq uint64) error {
 	return err
 }
 
+func (i *AgentIPC) handlePause(client *IPCClient, seq uint64) error {
+	err := i.agent.Pause()
+	resp := responseHeader{Seq: seq, Error: errToString(err)}
+	return client.Send(&resp, nil)
+}
+
+func (i *AgentIPC) handleResume(client *IPCClient, seq uint64) error {
+	i.agent.Resume()
+	resp := responseHeader{Seq: seq, Error: ""}
+	return client.Send(&resp, nil)
+}
+
 func (i *AgentIPC) handleTags(client *IPCClient, seq uint64) error {
 	var req tagsRequest
 	if err := client.dec.Decode(&req); err != nil {
@@ -994,13 +1403,22 @@ func (i *AgentIPC) handleQuery(client *IPCClient, seq uint64) error {
 	}
 
 	// Start the query
+	start := time.Now()
 	queryResp, err := i.agent.Query(req.Name, req.Payload, &params)
 
 	// Stream the query responses
 	if err == nil {
 		qs := newQueryResponseStream(client, seq, i.logger)
+		client.deadlineLock.Lock()
+		client.queries++
+		client.deadlineLock.Unlock()
 		defer func() {
-			go qs.Stream(queryResp)
+			go func() {
+				if last := qs.Stream(queryResp); !last.IsZero() {
+					i.agent.observeQuery(last.Sub(start))
+				}
+				i.queryDone(client)
+			}()
 		}()
 	}
 
@@ -1046,9 +1464,38 @@ func (i *AgentIPC) handleStats(client *IPCClient, seq uint64) error {
 		Error: "",
 	}
 	resp := i.agent.Stats()
+	resp["agent"]["rpc_addr"] = i.listener.Addr().String()
 	return client.Send(&header, resp)
 }
 
+// handleSelf is used to describe the local agent
+func (i *AgentIPC) handleSelf(client *IPCClient, seq uint64) error {
+	header := responseHeader{
+		Seq:   seq,
+		Error: "",
+	}
+	resp := newSelfResponse(i.agent)
+	resp.Config["rpc_addr"] = i.listener.Addr().String()
+	resp.Stats["agent"]["rpc_addr"] = i.listener.Addr().String()
+	return client.Send(&header, &resp)
+}
+
+// newSelfResponse collects the description of the local agent. The
+// coordinate is left out if coordinates are disabled.
+func newSelfResponse(a *Agent) selfResponse {
+	resp := selfResponse{
+		Member:   newMember(a.Serf().LocalMember()),
+		Config:   a.configStats(),
+		Versions: a.versionStats(),
+		Stats:    a.Stats(),
+	}
+	if coord, err := a.Serf().GetCoordinate(); err == nil {
+		resp.Coord = *coord
+		resp.HasCoord = true
+	}
+	return resp
+}
+
 // handleGetCoordinate is used to get the cached coordinate for a node.
 func (i *AgentIPC) handleGetCoordinate(client *IPCClient, seq uint64) error {
 	var req coordinateRequest
@@ -0,0 +1,43 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"encoding/json"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// ipcDecoder and ipcEncoder are implemented by each codec that an IPC
+// client may speak.
+type ipcDecoder interface {
+	Decode(v interface{}) error
+}
+
+type ipcEncoder interface {
+	Encode(v interface{}) error
+}
+
+// setupCodec picks the codec for the connection from the first byte the
+// client sends, and uses it in both directions from then on. A client
+// speaking JSON starts with an object, while a msgpack request header is
+// a map, which never starts with the '{' byte. Msgpack is the default.
+func (c *IPCClient) setupCodec() error {
+	b, err := c.reader.Peek(1)
+	if err != nil {
+		return err
+	}
+
+	if b[0] == '{' {
+		c.dec = json.NewDecoder(c.reader)
+		c.enc = json.NewEncoder(c.writer)
+		return nil
+	}
+
+	c.dec = codec.NewDecoder(c.reader,
+		&codec.MsgpackHandle{RawToString: true, WriteExt: true})
+	c.enc = codec.NewEncoder(c.writer,
+		&codec.MsgpackHandle{RawToString: true, WriteExt: true})
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"log"
+	"sync"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// coordinateStream is used to stream coordinate updates to a client over IPC
+type coordinateStream struct {
+	client  streamClient
+	coordCh chan serf.CoordinateUpdate
+	logger  *log.Logger
+	seq     uint64
+
+	// The agent may still deliver an update after the stream is
+	// deregistered, so sends and Stop are serialized by stopLock
+	stopLock sync.Mutex
+	stopped  bool
+}
+
+func newCoordinateStream(client streamClient, seq uint64, logger *log.Logger) *coordinateStream {
+	cs := &coordinateStream{
+		client:  client,
+		coordCh: make(chan serf.CoordinateUpdate, 512),
+		logger:  logger,
+		seq:     seq,
+	}
+	go cs.stream()
+	return cs
+}
+
+func (cs *coordinateStream) HandleCoordinate(update serf.CoordinateUpdate) {
+	cs.stopLock.Lock()
+	defer cs.stopLock.Unlock()
+	if cs.stopped {
+		return
+	}
+
+	// Do a non-blocking send, dropping updates for slow clients
+	select {
+	case cs.coordCh <- update:
+	default:
+		cs.logger.Printf("[WARN] agent.ipc: Dropping coordinate update to %v", cs.client)
+	}
+}
+
+func (cs *coordinateStream) Stop() {
+	cs.stopLock.Lock()
+	defer cs.stopLock.Unlock()
+	if cs.stopped {
+		return
+	}
+	cs.stopped = true
+	close(cs.coordCh)
+}
+
+func (cs *coordinateStream) stream() {
+	for update := range cs.coordCh {
+		header := responseHeader{
+			Seq:   cs.seq,
+			Error: "",
+		}
+		rec := coordinateUpdateRecord{
+			Node:  update.Node,
+			Coord: *update.Coord,
+		}
+		if err := cs.client.Send(&header, &rec); err != nil {
+			cs.logger.Printf("[ERR] agent.ipc: Failed to stream coordinate update to %v: %v",
+				cs.client, err)
+			return
+		}
+	}
+}
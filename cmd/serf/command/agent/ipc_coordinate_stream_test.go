@@ -0,0 +1,41 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"log"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/serf/coordinate"
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestIPCCoordinateStream_stopped(t *testing.T) {
+	sc := &MockStreamClient{}
+	cs := newCoordinateStream(sc, 42, log.New(os.Stderr, "", log.LstdFlags))
+	cs.Stop()
+
+	// Updates delivered after the stream stops are dropped, and stopping
+	// again is harmless
+	update := serf.CoordinateUpdate{Node: "foo", Coord: coordinate.NewCoordinate(coordinate.DefaultConfig())}
+	cs.HandleCoordinate(update)
+	cs.Stop()
+
+	// Updates racing with Stop don't panic
+	cs = newCoordinateStream(&MockStreamClient{}, 43, log.New(os.Stderr, "", log.LstdFlags))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cs.HandleCoordinate(update)
+			}
+		}()
+	}
+	cs.Stop()
+	wg.Wait()
+}
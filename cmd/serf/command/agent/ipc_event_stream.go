@@ -6,6 +6,7 @@ package agent
 import (
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/hashicorp/serf/serf"
 )
@@ -22,6 +23,11 @@ type eventStream struct {
 	filters []EventFilter
 	logger  *log.Logger
 	seq     uint64
+
+	// The agent may still deliver an event after the stream is
+	// deregistered, so sends and Stop are serialized by stopLock
+	stopLock sync.Mutex
+	stopped  bool
 }
 
 func newEventStream(client streamClient, filters []EventFilter, seq uint64, logger *log.Logger) *eventStream {
@@ -47,6 +53,11 @@ func (es *eventStream) HandleEvent(e serf.Event) {
 
 	// Do a non-blocking send
 HANDLE:
+	es.stopLock.Lock()
+	defer es.stopLock.Unlock()
+	if es.stopped {
+		return
+	}
 	select {
 	case es.eventCh <- e:
 	default:
@@ -55,6 +66,12 @@ HANDLE:
 }
 
 func (es *eventStream) Stop() {
+	es.stopLock.Lock()
+	defer es.stopLock.Unlock()
+	if es.stopped {
+		return
+	}
+	es.stopped = true
 	close(es.eventCh)
 }
 
@@ -68,6 +85,10 @@ func (es *eventStream) stream() {
 			err = es.sendUserEvent(e)
 		case *serf.Query:
 			err = es.sendQuery(e)
+		case serf.HealthEvent:
+			err = es.sendHealthEvent(e)
+		case serf.PartitionEvent:
+			err = es.sendPartitionEvent(e)
 		default:
 			err = fmt.Errorf("Unknown event type: %s", event.EventType().String())
 		}
@@ -83,20 +104,7 @@ func (es *eventStream) stream() {
 func (es *eventStream) sendMemberEvent(me serf.MemberEvent) error {
 	members := make([]Member, 0, len(me.Members))
 	for _, m := range me.Members {
-		sm := Member{
-			Name:        m.Name,
-			Addr:        m.Addr,
-			Port:        m.Port,
-			Tags:        m.Tags,
-			Status:      m.Status.String(),
-			ProtocolMin: m.ProtocolMin,
-			ProtocolMax: m.ProtocolMax,
-			ProtocolCur: m.ProtocolCur,
-			DelegateMin: m.DelegateMin,
-			DelegateMax: m.DelegateMax,
-			DelegateCur: m.DelegateCur,
-		}
-		members = append(members, sm)
+		members = append(members, newMember(m))
 	}
 
 	header := responseHeader{
@@ -126,6 +134,38 @@ func (es *eventStream) sendUserEvent(ue serf.UserEvent) error {
 	return es.client.Send(&header, &rec)
 }
 
+// sendHealthEvent is used to send a single health event
+func (es *eventStream) sendHealthEvent(he serf.HealthEvent) error {
+	header := responseHeader{
+		Seq:   es.seq,
+		Error: "",
+	}
+	rec := healthEventRecord{
+		Event:     he.EventType().String(),
+		Score:     he.Score,
+		Threshold: he.Threshold,
+		Degraded:  he.Degraded,
+	}
+	return es.client.Send(&header, &rec)
+}
+
+// sendPartitionEvent is used to send a single partition event
+func (es *eventStream) sendPartitionEvent(pe serf.PartitionEvent) error {
+	header := responseHeader{
+		Seq:   es.seq,
+		Error: "",
+	}
+	rec := partitionEventRecord{
+		Event:       pe.EventType().String(),
+		Partitioned: pe.Partitioned,
+		QuorumLost:  pe.QuorumLost,
+		Alive:       pe.Alive,
+		Failed:      pe.Failed,
+		Expected:    pe.Expected,
+	}
+	return es.client.Send(&header, &rec)
+}
+
 // sendQuery is used to send a single query event
 func (es *eventStream) sendQuery(q *serf.Query) error {
 	id := es.client.RegisterQuery(q)
@@ -157,3 +157,19 @@ func TestIPCEventStream(t *testing.T) {
 	}
 
 }
+
+func TestIPCEventStream_stopped(t *testing.T) {
+	sc := &MockStreamClient{}
+	es := newEventStream(sc, ParseEventFilter("*"), 42, log.New(os.Stderr, "", log.LstdFlags))
+	es.Stop()
+
+	// Events delivered after the stream stops are dropped, and stopping
+	// again is harmless
+	es.HandleEvent(serf.UserEvent{LTime: 123, Name: "foobar"})
+	es.Stop()
+
+	time.Sleep(5 * time.Millisecond)
+	if len(sc.headers) != 0 {
+		t.Fatalf("bad: %v", sc.headers)
+	}
+}
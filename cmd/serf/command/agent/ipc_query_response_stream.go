@@ -26,8 +26,9 @@ func newQueryResponseStream(client streamClient, seq uint64, logger *log.Logger)
 	return qs
 }
 
-// Stream is a long running routine used to stream the results of a query back to a client
-func (qs *queryResponseStream) Stream(resp *serf.QueryResponse) {
+// Stream is a long running routine used to stream the results of a query back to a client.
+// It returns when the last response came in, which is zero if none did.
+func (qs *queryResponseStream) Stream(resp *serf.QueryResponse) (last time.Time) {
 	// Setup a timer for the query ending
 	remaining := resp.Deadline().Sub(time.Now())
 	done := time.After(remaining)
@@ -42,6 +43,7 @@ func (qs *queryResponseStream) Stream(resp *serf.QueryResponse) {
 				return
 			}
 		case r := <-respCh:
+			last = time.Now()
 			if err := qs.sendResponse(r.From, r.Payload); err != nil {
 				qs.logger.Printf("[ERR] agent.ipc: Failed to stream response to %v: %v", qs.client, err)
 				return
@@ -0,0 +1,194 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/client"
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
+)
+
+// testIPCWithLimits starts an agent and an RPC server for it bounded by
+// limits, returning the address of the server
+func testIPCWithLimits(t *testing.T, ip net.IP, limits IPCLimits) (string, *Agent, *AgentIPC) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a := testAgent(t, ip, nil)
+	if err := a.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ipc := NewAgentIPC(a, "", nil, l, testutil.TestWriter(t), NewLogWriter(512), false, limits)
+	return l.Addr().String(), a, ipc
+}
+
+func TestAgentIPC_idleTimeout(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	addr, a, ipc := testIPCWithLimits(t, ip1, IPCLimits{IdleTimeout: 200 * time.Millisecond})
+	defer a.Shutdown()
+	defer ipc.Shutdown()
+
+	// A connection that never sends anything is closed
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+
+	// So is a client that stops sending requests, unless it has a stream
+	idle, err := client.NewRPCClient(addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer idle.Close()
+	monitoring, err := client.NewRPCClient(addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer monitoring.Close()
+	if _, err := monitoring.Monitor("INFO", make(chan string, 64)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if _, err := idle.Members(); err == nil {
+		t.Fatalf("idle client should be closed")
+	}
+	if _, err := monitoring.Members(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestAgentIPC_maxConns(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	addr, a, ipc := testIPCWithLimits(t, ip1, IPCLimits{MaxConns: 1})
+	defer a.Shutdown()
+	defer ipc.Shutdown()
+
+	first, err := client.NewRPCClient(addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := client.NewRPCClient(addr); err == nil {
+		t.Fatalf("client past the limit should be rejected")
+	}
+	if _, err := first.Members(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The slot is freed once the first client disconnects
+	first.Close()
+	retry.Run(t, func(r *retry.R) {
+		c, err := client.NewRPCClient(addr)
+		if err != nil {
+			r.Fatalf("err: %v", err)
+		}
+		c.Close()
+	})
+}
+
+func TestAgentIPC_filterMembers_changedWithin(t *testing.T) {
+	members := []serf.Member{
+		{Name: "flapping", Status: serf.StatusAlive, Tags: map[string]string{"role": "web"}},
+		{Name: "failed", Status: serf.StatusFailed, Tags: map[string]string{"role": "web"}},
+		{Name: "stable", Status: serf.StatusAlive, Tags: map[string]string{"role": "web"}},
+		{Name: "db", Status: serf.StatusAlive, Tags: map[string]string{"role": "db"}},
+		{Name: "unknown", Status: serf.StatusAlive},
+	}
+	now := time.Now()
+	times := map[string]time.Time{
+		"flapping": now.Add(-30 * time.Second),
+		"failed":   now.Add(-4 * time.Minute),
+		"stable":   now.Add(-time.Hour),
+		"db":       now.Add(-time.Minute),
+	}
+
+	i := &AgentIPC{}
+	cases := []struct {
+		tags   map[string]string
+		status string
+		window time.Duration
+		expect []string
+	}{
+		{nil, "", 5 * time.Minute, []string{"flapping", "failed", "db"}},
+		{nil, "", time.Minute + 30*time.Second, []string{"flapping", "db"}},
+		{nil, "", 0, []string{"flapping", "failed", "stable", "db", "unknown"}},
+		{map[string]string{"role": "web"}, "", 5 * time.Minute, []string{"flapping", "failed"}},
+		{map[string]string{"role": "web"}, "alive", 5 * time.Minute, []string{"flapping"}},
+	}
+
+	for _, tc := range cases {
+		result, err := i.filterMembers(members, tc.tags, tc.status, "", tc.window, times)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		var names []string
+		for _, m := range result {
+			names = append(names, m.Name)
+		}
+		if len(names) != len(tc.expect) {
+			t.Fatalf("window %v bad: %v", tc.window, names)
+		}
+		for idx := range names {
+			if names[idx] != tc.expect[idx] {
+				t.Fatalf("window %v bad: %v", tc.window, names)
+			}
+		}
+	}
+}
+
+func TestAgentIPC_filterMembers_alternation(t *testing.T) {
+	members := []serf.Member{
+		{Name: "web-1", Status: serf.StatusAlive, Tags: map[string]string{"role": "web"}},
+		{Name: "web-2", Status: serf.StatusFailed, Tags: map[string]string{"role": "webcache"}},
+		{Name: "db-1", Status: serf.StatusLeft, Tags: map[string]string{"role": "db"}},
+		{Name: "xdb-1", Status: serf.StatusLeaving, Tags: map[string]string{"role": "xdb"}},
+	}
+
+	i := &AgentIPC{}
+	cases := []struct {
+		tags   map[string]string
+		status string
+		name   string
+		expect []string
+	}{
+		// Each alternative must match the whole value
+		{nil, "alive|failed", "", []string{"web-1", "web-2"}},
+		{nil, "", "web-1|db-1", []string{"web-1", "db-1"}},
+		{map[string]string{"role": "web|db"}, "", "", []string{"web-1", "db-1"}},
+		{map[string]string{"role": "web|db"}, "left|leaving", "", []string{"db-1"}},
+	}
+
+	for _, tc := range cases {
+		result, err := i.filterMembers(members, tc.tags, tc.status, tc.name, 0, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		var names []string
+		for _, m := range result {
+			names = append(names, m.Name)
+		}
+		if !reflect.DeepEqual(names, tc.expect) {
+			t.Fatalf("tags %v status %q name %q bad: %v", tc.tags, tc.status, tc.name, names)
+		}
+	}
+}
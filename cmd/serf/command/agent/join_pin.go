@@ -0,0 +1,102 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// joinPinner resolves the hostnames in a set of join addresses once and
+// pins the resulting IPs, so that repeated join attempts go to the same
+// set of IPs even if DNS rotates between them. The pinned set is only
+// resolved again after the re-resolve interval, if one is given.
+type joinPinner struct {
+	lookup   func(host string) ([]string, error)
+	interval time.Duration
+	logger   *log.Logger
+
+	pinned     map[string][]string
+	resolvedAt time.Time
+}
+
+// newJoinPinner returns a joinPinner that resolves with the system
+// resolver. An interval of zero means addresses are never re-resolved.
+func newJoinPinner(interval time.Duration, logger *log.Logger) *joinPinner {
+	return &joinPinner{
+		lookup:   net.LookupHost,
+		interval: interval,
+		logger:   logger,
+		pinned:   make(map[string][]string),
+	}
+}
+
+// Addresses returns the pinned addresses to join for the given join
+// addresses, resolving any that have not been pinned yet, or all of them
+// if the re-resolve interval has passed.
+func (p *joinPinner) Addresses(addrs []string, now time.Time) []string {
+	refresh := p.interval > 0 && !p.resolvedAt.IsZero() && now.Sub(p.resolvedAt) >= p.interval
+	if refresh || p.resolvedAt.IsZero() {
+		p.resolvedAt = now
+	}
+
+	var result []string
+	for _, addr := range addrs {
+		prev, ok := p.pinned[addr]
+		if !ok || refresh {
+			resolved := p.resolve(addr, prev)
+			if ok && !reflect.DeepEqual(prev, resolved) {
+				p.logger.Printf("[INFO] agent: Join address %s re-resolved to %v (was %v)",
+					addr, resolved, prev)
+			}
+			p.pinned[addr] = resolved
+			prev = resolved
+		}
+		result = append(result, prev...)
+	}
+	return result
+}
+
+// resolve expands a single join address, which may be prefixed with a
+// node name and suffixed with a port, into one address per resolved IP.
+// If the lookup fails, the previously pinned addresses are kept, or the
+// address is used unresolved if there are none.
+func (p *joinPinner) resolve(addr string, prev []string) []string {
+	var name string
+	hostPort := addr
+	if i := strings.LastIndex(addr, "/"); i != -1 {
+		name, hostPort = addr[:i+1], addr[i+1:]
+	}
+
+	host, port := hostPort, ""
+	if net.ParseIP(hostPort) == nil {
+		if h, prt, err := net.SplitHostPort(hostPort); err == nil {
+			host, port = h, prt
+		}
+	}
+	if net.ParseIP(host) != nil {
+		return []string{addr}
+	}
+
+	ips, err := p.lookup(host)
+	if err != nil || len(ips) == 0 {
+		p.logger.Printf("[WARN] agent: Failed to resolve join address %s: %v", addr, err)
+		if len(prev) > 0 {
+			return prev
+		}
+		return []string{addr}
+	}
+
+	resolved := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if port != "" {
+			ip = net.JoinHostPort(ip, port)
+		}
+		resolved = append(resolved, name+ip)
+	}
+	return resolved
+}
@@ -0,0 +1,93 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJoinPinner_Addresses(t *testing.T) {
+	// The mock resolver rotates through a different IP on every lookup
+	lookups := 0
+	logs := new(bytes.Buffer)
+	p := newJoinPinner(time.Hour, log.New(logs, "", 0))
+	p.lookup = func(host string) ([]string, error) {
+		if host != "serf.example.com" {
+			return nil, fmt.Errorf("no such host")
+		}
+		lookups++
+		return []string{fmt.Sprintf("10.0.0.%d", lookups)}, nil
+	}
+
+	addrs := []string{
+		"serf.example.com:7946",
+		"node1/serf.example.com",
+		"127.0.0.1:7946",
+		"[::1]:7946",
+		"missing.example.com",
+	}
+	start := time.Now()
+	expected := []string{
+		"10.0.0.1:7946",
+		"node1/10.0.0.2",
+		"127.0.0.1:7946",
+		"[::1]:7946",
+		"missing.example.com",
+	}
+	if got := p.Addresses(addrs, start); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %#v", got)
+	}
+
+	// Retrying within the interval uses the pinned IPs
+	if got := p.Addresses(addrs, start.Add(time.Minute)); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %#v", got)
+	}
+	if lookups != 2 {
+		t.Fatalf("bad: %d", lookups)
+	}
+
+	// Once the interval passes, the addresses are resolved again and the
+	// change is logged
+	expected = []string{
+		"10.0.0.3:7946",
+		"node1/10.0.0.4",
+		"127.0.0.1:7946",
+		"[::1]:7946",
+		"missing.example.com",
+	}
+	if got := p.Addresses(addrs, start.Add(time.Hour)); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %#v", got)
+	}
+	if !strings.Contains(logs.String(), "Join address serf.example.com:7946 re-resolved to [10.0.0.3:7946] (was [10.0.0.1:7946])") {
+		t.Fatalf("bad: %s", logs.String())
+	}
+}
+
+func TestJoinPinner_keepsPinnedOnFailure(t *testing.T) {
+	fail := false
+	p := newJoinPinner(time.Second, log.New(new(bytes.Buffer), "", 0))
+	p.lookup = func(host string) ([]string, error) {
+		if fail {
+			return nil, fmt.Errorf("lookup timed out")
+		}
+		return []string{"10.0.0.1", "10.0.0.2"}, nil
+	}
+
+	start := time.Now()
+	expected := []string{"10.0.0.1:7946", "10.0.0.2:7946"}
+	if got := p.Addresses([]string{"serf.example.com:7946"}, start); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %#v", got)
+	}
+
+	fail = true
+	if got := p.Addresses([]string{"serf.example.com:7946"}, start.Add(time.Minute)); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad: %#v", got)
+	}
+}
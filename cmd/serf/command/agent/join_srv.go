@@ -0,0 +1,52 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// lookupSRV resolves a DNS SRV record name. It is a variable so that tests
+// can stub out DNS.
+var lookupSRV = func(name string) ([]*net.SRV, error) {
+	_, srvs, err := net.LookupSRV("", "", name)
+	return srvs, err
+}
+
+// isSRVName returns whether a join address names a DNS SRV record, such as
+// "_serf._tcp.example.com". Hostnames can't start with an underscore, so
+// these are never confused with plain addresses.
+func isSRVName(addr string) bool {
+	return strings.HasPrefix(addr, "_") && !strings.Contains(addr, ":")
+}
+
+// expandSRVAddrs replaces any SRV record names in a set of join addresses
+// with the host and port of each target in the record. Other addresses are
+// passed through for memberlist to resolve. If a lookup fails, the name is
+// kept so the join reports the failure for it.
+func expandSRVAddrs(addrs []string, logger *log.Logger) []string {
+	var result []string
+	for _, addr := range addrs {
+		if !isSRVName(addr) {
+			result = append(result, addr)
+			continue
+		}
+
+		srvs, err := lookupSRV(addr)
+		if err != nil || len(srvs) == 0 {
+			logger.Printf("[WARN] agent: Failed to resolve SRV record %s: %v", addr, err)
+			result = append(result, addr)
+			continue
+		}
+
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			result = append(result, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+	}
+	return result
+}
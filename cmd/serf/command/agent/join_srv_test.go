@@ -0,0 +1,49 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandSRVAddrs(t *testing.T) {
+	defer func(fn func(string) ([]*net.SRV, error)) { lookupSRV = fn }(lookupSRV)
+	lookupSRV = func(name string) ([]*net.SRV, error) {
+		if name != "_serf._tcp.example.com" {
+			return nil, fmt.Errorf("no such host")
+		}
+		return []*net.SRV{
+			{Target: "serf-1.example.com.", Port: 7946},
+			{Target: "10.0.0.2.", Port: 8000},
+		}, nil
+	}
+
+	logs := new(bytes.Buffer)
+	addrs := expandSRVAddrs([]string{
+		"10.0.0.1",
+		"_serf._tcp.example.com",
+		"serf.example.com:7946",
+		"_missing._tcp.example.com",
+	}, log.New(logs, "", 0))
+
+	expect := []string{
+		"10.0.0.1",
+		"serf-1.example.com:7946",
+		"10.0.0.2:8000",
+		"serf.example.com:7946",
+		"_missing._tcp.example.com",
+	}
+	if !reflect.DeepEqual(addrs, expect) {
+		t.Fatalf("bad: %#v", addrs)
+	}
+	if !strings.Contains(logs.String(), "Failed to resolve SRV record _missing._tcp.example.com") {
+		t.Fatalf("bad: %s", logs.String())
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// minKeyRotateInterval applies a lower bound to the key rotation interval,
+// since each rotation queries the whole cluster three times.
+const minKeyRotateInterval = time.Minute
+
+// keyRotationLoop rotates the encryption key every KeyRotateInterval until
+// the agent shuts down.
+func (a *Agent) keyRotationLoop() {
+	interval := a.agentConf.KeyRotateInterval
+	for {
+		select {
+		case <-time.After(interval):
+		case <-a.shutdownCh:
+			return
+		}
+		if err := a.RotateKey(); err != nil {
+			a.logger.Printf("[ERR] agent: Key rotation failed: %v", err)
+		}
+	}
+}
+
+// RotateKey replaces the primary encryption key of the cluster with a new
+// random one. The new key is installed on every node, made the primary key
+// once a majority of the nodes acknowledge the switch, and the old key is
+// removed once every node has switched. A node that missed the install could
+// no longer talk to the others, so the rotation is rolled back unless every
+// node installs the key. If not every node switches, the old key is left
+// installed so none of them are cut off.
+func (a *Agent) RotateKey() error {
+	keyring := a.conf.MemberlistConfig.Keyring
+	if keyring == nil {
+		return fmt.Errorf("Encryption is not enabled")
+	}
+	oldKey := base64.StdEncoding.EncodeToString(keyring.GetPrimaryKey())
+
+	raw := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return fmt.Errorf("Error reading random data: %v", err)
+	}
+	newKey := base64.StdEncoding.EncodeToString(raw)
+
+	a.logger.Printf("[INFO] agent: Rotating the encryption key")
+	resp, err := a.InstallKey(newKey)
+	if acked, total := keyAcks(resp); err != nil || acked < total {
+		a.RemoveKey(newKey)
+		return fmt.Errorf("Only %d of %d nodes installed the new key", acked, total)
+	}
+
+	resp, err = a.UseKey(newKey)
+	acked, total := keyAcks(resp)
+	if acked <= total/2 {
+		a.UseKey(oldKey)
+		a.RemoveKey(newKey)
+		return fmt.Errorf("Only %d of %d nodes switched to the new key", acked, total)
+	}
+	if err != nil {
+		a.logger.Printf("[WARN] agent: Only %d of %d nodes switched to the new key, "+
+			"keeping the old key installed", acked, total)
+		return nil
+	}
+
+	resp, err = a.RemoveKey(oldKey)
+	if err != nil {
+		acked, total := keyAcks(resp)
+		a.logger.Printf("[WARN] agent: Only %d of %d nodes removed the old key", acked, total)
+	}
+	a.logger.Printf("[INFO] agent: Rotated the encryption key")
+	return nil
+}
+
+// keyAcks returns how many nodes acknowledged a key request without an
+// error, out of how many nodes there are.
+func keyAcks(resp *serf.KeyResponse) (int, int) {
+	if resp == nil {
+		return 0, 0
+	}
+	return resp.NumResp - resp.NumErr, resp.NumNodes
+}
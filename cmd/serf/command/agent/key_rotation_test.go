@@ -0,0 +1,109 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
+)
+
+func TestAgent_RotateKey(t *testing.T) {
+	oldKey := "T9jncgl9mbLus+baTTa7q7nPSUrXwbDi2dhbtqir37s="
+
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	var agents []*Agent
+	var keyringFiles []string
+	for i := 0; i < 2; i++ {
+		keyringFile := filepath.Join(td, "keyring"+string(rune('a'+i))+".json")
+		if err := ioutil.WriteFile(keyringFile, []byte(`["`+oldKey+`"]`), 0600); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		keyringFiles = append(keyringFiles, keyringFile)
+
+		ip, returnFn := testutil.TakeIP()
+		defer returnFn()
+
+		agentConfig := DefaultConfig()
+		agentConfig.KeyringFile = keyringFile
+		serfConfig := serf.DefaultConfig()
+		serfConfig.KeyringFile = keyringFile
+		a := testAgentWithConfig(t, ip, agentConfig, serfConfig, nil)
+		if err := a.Start(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer a.Shutdown()
+		agents = append(agents, a)
+	}
+
+	addr := agents[1].conf.NodeName + "/" + agents[1].conf.MemberlistConfig.BindAddr
+	if _, err := agents[0].Join([]string{addr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	retry.Run(t, func(r *retry.R) {
+		if n := len(agents[0].Serf().Members()); n != 2 {
+			r.Fatalf("bad: %d", n)
+		}
+	})
+
+	if err := agents[0].RotateKey(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Every node has only the new key, and has saved it
+	var newKey string
+	for i, a := range agents {
+		keyring := a.conf.MemberlistConfig.Keyring
+		keys := keyring.GetKeys()
+		primary := base64.StdEncoding.EncodeToString(keyring.GetPrimaryKey())
+		if len(keys) != 1 || primary == oldKey {
+			t.Fatalf("bad: %d keys, primary %s", len(keys), primary)
+		}
+		if newKey == "" {
+			newKey = primary
+		} else if primary != newKey {
+			t.Fatalf("bad: %s != %s", primary, newKey)
+		}
+
+		data, err := ioutil.ReadFile(keyringFiles[i])
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !strings.Contains(string(data), newKey) || strings.Contains(string(data), oldKey) {
+			t.Fatalf("bad: %s", data)
+		}
+	}
+
+	// The nodes can still talk with the new key
+	if _, err := agents[0].ListKeys(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestAgent_RotateKey_noEncryption(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	a := testAgent(t, ip1, nil)
+	if err := a.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer a.Shutdown()
+
+	if err := a.RotateKey(); err == nil || !strings.Contains(err.Error(), "not enabled") {
+		t.Fatalf("err: %v", err)
+	}
+}
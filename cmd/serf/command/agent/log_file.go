@@ -0,0 +1,182 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFile is an io.Writer that appends agent logs to a file. Once the
+// file would grow beyond maxBytes it is renamed with a timestamp suffix
+// and a new one is started, keeping at most maxFiles of the rotated files
+// around.
+type logFile struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	lock   sync.Mutex
+	fh     *os.File
+	size   int64
+	closed bool
+}
+
+// newLogFile opens the log file at path, appending to it if it exists. A
+// maxBytes of zero disables rotation, and a maxFiles of zero keeps all the
+// rotated files.
+func newLogFile(path string, maxBytes int64, maxFiles int) (*logFile, error) {
+	l := &logFile{
+		path:     path,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Write is used to implement io.Writer
+func (l *logFile) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return 0, fmt.Errorf("Log file %s is closed", l.path)
+	}
+
+	// A failed rotation may have left no file open, so try again
+	if l.fh == nil {
+		if err := l.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	// If the file couldn't be rotated but is still open, keep writing to
+	// it rather than dropping the line, and rotate on the next write
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxBytes {
+		if err := l.rotate(); err != nil && l.fh == nil {
+			return 0, err
+		}
+	}
+
+	n, err := l.fh.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// Close closes the log file. Later writes fail.
+func (l *logFile) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.closed = true
+	if l.fh == nil {
+		return nil
+	}
+	err := l.fh.Close()
+	l.fh = nil
+	return err
+}
+
+// open opens the log file for appending, creating it if needed.
+func (l *logFile) open() error {
+	fh, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to open log file: %v", err)
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return fmt.Errorf("Failed to stat log file: %v", err)
+	}
+	l.fh = fh
+	l.size = fi.Size()
+	return nil
+}
+
+// rotate moves the current log file aside and starts a new one. The log
+// file is opened again even if it couldn't be moved, and is left nil only
+// if that fails too. The lock must be held.
+func (l *logFile) rotate() error {
+	err := l.fh.Close()
+	l.fh = nil
+	if err != nil {
+		return fmt.Errorf("Failed to close log file: %v", err)
+	}
+
+	rotated := fmt.Sprintf("%s.%d", l.path, time.Now().UnixNano())
+	renameErr := os.Rename(l.path, rotated)
+	if err := l.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("Failed to rotate log file: %v", renameErr)
+	}
+	return l.prune()
+}
+
+// prune removes the oldest rotated log files beyond maxFiles.
+func (l *logFile) prune() error {
+	if l.maxFiles <= 0 {
+		return nil
+	}
+
+	rotated, err := l.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	if len(rotated) <= l.maxFiles {
+		return nil
+	}
+	for _, path := range rotated[:len(rotated)-l.maxFiles] {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("Failed to remove old log file: %v", err)
+		}
+	}
+	return nil
+}
+
+// rotatedFiles returns the paths of the rotated log files, oldest first.
+func (l *logFile) rotatedFiles() ([]string, error) {
+	dir, base := filepath.Split(l.path)
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list log files: %v", err)
+	}
+
+	var rotated []string
+	for _, fi := range infos {
+		suffix := strings.TrimPrefix(fi.Name(), base+".")
+		if fi.IsDir() || suffix == fi.Name() || !isDigits(suffix) {
+			continue
+		}
+		rotated = append(rotated, filepath.Join(dir, fi.Name()))
+	}
+
+	// The timestamps have the same number of digits, so sort by name
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// isDigits checks that s is a non-empty string of decimal digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
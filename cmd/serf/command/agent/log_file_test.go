@@ -0,0 +1,150 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogFile_rotate(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "serf.log")
+
+	// Existing content is appended to
+	if err := ioutil.WriteFile(path, []byte("[INFO] old\n"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l, err := newLogFile(path, 32, 1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	lines := []string{
+		"[INFO] first\n",
+		"[INFO] second\n",
+		"[WARN] third\n",
+		"[ERR] fourth\n",
+		"[INFO] fifth\n",
+	}
+	for _, line := range lines {
+		if _, err := l.Write([]byte(line)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(data) != "[ERR] fourth\n[INFO] fifth\n" {
+		t.Fatalf("bad: %q", data)
+	}
+
+	// Only the newest rotated files are kept
+	rotated, err := l.rotatedFiles()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(rotated) != 1 {
+		t.Fatalf("bad: %v", rotated)
+	}
+	data, err = ioutil.ReadFile(rotated[0])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(data) != "[INFO] second\n[WARN] third\n" {
+		t.Fatalf("bad: %q", data)
+	}
+
+	l.Close()
+	if _, err := l.Write([]byte("[INFO] closed\n")); err == nil {
+		t.Fatalf("should fail once closed")
+	}
+}
+
+func TestLogFile_rotateFailed(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "serf.log")
+
+	l, err := newLogFile(path, 32, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	// The file can't be moved aside once it is gone, but it is opened
+	// again and logging carries on
+	if _, err := l.Write([]byte("[INFO] first line\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, line := range []string{"[INFO] second line\n", "[INFO] third line\n"} {
+		if _, err := l.Write([]byte(line)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(data) != "[INFO] third line\n" {
+		t.Fatalf("bad: %q", data)
+	}
+
+	// A file that couldn't be opened again is retried on the next write
+	l.lock.Lock()
+	l.fh.Close()
+	l.fh = nil
+	l.lock.Unlock()
+	if _, err := l.Write([]byte("[INFO] fourth\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(data) != "[INFO] third line\n[INFO] fourth\n" {
+		t.Fatalf("bad: %q", data)
+	}
+}
+
+func TestLogFile_noRotate(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "serf.log")
+
+	l, err := newLogFile(path, 0, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 100; i++ {
+		if _, err := l.Write([]byte("[INFO] line\n")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if rotated, err := l.rotatedFiles(); err != nil || len(rotated) != 0 {
+		t.Fatalf("bad: %v %v", rotated, err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// logTimeFormat is the timestamp prefix written by loggers created with
+// log.LstdFlags.
+const logTimeFormat = "2006/01/02 15:04:05"
+
+// jsonLogEntry is a single log line in the JSON format.
+type jsonLogEntry struct {
+	Timestamp string `json:"timestamp"`
+	Level     string `json:"level,omitempty"`
+	Subsystem string `json:"subsystem,omitempty"`
+	Message   string `json:"message"`
+}
+
+// jsonLogWriter converts log lines such as
+// "2006/01/02 15:04:05 [INFO] agent: message" into one JSON object per
+// line before writing them to the wrapped writer. Implements the
+// io.Writer interface.
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+// Write is used to implement io.Writer
+func (j *jsonLogWriter) Write(p []byte) (int, error) {
+	out, err := json.Marshal(parseLogLine(p))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := j.w.Write(append(out, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// parseLogLine splits a log line into its parts. Anything missing from the
+// line is left empty, apart from the timestamp which falls back to now.
+func parseLogLine(p []byte) *jsonLogEntry {
+	line := string(bytes.TrimRight(p, "\r\n"))
+
+	ts := time.Now()
+	if len(line) >= len(logTimeFormat) {
+		if t, err := time.ParseInLocation(logTimeFormat, line[:len(logTimeFormat)], time.Local); err == nil {
+			ts = t
+			line = strings.TrimPrefix(line[len(logTimeFormat):], " ")
+		}
+	}
+	entry := &jsonLogEntry{Timestamp: ts.Format(time.RFC3339)}
+
+	// Extract the level
+	if strings.HasPrefix(line, "[") {
+		if end := strings.IndexByte(line, ']'); end > 0 {
+			entry.Level = strings.ToLower(line[1:end])
+			line = strings.TrimPrefix(line[end+1:], " ")
+		}
+	}
+
+	// Extract the subsystem, which is a single word such as "agent.ipc"
+	if idx := strings.Index(line, ": "); idx > 0 && !strings.ContainsAny(line[:idx], " \t") {
+		entry.Subsystem = line[:idx]
+		line = line[idx+2:]
+	}
+
+	entry.Message = line
+	return entry
+}
@@ -0,0 +1,78 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLine(t *testing.T) {
+	ts := time.Date(2017, 7, 14, 2, 40, 0, 0, time.Local).Format(time.RFC3339)
+	cases := map[string]*jsonLogEntry{
+		"2017/07/14 02:40:00 [INFO] agent: Serf agent starting\n": {
+			Timestamp: ts,
+			Level:     "info",
+			Subsystem: "agent",
+			Message:   "Serf agent starting",
+		},
+		"2017/07/14 02:40:00 [WARN] agent.ipc: Invalid token: foo\n": {
+			Timestamp: ts,
+			Level:     "warn",
+			Subsystem: "agent.ipc",
+			Message:   "Invalid token: foo",
+		},
+		"2017/07/14 02:40:00 [DEBUG] Script output: done\n": {
+			Timestamp: ts,
+			Level:     "debug",
+			Message:   "Script output: done",
+		},
+		"2017/07/14 02:40:00 no level\n": {
+			Timestamp: ts,
+			Message:   "no level",
+		},
+	}
+	for in, expected := range cases {
+		if entry := parseLogLine([]byte(in)); !reflect.DeepEqual(entry, expected) {
+			t.Fatalf("%q: bad: %#v", in, entry)
+		}
+	}
+}
+
+func TestJSONLogWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	filter := LevelFilter()
+	filter.Writer = &jsonLogWriter{buf}
+	logger := log.New(filter, "", log.LstdFlags)
+
+	logger.Printf("[DEBUG] agent: filtered")
+	logger.Printf("[INFO] agent: multi\nline")
+	logger.Printf("[ERR] memberlist: failed")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("bad: %q", buf.String())
+	}
+	var entry jsonLogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if entry.Level != "info" || entry.Subsystem != "agent" || entry.Message != "multi\nline" {
+		t.Fatalf("bad: %#v", entry)
+	}
+	if _, err := time.Parse(time.RFC3339, entry.Timestamp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if entry.Level != "err" || entry.Subsystem != "memberlist" {
+		t.Fatalf("bad: %#v", entry)
+	}
+}
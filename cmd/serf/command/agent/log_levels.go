@@ -5,6 +5,7 @@ package agent
 
 import (
 	"io/ioutil"
+	"strings"
 
 	"github.com/hashicorp/logutils"
 )
@@ -19,6 +20,23 @@ func LevelFilter() *logutils.LevelFilter {
 	}
 }
 
+// logLevelAliases maps other common spellings of log levels to the ones
+// we use.
+var logLevelAliases = map[string]logutils.LogLevel{
+	"WARNING": "WARN",
+	"ERROR":   "ERR",
+}
+
+// ParseLogLevel normalizes a log level given by the user, ignoring case
+// and accepting the aliases above. The result still needs validating.
+func ParseLogLevel(level string) logutils.LogLevel {
+	level = strings.ToUpper(strings.TrimSpace(level))
+	if alias, ok := logLevelAliases[level]; ok {
+		return alias
+	}
+	return logutils.LogLevel(level)
+}
+
 // ValidateLevelFilter verifies that the log levels within the filter
 // are valid.
 func ValidateLevelFilter(minLevel logutils.LogLevel, filter *logutils.LevelFilter) bool {
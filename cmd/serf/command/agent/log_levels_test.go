@@ -0,0 +1,33 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"testing"
+
+	"github.com/hashicorp/logutils"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	cases := map[string]logutils.LogLevel{
+		"trace":   "TRACE",
+		"Debug":   "DEBUG",
+		" info ":  "INFO",
+		"warn":    "WARN",
+		"warning": "WARN",
+		"ERR":     "ERR",
+		"error":   "ERR",
+		"bogus":   "BOGUS",
+	}
+	filter := LevelFilter()
+	for in, expected := range cases {
+		level := ParseLogLevel(in)
+		if level != expected {
+			t.Fatalf("%q: expected %q, got %q", in, expected, level)
+		}
+		if valid := ValidateLevelFilter(level, filter); valid != (in != "bogus") {
+			t.Fatalf("%q: bad validity %v", in, valid)
+		}
+	}
+}
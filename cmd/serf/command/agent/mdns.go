@@ -28,6 +28,8 @@ type AgentMDNS struct {
 	server   *mdns.Server
 	replay   bool
 	iface    *net.Interface
+
+	shutdownCh chan struct{}
 }
 
 // NewAgentMDNS is used to create a new AgentMDNS
@@ -60,13 +62,14 @@ func NewAgentMDNS(agent *Agent, logOutput io.Writer, replay bool,
 
 	// Initialize the AgentMDNS
 	m := &AgentMDNS{
-		agent:    agent,
-		discover: discover,
-		logger:   log.New(logOutput, "", log.LstdFlags),
-		seen:     make(map[string]struct{}),
-		server:   server,
-		replay:   replay,
-		iface:    iface,
+		agent:      agent,
+		discover:   discover,
+		logger:     log.New(logOutput, "", log.LstdFlags),
+		seen:       make(map[string]struct{}),
+		server:     server,
+		replay:     replay,
+		iface:      iface,
+		shutdownCh: make(chan struct{}),
 	}
 
 	// Start the background workers
@@ -116,10 +119,19 @@ func (m *AgentMDNS) run() {
 		case <-poll:
 			poll = time.After(mdnsPollInterval)
 			go m.poll(hosts)
+
+		case <-m.shutdownCh:
+			return
 		}
 	}
 }
 
+// Shutdown stops advertising ourself and stops looking for new peers.
+func (m *AgentMDNS) Shutdown() error {
+	close(m.shutdownCh)
+	return m.server.Shutdown()
+}
+
 // poll is invoked periodically to check for new hosts
 func (m *AgentMDNS) poll(hosts chan *mdns.ServiceEntry) {
 	params := mdns.QueryParam{
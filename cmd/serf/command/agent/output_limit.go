@@ -0,0 +1,127 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// outputSummaryInterval is how often a summary of the suppressed
+	// handler output lines is logged while output is being dropped.
+	outputSummaryInterval = 10 * time.Second
+)
+
+// outputLimiter caps the rate at which event handler output is logged,
+// across all handlers, so that an event storm with chatty handlers does
+// not drown out the rest of the logs. Up to one second worth of lines can
+// be logged in a burst. Excess lines are dropped and counted, and the
+// count is logged periodically.
+type outputLimiter struct {
+	rate   float64
+	logger *log.Logger
+
+	lock        sync.Mutex
+	tokens      float64
+	last        time.Time
+	suppressed  int
+	lastSummary time.Time
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// newOutputLimiter returns an outputLimiter that allows the given number
+// of output lines per second, and starts logging the summaries of the
+// suppressed lines. It must be stopped once it is no longer used.
+func newOutputLimiter(rate int, logger *log.Logger) *outputLimiter {
+	l := &outputLimiter{
+		rate:        float64(rate),
+		logger:      logger,
+		tokens:      float64(rate),
+		lastSummary: time.Now(),
+		stopCh:      make(chan struct{}),
+	}
+	go l.run(outputSummaryInterval)
+	return l
+}
+
+// take returns how many of n lines may be logged at the given time, and
+// counts the rest as suppressed.
+func (l *outputLimiter) take(n int, now time.Time) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+
+	allowed := n
+	if float64(allowed) > l.tokens {
+		allowed = int(l.tokens)
+	}
+	l.tokens -= float64(allowed)
+	l.suppressed += n - allowed
+	return allowed
+}
+
+// flush logs a summary of the lines suppressed since the last flush, if
+// there were any.
+func (l *outputLimiter) flush(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.suppressed > 0 {
+		l.logger.Printf("[WARN] agent: %d lines of event handler output suppressed in the last %v",
+			l.suppressed, now.Sub(l.lastSummary).Round(time.Second))
+		l.suppressed = 0
+	}
+	l.lastSummary = now
+}
+
+// run flushes the summary of the suppressed lines on every interval until
+// the limiter is stopped.
+func (l *outputLimiter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			l.flush(now)
+		case <-l.stopCh:
+			return
+		}
+	}
+}
+
+// stop stops logging the summaries. It is safe to call more than once.
+func (l *outputLimiter) stop() {
+	l.stopOnce.Do(func() {
+		close(l.stopCh)
+	})
+}
+
+// logScriptOutput logs the output of an event handler, dropping any lines
+// past the rate allowed by the limiter. A nil limiter logs everything.
+func logScriptOutput(logger *log.Logger, limiter *outputLimiter, event string, output string) {
+	if limiter == nil {
+		logger.Printf("[DEBUG] agent: Event '%s' script output: %s", event, output)
+		return
+	}
+
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	allowed := limiter.take(len(lines), time.Now())
+	if allowed == 0 {
+		return
+	}
+	logger.Printf("[DEBUG] agent: Event '%s' script output: %s",
+		event, strings.Join(lines[:allowed], "\n"))
+}
@@ -0,0 +1,97 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil/retry"
+)
+
+func TestOutputLimiter_take(t *testing.T) {
+	var buf bytes.Buffer
+	l := newOutputLimiter(10, log.New(&buf, "", 0))
+	defer l.stop()
+	start := time.Now()
+	l.lastSummary = start
+
+	// A burst of one second worth of lines is allowed, the rest dropped
+	if n := l.take(4, start); n != 4 {
+		t.Fatalf("bad: %d", n)
+	}
+	if n := l.take(100, start); n != 6 {
+		t.Fatalf("bad: %d", n)
+	}
+	if n := l.take(5, start.Add(100*time.Millisecond)); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("bad: %s", buf.String())
+	}
+
+	// The suppressed lines are summarized on the next flush
+	l.flush(start.Add(outputSummaryInterval))
+	expected := "[WARN] agent: 98 lines of event handler output suppressed in the last 10s"
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatalf("bad: %s", buf.String())
+	}
+
+	// Nothing more to summarize once output slows down
+	buf.Reset()
+	if n := l.take(1, start.Add(3*outputSummaryInterval)); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	l.flush(start.Add(3 * outputSummaryInterval))
+	if buf.Len() != 0 {
+		t.Fatalf("bad: %s", buf.String())
+	}
+}
+
+func TestOutputLimiter_run(t *testing.T) {
+	buf := &syncBuffer{}
+	l := &outputLimiter{
+		rate:        1,
+		logger:      log.New(buf, "", 0),
+		tokens:      1,
+		lastSummary: time.Now(),
+		stopCh:      make(chan struct{}),
+	}
+	go l.run(10 * time.Millisecond)
+	defer l.stop()
+
+	// The summary is logged without waiting for more output
+	l.take(5, time.Now())
+	retry.Run(t, func(r *retry.R) {
+		if !strings.Contains(buf.String(), "4 lines of event handler output suppressed") {
+			r.Fatalf("bad: %s", buf.String())
+		}
+	})
+}
+
+func TestScriptEventHandler_outputRate(t *testing.T) {
+	buf := &syncBuffer{}
+	h := NewScriptEventHandler(
+		func() serf.Member { return serf.Member{Name: "ourname"} },
+		[]EventScript{
+			{
+				EventFilter: EventFilter{Event: "*"},
+				Script:      "for i in 1 2 3 4 5 6 7 8 9 10; do echo line$i; done",
+			},
+		},
+		log.New(buf, "", 0), 15)
+	defer h.Shutdown()
+
+	// An event storm of chatty handlers only logs up to the rate
+	for i := 0; i < 5; i++ {
+		h.HandleEvent(serf.UserEvent{Name: "deploy"})
+	}
+	if n := strings.Count(buf.String(), "line"); n < 15 || n >= 50 {
+		t.Fatalf("bad: %d lines logged\n%s", n, buf.String())
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPidFile(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "serf.pid")
+
+	if err := writePidFile(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(data) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Fatalf("bad: %q", data)
+	}
+
+	// Only the PID file and nothing left over from writing it
+	if infos, err := ioutil.ReadDir(td); err != nil || len(infos) != 1 {
+		t.Fatalf("bad: %v %v", infos, err)
+	}
+
+	if err := removePidFile(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("PID file should be removed: %v", err)
+	}
+
+	// Removing a missing file is fine
+	if err := removePidFile(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A file written by another process is left alone
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid()+1)), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := removePidFile(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("PID file of another process should be kept: %v", err)
+	}
+
+	if err := writePidFile(filepath.Join(td, "missing", "serf.pid")); err == nil {
+		t.Fatalf("should fail")
+	}
+}
@@ -6,6 +6,7 @@ package agent
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"io"
 	"net"
 	"strings"
@@ -15,6 +16,7 @@ import (
 	"github.com/hashicorp/serf/client"
 	"github.com/hashicorp/serf/serf"
 	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/version"
 )
 
 func testRPCClient(t *testing.T, ip net.IP) (*client.RPCClient, *Agent, *AgentIPC) {
@@ -40,7 +42,7 @@ func testRPCClientWithConfig(t *testing.T, ip net.IP, agentConf *Config,
 	mult := io.MultiWriter(tw, lw)
 
 	agent := testAgentWithConfig(t, ip, agentConf, serfConf, mult)
-	ipc := NewAgentIPC(agent, "", l, mult, lw)
+	ipc := NewAgentIPC(agent, "", nil, l, mult, lw, false, IPCLimits{})
 
 	rpcClient, err := client.NewRPCClient(l.Addr().String())
 	if err != nil {
@@ -217,6 +219,63 @@ func TestRPCClientJoin(t *testing.T) {
 	}
 }
 
+func TestRPCClientJoin_auditLog(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	client, a1, ipc := testRPCClient(t, ip1)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	// Enable audit logging
+	ipc.auditLog = true
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	a2 := testAgent(t, ip2, nil)
+	if err := a2.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer a2.Shutdown()
+
+	testutil.Yield()
+
+	if _, err := client.Join([]string{a2.conf.NodeName + "/" + a2.conf.MemberlistConfig.BindAddr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The keyring isn't enabled, so this fails
+	if _, _, _, err := client.ListKeys(); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Registering replays the buffered logs
+	h := &MockLogHandler{}
+	ipc.logWriter.RegisterHandler(h)
+	ipc.logWriter.DeregisterHandler(h)
+
+	for _, expected := range []string{
+		"command=join outcome=ok",
+		"command=list-keys outcome=error",
+	} {
+		found := false
+		for _, l := range h.logs {
+			if strings.Contains(l, "audit: client=127.0.0.1:") && strings.Contains(l, expected) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("missing audit log %q: %v", expected, h.logs)
+		}
+	}
+}
+
 func TestRPCClientMembers(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -939,6 +998,59 @@ func TestRPCClientAuth(t *testing.T) {
 	if err := rpcClient.UserEvent("deploy", nil, false); err != nil {
 		t.Fatalf("err: %v", err)
 	}
+
+	// A prefix of the key or a wrong key is rejected
+	for _, key := range []string{"foo", "foobarbaz", "barfoo"} {
+		config.AuthKey = key
+		if _, err := client.ClientFromConfig(&config); err == nil ||
+			err.Error() != invalidAuthToken {
+			t.Fatalf("key %q err: %v", key, err)
+		}
+	}
+}
+
+func TestRPCClientAuth_restrictedToken(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	cl, a1, ipc := testRPCClient(t, ip1)
+	defer ipc.Shutdown()
+	defer cl.Close()
+	defer a1.Shutdown()
+
+	// Setup a token that can only fire events
+	ipc.authTokens = map[string][]string{
+		"deploy": []string{"event"},
+	}
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.Yield()
+
+	config := client.Config{Addr: ipc.listener.Addr().String(), AuthKey: "deploy"}
+	rpcClient, err := client.ClientFromConfig(&config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer rpcClient.Close()
+
+	if err := rpcClient.UserEvent("deploy", nil, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, err = rpcClient.Members()
+	if err == nil || !strings.Contains(err.Error(), "Permission denied") ||
+		!strings.Contains(err.Error(), "'members'") {
+		t.Fatalf("should get permission error: %v", err)
+	}
+
+	// Unknown tokens are still rejected
+	config.AuthKey = "bogus"
+	if _, err := client.ClientFromConfig(&config); err == nil ||
+		err.Error() != invalidAuthToken {
+		t.Fatalf("err: %v", err)
+	}
 }
 
 func TestRPCClient_Keys_EncryptionDisabledError(t *testing.T) {
@@ -1120,6 +1232,52 @@ func TestRPCClientStats(t *testing.T) {
 	if stats["agent"]["name"] != a1.conf.NodeName {
 		t.Fatalf("bad: %v", stats)
 	}
+	if stats["agent"]["version"] != version.GetHumanVersion() {
+		t.Fatalf("bad: %v", stats)
+	}
+	if stats["memberlist"]["members"] != "1" || stats["memberlist"]["advertise"] == "" {
+		t.Fatalf("bad: %v", stats)
+	}
+}
+
+func TestRPCClientSelf(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	client, a1, ipc := testRPCClient(t, ip1)
+	defer ipc.Shutdown()
+	defer client.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.Yield()
+
+	self, err := client.Self()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if self.Member.Name != a1.conf.NodeName || self.Member.Status != "alive" {
+		t.Fatalf("bad: %#v", self.Member)
+	}
+	if self.Config["node_name"] != a1.conf.NodeName || self.Config["rpc_addr"] == "" {
+		t.Fatalf("bad: %v", self.Config)
+	}
+	if self.Config["encrypt"] != "false" || self.Config["rpc_auth"] != "false" {
+		t.Fatalf("bad: %v", self.Config)
+	}
+	if self.Versions.Version != version.GetHumanVersion() || self.Versions.Protocol != a1.conf.ProtocolVersion {
+		t.Fatalf("bad: %#v", self.Versions)
+	}
+	if !self.HasCoord || len(self.Coord.Vec) == 0 {
+		t.Fatalf("bad: %#v", self.Coord)
+	}
+	if self.Stats["agent"]["name"] != a1.conf.NodeName || self.Stats["agent"]["rpc_addr"] == "" {
+		t.Fatalf("bad: %v", self.Stats)
+	}
 }
 
 func TestRPCClientGetCoordinate(t *testing.T) {
@@ -1153,3 +1311,208 @@ func TestRPCClientGetCoordinate(t *testing.T) {
 		t.Fatalf("should have not gotten a coordinate")
 	}
 }
+
+func TestRPCClientCoordinateStream(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	rpcClient, a1, ipc := testRPCClient(t, ip1)
+	defer ipc.Shutdown()
+	defer rpcClient.Close()
+	defer a1.Shutdown()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	a2 := testAgent(t, ip2, nil)
+	if err := a2.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer a2.Shutdown()
+
+	updateCh := make(chan client.CoordinateUpdate, 64)
+	if handle, err := rpcClient.CoordinateStream(updateCh); err != nil {
+		t.Fatalf("err: %v", err)
+	} else {
+		defer rpcClient.Stop(handle)
+	}
+
+	testutil.Yield()
+
+	s2Addr := a2.conf.MemberlistConfig.BindAddr
+	if _, err := a1.Join([]string{a2.conf.NodeName + "/" + s2Addr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Probes of a2 should refine both its coordinate and our own
+	seen := make(map[string]bool)
+	timeout := time.After(5 * time.Second)
+	for !seen[a1.conf.NodeName] || !seen[a2.conf.NodeName] {
+		select {
+		case update := <-updateCh:
+			if !update.Coord.IsValid() {
+				t.Fatalf("bad: %#v", update)
+			}
+			seen[update.Node] = true
+		case <-timeout:
+			t.Fatalf("timeout waiting for coordinate updates: %v", seen)
+		}
+	}
+}
+
+func TestRPCClientCodecs(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	msgpackClient, a1, ipc := testRPCClient(t, ip1)
+	defer ipc.Shutdown()
+	defer msgpackClient.Close()
+	defer a1.Shutdown()
+
+	jsonClient, err := client.ClientFromConfig(&client.Config{
+		Addr:  ipc.listener.Addr().String(),
+		Codec: client.CodecJSON,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer jsonClient.Close()
+
+	if err := a1.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	a2 := testAgent(t, ip2, nil)
+	if err := a2.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer a2.Shutdown()
+
+	s2Addr := a2.conf.MemberlistConfig.BindAddr
+	if _, err := jsonClient.Join([]string{a2.conf.NodeName + "/" + s2Addr}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testutil.Yield()
+
+	// Both codecs see the same members
+	mem1, err := msgpackClient.Members()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	mem2, err := jsonClient.Members()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(mem1) != 2 || len(mem2) != 2 {
+		t.Fatalf("bad: %#v %#v", mem1, mem2)
+	}
+	for _, m1 := range mem1 {
+		var m2 *client.Member
+		for i := range mem2 {
+			if mem2[i].Name == m1.Name {
+				m2 = &mem2[i]
+			}
+		}
+		if m2 == nil || !m2.Addr.Equal(m1.Addr) || m2.Port != m1.Port || m2.Status != m1.Status {
+			t.Fatalf("bad: %#v %#v", m1, m2)
+		}
+	}
+
+	// Events sent over one codec are streamed over the other
+	eventCh := make(chan map[string]interface{}, 64)
+	handle, err := msgpackClient.Stream("user", eventCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer msgpackClient.Stop(handle)
+
+	if err := jsonClient.UserEvent("deploy", []byte("foo"), false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case e := <-eventCh:
+		if e["Name"].(string) != "deploy" {
+			t.Fatalf("bad: %#v", e)
+		}
+		if !bytes.Equal(e["Payload"].([]byte), []byte("foo")) {
+			t.Fatalf("bad: %#v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("should get event")
+	}
+
+	if _, err := client.ClientFromConfig(&client.Config{
+		Addr:  ipc.listener.Addr().String(),
+		Codec: "xml",
+	}); err == nil || !strings.Contains(err.Error(), "Unsupported codec") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRPCClient_handshake(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	cl, a1, ipc := testRPCClient(t, ip1)
+	defer ipc.Shutdown()
+	defer cl.Close()
+	defer a1.Shutdown()
+
+	var enc *json.Encoder
+	var dec *json.Decoder
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", ipc.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		enc = json.NewEncoder(conn)
+		dec = json.NewDecoder(conn)
+		return conn
+	}
+
+	call := func(command string, seq uint64, body interface{}) string {
+		if err := enc.Encode(&requestHeader{Command: command, Seq: seq}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if body != nil {
+			if err := enc.Encode(body); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		var resp responseHeader
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.Seq != seq {
+			t.Fatalf("bad seq: %d", resp.Seq)
+		}
+		return resp.Error
+	}
+
+	// Commands are refused until the handshake is done
+	conn := dial()
+	if err := call(membersCommand, 1, nil); err != handshakeRequired {
+		t.Fatalf("bad: %q", err)
+	}
+	conn.Close()
+
+	conn = dial()
+	defer conn.Close()
+	if err := call(handshakeCommand, 1, &handshakeRequest{Version: MaxIPCVersion + 1}); err != unsupportedIPCVersion {
+		t.Fatalf("bad: %q", err)
+	}
+	if err := call(handshakeCommand, 2, &handshakeRequest{Version: MaxIPCVersion}); err != "" {
+		t.Fatalf("bad: %q", err)
+	}
+	if err := call(handshakeCommand, 3, &handshakeRequest{Version: MaxIPCVersion}); err != duplicateHandshake {
+		t.Fatalf("bad: %q", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unixSocketPrefix marks an RPC address as the path of a Unix socket,
+// as in "unix:///var/run/serf.sock".
+const unixSocketPrefix = "unix://"
+
+// listenRPC opens the RPC listener for the given address, which is either
+// a TCP address or a Unix socket path with the unix:// prefix. A stale
+// socket left behind by an agent that didn't shut down cleanly is removed
+// first, but any other file at the path is left alone.
+func listenRPC(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, unixSocketPrefix)
+	if path == "" {
+		return nil, fmt.Errorf("Missing path for Unix socket RPC address %q", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("Can't listen on %s: file exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Can't listen on %s: socket is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("Failed to remove stale socket %s: %v", path, err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// listenerHasAddr returns if ln is listening on the given RPC address, so
+// the listeners handed off by a graceful restart can be matched up with
+// the configured addresses. A zero port matches any port.
+func listenerHasAddr(ln net.Listener, addr string) bool {
+	if strings.HasPrefix(addr, unixSocketPrefix) {
+		return ln.Addr().Network() == "unix" &&
+			ln.Addr().String() == strings.TrimPrefix(addr, unixSocketPrefix)
+	}
+
+	have, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return false
+	}
+	if want.Port != 0 && want.Port != have.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return have.IP == nil || have.IP.IsUnspecified()
+	}
+	return want.IP.Equal(have.IP)
+}
+
+// errListenerClosed is returned by Accept once a multiListener is closed.
+var errListenerClosed = errors.New("RPC listener closed")
+
+// acceptResult is a connection or error from one of the listeners of a
+// multiListener.
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// multiListener accepts connections from several listeners at once, so the
+// same RPC server can be reached at more than one address. Its address is
+// that of the first listener.
+type multiListener struct {
+	listeners []net.Listener
+	acceptCh  chan acceptResult
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+// newMultiListener returns a listener accepting connections from all of
+// the given listeners. A single listener is returned as is.
+func newMultiListener(listeners []net.Listener) net.Listener {
+	if len(listeners) == 1 {
+		return listeners[0]
+	}
+
+	m := &multiListener{
+		listeners: listeners,
+		acceptCh:  make(chan acceptResult),
+		closeCh:   make(chan struct{}),
+	}
+	for _, ln := range listeners {
+		go m.accept(ln)
+	}
+	return m
+}
+
+// accept passes on the connections accepted by one listener until the
+// multiListener is closed.
+func (m *multiListener) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		select {
+		case m.acceptCh <- acceptResult{conn, err}:
+		case <-m.closeCh:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case res := <-m.acceptCh:
+		return res.conn, res.err
+	case <-m.closeCh:
+		return nil, errListenerClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.closeCh)
+		for _, ln := range m.listeners {
+			if e := ln.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
+
+// keepAliveListener sets the TCP keepalive period of the connections it
+// accepts, so connections to clients that went away are noticed.
+type keepAliveListener struct {
+	net.Listener
+	period time.Duration
+}
+
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(l.period)
+	}
+	return conn, nil
+}
@@ -0,0 +1,162 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListenRPC_unix(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "serf.sock")
+
+	l, err := listenRPC(unixSocketPrefix + path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if l.Addr().Network() != "unix" {
+		t.Fatalf("bad: %v", l.Addr())
+	}
+
+	// A socket that is still being served is not taken over
+	if _, err := listenRPC(unixSocketPrefix + path); err == nil ||
+		!strings.Contains(err.Error(), "in use") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A stale socket left behind is replaced
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err = listenRPC(unixSocketPrefix + path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket should be removed on close: %v", err)
+	}
+
+	// Regular files are never removed
+	if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := listenRPC(unixSocketPrefix + path); err == nil ||
+		!strings.Contains(err.Error(), "not a socket") {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := listenRPC(unixSocketPrefix); err == nil {
+		t.Fatalf("should fail without a path")
+	}
+}
+
+func TestListenerHasAddr(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "serf.sock")
+
+	unixLn, err := listenRPC(unixSocketPrefix + path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer unixLn.Close()
+	tcpLn, err := listenRPC("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer tcpLn.Close()
+	port := tcpLn.Addr().(*net.TCPAddr).Port
+
+	cases := []struct {
+		ln     net.Listener
+		addr   string
+		expect bool
+	}{
+		{unixLn, unixSocketPrefix + path, true},
+		{unixLn, unixSocketPrefix + path + ".other", false},
+		{unixLn, tcpLn.Addr().String(), false},
+		{tcpLn, tcpLn.Addr().String(), true},
+		{tcpLn, "127.0.0.1:0", true},
+		{tcpLn, net.JoinHostPort("127.0.0.1", strconv.Itoa(port+1)), false},
+		{tcpLn, net.JoinHostPort("0.0.0.0", strconv.Itoa(port)), false},
+		{tcpLn, unixSocketPrefix + path, false},
+	}
+	for _, c := range cases {
+		if got := listenerHasAddr(c.ln, c.addr); got != c.expect {
+			t.Errorf("%v on %q: got %v", c.ln.Addr(), c.addr, got)
+		}
+	}
+}
+
+func TestMultiListener(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "serf.sock")
+
+	tcpLn, err := listenRPC("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	unixLn, err := listenRPC(unixSocketPrefix + path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l := newMultiListener([]net.Listener{tcpLn, unixLn})
+	if l.Addr().String() != tcpLn.Addr().String() {
+		t.Fatalf("bad: %v", l.Addr())
+	}
+
+	// Connections to either listener are accepted
+	for _, addr := range []net.Addr{tcpLn.Addr(), unixLn.Addr()} {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.Close()
+
+		accepted, err := l.Accept()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if accepted.LocalAddr().Network() != addr.Network() {
+			t.Fatalf("bad: %v", accepted.LocalAddr())
+		}
+		accepted.Close()
+	}
+
+	// Closing it closes all the listeners
+	if err := l.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := l.Accept(); err != errListenerClosed {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := net.Dial("unix", path); err == nil {
+		t.Fatalf("should not connect")
+	}
+
+	// A single listener is used as is
+	if l := newMultiListener([]net.Listener{tcpLn}); l != tcpLn {
+		t.Fatalf("bad: %v", l)
+	}
+}
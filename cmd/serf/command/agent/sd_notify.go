@@ -0,0 +1,43 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+const (
+	// sdReady, sdReloading and sdStopping are the states reported to
+	// systemd when the agent runs as a Type=notify service.
+	sdReady     = "READY=1"
+	sdReloading = "RELOADING=1"
+	sdStopping  = "STOPPING=1"
+)
+
+// sdNotify sends a state to systemd over the socket named by
+// NOTIFY_SOCKET. It does nothing if the variable is not set, which is the
+// case unless the agent runs as a systemd service with Type=notify.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	// A leading @ refers to the abstract socket namespace
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("Failed to notify systemd: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("Failed to notify systemd: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSDNotify(t *testing.T) {
+	// Nothing to do without a socket
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify(sdReady); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+	path := filepath.Join(td, "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	if err := sdNotify(sdStopping); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(buf[:n]) != sdStopping {
+		t.Fatalf("bad: %q", buf[:n])
+	}
+
+	// A missing socket is reported
+	os.Setenv("NOTIFY_SOCKET", filepath.Join(td, "missing.sock"))
+	if err := sdNotify(sdReady); err == nil {
+		t.Fatalf("should fail")
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// seedListTimeout bounds how long a single fetch of the seed list
+	// may take, so a hung endpoint does not stall the retry join loop.
+	seedListTimeout = 10 * time.Second
+
+	// seedListMaxSize is the largest seed list body that is accepted.
+	seedListMaxSize = 1024 * 1024
+)
+
+// seedList fetches the addresses to join from an HTTP endpoint. The
+// endpoint may serve either a JSON list of strings, or plain text with
+// one address per line. If a fetch fails, the last list that was
+// fetched successfully is used instead.
+type seedList struct {
+	url    string
+	client *http.Client
+	logger *log.Logger
+
+	lock sync.Mutex
+	last []string
+}
+
+// newSeedList returns a seedList that fetches from the given URL.
+func newSeedList(url string, logger *log.Logger) *seedList {
+	return &seedList{
+		url:    url,
+		client: &http.Client{Timeout: seedListTimeout},
+		logger: logger,
+	}
+}
+
+// Addresses fetches the current seed list. If the endpoint can't be
+// reached or returns a bad response, the last-known list is returned
+// along with the error.
+func (s *seedList) Addresses() ([]string, error) {
+	addrs, err := s.fetch()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		s.logger.Printf("[WARN] agent: Failed to fetch seed list from %s: %v (using %d last-known addresses)",
+			s.url, err, len(s.last))
+		return s.last, err
+	}
+
+	s.last = addrs
+	return addrs, nil
+}
+
+// fetch performs a single request against the seed list endpoint.
+func (s *seedList) fetch() ([]string, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected response code: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, seedListMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseSeedList(body)
+}
+
+// parseSeedList decodes a seed list body, which is either a JSON list of
+// addresses or one address per line. Blank lines and lines starting with
+// '#' are ignored in the line format.
+func parseSeedList(body []byte) ([]string, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var addrs []string
+		if err := json.Unmarshal(body, &addrs); err != nil {
+			return nil, fmt.Errorf("Failed to decode seed list: %v", err)
+		}
+		return addrs, nil
+	}
+
+	var addrs []string
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	return addrs, nil
+}
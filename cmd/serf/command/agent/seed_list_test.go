@@ -0,0 +1,70 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashicorp/serf/testutil"
+)
+
+func TestParseSeedList(t *testing.T) {
+	cases := []struct {
+		body   string
+		expect []string
+		err    bool
+	}{
+		{`["10.0.0.1", "10.0.0.2:7946"]`, []string{"10.0.0.1", "10.0.0.2:7946"}, false},
+		{"10.0.0.1\n\n# comment\n  10.0.0.2:7946  \n", []string{"10.0.0.1", "10.0.0.2:7946"}, false},
+		{"", nil, false},
+		{`["10.0.0.1"`, nil, true},
+	}
+
+	for _, tc := range cases {
+		addrs, err := parseSeedList([]byte(tc.body))
+		if (err != nil) != tc.err {
+			t.Fatalf("body %q err: %v", tc.body, err)
+		}
+		if !reflect.DeepEqual(addrs, tc.expect) {
+			t.Fatalf("body %q bad: %#v", tc.body, addrs)
+		}
+	}
+}
+
+func TestSeedList_lastKnown(t *testing.T) {
+	var fail int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`["10.0.0.1", "10.0.0.2"]`))
+	}))
+	defer server.Close()
+
+	seeds := newSeedList(server.URL, log.New(testutil.TestWriter(t), "", log.LstdFlags))
+	addrs, err := seeds.Addresses()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := []string{"10.0.0.1", "10.0.0.2"}
+	if !reflect.DeepEqual(addrs, expect) {
+		t.Fatalf("bad: %#v", addrs)
+	}
+
+	// A failing endpoint falls back to the last-known list
+	atomic.StoreInt32(&fail, 1)
+	addrs, err = seeds.Addresses()
+	if err == nil {
+		t.Fatalf("should fail")
+	}
+	if !reflect.DeepEqual(addrs, expect) {
+		t.Fatalf("bad: %#v", addrs)
+	}
+}
@@ -0,0 +1,15 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !windows
+// +build !windows
+
+package agent
+
+import "os"
+
+// startService does nothing outside of Windows, where the agent is
+// stopped with signals instead.
+func startService() (<-chan os.Signal, func(), error) {
+	return nil, func() {}, nil
+}
@@ -0,0 +1,112 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build windows
+// +build windows
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+const (
+	// serviceWaitHint is how long we tell the service control manager the
+	// next step of stopping may take. Progress is reported every
+	// serviceCheckInterval, so a graceful leave that takes longer than
+	// this isn't mistaken for a hung service and killed.
+	serviceWaitHint      = 10 * time.Second
+	serviceCheckInterval = time.Second
+)
+
+// serviceHandler reports the agent's state to the Windows service control
+// manager, and asks the agent to stop when the service is stopped.
+type serviceHandler struct {
+	signalCh chan os.Signal
+	doneCh   chan struct{}
+}
+
+// serviceSignal returns the signal the agent gets for a service control
+// request, if it is one asking the agent to stop. Stopping the service is
+// treated as an interrupt, and shutting down the system as a TERM, the
+// same as on Unix.
+func serviceSignal(cmd svc.Cmd) (os.Signal, bool) {
+	switch cmd {
+	case svc.Stop:
+		return os.Interrupt, true
+	case svc.PreShutdown, svc.Shutdown:
+		return syscall.SIGTERM, true
+	default:
+		return nil, false
+	}
+}
+
+// Execute is used to implement svc.Handler
+func (h *serviceHandler) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPreShutdown
+	s <- svc.Status{State: svc.Running, Accepts: accepted}
+
+	// Once stopping, keep reporting progress until the agent is done
+	ticker := time.NewTicker(serviceCheckInterval)
+	defer ticker.Stop()
+	var checkCh <-chan time.Time
+	status := svc.Status{State: svc.StopPending, WaitHint: uint32(serviceWaitHint / time.Millisecond)}
+	for {
+		select {
+		case req := <-r:
+			if req.Cmd == svc.Interrogate {
+				s <- req.CurrentStatus
+				continue
+			}
+			sig, ok := serviceSignal(req.Cmd)
+			if !ok || checkCh != nil {
+				continue
+			}
+			checkCh = ticker.C
+			s <- status
+			h.signalCh <- sig
+		case <-checkCh:
+			status.CheckPoint++
+			s <- status
+		case <-h.doneCh:
+			status.CheckPoint++
+			s <- status
+			return false, 0
+		}
+	}
+}
+
+// startService hooks the agent up to the service control manager if it
+// was started as a Windows service. The returned channel delivers a signal
+// when the service is asked to stop, and the returned func must be called
+// once the agent has shut down. The channel is nil when not running as a
+// service.
+func startService() (<-chan os.Signal, func(), error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to detect Windows service: %v", err)
+	}
+	if !isService {
+		return nil, func() {}, nil
+	}
+
+	h := &serviceHandler{
+		signalCh: make(chan os.Signal, 1),
+		doneCh:   make(chan struct{}),
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- svc.Run("serf", h)
+	}()
+
+	done := func() {
+		close(h.doneCh)
+		<-errCh
+	}
+	return h.signalCh, done, nil
+}
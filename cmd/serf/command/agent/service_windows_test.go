@@ -0,0 +1,77 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build windows
+// +build windows
+
+package agent
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+func TestServiceSignal(t *testing.T) {
+	cases := []struct {
+		cmd svc.Cmd
+		sig os.Signal
+		ok  bool
+	}{
+		{svc.Stop, os.Interrupt, true},
+		{svc.Shutdown, syscall.SIGTERM, true},
+		{svc.PreShutdown, syscall.SIGTERM, true},
+		{svc.Pause, nil, false},
+	}
+	for i, tc := range cases {
+		sig, ok := serviceSignal(tc.cmd)
+		if sig != tc.sig || ok != tc.ok {
+			t.Fatalf("case %d: bad: %v %v", i, sig, ok)
+		}
+	}
+}
+
+func TestServiceHandler_stop(t *testing.T) {
+	h := &serviceHandler{
+		signalCh: make(chan os.Signal, 1),
+		doneCh:   make(chan struct{}),
+	}
+	reqCh := make(chan svc.ChangeRequest)
+	statusCh := make(chan svc.Status, 16)
+	exitCh := make(chan struct{})
+	go func() {
+		h.Execute(nil, reqCh, statusCh)
+		close(exitCh)
+	}()
+
+	if s := <-statusCh; s.State != svc.Running {
+		t.Fatalf("bad: %#v", s)
+	}
+	reqCh <- svc.ChangeRequest{Cmd: svc.Stop}
+	if s := <-statusCh; s.State != svc.StopPending || s.WaitHint == 0 {
+		t.Fatalf("bad: %#v", s)
+	}
+	if sig := <-h.signalCh; sig != os.Interrupt {
+		t.Fatalf("bad: %v", sig)
+	}
+
+	// Progress is reported while the agent leaves
+	select {
+	case s := <-statusCh:
+		if s.State != svc.StopPending || s.CheckPoint != 1 {
+			t.Fatalf("bad: %#v", s)
+		}
+	case <-time.After(5 * serviceCheckInterval):
+		t.Fatalf("no progress reported")
+	}
+
+	close(h.doneCh)
+	select {
+	case <-exitCh:
+	case <-time.After(time.Second):
+		t.Fatalf("handler didn't exit")
+	}
+}
@@ -5,6 +5,7 @@ package agent
 
 import (
 	"bytes"
+	"strings"
 
 	"github.com/hashicorp/go-syslog"
 	"github.com/hashicorp/logutils"
@@ -21,6 +22,25 @@ var levelPriority = map[string]gsyslog.Priority{
 	"CRIT":  gsyslog.LOG_CRIT,
 }
 
+// syslogFacilities are the facility names accepted by go-syslog.
+var syslogFacilities = []string{
+	"KERN", "USER", "MAIL", "DAEMON", "AUTH", "SYSLOG", "LPR", "NEWS",
+	"UUCP", "CRON", "AUTHPRIV", "FTP", "LOCAL0", "LOCAL1", "LOCAL2",
+	"LOCAL3", "LOCAL4", "LOCAL5", "LOCAL6", "LOCAL7",
+}
+
+// validSyslogFacility checks that the facility is one we can log to,
+// ignoring case.
+func validSyslogFacility(facility string) bool {
+	facility = strings.ToUpper(facility)
+	for _, f := range syslogFacilities {
+		if f == facility {
+			return true
+		}
+	}
+	return false
+}
+
 // SyslogWrapper is used to cleaup log messages before
 // writing them to a Syslogger. Implements the io.Writer
 // interface.
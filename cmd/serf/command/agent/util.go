@@ -4,8 +4,16 @@
 package agent
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
 	"runtime"
 	"strconv"
+	"strings"
 )
 
 // runtimeStats is used to return various runtime information
@@ -19,3 +27,239 @@ func runtimeStats() map[string]string {
 		"cpu_count":  strconv.FormatInt(int64(runtime.NumCPU()), 10),
 	}
 }
+
+// usableHostname checks if a hostname is suitable as a node name. Empty
+// names and the generic loopback names many containers report would
+// collide across nodes, so they are rejected.
+func usableHostname(name string) bool {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "localhost", "localhost.localdomain":
+		return false
+	}
+	return true
+}
+
+// bindAuto is the bind address that has the agent pick the private
+// address of the host to bind to.
+const bindAuto = "auto"
+
+// isAutoBind checks if a bind address, with or without a port, asks for
+// the private address of the host to be picked.
+func isAutoBind(addr string) bool {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	return strings.EqualFold(host, bindAuto)
+}
+
+// privateBlocks are the IPv4 ranges considered private when picking an
+// address to bind to, or to advertise for a listener bound to all
+// interfaces.
+var privateBlocks = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10"}
+
+// isPrivateIPv4 checks if an address is in one of the privateBlocks.
+func isPrivateIPv4(ip net.IP) bool {
+	if ip.To4() == nil {
+		return false
+	}
+	for _, block := range privateBlocks {
+		_, private, _ := net.ParseCIDR(block)
+		if private.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// onlyPrivateIP returns the private IPv4 address among addrs. It is an error
+// if there isn't exactly one, since guessing among several could bind to
+// an address the other nodes can't reach.
+func onlyPrivateIP(addrs []net.Addr) (net.IP, error) {
+	var found []net.IP
+	seen := make(map[string]bool)
+	for _, a := range addrs {
+		var ip net.IP
+		switch addr := a.(type) {
+		case *net.IPNet:
+			ip = addr.IP
+		case *net.IPAddr:
+			ip = addr.IP
+		default:
+			continue
+		}
+		if !isPrivateIPv4(ip) || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		found = append(found, ip)
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("No private IPv4 address found, set one with -bind")
+	case 1:
+		return found[0], nil
+	default:
+		ips := make([]string, 0, len(found))
+		for _, ip := range found {
+			ips = append(ips, ip.String())
+		}
+		return nil, fmt.Errorf("Multiple private IPv4 addresses found (%s), pick one with -bind, or an interface with -iface",
+			strings.Join(ips, ", "))
+	}
+}
+
+// autoBindAddr replaces the host of an "auto" bind address with the private
+// address of this host, keeping any port. Only the addresses of iface are
+// considered if it is set, or else those of every interface that is up and
+// isn't a loopback.
+func autoBindAddr(bind string, iface *net.Interface) (string, error) {
+	var addrs []net.Addr
+	if iface != nil {
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return "", fmt.Errorf("Failed to get interface addresses: %s", err)
+		}
+		addrs = ifaceAddrs
+	} else {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return "", fmt.Errorf("Failed to list network interfaces: %s", err)
+		}
+		for _, i := range ifaces {
+			if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			ifaceAddrs, err := i.Addrs()
+			if err != nil {
+				return "", fmt.Errorf("Failed to get addresses of interface '%s': %s", i.Name, err)
+			}
+			addrs = append(addrs, ifaceAddrs...)
+		}
+	}
+
+	ip, err := onlyPrivateIP(addrs)
+	if err != nil {
+		return "", err
+	}
+	port := strconv.Itoa(DefaultBindPort)
+	if _, p, err := net.SplitHostPort(bind); err == nil {
+		port = p
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// generateNodeName derives a node name from the hardware address of the
+// first interface that is up and not a loopback. The same machine always
+// gets the same name, so it stays stable across restarts.
+func generateNodeName(ifaces []net.Interface) (string, error) {
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if len(iface.HardwareAddr) == 0 {
+			continue
+		}
+		return "serf-" + hex.EncodeToString(iface.HardwareAddr), nil
+	}
+	return "", fmt.Errorf("No network interface with a hardware address to derive a node name from")
+}
+
+// The schemes a node name can be picked with when none is given. The
+// hostname scheme uses the hostname as is, or a name derived from the
+// hardware address if the hostname can't be used. The others generate a
+// random name, which is kept next to the snapshot so it is stable across
+// restarts.
+const (
+	nodeNameHostname       = "hostname"
+	nodeNameHostnameSuffix = "hostname-suffix"
+	nodeNameUUID           = "uuid"
+)
+
+// maxNodeNameLen is the longest node name allowed when node names are
+// validated.
+const maxNodeNameLen = 128
+
+// normalizeHostname turns a hostname into a valid node name, by lower
+// casing it and replacing anything but letters, digits, dashes and dots
+// with dashes. The result is left short enough to append a suffix of
+// suffixLen characters and a dash.
+func normalizeHostname(name string, suffixLen int) string {
+	name = strings.Trim(strings.ToLower(strings.TrimSpace(name)), ".")
+	normalized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '.' {
+			return r
+		}
+		return '-'
+	}, name)
+	if max := maxNodeNameLen - suffixLen - 1; len(normalized) > max {
+		normalized = normalized[:max]
+	}
+	return strings.Trim(normalized, "-.")
+}
+
+// randomHex returns n random bytes encoded as hex.
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", fmt.Errorf("Error reading random data: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// generateUUID returns a random UUID in its usual text form.
+func generateUUID() (string, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%s-%s-%s", id[0:8], id[8:12], id[12:16], id[16:20], id[20:32]), nil
+}
+
+// randomNodeName generates a node name for the hostname-suffix or uuid
+// scheme. The hostname-suffix scheme appends a short random suffix to the
+// normalized hostname, so machines cloned from the same image get apart.
+func randomNodeName(scheme, host string) (string, error) {
+	if scheme == nodeNameUUID {
+		return generateUUID()
+	}
+	suffix, err := randomHex(4)
+	if err != nil {
+		return "", err
+	}
+	host = normalizeHostname(host, len(suffix))
+	if host == "" {
+		host = "serf"
+	}
+	return host + "-" + suffix, nil
+}
+
+// nodeNamePath returns the file a generated node name is kept in, next to
+// the snapshot. Without a snapshot the name isn't kept.
+func nodeNamePath(snapshotPath string) string {
+	if snapshotPath == "" {
+		return ""
+	}
+	return snapshotPath + ".node-name"
+}
+
+// loadNodeName reads a node name kept by an earlier run, returning an
+// empty name if there is none.
+func loadNodeName(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("Error reading node name file: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// saveNodeName keeps a generated node name for later runs.
+func saveNodeName(path, name string) error {
+	if err := ioutil.WriteFile(path, []byte(name+"\n"), 0644); err != nil {
+		return fmt.Errorf("Error writing node name file: %v", err)
+	}
+	return nil
+}
@@ -7,6 +7,8 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -52,3 +54,136 @@ func testAgentWithConfig(t *testing.T, ip net.IP, agentConfig *Config, serfConfi
 	}
 	return agent
 }
+
+func TestGenerateNodeName(t *testing.T) {
+	ifaces := []net.Interface{
+		{Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+		{Name: "ifb0", HardwareAddr: net.HardwareAddr{0xf6, 0x11, 0x65, 0xd1, 0x6f, 0x0c}},
+		{Name: "eth0", Flags: net.FlagUp, HardwareAddr: net.HardwareAddr{0x02, 0xfc, 0x00, 0x00, 0x00, 0x01}},
+	}
+	name, err := generateNodeName(ifaces)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if name != "serf-02fc00000001" {
+		t.Fatalf("bad: %s", name)
+	}
+
+	if _, err := generateNodeName(ifaces[:2]); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestNormalizeHostname(t *testing.T) {
+	cases := map[string]string{
+		"web-1":                "web-1",
+		" Web_1.Example.COM. ": "web-1.example.com",
+		"_db@2_":               "db-2",
+		"":                     "",
+	}
+	for input, expected := range cases {
+		if name := normalizeHostname(input, 8); name != expected {
+			t.Fatalf("%q: bad: %q", input, name)
+		}
+	}
+
+	// Room is left for the suffix
+	if name := normalizeHostname(strings.Repeat("a", 200), 8); len(name) != maxNodeNameLen-9 {
+		t.Fatalf("bad: %d", len(name))
+	}
+}
+
+func TestRandomNodeName(t *testing.T) {
+	name, err := randomNodeName(nodeNameHostnameSuffix, "Web_1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok, _ := regexp.MatchString(`^web-1-[0-9a-f]{8}$`, name); !ok {
+		t.Fatalf("bad: %s", name)
+	}
+	other, err := randomNodeName(nodeNameHostnameSuffix, "Web_1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if other == name {
+		t.Fatalf("bad: %s", other)
+	}
+
+	// Without a hostname there is still a prefix
+	if name, err = randomNodeName(nodeNameHostnameSuffix, ""); err != nil || !strings.HasPrefix(name, "serf-") {
+		t.Fatalf("bad: %s %v", name, err)
+	}
+
+	name, err = randomNodeName(nodeNameUUID, "web-1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ok, _ := regexp.MatchString(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`, name); !ok {
+		t.Fatalf("bad: %s", name)
+	}
+}
+
+func TestUsableHostname(t *testing.T) {
+	cases := map[string]bool{
+		"":                      false,
+		"localhost":             false,
+		"LOCALHOST.localdomain": false,
+		"web-1":                 true,
+	}
+	for name, expected := range cases {
+		if usableHostname(name) != expected {
+			t.Fatalf("bad: %q", name)
+		}
+	}
+}
+
+func TestIsAutoBind(t *testing.T) {
+	cases := map[string]bool{
+		"auto":         true,
+		"AUTO:7946":    true,
+		"0.0.0.0":      false,
+		"10.0.0.1:123": false,
+		"autoscaler":   false,
+	}
+	for addr, expected := range cases {
+		if isAutoBind(addr) != expected {
+			t.Fatalf("bad: %q", addr)
+		}
+	}
+}
+
+func TestOnlyPrivateIP(t *testing.T) {
+	addr := func(s string) net.Addr {
+		ip, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		ipNet.IP = ip
+		return ipNet
+	}
+
+	// Public and IPv6 addresses are skipped
+	addrs := []net.Addr{
+		addr("203.0.113.7/24"),
+		addr("fd00::1/64"),
+		addr("172.31.4.2/20"),
+		addr("172.32.0.1/16"),
+	}
+	ip, err := onlyPrivateIP(addrs)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ip.String() != "172.31.4.2" {
+		t.Fatalf("bad: %s", ip)
+	}
+
+	if _, err := onlyPrivateIP(addrs[:2]); err == nil || !strings.Contains(err.Error(), "No private IPv4") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Several candidates are all listed, rather than one being picked
+	_, err = onlyPrivateIP(append(addrs, addr("192.168.1.10/24"), addr("10.1.2.3/8")))
+	if err == nil || !strings.Contains(err.Error(), "172.31.4.2, 192.168.1.10, 10.1.2.3") {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+)
+
+// ValidateConfig checks a complete configuration for settings the agent
+// would refuse to start with, and returns every problem found. Only the
+// configuration itself is checked, so files and network interfaces that
+// are missing from this host are not reported.
+func ValidateConfig(config *Config) []error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if config.RequireNodeName && config.NodeName == "" {
+		fail("A node name is required, set one with -node or 'node_name'")
+	}
+	switch config.NodeNameScheme {
+	case "", nodeNameHostname, nodeNameHostnameSuffix, nodeNameUUID:
+	default:
+		fail("Unknown node name scheme '%s', must be one of %s, %s or %s", config.NodeNameScheme,
+			nodeNameHostname, nodeNameHostnameSuffix, nodeNameUUID)
+	}
+
+	// Check the addresses can be parsed
+	if _, _, err := config.AddrParts(config.BindAddr); err != nil {
+		fail("Invalid bind address: %s", err)
+	}
+	if config.AdvertiseAddr != "" {
+		if _, _, err := config.AdvertiseAddrParts(); err != nil {
+			fail("Invalid advertise address: %s", err)
+		}
+	}
+	rpcAddrs := make(map[string]bool)
+	for _, addr := range config.RPCAddrs() {
+		if strings.HasPrefix(addr, unixSocketPrefix) {
+			if addr == unixSocketPrefix {
+				fail("Missing path for Unix socket RPC address %q", addr)
+			}
+		} else if _, _, err := net.SplitHostPort(addr); err != nil {
+			fail("Invalid RPC address: %s", err)
+		}
+		if rpcAddrs[addr] {
+			fail("Duplicate RPC address %q", addr)
+		}
+		rpcAddrs[addr] = true
+	}
+	if config.HTTPAddr != "" {
+		if _, _, err := net.SplitHostPort(config.HTTPAddr); err != nil {
+			fail("Invalid HTTP address: %s", err)
+		}
+	}
+
+	for _, script := range config.EventScripts() {
+		if !script.Valid() {
+			fail("Invalid event script: %s", script.String())
+		}
+	}
+	if config.EventHandlerConcurrency < 0 {
+		fail("Event handler concurrency can't be negative")
+	}
+	if config.EventHandlerTimeout < 0 {
+		fail("Event handler timeout can't be negative")
+	}
+	for _, plugin := range config.EventPluginScripts() {
+		if !plugin.Valid() || plugin.Format != "" || plugin.Script == "" ||
+			plugin.Concurrency != 0 {
+			fail("Invalid event plugin: %s", plugin.String())
+		}
+	}
+
+	// Check the encryption key now, rather than failing later in memberlist
+	if config.EncryptKey != "" {
+		key, err := config.EncryptBytes()
+		if err == nil {
+			err = memberlist.ValidateKey(key)
+		}
+		if err != nil {
+			fail("Invalid encryption key: %s. Use 'serf keygen' to generate a valid key.", err)
+		}
+		if config.KeyringFile != "" {
+			fail("Encryption key not allowed while using a keyring")
+		}
+	}
+
+	// A rotated key must survive restarts, which only the keyring file does
+	if config.KeyRotateInterval != 0 {
+		if config.KeyringFile == "" {
+			fail("Key rotation requires a keyring file")
+		}
+		if config.KeyRotateInterval < minKeyRotateInterval {
+			fail("Key rotation interval must be at least %v", minKeyRotateInterval)
+		}
+	}
+
+	if (config.RPCTLSCert != "" || config.RPCTLSKey != "" || config.RPCTLSCA != "") &&
+		(config.RPCTLSCert == "" || config.RPCTLSKey == "") {
+		fail("Both a certificate and a key are required for RPC TLS")
+	}
+	if config.RPCMaxConns < 0 {
+		fail("RPC max conns can't be negative")
+	}
+	if config.RPCIdleTimeout < 0 || config.RPCReadTimeout < 0 || config.RPCWriteTimeout < 0 {
+		fail("RPC timeouts can't be negative")
+	}
+	if config.RPCKeepAlive < 0 {
+		fail("RPC keepalive can't be negative")
+	}
+
+	if config.Protocol < int(serf.ProtocolVersionMin) || config.Protocol > int(serf.ProtocolVersionMax) {
+		fail("Unsupported protocol version %d. Must be in range: [%d, %d]",
+			config.Protocol, serf.ProtocolVersionMin, serf.ProtocolVersionMax)
+	}
+
+	// Check the profile, and the gossip timing settings applied to it
+	if ml, err := profileMemberlistConfig(config.Profile); err != nil {
+		errs = append(errs, err)
+	} else if err := applyGossipTiming(config, ml); err != nil {
+		errs = append(errs, err)
+	}
+
+	if config.CoalescePeriod < 0 || config.QuiescentPeriod < 0 ||
+		config.UserCoalescePeriod < 0 || config.UserQuiescentPeriod < 0 {
+		fail("Coalesce and quiescent periods can't be negative")
+	}
+
+	if config.QueryResponseSizeLimit <= 0 || config.QuerySizeLimit <= 0 || config.UserEventSizeLimit <= 0 {
+		fail("Query and user event size limits must be positive")
+	}
+	if config.UserEventSizeLimit > serf.UserEventSizeLimit {
+		fail("User event size limit %d exceeds the maximum of %d bytes",
+			config.UserEventSizeLimit, serf.UserEventSizeLimit)
+	}
+
+	if config.EventBuffer < 0 || config.QueryBuffer < 0 {
+		fail("Event and query buffer sizes can't be negative")
+	}
+
+	if config.UserEventRateLimit < 0 || config.QueryRateLimit < 0 || config.RateLimitInterval < 0 {
+		fail("Rate limit settings can't be negative")
+	}
+
+	if config.ReconnectInterval < 0 || config.ReconnectTimeout < 0 || config.ReconnectMaxAttempts < 0 ||
+		config.TombstoneTimeout < 0 || config.ReapInterval < 0 {
+		fail("Reconnect and reap settings can't be negative")
+	}
+
+	if config.HealthCheckScript != "" {
+		if config.HealthCheckInterval <= 0 {
+			fail("Health check interval must be positive")
+		}
+		if _, ok := config.Tags[healthCheckTag]; ok {
+			fail("Tag '%s' is reserved for the health check", healthCheckTag)
+		}
+	}
+
+	if config.GracefulTimeout < 0 {
+		fail("Graceful timeout can't be negative")
+	}
+
+	if config.PartitionFailureRatio < 0 || config.PartitionFailureRatio > 1 {
+		fail("Partition failure ratio must be between 0 and 1")
+	}
+	if config.PartitionWindow < 0 || config.ExpectedClusterSize < 0 {
+		fail("Partition settings can't be negative")
+	}
+
+	filter := LevelFilter()
+	if level := ParseLogLevel(config.LogLevel); !ValidateLevelFilter(level, filter) {
+		fail("Invalid log level: %s. Valid log levels are: %v", level, filter.Levels)
+	}
+
+	if config.LogRotateBytes < 0 || config.LogRotateMaxFiles < 0 {
+		fail("Log rotation settings can't be negative")
+	}
+
+	if config.EnableSyslog && !validSyslogFacility(config.SyslogFacility) {
+		fail("Invalid syslog facility: %s", config.SyslogFacility)
+	}
+
+	return errs
+}
@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateConfig(t *testing.T) {
+	if errs := ValidateConfig(DefaultConfig()); len(errs) != 0 {
+		t.Fatalf("bad: %v", errs)
+	}
+
+	// Plugins may have their own timeout
+	valid := DefaultConfig()
+	valid.EventPlugins = []string{"[timeout=5s]plugin"}
+	if errs := ValidateConfig(valid); len(errs) != 0 {
+		t.Fatalf("bad: %v", errs)
+	}
+
+	cases := []struct {
+		name   string
+		modify func(c *Config)
+		err    string
+	}{
+		{"node name", func(c *Config) { c.RequireNodeName = true }, "node name is required"},
+		{"advertise", func(c *Config) { c.AdvertiseAddr = "0.0.0.0" }, "Invalid advertise address"},
+		{"rpc", func(c *Config) { c.RPCAddr = "127.0.0.1" }, "Invalid RPC address"},
+		{"rpc unix", func(c *Config) { c.RPCAddr = unixSocketPrefix }, "Missing path"},
+		{"rpc extra", func(c *Config) { c.RPCExtraAddrs = []string{"localhost"} }, "Invalid RPC address"},
+		{"rpc duplicate", func(c *Config) { c.RPCExtraAddrs = []string{c.RPCAddr} }, "Duplicate RPC address"},
+		{"http", func(c *Config) { c.HTTPAddr = "localhost" }, "Invalid HTTP address"},
+		{"keyring", func(c *Config) {
+			c.EncryptKey = "pUqJrVyVRj5jsiYEkM/tFQYfWyJIv4s3XkvDwy7Cu5s="
+			c.KeyringFile = "keyring.json"
+		}, "not allowed while using a keyring"},
+		{"tls", func(c *Config) { c.RPCTLSCert = "cert.pem" }, "Both a certificate and a key"},
+		{"log level", func(c *Config) { c.LogLevel = "loud" }, "Invalid log level"},
+		{"health check interval", func(c *Config) {
+			c.HealthCheckScript = "check.sh"
+			c.HealthCheckInterval = 0
+		}, "Health check interval"},
+		{"health check tag", func(c *Config) {
+			c.HealthCheckScript = "check.sh"
+			c.Tags = map[string]string{"status": "up"}
+		}, "reserved for the health check"},
+		{"key rotation keyring", func(c *Config) { c.KeyRotateInterval = time.Hour }, "requires a keyring file"},
+		{"key rotation interval", func(c *Config) {
+			c.KeyringFile = "keyring.json"
+			c.KeyRotateInterval = time.Second
+		}, "at least"},
+		{"graceful timeout", func(c *Config) { c.GracefulTimeout = -time.Second }, "Graceful timeout"},
+		{"partition ratio", func(c *Config) { c.PartitionFailureRatio = 1.5 }, "between 0 and 1"},
+		{"partition size", func(c *Config) { c.ExpectedClusterSize = -3 }, "Partition settings"},
+		{"event handler", func(c *Config) { c.EventHandlers = []string{"[timeout=soon]foo.sh"} }, "Invalid event script"},
+		{"event handler concurrency", func(c *Config) { c.EventHandlerConcurrency = -1 }, "Event handler concurrency"},
+		{"event handler timeout", func(c *Config) { c.EventHandlerTimeout = -time.Second }, "Event handler timeout"},
+		{"node name scheme", func(c *Config) { c.NodeNameScheme = "random" }, "Unknown node name scheme"},
+		{"reconnect attempts", func(c *Config) { c.ReconnectMaxAttempts = -1 }, "Reconnect and reap"},
+		{"rpc max conns", func(c *Config) { c.RPCMaxConns = -1 }, "RPC max conns"},
+		{"rpc timeout", func(c *Config) { c.RPCWriteTimeout = -time.Second }, "RPC timeouts"},
+		{"rpc keepalive", func(c *Config) { c.RPCKeepAlive = -time.Second }, "RPC keepalive"},
+		{"event plugin concurrency", func(c *Config) { c.EventPlugins = []string{"[concurrency=2]plugin"} }, "Invalid event plugin"},
+	}
+	for _, tc := range cases {
+		config := DefaultConfig()
+		tc.modify(config)
+		errs := ValidateConfig(config)
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), tc.err) {
+			t.Fatalf("%s: bad: %v", tc.name, errs)
+		}
+	}
+
+	// Every problem is reported, not just the first
+	config := DefaultConfig()
+	config.Protocol = 99
+	config.Profile = "moon"
+	config.EventBuffer = -1
+	if errs := ValidateConfig(config); len(errs) != 3 {
+		t.Fatalf("bad: %v", errs)
+	}
+}
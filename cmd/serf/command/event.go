@@ -7,12 +7,14 @@ import (
 	"flag"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/hashicorp/serf/client"
 	"github.com/mitchellh/cli"
 )
 
-// EventCommand is a Command implementation that queries a running
-// Serf agent what members are part of the cluster currently.
+// EventCommand is a Command implementation that dispatches a custom
+// user event across the cluster through a running Serf agent.
 type EventCommand struct {
 	Ui cli.Ui
 }
@@ -31,6 +33,11 @@ Options:
                             that repeated events of the same name within a
                             short period of time are ignored, except the last
                             one received. Default is true.
+  -count=1                  Number of times to fire the event. This is meant
+                            for load testing gossip propagation only, and
+                            should not be used against production clusters.
+  -interval=0s              Time to wait between each fire when -count is
+                            more than one.
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
   -rpc-auth=""              RPC auth token of the Serf agent.
 `
@@ -39,10 +46,14 @@ Options:
 
 func (c *EventCommand) Run(args []string) int {
 	var coalesce bool
+	var count int
+	var interval time.Duration
 
 	cmdFlags := flag.NewFlagSet("event", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
 	cmdFlags.BoolVar(&coalesce, "coalesce", true, "coalesce")
+	cmdFlags.IntVar(&count, "count", 1, "number of times to fire")
+	cmdFlags.DurationVar(&interval, "interval", 0, "interval between fires")
 	rpcAddr := RPCAddrFlag(cmdFlags)
 	rpcAuth := RPCAuthFlag(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
@@ -62,6 +73,11 @@ func (c *EventCommand) Run(args []string) int {
 		return 1
 	}
 
+	if count < 1 {
+		c.Ui.Error("The -count must be at least 1.")
+		return 1
+	}
+
 	event := args[0]
 	var payload []byte
 	if len(args) == 2 {
@@ -75,6 +91,10 @@ func (c *EventCommand) Run(args []string) int {
 	}
 	defer client.Close()
 
+	if count > 1 {
+		return c.fireRepeatedly(client, event, payload, coalesce, count, interval)
+	}
+
 	if err := client.UserEvent(event, payload, coalesce); err != nil {
 		c.Ui.Error(fmt.Sprintf("Error sending event: %s", err))
 		return 1
@@ -85,6 +105,42 @@ func (c *EventCommand) Run(args []string) int {
 	return 0
 }
 
+// fireRepeatedly dispatches the same event count times for load testing,
+// then reports the aggregate timing. Each fire goes through the agent, so
+// the event size limit is checked every time.
+func (c *EventCommand) fireRepeatedly(rpcClient *client.RPCClient, event string, payload []byte,
+	coalesce bool, count int, interval time.Duration) int {
+	c.Ui.Warn(fmt.Sprintf("WARNING: Firing event '%s' %d times. This is a load "+
+		"testing tool and will flood the cluster with gossip!", event, count))
+
+	// The average only covers the dispatches, not the sleeps between them
+	start := time.Now()
+	var dispatching, slowest time.Duration
+	for i := 0; i < count; i++ {
+		if i > 0 && interval > 0 {
+			time.Sleep(interval)
+		}
+
+		fireStart := time.Now()
+		if err := rpcClient.UserEvent(event, payload, coalesce); err != nil {
+			c.Ui.Error(fmt.Sprintf("Error sending event %d of %d: %s", i+1, count, err))
+			return 1
+		}
+		d := time.Since(fireStart)
+		dispatching += d
+		if d > slowest {
+			slowest = d
+		}
+	}
+	total := time.Since(start)
+
+	c.Ui.Output(fmt.Sprintf("Event '%s' dispatched %d times in %v! Coalescing enabled: %#v",
+		event, count, total, coalesce))
+	c.Ui.Output(fmt.Sprintf("Average dispatch: %v, slowest dispatch: %v",
+		dispatching/time.Duration(count), slowest))
+	return 0
+}
+
 func (c *EventCommand) Synopsis() string {
 	return "Send a custom event through the Serf cluster"
 }
@@ -4,9 +4,13 @@
 package command
 
 import (
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
 	"github.com/mitchellh/cli"
 )
 
@@ -39,3 +43,135 @@ func TestEventCommandRun_tooMany(t *testing.T) {
 		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
 	}
 }
+
+func TestEventCommandRun(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &EventCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "deploy", "foo"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if !strings.Contains(ui.OutputWriter.String(), "Event 'deploy' dispatched! Coalescing enabled: true") {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	retry.Run(t, func(r *retry.R) {
+		if n := a1.EventCounts()["user"]; n != 1 {
+			r.Fatalf("bad: %d", n)
+		}
+	})
+}
+
+func TestEventCommandRun_count(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &EventCommand{Ui: ui}
+	args := []string{
+		"-rpc-addr=" + rpcAddr,
+		"-coalesce=false",
+		"-count=5",
+		"-interval=100ms",
+		"deploy",
+		"foo",
+	}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "load testing tool") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+	if !strings.Contains(ui.OutputWriter.String(), "dispatched 5 times") {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	// The average leaves out the interval slept between fires
+	m := regexp.MustCompile(`Average dispatch: (\S+),`).FindStringSubmatch(ui.OutputWriter.String())
+	if m == nil {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+	if avg, err := time.ParseDuration(m[1]); err != nil || avg >= 50*time.Millisecond {
+		t.Fatalf("bad: %v %v", m[1], err)
+	}
+
+	retry.Run(t, func(r *retry.R) {
+		if n := a1.EventCounts()["user"]; n != 5 {
+			r.Fatalf("bad: %d", n)
+		}
+	})
+}
+
+func TestEventCommandRun_countSizeLimit(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &EventCommand{Ui: ui}
+	args := []string{
+		"-rpc-addr=" + rpcAddr,
+		"-count=3",
+		"deploy",
+		strings.Repeat("x", 1024),
+	}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "Error sending event 1 of 3") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestEventCommandRun_badCount(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &EventCommand{Ui: ui}
+	args := []string{"-rpc-addr=foo", "-count=0", "deploy"}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "-count") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
@@ -22,7 +22,7 @@ var _ cli.Command = &ForceLeaveCommand{}
 func (c *ForceLeaveCommand) Run(args []string) int {
 	var prune bool
 
-	cmdFlags := flag.NewFlagSet("join", flag.ContinueOnError)
+	cmdFlags := flag.NewFlagSet("force-leave", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
 	cmdFlags.BoolVar(&prune, "prune", false, "Remove agent forcibly from list of members")
 	rpcAddr := RPCAddrFlag(cmdFlags)
@@ -48,20 +48,15 @@ func (c *ForceLeaveCommand) Run(args []string) int {
 
 	if prune {
 		err = client.ForceLeavePrune(nodes[0])
-		if err != nil {
-			c.Ui.Error(fmt.Sprintf("Error force leaving: %s", err))
-			return 1
-		}
-		return 0
-
+	} else {
+		err = client.ForceLeave(nodes[0])
 	}
-
-	err = client.ForceLeave(nodes[0])
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error force leaving: %s", err))
 		return 1
 	}
 
+	c.Ui.Output(fmt.Sprintf("Force leave of '%s' complete", nodes[0]))
 	return 0
 }
 
@@ -68,6 +68,10 @@ WAIT:
 		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
 	}
 
+	if !strings.Contains(ui.OutputWriter.String(), "Force leave of '"+a2.SerfConfig().NodeName+"' complete") {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
 	m = a1.Serf().Members()
 	if len(m) != 2 {
 		t.Fatalf("should have 2 members: %#v", a1.Serf().Members())
@@ -8,8 +8,10 @@ import (
 	"flag"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/hashicorp/serf/client"
 	"github.com/mitchellh/cli"
 )
 
@@ -55,9 +57,20 @@ func (i *InfoCommand) Run(args []string) int {
 		i.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
 		return 1
 	}
-	defer client.Close()
-
-	stats, err := client.Stats()
+	defer func() { client.Close() }()
+
+	var stats map[string]map[string]string
+	self, err := client.Self()
+	if err == nil {
+		stats = selfStats(self)
+	} else if strings.Contains(err.Error(), unsupportedCommand) {
+		// Older agents only answer stats, and close the connection after a
+		// command they don't know
+		client.Close()
+		if client, err = RPCClient(*rpcAddr, *rpcAuth); err == nil {
+			stats, err = client.Stats()
+		}
+	}
 	if err != nil {
 		i.Ui.Error(fmt.Sprintf("Error querying agent: %s", err))
 		return 1
@@ -77,6 +90,34 @@ func (i *InfoCommand) Synopsis() string {
 	return "Provides debugging information for operators"
 }
 
+// unsupportedCommand is the error an agent answers a command it doesn't
+// know with
+const unsupportedCommand = "Unsupported command"
+
+// selfStats adds the config, versions and coordinate of the agent to its
+// stats, as sections of their own
+func selfStats(self *client.Self) map[string]map[string]string {
+	stats := self.Stats
+	stats["config"] = self.Config
+	stats["versions"] = map[string]string{
+		"version":      self.Versions.Version,
+		"protocol":     strconv.Itoa(int(self.Versions.Protocol)),
+		"protocol_min": strconv.Itoa(int(self.Versions.ProtocolMin)),
+		"protocol_max": strconv.Itoa(int(self.Versions.ProtocolMax)),
+		"go_version":   self.Versions.GoVersion,
+	}
+	if self.HasCoord {
+		coord := self.Coord
+		stats["coordinate"] = map[string]string{
+			"vec":        fmt.Sprintf("%v", coord.Vec),
+			"error":      strconv.FormatFloat(coord.Error, 'f', -1, 64),
+			"adjustment": strconv.FormatFloat(coord.Adjustment, 'f', -1, 64),
+			"height":     strconv.FormatFloat(coord.Height, 'f', -1, 64),
+		}
+	}
+	return stats
+}
+
 type StatsContainer map[string]map[string]string
 
 func (s StatsContainer) String() string {
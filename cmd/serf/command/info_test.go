@@ -4,6 +4,7 @@
 package command
 
 import (
+	"encoding/json"
 	"strings"
 	"testing"
 
@@ -37,3 +38,36 @@ func TestInfoCommandRun(t *testing.T) {
 		t.Fatalf("bad: %#v", ui.OutputWriter.String())
 	}
 }
+
+func TestInfoCommandRun_formatJSON(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &InfoCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-format=json"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	var stats map[string]map[string]string
+	if err := json.Unmarshal(ui.OutputWriter.Bytes(), &stats); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, section := range []string{"agent", "runtime", "serf", "memberlist", "config", "versions", "coordinate"} {
+		if len(stats[section]) == 0 {
+			t.Fatalf("missing section %q: %#v", section, stats)
+		}
+	}
+}
@@ -28,7 +28,8 @@ Usage: serf join [options] address ...
 
 Options:
 
-  -replay                   Replay past user events.
+  -replay                   Replay past user events. By default, user events
+                            sent before the join are ignored.
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
   -rpc-auth=""              RPC auth token of the Serf agent.
 `
@@ -68,8 +69,12 @@ func (c *JoinCommand) Run(args []string) int {
 		return 1
 	}
 
+	nodes := "nodes"
+	if n == 1 {
+		nodes = "node"
+	}
 	c.Ui.Output(fmt.Sprintf(
-		"Successfully joined cluster by contacting %d nodes.", n))
+		"Successfully joined cluster by contacting %d %s.", n, nodes))
 	return 0
 }
 
@@ -45,6 +45,41 @@ func TestJoinCommandRun(t *testing.T) {
 	if len(a1.Serf().Members()) != 2 {
 		t.Fatalf("bad: %#v", a1.Serf().Members())
 	}
+
+	if !strings.Contains(ui.OutputWriter.String(), "by contacting 1 node.") {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+}
+
+func TestJoinCommandRun_fail(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	ip3, returnFn3 := testutil.TakeIP()
+	defer returnFn3()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	// Nothing is listening on the address we join
+	ui := new(cli.MockUi)
+	c := &JoinCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, ip3.String()}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "Error joining the cluster") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
 }
 
 func TestJoinCommandRun_noAddrs(t *testing.T) {
@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/mitchellh/cli"
@@ -21,16 +22,13 @@ type KeygenCommand struct {
 var _ cli.Command = &KeygenCommand{}
 
 func (c *KeygenCommand) Run(_ []string) int {
+	// A single Read may return fewer bytes than asked for, so keep
+	// reading until the key is full
 	key := make([]byte, 32)
-	n, err := rand.Reader.Read(key)
-	if err != nil {
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
 		c.Ui.Error(fmt.Sprintf("Error reading random data: %s", err))
 		return 1
 	}
-	if n != 32 {
-		c.Ui.Error(fmt.Sprintf("Couldn't read enough entropy. Generate more entropy!"))
-		return 1
-	}
 
 	c.Ui.Output(base64.StdEncoding.EncodeToString(key))
 	return 0
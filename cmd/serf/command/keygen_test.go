@@ -7,6 +7,7 @@ import (
 	"encoding/base64"
 	"testing"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/mitchellh/cli"
 )
 
@@ -27,4 +28,17 @@ func TestKeygenCommand(t *testing.T) {
 	if len(result) != 32 {
 		t.Fatalf("bad: %#v", result)
 	}
+	if err := memberlist.ValidateKey(result); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Every run generates a new key
+	ui2 := new(cli.MockUi)
+	c = &KeygenCommand{Ui: ui2}
+	if code := c.Run(nil); code != 0 {
+		t.Fatalf("bad: %d", code)
+	}
+	if ui2.OutputWriter.String() == output {
+		t.Fatalf("bad: %s", output)
+	}
 }
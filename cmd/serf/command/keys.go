@@ -6,6 +6,7 @@ package command
 import (
 	"flag"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/mitchellh/cli"
@@ -60,7 +61,6 @@ Options:
 
 func (c *KeysCommand) Run(args []string) int {
 	var installKey, useKey, removeKey string
-	var lines []string
 	var listKeys bool
 
 	cmdFlags := flag.NewFlagSet("key", flag.ContinueOnError)
@@ -110,13 +110,7 @@ func (c *KeysCommand) Run(args []string) int {
 		keys, total, failures, err := client.ListKeys()
 
 		if err != nil {
-			if len(failures) > 0 {
-				for node, message := range failures {
-					lines = append(lines, fmt.Sprintf("failed: | %s | %s", node, message))
-				}
-				out := columnize.SimpleFormat(lines)
-				c.Ui.Error(out)
-			}
+			c.reportFailures(failures)
 
 			c.Ui.Error("")
 			c.Ui.Error(fmt.Sprintf("Failed to gather member keys: %s", err))
@@ -126,9 +120,11 @@ func (c *KeysCommand) Run(args []string) int {
 		c.Ui.Info("Keys gathered, listing cluster keys...")
 		c.Ui.Output("")
 
+		var lines []string
 		for key, num := range keys {
 			lines = append(lines, fmt.Sprintf("%s | [%d/%d]", key, num, total))
 		}
+		sort.Strings(lines)
 		out := columnize.SimpleFormat(lines)
 		c.Ui.Output(out)
 
@@ -138,13 +134,7 @@ func (c *KeysCommand) Run(args []string) int {
 	if installKey != "" {
 		c.Ui.Info("Installing key on all members...")
 		if failures, err := client.InstallKey(installKey); err != nil {
-			if len(failures) > 0 {
-				for node, message := range failures {
-					lines = append(lines, fmt.Sprintf("failed: | %s | %s", node, message))
-				}
-				out := columnize.SimpleFormat(lines)
-				c.Ui.Error(out)
-			}
+			c.reportFailures(failures)
 			c.Ui.Error("")
 			c.Ui.Error(fmt.Sprintf("Error installing key: %s", err))
 			return 1
@@ -156,13 +146,7 @@ func (c *KeysCommand) Run(args []string) int {
 	if useKey != "" {
 		c.Ui.Info("Changing primary key on all members...")
 		if failures, err := client.UseKey(useKey); err != nil {
-			if len(failures) > 0 {
-				for node, message := range failures {
-					lines = append(lines, fmt.Sprintf("failed: | %s | %s", node, message))
-				}
-				out := columnize.SimpleFormat(lines)
-				c.Ui.Error(out)
-			}
+			c.reportFailures(failures)
 			c.Ui.Error("")
 			c.Ui.Error(fmt.Sprintf("Error changing primary key: %s", err))
 			return 1
@@ -174,13 +158,7 @@ func (c *KeysCommand) Run(args []string) int {
 	if removeKey != "" {
 		c.Ui.Info("Removing key on all members...")
 		if failures, err := client.RemoveKey(removeKey); err != nil {
-			if len(failures) > 0 {
-				for node, message := range failures {
-					lines = append(lines, fmt.Sprintf("failed: | %s | %s", node, message))
-				}
-				out := columnize.SimpleFormat(lines)
-				c.Ui.Error(out)
-			}
+			c.reportFailures(failures)
 			c.Ui.Error("")
 			c.Ui.Error(fmt.Sprintf("Error removing key: %s", err))
 			return 1
@@ -193,6 +171,21 @@ func (c *KeysCommand) Run(args []string) int {
 	return 0
 }
 
+// reportFailures outputs the nodes that failed a key operation, along with
+// their error messages, sorted by node name.
+func (c *KeysCommand) reportFailures(failures map[string]string) {
+	if len(failures) == 0 {
+		return
+	}
+
+	var lines []string
+	for node, message := range failures {
+		lines = append(lines, fmt.Sprintf("failed: | %s | %s", node, message))
+	}
+	sort.Strings(lines)
+	c.Ui.Error(columnize.SimpleFormat(lines))
+}
+
 func (c *KeysCommand) Synopsis() string {
 	return "Manipulate the internal encryption keyring used by Serf"
 }
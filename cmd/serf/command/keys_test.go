@@ -348,6 +348,12 @@ func TestKeysCommandRun_ListKeys(t *testing.T) {
 	if !strings.Contains(ui.OutputWriter.String(), "WbL6oaTPom+7RG7Q/INbJWKy09OLar/Hf2SuOAdoQE4=") {
 		t.Fatalf("missing expected key")
 	}
+
+	// Keys are listed in a stable order
+	out := ui.OutputWriter.String()
+	if strings.Index(out, "WbL6") > strings.Index(out, "ZWTL") {
+		t.Fatalf("keys not sorted: %s", out)
+	}
 }
 
 func TestKeysCommandRun_ListKeysFailure(t *testing.T) {
@@ -42,6 +42,15 @@ func (c *LeaveCommand) Run(args []string) int {
 		return 1
 	}
 
+	// A node name here most likely means force-leave was intended, and
+	// leaving with the local agent instead would be a nasty surprise
+	if len(cmdFlags.Args()) > 0 {
+		c.Ui.Error("The leave command takes no arguments. Use 'serf force-leave' to remove another node.")
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+
 	client, err := RPCClient(*rpcAddr, *rpcAuth)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
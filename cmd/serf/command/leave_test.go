@@ -7,7 +7,9 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/hashicorp/serf/serf"
 	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
 	"github.com/mitchellh/cli"
 )
 
@@ -36,4 +38,26 @@ func TestLeaveCommandRun(t *testing.T) {
 	if !strings.Contains(ui.OutputWriter.String(), "leave complete") {
 		t.Fatalf("bad: %#v", ui.OutputWriter.String())
 	}
+
+	// The agent shuts down after responding
+	retry.Run(t, func(r *retry.R) {
+		if state := a1.Serf().State(); state != serf.SerfShutdown {
+			r.Fatalf("bad: %v", state)
+		}
+	})
+}
+
+func TestLeaveCommandRun_args(t *testing.T) {
+	ui := new(cli.MockUi)
+	c := &LeaveCommand{Ui: ui}
+	args := []string{"-rpc-addr=foo", "node1"}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "serf force-leave") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
 }
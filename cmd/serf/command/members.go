@@ -4,11 +4,16 @@
 package command
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"text/template"
+	"time"
 
+	"github.com/hashicorp/serf/client"
 	"github.com/hashicorp/serf/cmd/serf/command/agent"
 	"github.com/mitchellh/cli"
 	"github.com/ryanuber/columnize"
@@ -17,22 +22,28 @@ import (
 // MembersCommand is a Command implementation that queries a running
 // Serf agent what members are part of the cluster currently.
 type MembersCommand struct {
-	Ui cli.Ui
+	ShutdownCh <-chan struct{}
+	Ui         cli.Ui
 }
 
 var _ cli.Command = &MembersCommand{}
 
+// memberEvents is the event stream filter for the events that change the
+// member list, which are watched for with -watch.
+const memberEvents = "member-join,member-leave,member-failed,member-update,member-reap"
+
 // A container of member details. Maintaining a command-specific struct here
 // makes sense so that the agent.Member struct can evolve without changing the
 // keys in the output interface.
 type Member struct {
-	detail bool
-	Name   string            `json:"name"`
-	Addr   string            `json:"addr"`
-	Port   uint16            `json:"port"`
-	Tags   map[string]string `json:"tags"`
-	Status string            `json:"status"`
-	Proto  map[string]uint8  `json:"protocol"`
+	detail          bool
+	Name            string            `json:"name"`
+	Addr            string            `json:"addr"`
+	Port            uint16            `json:"port"`
+	Tags            map[string]string `json:"tags"`
+	Status          string            `json:"status"`
+	Proto           map[string]uint8  `json:"protocol"`
+	MemberlistProto map[string]uint8  `json:"memberlist_protocol"`
 }
 
 type MemberContainer struct {
@@ -49,12 +60,30 @@ func (c MemberContainer) String() string {
 			line += fmt.Sprintf(
 				"|Protocol Version: %d|Available Protocol Range: [%d, %d]",
 				member.Proto["version"], member.Proto["min"], member.Proto["max"])
+			line += fmt.Sprintf(
+				"|Memberlist Protocol Version: %d|Memberlist Protocol Range: [%d, %d]",
+				member.MemberlistProto["version"], member.MemberlistProto["min"], member.MemberlistProto["max"])
 		}
 		result = append(result, line)
 	}
 	return columnize.SimpleFormat(result)
 }
 
+// renderMembers executes the template once for each member, placing each
+// member's output on its own line.
+func renderMembers(tmpl *template.Template, members []Member) (string, error) {
+	var buf bytes.Buffer
+	for _, member := range members {
+		if err := tmpl.Execute(&buf, member); err != nil {
+			return "", err
+		}
+		if buf.Len() > 0 && buf.Bytes()[buf.Len()-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
 func (c *MembersCommand) Help() string {
 	helpText := `
 Usage: serf members [options]
@@ -63,15 +92,31 @@ Usage: serf members [options]
 
 Options:
 
-  -detailed                 Additional information such as protocol verions
-                            will be shown (only affects text output format).
+  -detailed                 Additional information such as the Serf and
+                            memberlist protocol versions each member speaks
+                            and understands will be shown (only affects text
+                            output format).
 
   -format                   If provided, output is returned in the specified
                             format. Valid formats are 'json', and 'text' (default)
 
+  -template=<template>      If provided, each member is rendered on its own line
+                            through the given Go text/template. The fields
+                            available are .Name, .Addr, .Port, .Status, .Tags,
+                            .Proto and .MemberlistProto. This can't be combined
+                            with -format.
+
+  -changed-within=<duration>
+                            If provided, only members whose status changed within
+                            the given duration, such as "5m", are returned, as seen
+                            by the agent. This helps find flapping members, and can
+                            be combined with the other filters.
+
   -name=<regexp>            If provided, only members matching the regexp are
                             returned. The regexp is anchored at the start and end,
-                            and must be a full match.
+                            and must be a full match. This can be combined with
+                            the tag and status filters, in which case members
+                            must match all of them.
 
   -role=<regexp>            If provided, output is filtered to only nodes matching
                             the regular expression for role
@@ -88,6 +133,11 @@ Options:
                             multiple keys. The regexp is anchored at the start and end,
                             and must be a full match.
 
+  -watch                    If provided, the command keeps running and prints the
+                            members again each time the member list changes,
+                            until it is interrupted. The filters and output
+                            format apply to each listing.
+
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
 
   -rpc-auth=""              RPC auth token of the Serf agent.
@@ -96,8 +146,9 @@ Options:
 }
 
 func (c *MembersCommand) Run(args []string) int {
-	var detailed bool
-	var roleFilter, statusFilter, nameFilter, format string
+	var detailed, watch bool
+	var roleFilter, statusFilter, nameFilter, format, tmplText string
+	var changedWithin time.Duration
 	var tags []string
 	cmdFlags := flag.NewFlagSet("members", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
@@ -105,8 +156,11 @@ func (c *MembersCommand) Run(args []string) int {
 	cmdFlags.StringVar(&roleFilter, "role", "", "role filter")
 	cmdFlags.StringVar(&statusFilter, "status", "", "status filter")
 	cmdFlags.StringVar(&format, "format", "text", "output format")
+	cmdFlags.StringVar(&tmplText, "template", "", "output template")
 	cmdFlags.Var((*agent.AppendSliceValue)(&tags), "tag", "tag filter")
 	cmdFlags.StringVar(&nameFilter, "name", "", "name filter")
+	cmdFlags.DurationVar(&changedWithin, "changed-within", 0, "status change filter")
+	cmdFlags.BoolVar(&watch, "watch", false, "watch for changes")
 	rpcAddr := RPCAddrFlag(cmdFlags)
 	rpcAuth := RPCAuthFlag(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
@@ -119,6 +173,26 @@ func (c *MembersCommand) Run(args []string) int {
 		tags = append(tags, fmt.Sprintf("role=%s", roleFilter))
 	}
 
+	if changedWithin < 0 {
+		c.Ui.Error("Error: -changed-within can't be negative")
+		return 1
+	}
+
+	var tmpl *template.Template
+	if tmplText != "" {
+		if format != "text" {
+			c.Ui.Error("Error: -template can't be used together with -format")
+			return 1
+		}
+
+		var err error
+		tmpl, err = template.New("members").Parse(tmplText)
+		if err != nil {
+			c.Ui.Error(fmt.Sprintf("Error parsing template: %s", err))
+			return 1
+		}
+	}
+
 	reqtags, err := agent.UnmarshalTags(tags)
 	if err != nil {
 		c.Ui.Error(fmt.Sprintf("Error: %s", err))
@@ -132,13 +206,70 @@ func (c *MembersCommand) Run(args []string) int {
 	}
 	defer client.Close()
 
-	members, err := client.MembersFiltered(reqtags, statusFilter, nameFilter)
+	list := func() (string, error) {
+		members, err := client.MembersChangedWithin(reqtags, statusFilter, nameFilter, changedWithin)
+		if err != nil {
+			return "", fmt.Errorf("Error retrieving members: %s", err)
+		}
+		return c.output(members, detailed, tmpl, format)
+	}
+
+	if !watch {
+		output, err := list()
+		if err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+		if output != "" || tmpl == nil {
+			c.Ui.Output(output)
+		}
+		return 0
+	}
+
+	// Start streaming before the first listing, so no change is missed
+	eventCh := make(chan map[string]interface{}, 1024)
+	streamHandle, err := client.Stream(memberEvents, eventCh)
 	if err != nil {
-		c.Ui.Error(fmt.Sprintf("Error retrieving members: %s", err))
+		c.Ui.Error(fmt.Sprintf("Error starting stream: %s", err))
 		return 1
 	}
+	defer client.Stop(streamHandle)
+
+	for {
+		output, err := list()
+		if err != nil {
+			c.Ui.Error(err.Error())
+			return 1
+		}
+		c.Ui.Output(output)
+
+		var event map[string]interface{}
+		select {
+		case event = <-eventCh:
+		case <-c.ShutdownCh:
+			return 0
+		}
+
+		// A burst of changes is listed once, after the events already received
+		for event != nil && len(eventCh) > 0 {
+			event = <-eventCh
+		}
+		if event == nil {
+			c.Ui.Error("Remote side ended the stream! This usually means that the\n" +
+				"remote side has exited or crashed.")
+			return 1
+		}
+		if tmpl != nil || format == "text" {
+			c.Ui.Output("")
+		}
+	}
+}
 
-	result := MemberContainer{}
+// output formats the members the way they are printed, sorted by name.
+func (c *MembersCommand) output(members []client.Member, detailed bool,
+	tmpl *template.Template, format string) (string, error) {
+	// Start with an empty list, so JSON output has no members as [] not null
+	result := MemberContainer{Members: []Member{}}
 
 	for _, member := range members {
 		addr := net.TCPAddr{IP: member.Addr, Port: int(member.Port)}
@@ -155,17 +286,32 @@ func (c *MembersCommand) Run(args []string) int {
 				"max":     member.DelegateMax,
 				"version": member.DelegateCur,
 			},
+			MemberlistProto: map[string]uint8{
+				"min":     member.ProtocolMin,
+				"max":     member.ProtocolMax,
+				"version": member.ProtocolCur,
+			},
 		})
 	}
 
+	// Sort by name so the output is stable between runs
+	sort.Slice(result.Members, func(i, j int) bool {
+		return result.Members[i].Name < result.Members[j].Name
+	})
+
+	if tmpl != nil {
+		output, err := renderMembers(tmpl, result.Members)
+		if err != nil {
+			return "", fmt.Errorf("Error executing template: %s", err)
+		}
+		return output, nil
+	}
+
 	output, err := formatOutput(result, format)
 	if err != nil {
-		c.Ui.Error(fmt.Sprintf("Encoding error: %s", err))
-		return 1
+		return "", fmt.Errorf("Encoding error: %s", err)
 	}
-
-	c.Ui.Output(string(output))
-	return 0
+	return string(output), nil
 }
 
 func (c *MembersCommand) Synopsis() string {
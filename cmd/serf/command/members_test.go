@@ -4,10 +4,16 @@
 package command
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
 	"github.com/mitchellh/cli"
 )
 
@@ -38,6 +44,108 @@ func TestMembersCommandRun(t *testing.T) {
 	}
 }
 
+func TestMembersCommandRun_sorted(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	ip3, returnFn3 := testutil.TakeIP()
+	defer returnFn3()
+
+	ip4, returnFn4 := testutil.TakeIP()
+	defer returnFn4()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	var names []string
+	for _, ip := range []net.IP{ip2, ip3} {
+		a := testAgent(t, ip)
+		defer a.Shutdown()
+
+		name := a.SerfConfig().NodeName
+		if _, err := a1.Join([]string{name + "/" + ip.String()}, false); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		names = append(names, name)
+	}
+	names = append(names, a1.SerfConfig().NodeName)
+	sort.Strings(names)
+
+	rpcAddr, ipc := testIPC(t, ip4, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-template={{.Name}}"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	expected := strings.Join(names, "\n") + "\n"
+	if ui.OutputWriter.String() != expected {
+		t.Fatalf("bad: %#v. Expected: %#v", ui.OutputWriter.String(), expected)
+	}
+}
+
+func TestMembersCommandRun_formatJSON(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-format=json"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	var result MemberContainer
+	if err := json.Unmarshal(ui.OutputWriter.Bytes(), &result); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(result.Members) != 1 {
+		t.Fatalf("bad: %#v", result)
+	}
+	m := result.Members[0]
+	if m.Name != a1.SerfConfig().NodeName || m.Status != "alive" || m.Tags["tag1"] != "foo" {
+		t.Fatalf("bad: %#v", m)
+	}
+	if m.Proto["version"] == 0 || m.Proto["max"] < m.Proto["min"] {
+		t.Fatalf("bad: %#v", m.Proto)
+	}
+	if m.MemberlistProto["version"] == 0 || m.MemberlistProto["max"] < m.MemberlistProto["min"] {
+		t.Fatalf("bad: %#v", m.MemberlistProto)
+	}
+
+	// No matching members is an empty list rather than null
+	ui = new(cli.MockUi)
+	c = &MembersCommand{Ui: ui}
+	args = []string{"-rpc-addr=" + rpcAddr, "-format=json", "-status=failed"}
+
+	code = c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	if !strings.Contains(ui.OutputWriter.String(), `"members": []`) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+}
+
 func TestMembersCommandRun_statusFilter(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -278,3 +386,302 @@ func TestMembersCommandRun_multiTagFilter_failed(t *testing.T) {
 		t.Fatalf("bad: %#v", ui.OutputWriter.String())
 	}
 }
+
+func TestMembersCommandRun_nameFilter(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	args := []string{
+		"-rpc-addr=" + rpcAddr,
+		`-name=127\.0\.0\.[0-9]+`,
+		"-tag=tag1=foo",
+	}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if !strings.Contains(ui.OutputWriter.String(), a1.SerfConfig().NodeName) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	// The name filter is combined with the tag filter
+	ui = new(cli.MockUi)
+	c = &MembersCommand{Ui: ui}
+	args = []string{
+		"-rpc-addr=" + rpcAddr,
+		`-name=127\.0\.0\.[0-9]+`,
+		"-tag=tag1=nomatch",
+	}
+
+	code = c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if strings.Contains(ui.OutputWriter.String(), a1.SerfConfig().NodeName) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+}
+
+func TestMembersCommandRun_nameFilter_invalid(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	args := []string{
+		"-rpc-addr=" + rpcAddr,
+		"-name=web-[0-9",
+	}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d. %#v", code, ui.OutputWriter.String())
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "Invalid regex for name filter") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
+
+func TestMembersCommandRun_detailed(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-detailed"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	local := a1.Serf().LocalMember()
+	for _, expected := range []string{
+		fmt.Sprintf("Protocol Version: %d", local.DelegateCur),
+		fmt.Sprintf("Available Protocol Range: [%d, %d]", local.DelegateMin, local.DelegateMax),
+		fmt.Sprintf("Memberlist Protocol Version: %d", local.ProtocolCur),
+		fmt.Sprintf("Memberlist Protocol Range: [%d, %d]", local.ProtocolMin, local.ProtocolMax),
+	} {
+		if !strings.Contains(ui.OutputWriter.String(), expected) {
+			t.Fatalf("missing %q in: %s", expected, ui.OutputWriter.String())
+		}
+	}
+}
+
+func TestMembersCommandRun_template(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	args := []string{
+		"-rpc-addr=" + rpcAddr,
+		"-template={{.Name}} is {{.Status}} at {{.Addr}}",
+	}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	expected := a1.SerfConfig().NodeName + " is alive at " + ip1.String() + ":"
+	if !strings.HasPrefix(ui.OutputWriter.String(), expected) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+}
+
+func TestMembersCommandRun_templateInvalid(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	cases := map[string]string{
+		"{{.Name":    "Error parsing template",
+		"{{.Bogus}}": "Error executing template",
+	}
+	for tmpl, expected := range cases {
+		ui := new(cli.MockUi)
+		c := &MembersCommand{Ui: ui}
+		args := []string{
+			"-rpc-addr=" + rpcAddr,
+			"-template=" + tmpl,
+		}
+
+		code := c.Run(args)
+		if code != 1 {
+			t.Fatalf("bad: %d", code)
+		}
+
+		if !strings.Contains(ui.ErrorWriter.String(), expected) {
+			t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+		}
+	}
+}
+
+func TestMembersCommandRun_changedWithin(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &MembersCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-changed-within=1h"}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if !strings.Contains(ui.OutputWriter.String(), a1.SerfConfig().NodeName) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	// The time filter is combined with the other filters
+	ui = new(cli.MockUi)
+	c = &MembersCommand{Ui: ui}
+	args = []string{"-rpc-addr=" + rpcAddr, "-changed-within=1h", "-status=failed"}
+
+	code = c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if strings.Contains(ui.OutputWriter.String(), a1.SerfConfig().NodeName) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+
+	// A member that has not changed status within the window is excluded
+	time.Sleep(50 * time.Millisecond)
+	ui = new(cli.MockUi)
+	c = &MembersCommand{Ui: ui}
+	args = []string{"-rpc-addr=" + rpcAddr, "-changed-within=10ms"}
+
+	code = c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	if strings.Contains(ui.OutputWriter.String(), a1.SerfConfig().NodeName) {
+		t.Fatalf("bad: %#v", ui.OutputWriter.String())
+	}
+}
+
+func TestMembersCommandRun_watch(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	ip3, returnFn3 := testutil.TakeIP()
+	defer returnFn3()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	shutdownCh := make(chan struct{})
+	ui := cli.NewMockUi()
+	c := &MembersCommand{ShutdownCh: shutdownCh, Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-watch", "-template={{.Name}} {{.Status}}"}
+
+	resultCh := make(chan int)
+	go func() {
+		resultCh <- c.Run(args)
+	}()
+
+	name1 := a1.SerfConfig().NodeName
+	retry.Run(t, func(r *retry.R) {
+		if out := ui.OutputWriter.String(); out != name1+" alive\n" {
+			r.Fatalf("bad: %#v", out)
+		}
+	})
+
+	// The members are listed again once another node joins
+	a2 := testAgent(t, ip3)
+	defer a2.Shutdown()
+	name2 := a2.SerfConfig().NodeName
+	if _, err := a1.Join([]string{name2 + "/" + ip3.String()}, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	names := []string{name1, name2}
+	sort.Strings(names)
+	expected := names[0] + " alive\n" + names[1] + " alive\n"
+	retry.Run(t, func(r *retry.R) {
+		out := ui.OutputWriter.String()
+		if !strings.HasPrefix(out, name1+" alive\n\n") || !strings.HasSuffix(out, expected) {
+			r.Fatalf("bad: %#v", out)
+		}
+	})
+
+	close(shutdownCh)
+	select {
+	case code := <-resultCh:
+		if code != 0 {
+			t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
@@ -6,6 +6,7 @@ package command
 import (
 	"flag"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 
@@ -13,8 +14,8 @@ import (
 	"github.com/mitchellh/cli"
 )
 
-// MonitorCommand is a Command implementation that queries a running
-// Serf agent what members are part of the cluster currently.
+// MonitorCommand is a Command implementation that streams the logs and
+// events of a running Serf agent.
 type MonitorCommand struct {
 	ShutdownCh <-chan struct{}
 	Ui         cli.Ui
@@ -91,9 +92,16 @@ func (c *MonitorCommand) Run(args []string) int {
 				if event == nil {
 					break OUTER
 				}
+				// Output the fields in a stable order
+				keys := make([]string, 0, len(event))
+				for key := range event {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+
 				c.Ui.Info("Event Info:")
-				for key, val := range event {
-					c.Ui.Info(fmt.Sprintf("\t%s: %#v", key, val))
+				for _, key := range keys {
+					c.Ui.Info(fmt.Sprintf("\t%s: %#v", key, event[key]))
 				}
 			}
 		}
@@ -0,0 +1,89 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package command
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
+	"github.com/mitchellh/cli"
+)
+
+func TestMonitorCommandRun(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	shutdownCh := make(chan struct{})
+	ui := cli.NewMockUi()
+	c := &MonitorCommand{ShutdownCh: shutdownCh, Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-log-level=debug"}
+
+	resultCh := make(chan int)
+	go func() {
+		resultCh <- c.Run(args)
+	}()
+
+	// Events are streamed with their fields in order
+	retry.Run(t, func(r *retry.R) {
+		if err := a1.UserEvent("deploy", []byte("foo"), false); err != nil {
+			r.Fatalf("err: %v", err)
+		}
+		out := ui.OutputWriter.String()
+		if !strings.Contains(out, "Event Info:") {
+			r.Fatalf("bad: %s", out)
+		}
+		if strings.Index(out, "\tLTime:") > strings.Index(out, "\tName:") {
+			r.Fatalf("bad: %s", out)
+		}
+	})
+
+	close(shutdownCh)
+	select {
+	case code := <-resultCh:
+		if code != 0 {
+			t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestMonitorCommandRun_badLogLevel(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &MonitorCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr, "-log-level=loud"}
+
+	code := c.Run(args)
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	if !strings.Contains(ui.ErrorWriter.String(), "Unknown log level") {
+		t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+	}
+}
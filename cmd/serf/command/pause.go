@@ -0,0 +1,72 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package command
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/cli"
+)
+
+// PauseCommand is a Command implementation that instructs
+// the Serf agent to stop actively spreading gossip
+type PauseCommand struct {
+	Ui cli.Ui
+}
+
+var _ cli.Command = &PauseCommand{}
+
+func (c *PauseCommand) Help() string {
+	helpText := `
+Usage: serf pause
+
+  Causes the agent to stop actively spreading gossip, without leaving the
+  cluster. This is meant to reduce the load on a node during maintenance.
+  Events, queries and other messages are queued until the agent is resumed
+  with "serf resume".
+
+  While paused the agent also stops probing other members, gossiping and
+  starting member list syncs, so it won't notice failed members until it
+  is resumed. It still answers the probes of other members, joins in the
+  member list syncs they start, and handles and answers what it receives,
+  so it keeps being seen as healthy.
+
+Options:
+
+  -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+  -rpc-auth=""              RPC auth token of the Serf agent.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *PauseCommand) Run(args []string) int {
+	cmdFlags := flag.NewFlagSet("pause", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcAuth := RPCAuthFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcAuth)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	if err := client.Pause(); err != nil {
+		c.Ui.Error(fmt.Sprintf("Error pausing gossip: %s", err))
+		return 1
+	}
+
+	c.Ui.Output("Gossip paused")
+	return 0
+}
+
+func (c *PauseCommand) Synopsis() string {
+	return "Pauses gossip without leaving the cluster"
+}
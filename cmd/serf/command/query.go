@@ -6,6 +6,7 @@ package command
 import (
 	"flag"
 	"fmt"
+	"regexp"
 	"strings"
 	"time"
 
@@ -62,7 +63,7 @@ func (c *QueryCommand) Run(args []string) int {
 	var timeout time.Duration
 	var format string
 	var relayFactor int
-	cmdFlags := flag.NewFlagSet("event", flag.ContinueOnError)
+	cmdFlags := flag.NewFlagSet("query", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
 	cmdFlags.Var((*agent.AppendSliceValue)(&nodes), "node", "node filter")
 	cmdFlags.Var((*agent.AppendSliceValue)(&tags), "tag", "tag filter")
@@ -101,6 +102,20 @@ func (c *QueryCommand) Run(args []string) int {
 		return 1
 	}
 
+	if timeout < 0 {
+		c.Ui.Error("The -timeout must not be negative")
+		return 1
+	}
+
+	// Check the tag filters here, since nodes silently ignore a query
+	// with a filter they can't compile
+	for tag, expr := range filterTags {
+		if _, err := regexp.Compile(expr); err != nil {
+			c.Ui.Error(fmt.Sprintf("Invalid filter for tag '%s': %s", tag, err))
+			return 1
+		}
+	}
+
 	name := args[0]
 	var payload []byte
 	if len(args) == 2 {
@@ -265,3 +265,34 @@ func TestQueryCommandRun_invalidRelayFactor(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryCommandRun_invalidFilters(t *testing.T) {
+	ui := new(cli.MockUi)
+	{
+		c := &QueryCommand{Ui: ui}
+		args := []string{"-rpc-addr=foo", "-timeout=-1s", "foo"}
+
+		code := c.Run(args)
+		if code != 1 {
+			t.Fatalf("bad: %d", code)
+		}
+
+		if !strings.Contains(ui.ErrorWriter.String(), "-timeout must not be negative") {
+			t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+		}
+	}
+
+	{
+		c := &QueryCommand{Ui: ui}
+		args := []string{"-rpc-addr=foo", "-tag=role=web[", "foo"}
+
+		code := c.Run(args)
+		if code != 1 {
+			t.Fatalf("bad: %d", code)
+		}
+
+		if !strings.Contains(ui.ErrorWriter.String(), "Invalid filter for tag 'role'") {
+			t.Fatalf("bad: %#v", ui.ErrorWriter.String())
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package command
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/serf/client"
+	"github.com/mitchellh/cli"
+	"github.com/ryanuber/columnize"
+)
+
+// QueryVersionsCommand is a Command implementation that asks every member
+// of the cluster which versions it is running and tallies the results.
+type QueryVersionsCommand struct {
+	Ui cli.Ui
+}
+
+var _ cli.Command = &QueryVersionsCommand{}
+
+func (c *QueryVersionsCommand) Help() string {
+	helpText := `
+Usage: serf query-versions [options]
+
+  Asks all members of the cluster which Serf version, protocol version and
+  Go version they are running, and prints how many members run each
+  combination. This is useful to confirm the whole cluster has been upgraded
+  before raising the protocol version.
+
+  Returns 0 if all nodes replied, and 1 otherwise.
+
+Options:
+
+  -format                  If provided, output is returned in the specified
+                           format. Valid formats are 'json', and 'text' (default)
+
+  -rpc-addr=127.0.0.1:7373 RPC address of the Serf agent.
+
+  -rpc-auth=""             RPC auth token of the Serf agent.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *QueryVersionsCommand) Run(args []string) int {
+	var format string
+	cmdFlags := flag.NewFlagSet("query-versions", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&format, "format", "text", "output format")
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcAuth := RPCAuthFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcAuth)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	versions, total, failures, err := client.QueryVersions()
+	if err != nil && len(versions) == 0 {
+		c.Ui.Error(fmt.Sprintf("Error querying versions: %s", err))
+		return 1
+	}
+
+	output, ferr := formatOutput(VersionsContainer{
+		Versions: versions,
+		NumNodes: total,
+	}, format)
+	if ferr != nil {
+		c.Ui.Error(fmt.Sprintf("Encoding error: %s", ferr))
+		return 1
+	}
+	c.Ui.Output(string(output))
+
+	// Report partial results along with what went wrong
+	if err != nil {
+		var lines []string
+		for node, message := range failures {
+			lines = append(lines, fmt.Sprintf("failed: | %s | %s", node, message))
+		}
+		if len(lines) > 0 {
+			sort.Strings(lines)
+			c.Ui.Error(columnize.SimpleFormat(lines))
+		}
+		c.Ui.Error("")
+		c.Ui.Error(fmt.Sprintf("Error querying versions: %s", err))
+		return 1
+	}
+	return 0
+}
+
+func (c *QueryVersionsCommand) Synopsis() string {
+	return "Tallies the versions run by members of the cluster"
+}
+
+// VersionsContainer holds the versions reported by each member, along with
+// the number of members that were expected to respond
+type VersionsContainer struct {
+	Versions map[string]client.NodeVersion `json:"versions"`
+	NumNodes int                           `json:"num_nodes"`
+}
+
+func (v VersionsContainer) String() string {
+	// Count the members running each combination of versions
+	counts := make(map[string]int)
+	for _, version := range v.Versions {
+		line := fmt.Sprintf("%s | protocol %d (%d-%d) | %s",
+			version.Version, version.Protocol, version.ProtocolMin,
+			version.ProtocolMax, version.GoVersion)
+		counts[line]++
+	}
+
+	lines := make([]string, 0, len(counts))
+	for line, num := range counts {
+		lines = append(lines, fmt.Sprintf("%s | [%d/%d]", line, num, v.NumNodes))
+	}
+	sort.Strings(lines)
+	return columnize.SimpleFormat(lines)
+}
@@ -0,0 +1,48 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package command
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/serf/cmd/serf/command/agent"
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+	"github.com/mitchellh/cli"
+)
+
+func TestQueryVersionsCommandRun(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	serfConfig := serf.DefaultConfig()
+	serfConfig.BuildVersion = "1.2.3"
+	a1 := testAgentWithConfig(t, ip1, agent.DefaultConfig(), serfConfig)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui := new(cli.MockUi)
+	c := &QueryVersionsCommand{Ui: ui}
+	args := []string{"-rpc-addr=" + rpcAddr}
+
+	code := c.Run(args)
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+
+	out := ui.OutputWriter.String()
+	if !strings.Contains(out, "1.2.3") || !strings.Contains(out, "protocol 4 (2-6)") {
+		t.Fatalf("bad: %#v", out)
+	}
+	if !strings.Contains(out, runtime.Version()) || !strings.Contains(out, "[1/1]") {
+		t.Fatalf("bad: %#v", out)
+	}
+}
@@ -46,7 +46,7 @@ Options:
 
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
   -rpc-auth=""              RPC auth token of the Serf agent.
-  -verbose                  Verbose mode
+  -verbose                  Verbose mode, showing when each ack arrived
 `
 	return strings.TrimSpace(helpText)
 }
@@ -90,7 +90,7 @@ func (c *ReachabilityCommand) Run(args []string) int {
 	// Start the query
 	params := client.QueryParam{
 		RequestAck: true,
-		Name:       serf.InternalQueryPrefix + "ping",
+		Name:       serf.PingQueryName,
 		AckCh:      ackCh,
 	}
 	if err := cl.Query(&params); err != nil {
@@ -115,7 +115,8 @@ OUTER:
 				break OUTER
 			}
 			if verbose {
-				c.Ui.Output(fmt.Sprintf("\tAck from '%s'", a))
+				elapsed := float64(time.Now().Sub(start)) / float64(time.Second)
+				c.Ui.Output(fmt.Sprintf("\tAck from '%s' after %0.2f sec", a, elapsed))
 			}
 			numAcks++
 			if _, ok := acksFrom[a]; ok {
@@ -4,6 +4,7 @@
 package command
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 
@@ -33,7 +34,8 @@ func TestReachabilityCommand_Run(t *testing.T) {
 		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
 	}
 
-	if !strings.Contains(ui.OutputWriter.String(), a1.SerfConfig().NodeName) {
+	ack := fmt.Sprintf("Ack from '%s' after ", a1.SerfConfig().NodeName)
+	if !strings.Contains(ui.OutputWriter.String(), ack) {
 		t.Fatalf("bad: %#v", ui.OutputWriter.String())
 	}
 	if !strings.Contains(ui.OutputWriter.String(), "Successfully") {
@@ -0,0 +1,64 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package command
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/cli"
+)
+
+// ResumeCommand is a Command implementation that instructs
+// the Serf agent to resume gossip after a pause
+type ResumeCommand struct {
+	Ui cli.Ui
+}
+
+var _ cli.Command = &ResumeCommand{}
+
+func (c *ResumeCommand) Help() string {
+	helpText := `
+Usage: serf resume
+
+  Causes the agent to resume gossip after it was paused with "serf pause".
+  Anything queued while paused is sent out.
+
+Options:
+
+  -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+  -rpc-auth=""              RPC auth token of the Serf agent.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *ResumeCommand) Run(args []string) int {
+	cmdFlags := flag.NewFlagSet("resume", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcAuth := RPCAuthFlag(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcAuth)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		return 1
+	}
+	defer client.Close()
+
+	if err := client.Resume(); err != nil {
+		c.Ui.Error(fmt.Sprintf("Error resuming gossip: %s", err))
+		return 1
+	}
+
+	c.Ui.Output("Gossip resumed")
+	return 0
+}
+
+func (c *ResumeCommand) Synopsis() string {
+	return "Resumes gossip after a pause"
+}
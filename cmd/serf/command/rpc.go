@@ -4,34 +4,85 @@
 package command
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/serf/client"
 )
 
 // RPCAddrFlag returns a pointer to a string that will be populated
 // when the given flagset is parsed with the RPC address of the Serf.
+// The SERF_RPC_ADDR environment variable, if set, is used as the default.
 func RPCAddrFlag(f *flag.FlagSet) *string {
-	defaultRpcAddr := os.Getenv("SERF_RPC_ADDR")
+	defaultRpcAddr := strings.TrimSpace(os.Getenv("SERF_RPC_ADDR"))
 	if defaultRpcAddr == "" {
 		defaultRpcAddr = "127.0.0.1:7373"
 	}
 
 	return f.String("rpc-addr", defaultRpcAddr,
-		"RPC address of the Serf agent")
+		"RPC address of the Serf agent, or unix:///path for a Unix socket (env SERF_RPC_ADDR)")
 }
 
 // RPCAuthFlag returns a pointer to a string that will be populated
 // when the given flagset is parsed with the RPC auth token of the Serf.
+// The SERF_RPC_AUTH environment variable, if set, is used as the default.
 func RPCAuthFlag(f *flag.FlagSet) *string {
-	rpcAuth := os.Getenv("SERF_RPC_AUTH")
+	rpcAuth := strings.TrimSpace(os.Getenv("SERF_RPC_AUTH"))
 	return f.String("rpc-auth", rpcAuth,
-		"RPC auth token of the Serf agent")
+		"RPC auth token of the Serf agent (env SERF_RPC_AUTH)")
 }
 
-// RPCClient returns a new Serf RPC client with the given address.
+// RPCClient returns a new Serf RPC client with the given address. If the
+// agent serves RPC over TLS, the SERF_RPC_TLS_CA environment variable gives
+// the CA to verify it with, and SERF_RPC_TLS_CERT and SERF_RPC_TLS_KEY give
+// the client certificate to present, if the agent requires one.
 func RPCClient(addr, auth string) (*client.RPCClient, error) {
-	config := client.Config{Addr: addr, AuthKey: auth}
+	return rpcClientTimeout(addr, auth, 0)
+}
+
+// rpcClientTimeout is like RPCClient, but gives up on connecting to the
+// agent after timeout. A timeout of zero uses the client default.
+func rpcClientTimeout(addr, auth string, timeout time.Duration) (*client.RPCClient, error) {
+	tlsConfig, err := rpcTLSConfig(os.Getenv("SERF_RPC_TLS_CA"),
+		os.Getenv("SERF_RPC_TLS_CERT"), os.Getenv("SERF_RPC_TLS_KEY"))
+	if err != nil {
+		return nil, err
+	}
+
+	config := client.Config{Addr: addr, AuthKey: auth, TLSConfig: tlsConfig, Timeout: timeout}
 	return client.ClientFromConfig(&config)
 }
+
+// rpcTLSConfig returns the TLS configuration to dial the agent with, or nil
+// if none of the TLS files are given.
+func rpcTLSConfig(ca, cert, key string) (*tls.Config, error) {
+	if ca == "" && cert == "" && key == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read RPC TLS CA: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in RPC TLS CA %s", ca)
+		}
+	}
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load RPC TLS certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,48 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package command
+
+import (
+	"flag"
+	"os"
+	"testing"
+)
+
+func TestRPCFlags_env(t *testing.T) {
+	os.Unsetenv("SERF_RPC_ADDR")
+	os.Unsetenv("SERF_RPC_AUTH")
+
+	f := flag.NewFlagSet("test", flag.ContinueOnError)
+	addr, auth := RPCAddrFlag(f), RPCAuthFlag(f)
+	if err := f.Parse(nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if *addr != "127.0.0.1:7373" || *auth != "" {
+		t.Fatalf("bad: %q %q", *addr, *auth)
+	}
+
+	os.Setenv("SERF_RPC_ADDR", "10.0.0.1:7373\n")
+	os.Setenv("SERF_RPC_AUTH", "secret")
+	defer os.Unsetenv("SERF_RPC_ADDR")
+	defer os.Unsetenv("SERF_RPC_AUTH")
+
+	f = flag.NewFlagSet("test", flag.ContinueOnError)
+	addr, auth = RPCAddrFlag(f), RPCAuthFlag(f)
+	if err := f.Parse(nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if *addr != "10.0.0.1:7373" || *auth != "secret" {
+		t.Fatalf("bad: %q %q", *addr, *auth)
+	}
+
+	// The flags still win over the environment
+	f = flag.NewFlagSet("test", flag.ContinueOnError)
+	addr, auth = RPCAddrFlag(f), RPCAuthFlag(f)
+	if err := f.Parse([]string{"-rpc-addr=10.0.0.2:7373", "-rpc-auth=other"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if *addr != "10.0.0.2:7373" || *auth != "other" {
+		t.Fatalf("bad: %q %q", *addr, *auth)
+	}
+}
@@ -30,6 +30,9 @@ Usage: serf rtt [options] node1 [node2]
 
 Options:
 
+  -format                   If provided, output is returned in the specified
+                            format. Valid formats are 'json', and 'text' (default)
+
   -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
 
   -rpc-auth=""              RPC auth token of the Serf agent.
@@ -38,8 +41,10 @@ Options:
 }
 
 func (c *RTTCommand) Run(args []string) int {
+	var format string
 	cmdFlags := flag.NewFlagSet("rtt", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&format, "format", "text", "output format")
 	rpcAddr := RPCAddrFlag(cmdFlags)
 	rpcAuth := RPCAuthFlag(cmdFlags)
 	if err := cmdFlags.Parse(args); err != nil {
@@ -90,12 +95,38 @@ func (c *RTTCommand) Run(args []string) int {
 		return 1
 	}
 
+	// Agents with different coordinate settings can't be compared.
+	if !coord1.IsCompatibleWith(coord2) {
+		c.Ui.Error(fmt.Sprintf("Coordinates for %q and %q have different dimensions", nodes[0], nodes[1]))
+		return 1
+	}
+
 	// Report the round trip time.
-	dist := fmt.Sprintf("%.3f ms", coord1.DistanceTo(coord2).Seconds()*1000.0)
-	c.Ui.Output(fmt.Sprintf("Estimated %s <-> %s rtt: %s", nodes[0], nodes[1], dist))
+	output, err := formatOutput(RTTContainer{
+		Node1: nodes[0],
+		Node2: nodes[1],
+		RTT:   coord1.DistanceTo(coord2).Seconds() * 1000.0,
+	}, format)
+	if err != nil {
+		c.Ui.Error(fmt.Sprintf("Encoding error: %s", err))
+		return 1
+	}
+	c.Ui.Output(string(output))
 	return 0
 }
 
 func (c *RTTCommand) Synopsis() string {
 	return "Estimates network round trip time between nodes"
 }
+
+// RTTContainer holds the estimated round trip time between two nodes, in
+// milliseconds
+type RTTContainer struct {
+	Node1 string  `json:"node1"`
+	Node2 string  `json:"node2"`
+	RTT   float64 `json:"rtt_ms"`
+}
+
+func (r RTTContainer) String() string {
+	return fmt.Sprintf("Estimated %s <-> %s rtt: %.3f ms", r.Node1, r.Node2, r.RTT)
+}
@@ -4,6 +4,7 @@
 package command
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 	"testing"
@@ -91,6 +92,25 @@ func TestRTTCommand_Run(t *testing.T) {
 		}
 	}
 
+	// JSON output.
+	{
+		ui := new(cli.MockUi)
+		c := &RTTCommand{Ui: ui}
+		code := c.Run([]string{"-rpc-addr=" + rpcAddr, "-format=json", a1.SerfConfig().NodeName})
+		if code != 0 {
+			t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+		}
+
+		var out RTTContainer
+		if err := json.Unmarshal(ui.OutputWriter.Bytes(), &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.Node1 != a1.SerfConfig().NodeName || out.Node2 != a1.SerfConfig().NodeName ||
+			fmt.Sprintf("%.3f ms", out.RTT) != dist_str {
+			t.Fatalf("bad: %#v", out)
+		}
+	}
+
 	// Try an unknown node.
 	args = []string{"nope"}
 	{
@@ -56,18 +56,26 @@ func (c *TagsCommand) Run(args []string) int {
 		return 1
 	}
 
-	client, err := RPCClient(*rpcAddr, *rpcAuth)
+	tags, err := agent.UnmarshalTags(tagPairs)
 	if err != nil {
-		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+		c.Ui.Error(fmt.Sprintf("Error: %s", err))
 		return 1
 	}
-	defer client.Close()
 
-	tags, err := agent.UnmarshalTags(tagPairs)
+	// Setting and deleting the same tag is ambiguous, so refuse it
+	for _, name := range delTags {
+		if _, ok := tags[name]; ok {
+			c.Ui.Error(fmt.Sprintf("Error: Tag '%s' can't be both set and deleted", name))
+			return 1
+		}
+	}
+
+	client, err := RPCClient(*rpcAddr, *rpcAuth)
 	if err != nil {
-		c.Ui.Error(fmt.Sprintf("Error: %s", err))
+		c.Ui.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
 		return 1
 	}
+	defer client.Close()
 
 	if err := client.UpdateTags(tags, delTags); err != nil {
 		c.Ui.Error(fmt.Sprintf("Error setting tags: %s", err))
@@ -68,3 +68,28 @@ func TestTagsCommandRun(t *testing.T) {
 		t.Fatalf("bad: %v", m0.Tags)
 	}
 }
+
+func TestTagsCommandRun_badTags(t *testing.T) {
+	cases := []struct {
+		args   []string
+		expect string
+	}{
+		{[]string{"-set", "a"}, "Invalid tag: 'a'"},
+		{[]string{"-set", "a=1", "-delete", "a"}, "can't be both set and deleted"},
+	}
+
+	for _, tc := range cases {
+		ui := new(cli.MockUi)
+		c := &TagsCommand{Ui: ui}
+		args := append([]string{"-rpc-addr=foo"}, tc.args...)
+
+		code := c.Run(args)
+		if code != 1 {
+			t.Fatalf("args %v bad: %d", tc.args, code)
+		}
+
+		if !strings.Contains(ui.ErrorWriter.String(), tc.expect) {
+			t.Fatalf("args %v bad: %#v", tc.args, ui.ErrorWriter.String())
+		}
+	}
+}
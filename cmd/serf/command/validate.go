@@ -0,0 +1,80 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package command
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/hashicorp/serf/cmd/serf/command/agent"
+	"github.com/mitchellh/cli"
+)
+
+// ValidateCommand is a Command implementation that checks agent
+// configuration files without starting an agent.
+type ValidateCommand struct {
+	Ui cli.Ui
+}
+
+var _ cli.Command = &ValidateCommand{}
+
+func (c *ValidateCommand) Help() string {
+	helpText := `
+Usage: serf validate [options] FILE_OR_DIRECTORY...
+
+  Checks the agent configuration in the given files and directories,
+  read the same way as -config-file and -config-dir, and reports every
+  problem found. Exits non-zero if the configuration is not valid, so
+  configs can be checked before they are deployed.
+
+  Only the configuration is checked: files it refers to and network
+  interfaces are not looked up on this host.
+
+Options:
+
+  -quiet                    Only output errors.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *ValidateCommand) Run(args []string) int {
+	var quiet bool
+	cmdFlags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.BoolVar(&quiet, "quiet", false, "only output errors")
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	paths := cmdFlags.Args()
+	if len(paths) == 0 {
+		c.Ui.Error("At least one config file or directory is required")
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+
+	fileConfig, err := agent.ReadConfigPaths(paths)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		return 1
+	}
+	config := agent.MergeConfig(agent.DefaultConfig(), fileConfig)
+
+	if errs := agent.ValidateConfig(config); len(errs) > 0 {
+		for _, err := range errs {
+			c.Ui.Error(err.Error())
+		}
+		return 1
+	}
+
+	if !quiet {
+		c.Ui.Output("Configuration is valid!")
+	}
+	return 0
+}
+
+func (c *ValidateCommand) Synopsis() string {
+	return "Validates agent configuration files"
+}
@@ -0,0 +1,70 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package command
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/cli"
+)
+
+func TestValidateCommand_implements(t *testing.T) {
+	var _ cli.Command = &ValidateCommand{}
+}
+
+func TestValidateCommand(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	write := func(name, contents string) string {
+		path := filepath.Join(td, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return path
+	}
+	good := write("good.json", `{"node_name": "foo", "bind": "127.0.0.1:7946"}`)
+	bad := write("bad.json", `{"bind": "127.0.0.1:nope", "protocol": 99, "event_handlers": ["nope=foo.sh"]}`)
+	unknown := write("unknown.json", `{"not_a_setting": true}`)
+
+	cases := []struct {
+		args   []string
+		code   int
+		output string
+		errs   []string
+	}{
+		{nil, 1, "", []string{"At least one config file"}},
+		{[]string{good}, 0, "Configuration is valid!", nil},
+		{[]string{"-quiet", good}, 0, "", nil},
+		{[]string{good, bad}, 1, "", []string{
+			"Invalid bind address",
+			"Invalid event script",
+			"Unsupported protocol version 99",
+		}},
+		{[]string{unknown}, 1, "", []string{"not_a_setting"}},
+		{[]string{filepath.Join(td, "missing.json")}, 1, "", []string{"Error reading"}},
+	}
+	for _, tc := range cases {
+		ui := cli.NewMockUi()
+		c := &ValidateCommand{Ui: ui}
+		if code := c.Run(tc.args); code != tc.code {
+			t.Fatalf("%v: bad code %d: %s", tc.args, code, ui.ErrorWriter.String())
+		}
+		if out := strings.TrimSpace(ui.OutputWriter.String()); out != tc.output {
+			t.Fatalf("%v: bad output: %q", tc.args, out)
+		}
+		for _, want := range tc.errs {
+			if !strings.Contains(ui.ErrorWriter.String(), want) {
+				t.Fatalf("%v: missing %q in: %s", tc.args, want, ui.ErrorWriter.String())
+			}
+		}
+	}
+}
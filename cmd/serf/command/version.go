@@ -4,26 +4,113 @@
 package command
 
 import (
+	"flag"
 	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/serf"
 	"github.com/mitchellh/cli"
 )
 
-// VersionCommand is a Command implementation prints the version.
+// versionProbeTimeout is how long the version command tries to reach an
+// agent it wasn't pointed at before showing only the local versions.
+const versionProbeTimeout = 500 * time.Millisecond
+
+// VersionCommand is a Command implementation prints the version, along
+// with the protocol versions supported by this binary and, if one is
+// reachable, by the local agent.
 type VersionCommand struct {
 	Version string
 	UI      cli.Ui
 }
 
 func (c *VersionCommand) Help() string {
-	return ""
+	helpText := `
+Usage: serf version [options]
+
+  Prints the Serf version and the protocol versions it supports. If an
+  agent is reachable over RPC, its version and protocols are shown too,
+  which is useful when planning a rolling upgrade. An agent is only
+  required if -rpc-addr or SERF_RPC_ADDR is set.
+
+Options:
+
+  -rpc-addr=127.0.0.1:7373  RPC address of the Serf agent.
+
+  -rpc-auth=""              RPC auth token of the Serf agent.
+`
+	return strings.TrimSpace(helpText)
 }
 
-func (c *VersionCommand) Run(_ []string) int {
+func (c *VersionCommand) Run(args []string) int {
+	cmdFlags := flag.NewFlagSet("version", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.UI.Output(c.Help()) }
+	rpcAddr := RPCAddrFlag(cmdFlags)
+	rpcAuth := RPCAuthFlag(cmdFlags)
+
+	// "serf -v" and "serf --version" run this command with the flag
+	// still in the arguments
+	var flags []string
+	for _, arg := range args {
+		if arg != "-v" && arg != "--version" {
+			flags = append(flags, arg)
+		}
+	}
+	if err := cmdFlags.Parse(flags); err != nil {
+		return 1
+	}
+
 	c.UI.Output(c.Version)
 	c.UI.Output(fmt.Sprintf("Agent Protocol: %d (Understands back to: %d)",
 		serf.ProtocolVersionMax, serf.ProtocolVersionMin))
+	c.UI.Output(fmt.Sprintf("Memberlist Protocol: %d (Understands back to: %d)",
+		memberlist.ProtocolVersionMax, memberlist.ProtocolVersionMin))
+
+	// The local agent is optional unless we were pointed at one, so only
+	// try it briefly otherwise and don't fail if it isn't running
+	asked := os.Getenv("SERF_RPC_ADDR") != ""
+	cmdFlags.Visit(func(f *flag.Flag) {
+		if f.Name == "rpc-addr" {
+			asked = true
+		}
+	})
+	var timeout time.Duration
+	if !asked {
+		timeout = versionProbeTimeout
+	}
+	client, err := rpcClientTimeout(*rpcAddr, *rpcAuth, timeout)
+	if err != nil {
+		if asked {
+			c.UI.Error(fmt.Sprintf("Error connecting to Serf agent: %s", err))
+			return 1
+		}
+		return 0
+	}
+	defer client.Close()
+
+	c.UI.Output("")
+	stats, err := client.Stats()
+	if err != nil {
+		c.UI.Output(fmt.Sprintf("Local agent at %s: %s", *rpcAddr, err))
+		return 0
+	}
+	name := stats["agent"]["name"]
+	c.UI.Output(fmt.Sprintf("Local agent at %s: %s", *rpcAddr, stats["agent"]["version"]))
+
+	members, err := client.MembersFiltered(nil, "", regexp.QuoteMeta(name))
+	if err != nil || len(members) != 1 {
+		c.UI.Output(fmt.Sprintf("  Unable to get the protocol versions of %s", name))
+		return 0
+	}
+	m := members[0]
+	c.UI.Output(fmt.Sprintf("  Agent Protocol: %d (Understands %d to %d)",
+		m.DelegateCur, m.DelegateMin, m.DelegateMax))
+	c.UI.Output(fmt.Sprintf("  Memberlist Protocol: %d (Understands %d to %d)",
+		m.ProtocolCur, m.ProtocolMin, m.ProtocolMax))
 	return 0
 }
 
@@ -0,0 +1,79 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package command
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/hashicorp/serf/testutil"
+	"github.com/mitchellh/cli"
+)
+
+func TestVersionCommand_implements(t *testing.T) {
+	var _ cli.Command = &VersionCommand{}
+}
+
+func TestVersionCommandRun(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	// Without an agent only this binary's versions are shown
+	ui := new(cli.MockUi)
+	c := &VersionCommand{UI: ui, Version: "Serf v1.2.3"}
+	code := c.Run([]string{"-v"})
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	out := ui.OutputWriter.String()
+	expected := fmt.Sprintf("Agent Protocol: %d (Understands back to: %d)",
+		serf.ProtocolVersionMax, serf.ProtocolVersionMin)
+	if !strings.HasPrefix(out, "Serf v1.2.3\n") || !strings.Contains(out, expected) ||
+		!strings.Contains(out, "Memberlist Protocol:") {
+		t.Fatalf("bad: %s", out)
+	}
+	if strings.Contains(out, "Local agent") {
+		t.Fatalf("bad: %s", out)
+	}
+
+	// An agent asked for by address has to be reachable, but the local
+	// versions are still shown
+	ui = new(cli.MockUi)
+	c = &VersionCommand{UI: ui, Version: "Serf v1.2.3"}
+	code = c.Run([]string{"-rpc-addr=" + ip2.String() + ":11111"})
+	if code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+	if !strings.HasPrefix(ui.OutputWriter.String(), "Serf v1.2.3\n") {
+		t.Fatalf("bad: %s", ui.OutputWriter.String())
+	}
+	if !strings.Contains(ui.ErrorWriter.String(), "Error connecting to Serf agent") {
+		t.Fatalf("bad: %s", ui.ErrorWriter.String())
+	}
+
+	a1 := testAgent(t, ip1)
+	defer a1.Shutdown()
+
+	rpcAddr, ipc := testIPC(t, ip2, a1)
+	defer ipc.Shutdown()
+
+	ui = new(cli.MockUi)
+	c = &VersionCommand{UI: ui, Version: "Serf v1.2.3"}
+	code = c.Run([]string{"-rpc-addr=" + rpcAddr})
+	if code != 0 {
+		t.Fatalf("bad: %d. %#v", code, ui.ErrorWriter.String())
+	}
+	out = ui.OutputWriter.String()
+	member := a1.Serf().LocalMember()
+	expected = fmt.Sprintf("  Agent Protocol: %d (Understands %d to %d)",
+		member.DelegateCur, member.DelegateMin, member.DelegateMax)
+	if !strings.Contains(out, "Local agent at "+rpcAddr) || !strings.Contains(out, expected) {
+		t.Fatalf("bad: %s", out)
+	}
+}
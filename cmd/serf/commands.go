@@ -72,7 +72,8 @@ func init() {
 
 		"members": func() (cli.Command, error) {
 			return &command.MembersCommand{
-				Ui: ui,
+				ShutdownCh: makeShutdownCh(),
+				Ui:         ui,
 			}, nil
 		},
 
@@ -83,12 +84,24 @@ func init() {
 			}, nil
 		},
 
+		"pause": func() (cli.Command, error) {
+			return &command.PauseCommand{
+				Ui: ui,
+			}, nil
+		},
+
 		"tags": func() (cli.Command, error) {
 			return &command.TagsCommand{
 				Ui: ui,
 			}, nil
 		},
 
+		"query-versions": func() (cli.Command, error) {
+			return &command.QueryVersionsCommand{
+				Ui: ui,
+			}, nil
+		},
+
 		"reachability": func() (cli.Command, error) {
 			return &command.ReachabilityCommand{
 				ShutdownCh: makeShutdownCh(),
@@ -96,6 +109,12 @@ func init() {
 			}, nil
 		},
 
+		"resume": func() (cli.Command, error) {
+			return &command.ResumeCommand{
+				Ui: ui,
+			}, nil
+		},
+
 		"rtt": func() (cli.Command, error) {
 			return &command.RTTCommand{
 				Ui: ui,
@@ -108,6 +127,12 @@ func init() {
 			}, nil
 		},
 
+		"validate": func() (cli.Command, error) {
+			return &command.ValidateCommand{
+				Ui: ui,
+			}, nil
+		},
+
 		"version": func() (cli.Command, error) {
 			return &command.VersionCommand{
 				UI:      ui,
@@ -19,4 +19,5 @@ require (
 	github.com/mitchellh/mapstructure v1.5.0
 	github.com/posener/complete v1.2.3 // indirect
 	github.com/ryanuber/columnize v2.1.2+incompatible
+	golang.org/x/sys v0.0.0-20220728004956-3c1f35247d10
 )
@@ -32,10 +32,12 @@ func (c *memberEventCoalescer) Handle(e Event) bool {
 
 func (c *memberEventCoalescer) Coalesce(raw Event) {
 	e := raw.(MemberEvent)
-	for _, m := range e.Members {
+	for i := range e.Members {
+		// Point into the slice, not at the loop variable which is reused
+		m := &e.Members[i]
 		c.latestEvents[m.Name] = coalesceEvent{
 			Type:   e.Type,
-			Member: &m,
+			Member: m,
 		}
 	}
 }
@@ -166,6 +166,33 @@ func TestMemberEventCoalesce_TagUpdate(t *testing.T) {
 	}
 }
 
+func TestMemberEventCoalesce_multipleMembers(t *testing.T) {
+	c := &memberEventCoalescer{
+		lastEvents:   make(map[string]EventType),
+		latestEvents: make(map[string]coalesceEvent),
+	}
+	c.Coalesce(MemberEvent{
+		Type:    EventMemberJoin,
+		Members: []Member{{Name: "foo"}, {Name: "bar"}, {Name: "baz"}},
+	})
+
+	outCh := make(chan Event, 64)
+	c.Flush(outCh)
+	if len(outCh) != 1 {
+		t.Fatalf("expected one event, got %d", len(outCh))
+	}
+
+	e := (<-outCh).(MemberEvent)
+	var names []string
+	for _, m := range e.Members {
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"bar", "baz", "foo"}) {
+		t.Fatalf("bad: %v", names)
+	}
+}
+
 func TestMemberEventCoalesce_passThrough(t *testing.T) {
 	cases := []struct {
 		e      Event
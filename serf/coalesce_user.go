@@ -3,6 +3,10 @@
 
 package serf
 
+import (
+	"sort"
+)
+
 type latestUserEvents struct {
 	LTime  LamportTime
 	Events []Event
@@ -46,8 +50,21 @@ func (c *userEventCoalescer) Coalesce(e Event) {
 }
 
 func (c *userEventCoalescer) Flush(outChan chan<- Event) {
-	for _, latest := range c.events {
-		for _, e := range latest.Events {
+	// Deliver the events in the order they were fired, rather than in
+	// an order that changes from one flush to the next
+	latest := make([]*latestUserEvents, 0, len(c.events))
+	for _, l := range c.events {
+		latest = append(latest, l)
+	}
+	sort.SliceStable(latest, func(i, j int) bool {
+		if latest[i].LTime != latest[j].LTime {
+			return latest[i].LTime < latest[j].LTime
+		}
+		return latest[i].Events[0].(UserEvent).Name < latest[j].Events[0].(UserEvent).Name
+	})
+
+	for _, l := range latest {
+		for _, e := range l.Events {
 			outChan <- e
 		}
 	}
@@ -84,6 +84,38 @@ USEREVENTFORLOOP:
 	}
 }
 
+func TestUserEventCoalesce_flushOrder(t *testing.T) {
+	c := &userEventCoalescer{
+		events: make(map[string]*latestUserEvents),
+	}
+	send := []UserEvent{
+		{LTime: 5, Name: "deploy", Coalesce: true},
+		{LTime: 3, Name: "restart", Coalesce: true},
+		{LTime: 4, Name: "zap", Coalesce: true},
+		{LTime: 4, Name: "alpha", Coalesce: true},
+		{LTime: 6, Name: "restart", Coalesce: true},
+	}
+	for _, e := range send {
+		c.Coalesce(e)
+	}
+
+	outCh := make(chan Event, 64)
+	c.Flush(outCh)
+	close(outCh)
+
+	var names []string
+	for e := range outCh {
+		names = append(names, e.(UserEvent).Name)
+	}
+	expected := []string{"alpha", "zap", "deploy", "restart"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("bad: %v", names)
+	}
+	if len(c.events) != 0 {
+		t.Fatalf("events should be cleared: %v", c.events)
+	}
+}
+
 func TestUserEventCoalesce_passThrough(t *testing.T) {
 	cases := []struct {
 		e      Event
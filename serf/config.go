@@ -20,6 +20,7 @@ var ProtocolVersionMap map[uint8]uint8
 
 func init() {
 	ProtocolVersionMap = map[uint8]uint8{
+		6: 2,
 		5: 2,
 		4: 2,
 		3: 2,
@@ -40,6 +41,17 @@ type Config struct {
 	// map.
 	Tags map[string]string
 
+	// BuildVersion is the version of the application embedding Serf. It
+	// is reported to other members asking for our version with
+	// QueryVersions, and may be left empty.
+	BuildVersion string
+
+	// MaxTags limits the number of tags this node may advertise. This is
+	// checked in addition to the encoded size limit of the tags, and is
+	// enforced both at startup and when calling SetTags. If this is zero,
+	// there is no limit on the number of tags.
+	MaxTags int
+
 	// EventCh is a channel that receives all the Serf events. The events
 	// are sent on this channel in proper ordering. Care must be taken that
 	// this channel doesn't block, either by processing the events quick
@@ -47,6 +59,14 @@ type Config struct {
 	// within Serf itself. If no EventCh is specified, no events will be fired,
 	// but point-in-time snapshots of members can still be retrieved by
 	// calling Members on Serf.
+	//
+	// The values sent are MemberEvent, UserEvent and *Query, along with
+	// HealthEvent and PartitionEvent when HealthScoreThreshold and
+	// PartitionFailureRatio are set. Events are never dropped: Serf queues
+	// up to 1024 of them internally, and once that queue is full it blocks
+	// while holding the lock for the kind of event being delivered. Gossip
+	// processing then stalls, and calling methods such as Members from the
+	// goroutine that should be reading EventCh can deadlock.
 	EventCh chan<- Event
 
 	// ProtocolVersion is the protocol version to speak. This must be between
@@ -66,6 +86,15 @@ type Config struct {
 	// we leave.
 	LeavePropagateDelay time.Duration
 
+	// LeaveBroadcastRepeat is how many extra times the leave intent is
+	// broadcast during a graceful leave, waiting LeaveBroadcastInterval
+	// before each one. On a lossy network this improves the odds that
+	// peers see the leave rather than marking the node as failed. At most
+	// MaxLeaveBroadcastRepeat repeats are sent, and they stop once
+	// BroadcastTimeout has passed since the first repeat.
+	LeaveBroadcastRepeat   int
+	LeaveBroadcastInterval time.Duration
+
 	// The settings below relate to Serf's event coalescence feature. Serf
 	// is able to coalesce multiple events into single events in order to
 	// reduce the amount of noise that is sent along the EventCh. For example
@@ -108,6 +137,11 @@ type Config struct {
 	// ReconnectTimeout is the amount of time to attempt to reconnect to
 	// a failed node before giving up and considering it completely gone.
 	//
+	// ReconnectMaxAttempts is how many times this node attempts to
+	// reconnect to a failed node before it stops trying. The node is
+	// still kept as failed until ReconnectTimeout passes. If this is 0,
+	// there is no limit.
+	//
 	// TombstoneTimeout is the amount of time to keep around nodes
 	// that gracefully left as tombstones for syncing state with other
 	// Serf nodes.
@@ -116,6 +150,8 @@ type Config struct {
 	ReconnectTimeout  time.Duration
 	TombstoneTimeout  time.Duration
 
+	ReconnectMaxAttempts int
+
 	// FlapTimeout is the amount of time less than which we consider a node
 	// being failed and rejoining looks like a flap for telemetry purposes.
 	// This should be set less than a typical reboot time, but large enough
@@ -127,6 +163,49 @@ type Config struct {
 	// queue to apply the warning and max depth.
 	QueueCheckInterval time.Duration
 
+	// HealthScoreThreshold is the memberlist health score at which the
+	// local node is considered degraded. When the score reaches it, or
+	// falls back below it, an EventHealth is delivered on EventCh. A value
+	// of zero disables health events.
+	//
+	// HealthCheckInterval is how often the health score is sampled, and
+	// HealthScoreDebounce is how long the score must stay on the other side
+	// of the threshold before an event fires, so a flapping score does not
+	// produce a storm of events.
+	HealthScoreThreshold int
+	HealthCheckInterval  time.Duration
+	HealthScoreDebounce  time.Duration
+
+	// PartitionFailureRatio is the fraction of the members that must fail
+	// within PartitionWindow for a probable network partition to be
+	// detected. An EventPartition is delivered on EventCh when it is, and
+	// again once fewer than that fraction are still failed. A value of zero
+	// disables partition detection.
+	//
+	// ExpectedClusterSize is the number of members the cluster should
+	// have. When it is set, an EventPartition is also delivered once no
+	// more than half of them are alive, and again once more than half are.
+	// A value of zero disables quorum tracking.
+	//
+	// Both are checked every HealthCheckInterval.
+	PartitionFailureRatio float64
+	PartitionWindow       time.Duration
+	ExpectedClusterSize   int
+
+	// VersionCheckInterval is how often a version query is sent to the
+	// cluster to detect members speaking a different Serf protocol version
+	// than this node. Members that don't answer are checked against the
+	// protocol versions they gossip. Any drift is logged as a warning. A
+	// value of zero disables the check.
+	VersionCheckInterval time.Duration
+
+	// ReachabilityCheckInterval is how often every member is pinged
+	// directly, to detect asymmetric connectivity where some members can
+	// reach us and others can only be reached through indirect probes.
+	// Each check sends a ping to every member, so it is disabled by
+	// default. A value of zero disables the check.
+	ReachabilityCheckInterval time.Duration
+
 	// QueueDepthWarning is used to generate warning message if the
 	// number of queued messages to broadcast exceeds this number. This
 	// is to provide the user feedback if events are being triggered
@@ -157,6 +236,10 @@ type Config struct {
 	// not deliver messages that are older than the oldest entry in the buffer.
 	// Thus if a client is generating too many events, it's possible that the
 	// buffer gets overrun and messages are not delivered.
+	//
+	// The buffered events are also sent to nodes joining through us, so
+	// a node that was briefly down still gets the events it missed,
+	// unless it joins with ignoreOld set.
 	EventBuffer int
 
 	// QueryBuffer is used to control how many queries are buffered.
@@ -217,6 +300,26 @@ type Config struct {
 	// succeeds and will also avoid replaying old user events.
 	SnapshotPath string
 
+	// SnapshotCompactionThreshold is the minimum size in bytes the snapshot
+	// must reach before it is compacted. The snapshot may be allowed to grow
+	// larger than this for big clusters, since the threshold is scaled by the
+	// number of known alive nodes. If this is not set (it is zero), it will
+	// be set to a reasonable default.
+	//
+	// SnapshotMinCompactionInterval is the minimum amount of time between
+	// two compactions. This avoids thrashing the disk when the write volume
+	// is high and the snapshot keeps growing past the threshold. If this
+	// is zero, a compaction happens every time the threshold is crossed.
+	SnapshotCompactionThreshold   int
+	SnapshotMinCompactionInterval time.Duration
+
+	// SnapshotReplayLimit bounds how many of the members recorded as alive
+	// in the snapshot are replayed on startup to rejoin the cluster. If the
+	// snapshot has more, a warning is logged and only the most recently
+	// seen members are used, most recent first. If this is zero, all of
+	// them are replayed in random order.
+	SnapshotReplayLimit int
+
 	// RejoinAfterLeave controls our interaction with the snapshot file.
 	// When set to false (default), a leave causes a Serf to not rejoin
 	// the cluster until an explicit join is received. If this is set to
@@ -239,6 +342,12 @@ type Config struct {
 	// two nodes. Enabling this option adds some overhead to ping messages.
 	DisableCoordinates bool
 
+	// CoordinateUpdateCh is an optional channel that receives a
+	// CoordinateUpdate each time a ping refines the coordinate of a peer,
+	// along with one for the local node's own coordinate. Sends never
+	// block, so updates are dropped if the channel is full.
+	CoordinateUpdateCh chan<- CoordinateUpdate
+
 	// KeyringFile provides the location of a writable file where Serf can
 	// persist changes to the encryption keyring.
 	KeyringFile string
@@ -251,6 +360,24 @@ type Config struct {
 	// It's optimal to be relatively small, since it's going to be gossiped through the cluster.
 	UserEventSizeLimit int
 
+	// CompressionThreshold is the size in bytes above which encoded user
+	// events and push/pull state syncs are compressed before they are sent.
+	// Compressed messages are understood from protocol version 6, so this
+	// only takes effect when ProtocolVersion is at least 6. The size limits
+	// apply before compression. Zero disables compression.
+	CompressionThreshold int
+
+	// UserEventRateLimit and QueryRateLimit cap how many user events and
+	// queries are delivered on EventCh in each RateLimitInterval. Anything
+	// over the limit is still gossiped on to the other members, but is
+	// dropped here and counted in the
+	// serf.rate_limited.events and serf.rate_limited.queries metrics.
+	// Dropped queries are not acked. Internal queries are never limited.
+	// A limit of zero disables it.
+	UserEventRateLimit int
+	QueryRateLimit     int
+	RateLimitInterval  time.Duration
+
 	// messageDropper is a callback used for selectively ignoring inbound
 	// gossip messages. This should only be used in unit tests needing careful
 	// control over sequencing of gossip arrival
@@ -262,6 +389,11 @@ type Config struct {
 	// the application to cause reaping of a node to happen when it otherwise wouldn't
 	ReconnectTimeoutOverride ReconnectTimeoutOverrider
 
+	// Reconnecter is an optional interface which when present is told about
+	// each attempt to reconnect to a failed node, and can change the address
+	// that is tried or skip the attempt
+	Reconnecter Reconnecter
+
 	// ValidateNodeNames controls whether nodenames only
 	// contain alphanumeric, dashes and '.'characters
 	// and sets maximum length to 128 characters
@@ -295,7 +427,9 @@ func DefaultConfig() *Config {
 		NodeName:                     hostname,
 		BroadcastTimeout:             5 * time.Second,
 		LeavePropagateDelay:          1 * time.Second,
+		LeaveBroadcastInterval:       500 * time.Millisecond,
 		EventBuffer:                  512,
+		SnapshotCompactionThreshold:  snapshotSizeLimit,
 		QueryBuffer:                  512,
 		LogOutput:                    os.Stderr,
 		ProtocolVersion:              4,
@@ -304,6 +438,9 @@ func DefaultConfig() *Config {
 		ReconnectInterval:            30 * time.Second,
 		ReconnectTimeout:             24 * time.Hour,
 		QueueCheckInterval:           30 * time.Second,
+		HealthCheckInterval:          1 * time.Second,
+		HealthScoreDebounce:          5 * time.Second,
+		PartitionWindow:              30 * time.Second,
 		QueueDepthWarning:            128,
 		MaxQueueDepth:                4096,
 		TombstoneTimeout:             24 * time.Hour,
@@ -316,5 +453,7 @@ func DefaultConfig() *Config {
 		DisableCoordinates:           false,
 		ValidateNodeNames:            false,
 		UserEventSizeLimit:           512,
+		CompressionThreshold:         256,
+		RateLimitInterval:            time.Second,
 	}
 }
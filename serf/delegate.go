@@ -39,6 +39,18 @@ func (d *delegate) NotifyMsg(buf []byte) {
 	rebroadcastQueue := d.serf.broadcasts
 	t := messageType(buf[0])
 
+	// A compressed message is handled as the message it wraps, but passed
+	// on as it came in if it gets rebroadcast
+	msg := buf
+	if t == messageCompressType {
+		var err error
+		if msg, err = decompressMessage(buf[1:]); err != nil {
+			d.serf.logger.Printf("[ERR] serf: Error decompressing message: %s", err)
+			return
+		}
+		t = messageType(msg[0])
+	}
+
 	if d.serf.config.messageDropper(t) {
 		return
 	}
@@ -46,7 +58,7 @@ func (d *delegate) NotifyMsg(buf []byte) {
 	switch t {
 	case messageLeaveType:
 		var leave messageLeave
-		if err := decodeMessage(buf[1:], &leave); err != nil {
+		if err := decodeMessage(msg[1:], &leave); err != nil {
 			d.serf.logger.Printf("[ERR] serf: Error decoding leave message: %s", err)
 			break
 		}
@@ -56,7 +68,7 @@ func (d *delegate) NotifyMsg(buf []byte) {
 
 	case messageJoinType:
 		var join messageJoin
-		if err := decodeMessage(buf[1:], &join); err != nil {
+		if err := decodeMessage(msg[1:], &join); err != nil {
 			d.serf.logger.Printf("[ERR] serf: Error decoding join message: %s", err)
 			break
 		}
@@ -66,7 +78,7 @@ func (d *delegate) NotifyMsg(buf []byte) {
 
 	case messageUserEventType:
 		var event messageUserEvent
-		if err := decodeMessage(buf[1:], &event); err != nil {
+		if err := decodeMessage(msg[1:], &event); err != nil {
 			d.serf.logger.Printf("[ERR] serf: Error decoding user event message: %s", err)
 			break
 		}
@@ -77,7 +89,7 @@ func (d *delegate) NotifyMsg(buf []byte) {
 
 	case messageQueryType:
 		var query messageQuery
-		if err := decodeMessage(buf[1:], &query); err != nil {
+		if err := decodeMessage(msg[1:], &query); err != nil {
 			d.serf.logger.Printf("[ERR] serf: Error decoding query message: %s", err)
 			break
 		}
@@ -88,7 +100,7 @@ func (d *delegate) NotifyMsg(buf []byte) {
 
 	case messageQueryResponseType:
 		var resp messageQueryResponse
-		if err := decodeMessage(buf[1:], &resp); err != nil {
+		if err := decodeMessage(msg[1:], &resp); err != nil {
 			d.serf.logger.Printf("[ERR] serf: Error decoding query response message: %s", err)
 			break
 		}
@@ -99,7 +111,7 @@ func (d *delegate) NotifyMsg(buf []byte) {
 	case messageRelayType:
 		var header relayHeader
 		var handle codec.MsgpackHandle
-		reader := bytes.NewReader(buf[1:])
+		reader := bytes.NewReader(msg[1:])
 		decoder := codec.NewDecoder(reader, &handle)
 		if err := decoder.Decode(&header); err != nil {
 			d.serf.logger.Printf("[ERR] serf: Error decoding relay header: %s", err)
@@ -116,7 +128,7 @@ func (d *delegate) NotifyMsg(buf []byte) {
 		}
 
 		d.serf.logger.Printf("[DEBUG] serf: Relaying response to addr: %s", header.DestAddr.String())
-		if err := d.serf.memberlist.SendToAddress(addr, raw); err != nil {
+		if err := d.serf.Memberlist().SendToAddress(addr, raw); err != nil {
 			d.serf.logger.Printf("[ERR] serf: Error forwarding message to %s: %s", header.DestAddr.String(), err)
 			break
 		}
@@ -138,6 +150,11 @@ func (d *delegate) NotifyMsg(buf []byte) {
 }
 
 func (d *delegate) GetBroadcasts(overhead, limit int) [][]byte {
+	// Hold on to everything while gossip is paused
+	if d.serf.Paused() {
+		return nil
+	}
+
 	msgs := d.serf.broadcasts.GetBroadcasts(overhead, limit)
 
 	// Determine the bytes used already
@@ -189,6 +206,12 @@ func (d *delegate) LocalState(join bool) []byte {
 		QueryLTime:   d.serf.queryClock.Time(),
 	}
 
+	// While gossip is paused, membership is still synced but user events
+	// are held back, as they would be from our broadcasts
+	if d.serf.Paused() {
+		pp.Events = nil
+	}
+
 	// Add all the join LTimes
 	for name, member := range d.serf.members {
 		pp.StatusLTimes[name] = member.statusLTime
@@ -205,7 +228,7 @@ func (d *delegate) LocalState(join bool) []byte {
 		d.serf.logger.Printf("[ERR] serf: Failed to encode local state: %v", err)
 		return nil
 	}
-	return buf
+	return d.serf.compressMessage(buf)
 }
 
 func (d *delegate) MergeRemoteState(buf []byte, isJoin bool) {
@@ -215,6 +238,15 @@ func (d *delegate) MergeRemoteState(buf []byte, isJoin bool) {
 		return
 	}
 
+	// Unwrap the state if it was compressed
+	if messageType(buf[0]) == messageCompressType {
+		var err error
+		if buf, err = decompressMessage(buf[1:]); err != nil {
+			d.serf.logger.Printf("[ERR] serf: Failed to decompress remote state: %v", err)
+			return
+		}
+	}
+
 	// Check the message type
 	if messageType(buf[0]) != messagePushPullType {
 		d.serf.logger.Printf("[ERR] serf: Remote state has bad type prefix: %v", buf[0])
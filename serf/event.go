@@ -24,6 +24,8 @@ const (
 	EventMemberReap
 	EventUser
 	EventQuery
+	EventHealth
+	EventPartition
 )
 
 func (t EventType) String() string {
@@ -42,6 +44,10 @@ func (t EventType) String() string {
 		return "user"
 	case EventQuery:
 		return "query"
+	case EventHealth:
+		return "health"
+	case EventPartition:
+		return "partition"
 	default:
 		panic(fmt.Sprintf("unknown event type: %d", t))
 	}
@@ -86,6 +92,9 @@ func (m MemberEvent) String() string {
 // UserEvent is the struct used for events that are triggered
 // by the user and are not related to members
 type UserEvent struct {
+	// LTime is the event clock time the event was sent at. Events with the
+	// same name and LTime are the same event, so consumers can use it to
+	// skip events they already handled.
 	LTime    LamportTime
 	Name     string
 	Payload  []byte
@@ -100,6 +109,55 @@ func (u UserEvent) String() string {
 	return fmt.Sprintf("user-event: %s", u.Name)
 }
 
+// HealthEvent is the struct used for events that are triggered when the
+// local node's health score crosses the configured threshold. Degraded is
+// true when the score has risen to the threshold, and false once it has
+// fallen back below it.
+type HealthEvent struct {
+	Score     int
+	Threshold int
+	Degraded  bool
+}
+
+func (h HealthEvent) EventType() EventType {
+	return EventHealth
+}
+
+func (h HealthEvent) String() string {
+	if h.Degraded {
+		return fmt.Sprintf("health: degraded (score %d >= %d)", h.Score, h.Threshold)
+	}
+	return fmt.Sprintf("health: recovered (score %d < %d)", h.Score, h.Threshold)
+}
+
+// PartitionEvent is the struct used for events that are triggered when a
+// probable network partition or loss of quorum is detected, or ends. Each
+// event holds the current state of both, and the member counts they were
+// decided from. Expected is zero when quorum isn't being tracked.
+type PartitionEvent struct {
+	Partitioned bool
+	QuorumLost  bool
+	Alive       int
+	Failed      int
+	Expected    int
+}
+
+func (p PartitionEvent) EventType() EventType {
+	return EventPartition
+}
+
+func (p PartitionEvent) String() string {
+	state := "none"
+	if p.Partitioned {
+		state = "detected"
+	}
+	result := fmt.Sprintf("partition: %s (%d of %d members failed)", state, p.Failed, p.Alive+p.Failed)
+	if p.QuorumLost {
+		result += fmt.Sprintf(", quorum lost (%d of %d expected alive)", p.Alive, p.Expected)
+	}
+	return result
+}
+
 // Query is the struct used by EventQuery type events
 type Query struct {
 	LTime   LamportTime
@@ -139,7 +197,7 @@ func (q *Query) createResponse(buf []byte) messageQueryResponse {
 	return messageQueryResponse{
 		LTime:   q.LTime,
 		ID:      q.id,
-		From:    q.serf.config.NodeName,
+		From:    q.serf.nodeName(),
 		Payload: buf,
 	}
 }
@@ -178,7 +236,7 @@ func (q *Query) respondWithMessageAndResponse(raw []byte, resp messageQueryRespo
 		Addr: udpAddr.String(),
 		Name: q.sourceNode,
 	}
-	if err := q.serf.memberlist.SendToAddress(addr, raw); err != nil {
+	if err := q.serf.Memberlist().SendToAddress(addr, raw); err != nil {
 		return err
 	}
 
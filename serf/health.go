@@ -0,0 +1,76 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"time"
+)
+
+// healthMonitor tracks the local health score against a threshold and
+// decides when a HealthEvent should be emitted. A crossing only counts
+// once the score has stayed on the new side of the threshold for the
+// debounce period.
+type healthMonitor struct {
+	threshold int
+	debounce  time.Duration
+
+	degraded     bool
+	pendingSince time.Time
+}
+
+// observe records a health score sample taken at the given time and
+// returns the event to emit, or nil if nothing has changed.
+func (h *healthMonitor) observe(score int, now time.Time) *HealthEvent {
+	over := score >= h.threshold
+	if over == h.degraded {
+		h.pendingSince = time.Time{}
+		return nil
+	}
+
+	if h.pendingSince.IsZero() {
+		h.pendingSince = now
+	}
+	if now.Sub(h.pendingSince) < h.debounce {
+		return nil
+	}
+
+	h.degraded = over
+	h.pendingSince = time.Time{}
+	return &HealthEvent{
+		Score:     score,
+		Threshold: h.threshold,
+		Degraded:  over,
+	}
+}
+
+// monitorHealthScore periodically samples the memberlist health score and
+// delivers a HealthEvent whenever it crosses the configured threshold.
+func (s *Serf) monitorHealthScore() {
+	monitor := &healthMonitor{
+		threshold: s.config.HealthScoreThreshold,
+		debounce:  s.config.HealthScoreDebounce,
+	}
+	for {
+		select {
+		case <-time.After(s.config.HealthCheckInterval):
+			score := s.Memberlist().GetHealthScore()
+			e := monitor.observe(score, time.Now())
+			if e == nil {
+				continue
+			}
+			if e.Degraded {
+				s.logger.Printf("[WARN] serf: Health score %d reached threshold %d", e.Score, e.Threshold)
+			} else {
+				s.logger.Printf("[INFO] serf: Health score %d recovered below threshold %d", e.Score, e.Threshold)
+			}
+			select {
+			case s.config.EventCh <- *e:
+			case <-s.shutdownCh:
+				return
+			}
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
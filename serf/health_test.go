@@ -0,0 +1,76 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthMonitor_observe(t *testing.T) {
+	h := &healthMonitor{threshold: 3, debounce: 5 * time.Second}
+	start := time.Now()
+
+	// Score climbs past the threshold and flaps before settling. Only
+	// the crossing that holds for the debounce period should fire.
+	samples := []struct {
+		score  int
+		offset time.Duration
+	}{
+		{0, 0},
+		{1, 1 * time.Second},
+		{4, 2 * time.Second},
+		{2, 3 * time.Second},
+		{5, 4 * time.Second},
+		{6, 6 * time.Second},
+		{8, 9 * time.Second},
+		{7, 10 * time.Second},
+		{5, 20 * time.Second},
+	}
+
+	var events []*HealthEvent
+	for _, s := range samples {
+		if e := h.observe(s.score, start.Add(s.offset)); e != nil {
+			events = append(events, e)
+		}
+	}
+	if len(events) != 1 {
+		t.Fatalf("bad: %#v", events)
+	}
+	if e := events[0]; !e.Degraded || e.Score != 8 || e.Threshold != 3 {
+		t.Fatalf("bad: %#v", e)
+	}
+	if e := events[0]; e.EventType() != EventHealth || e.EventType().String() != "health" {
+		t.Fatalf("bad: %#v", e)
+	}
+
+	// Falling back below the threshold fires a single recovery event.
+	now := start.Add(30 * time.Second)
+	if e := h.observe(1, now); e != nil {
+		t.Fatalf("bad: %#v", e)
+	}
+	e := h.observe(0, now.Add(5*time.Second))
+	if e == nil || e.Degraded || e.Score != 0 {
+		t.Fatalf("bad: %#v", e)
+	}
+	if e := h.observe(0, now.Add(10*time.Second)); e != nil {
+		t.Fatalf("bad: %#v", e)
+	}
+}
+
+func TestHealthMonitor_noDebounce(t *testing.T) {
+	h := &healthMonitor{threshold: 1}
+	now := time.Now()
+
+	if e := h.observe(0, now); e != nil {
+		t.Fatalf("bad: %#v", e)
+	}
+	e := h.observe(1, now)
+	if e == nil || !e.Degraded {
+		t.Fatalf("bad: %#v", e)
+	}
+	if e := h.observe(2, now); e != nil {
+		t.Fatalf("bad: %#v", e)
+	}
+}
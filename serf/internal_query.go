@@ -7,6 +7,8 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
+	"net"
+	"runtime"
 	"strings"
 )
 
@@ -15,6 +17,11 @@ const (
 	// They are handled internally, and not forwarded to a client.
 	InternalQueryPrefix = "_serf_"
 
+	// PingQueryName is the name of the built-in query that every member
+	// acks, and answers with its node name. It can be used to check which
+	// members a query reaches without installing any handlers.
+	PingQueryName = InternalQueryPrefix + pingQuery
+
 	// pingQuery is run to check for reachability
 	pingQuery = "ping"
 
@@ -33,6 +40,12 @@ const (
 	// listKeysQuery is used to list all known keys in the cluster
 	listKeysQuery = "list-keys"
 
+	// versionQuery is used to gather the versions run by each member
+	versionQuery = "version"
+
+	// reachQuery asks members to probe another member on our behalf
+	reachQuery = "reach"
+
 	// minEncodedKeyLength is used to compute the max number of keys in a list key
 	// response. eg 1024/25 = 40. a message with max size of 1024 bytes cannot
 	// contain more than 40 keys. There is a test
@@ -113,7 +126,7 @@ func (s *serfQueries) handleQuery(q *Query) {
 	queryName := q.Name[len(InternalQueryPrefix):]
 	switch queryName {
 	case pingQuery:
-		// Nothing to do, we will ack the query
+		s.handlePing(q)
 	case conflictQuery:
 		s.handleConflict(q)
 	case installKeyQuery:
@@ -124,11 +137,24 @@ func (s *serfQueries) handleQuery(q *Query) {
 		s.handleRemoveKey(q)
 	case listKeysQuery:
 		s.handleListKeys(q)
+	case versionQuery:
+		s.handleVersion(q)
+	case reachQuery:
+		s.handleReach(q)
 	default:
 		s.logger.Printf("[WARN] serf: Unhandled internal query '%s'", queryName)
 	}
 }
 
+// handlePing is invoked when we get a ping query. The query is acked
+// already if that was requested, so all that is left is to respond with
+// our name.
+func (s *serfQueries) handlePing(q *Query) {
+	if err := q.Respond([]byte(s.serf.nodeName())); err != nil {
+		s.logger.Printf("[ERR] serf: Failed to respond to ping query: %v", err)
+	}
+}
+
 // handleConflict is invoked when we get a query that is attempting to
 // disambiguate a name conflict. They payload is a node name, and the response
 // should the address we believe that node is at, if any.
@@ -137,7 +163,7 @@ func (s *serfQueries) handleConflict(q *Query) {
 	node := string(q.Payload)
 
 	// Do not respond to the query if it is about us
-	if node == s.serf.config.NodeName {
+	if node == s.serf.nodeName() {
 		return
 	}
 	s.logger.Printf("[DEBUG] serf: Got conflict resolution query for '%s'", node)
@@ -163,6 +189,59 @@ func (s *serfQueries) handleConflict(q *Query) {
 	}
 }
 
+// handleVersion is invoked when we get a query asking which versions we
+// are running. We respond with our build, protocol and Go versions.
+func (s *serfQueries) handleVersion(q *Query) {
+	resp := NodeVersion{
+		Version:     s.serf.config.BuildVersion,
+		Protocol:    s.serf.config.ProtocolVersion,
+		ProtocolMin: ProtocolVersionMin,
+		ProtocolMax: ProtocolVersionMax,
+		GoVersion:   runtime.Version(),
+	}
+
+	buf, err := encodeMessage(messageVersionResponseType, &resp)
+	if err != nil {
+		s.logger.Printf("[ERR] serf: Failed to encode version query response: %v", err)
+		return
+	}
+
+	if err := q.Respond(buf); err != nil {
+		s.logger.Printf("[ERR] serf: Failed to respond to version query: %v", err)
+	}
+}
+
+// handleReach is invoked when we get a query asking us to ping another
+// member on behalf of a node that couldn't reach it directly.
+func (s *serfQueries) handleReach(q *Query) {
+	var req reachRequest
+	if len(q.Payload) < 1 || messageType(q.Payload[0]) != messageReachRequestType {
+		s.logger.Printf("[ERR] serf: Invalid reach query request type from %s", q.sourceNode)
+		return
+	}
+	if err := decodeMessage(q.Payload[1:], &req); err != nil {
+		s.logger.Printf("[ERR] serf: Failed to decode reach request: %v", err)
+		return
+	}
+
+	addr := &net.UDPAddr{IP: req.Addr, Port: int(req.Port)}
+	_, err := s.serf.Memberlist().Ping(req.Node, addr)
+	if err != nil {
+		s.logger.Printf("[DEBUG] serf: Failed to reach %s for reachability query: %v", req.Node, err)
+	}
+
+	resp := nodeReachResponse{Reachable: err == nil}
+	buf, err := encodeMessage(messageReachResponseType, &resp)
+	if err != nil {
+		s.logger.Printf("[ERR] serf: Failed to encode reach query response: %v", err)
+		return
+	}
+
+	if err := q.Respond(buf); err != nil {
+		s.logger.Printf("[ERR] serf: Failed to respond to reach query: %v", err)
+	}
+}
+
 func (s *serfQueries) keyListResponseWithCorrectSize(q *Query, resp *nodeKeyResponse) ([]byte, messageQueryResponse, error) {
 	maxListKeys := q.serf.config.QueryResponseSizeLimit / minEncodedKeyLength
 	actual := len(resp.Keys)
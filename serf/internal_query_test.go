@@ -49,7 +49,7 @@ func TestSerfQueries_Passthrough(t *testing.T) {
 }
 
 func TestSerfQueries_Ping(t *testing.T) {
-	serf := &Serf{}
+	serf := &Serf{config: &Config{NodeName: "foo"}}
 	logger := log.New(os.Stderr, "", log.LstdFlags)
 	outCh := make(chan Event, 4)
 	shutdown := make(chan struct{})
@@ -60,7 +60,7 @@ func TestSerfQueries_Ping(t *testing.T) {
 	}
 
 	// Send a ping
-	eventCh <- &Query{LTime: 42, Name: "_serf_ping"}
+	eventCh <- &Query{LTime: 42, Name: "_serf_ping", serf: serf}
 
 	// Should not get passed through
 	select {
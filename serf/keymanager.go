@@ -130,7 +130,7 @@ func (k *KeyManager) handleKeyRequest(key, query string, opts *KeyRequestOptions
 	}
 
 	// Handle the response stream and populate the KeyResponse
-	resp.NumNodes = k.serf.memberlist.NumMembers()
+	resp.NumNodes = k.serf.Memberlist().NumMembers()
 	k.streamKeyResp(resp, queryResp.respCh)
 
 	// Check the response for any reported failure conditions
@@ -0,0 +1,104 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+// MemberSubscription delivers the member events that follow the snapshot
+// of members it was created with by SubscribeMembers. Unlike the EventCh
+// in the Config, events are not coalesced, so each one names exactly one
+// member.
+type MemberSubscription struct {
+	serf    *Serf
+	eventCh chan MemberEvent
+}
+
+// SubscribeMembers returns a snapshot of the members of the cluster along
+// with a subscription to the member events that follow it. The snapshot
+// and the subscription are taken together, so applying the events to the
+// snapshot in order gives the current members, with no change missed or
+// seen twice. Status changes without an event type of their own, like a
+// member starting to leave, are delivered as an EventMemberUpdate.
+//
+// Up to buffer events are held for the subscriber. If it falls further
+// behind, the subscription is closed, as events would otherwise be lost,
+// and the subscriber should subscribe again to get a new snapshot. All
+// subscriptions are closed when Serf is shut down. The subscription must
+// be closed once it is no longer used.
+func (s *Serf) SubscribeMembers(buffer int) ([]Member, *MemberSubscription) {
+	if buffer < 1 {
+		buffer = 1
+	}
+	sub := &MemberSubscription{
+		serf:    s,
+		eventCh: make(chan MemberEvent, buffer),
+	}
+
+	s.memberLock.Lock()
+	defer s.memberLock.Unlock()
+
+	members := make([]Member, 0, len(s.members))
+	for _, m := range s.members {
+		members = append(members, copyMember(m.Member))
+	}
+	if s.memberSubsClosed {
+		close(sub.eventCh)
+		return members, sub
+	}
+	if s.memberSubs == nil {
+		s.memberSubs = make(map[*MemberSubscription]struct{})
+	}
+	s.memberSubs[sub] = struct{}{}
+	return members, sub
+}
+
+// Events returns the channel the member events are delivered on. It is
+// closed once the subscription is closed, or if the subscriber fell too
+// far behind.
+func (sub *MemberSubscription) Events() <-chan MemberEvent {
+	return sub.eventCh
+}
+
+// Close stops the subscription and closes its channel. It is safe to call
+// more than once.
+func (sub *MemberSubscription) Close() {
+	s := sub.serf
+	s.memberLock.Lock()
+	defer s.memberLock.Unlock()
+
+	if _, ok := s.memberSubs[sub]; ok {
+		delete(s.memberSubs, sub)
+		close(sub.eventCh)
+	}
+}
+
+// notifyMemberSubs sends a member event to the subscribers, closing the
+// subscriptions of any that are too far behind to take it. The member lock
+// must be held, so events are delivered in the order members change.
+func (s *Serf) notifyMemberSubs(eventType EventType, member Member) {
+	for sub := range s.memberSubs {
+		event := MemberEvent{
+			Type:    eventType,
+			Members: []Member{copyMember(member)},
+		}
+		select {
+		case sub.eventCh <- event:
+		default:
+			s.logger.Printf("[WARN] serf: Member subscriber fell behind, closing its subscription")
+			delete(s.memberSubs, sub)
+			close(sub.eventCh)
+		}
+	}
+}
+
+// closeMemberSubs closes all the subscriptions, and any made after, when
+// Serf is shut down.
+func (s *Serf) closeMemberSubs() {
+	s.memberLock.Lock()
+	defer s.memberLock.Unlock()
+
+	for sub := range s.memberSubs {
+		delete(s.memberSubs, sub)
+		close(sub.eventCh)
+	}
+	s.memberSubsClosed = true
+}
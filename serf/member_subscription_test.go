@@ -0,0 +1,160 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/testutil"
+)
+
+func TestSerf_SubscribeMembers(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	s1Config := testConfig(t, ip1)
+	s2Config := testConfig(t, ip2)
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	members, sub := s1.SubscribeMembers(16)
+	defer sub.Close()
+	if len(members) != 1 || members[0].Name != s1Config.NodeName {
+		t.Fatalf("bad: %v", members)
+	}
+
+	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The join follows the snapshot
+	select {
+	case e := <-sub.Events():
+		if e.Type != EventMemberJoin || len(e.Members) != 1 || e.Members[0].Name != s2Config.NodeName {
+			t.Fatalf("bad: %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// A new subscription sees both members in its snapshot instead
+	members, sub2 := s1.SubscribeMembers(16)
+	if len(members) != 2 {
+		t.Fatalf("bad: %v", members)
+	}
+
+	// Closing is safe to repeat, and closes the channel
+	sub2.Close()
+	sub2.Close()
+	if _, ok := <-sub2.Events(); ok {
+		t.Fatalf("should be closed")
+	}
+}
+
+func TestSerf_SubscribeMembers_slow(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	s1, err := Create(testConfig(t, ip1))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	_, sub := s1.SubscribeMembers(1)
+	defer sub.Close()
+
+	// A subscriber that falls behind is closed rather than missing events
+	member := Member{Name: "foo", Tags: map[string]string{"role": "web"}}
+	s1.memberLock.Lock()
+	s1.notifyMemberSubs(EventMemberJoin, member)
+	s1.notifyMemberSubs(EventMemberUpdate, member)
+	s1.memberLock.Unlock()
+
+	e, ok := <-sub.Events()
+	if !ok || e.Type != EventMemberJoin || e.Members[0].Name != "foo" {
+		t.Fatalf("bad: %v", e)
+	}
+	if _, ok := <-sub.Events(); ok {
+		t.Fatalf("should be closed")
+	}
+
+	// The event doesn't share the member's tags
+	e.Members[0].Tags["role"] = "db"
+	if member.Tags["role"] != "web" {
+		t.Fatalf("bad: %v", member.Tags)
+	}
+}
+
+func TestSerf_SubscribeMembers_intents(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	s1, err := Create(testConfig(t, ip1))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s1.handleNodeJoin(&memberlist.Node{Name: "foo", Addr: net.IP{127, 0, 0, 1}})
+	_, sub := s1.SubscribeMembers(4)
+	defer sub.Close()
+
+	// Leave and join intents only change the status, and still show up
+	s1.handleNodeLeaveIntent(&messageLeave{LTime: 10, Node: "foo"})
+	s1.handleNodeJoinIntent(&messageJoin{LTime: 11, Node: "foo"})
+	for _, status := range []MemberStatus{StatusLeaving, StatusAlive} {
+		select {
+		case e := <-sub.Events():
+			if e.Type != EventMemberUpdate || e.Members[0].Name != "foo" || e.Members[0].Status != status {
+				t.Fatalf("bad: %v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %v", status)
+		}
+	}
+}
+
+func TestSerf_SubscribeMembers_shutdown(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	s1, err := Create(testConfig(t, ip1))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, sub := s1.SubscribeMembers(1)
+	defer sub.Close()
+	if err := s1.Shutdown(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := <-sub.Events(); ok {
+		t.Fatalf("should be closed")
+	}
+
+	// Subscribing after shutdown gives a closed subscription
+	_, sub = s1.SubscribeMembers(1)
+	defer sub.Close()
+	if _, ok := <-sub.Events(); ok {
+		t.Fatalf("should be closed")
+	}
+}
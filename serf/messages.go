@@ -5,6 +5,9 @@ package serf
 
 import (
 	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"time"
 
@@ -26,6 +29,10 @@ const (
 	messageKeyRequestType
 	messageKeyResponseType
 	messageRelayType
+	messageVersionResponseType
+	messageReachResponseType
+	messageReachRequestType
+	messageCompressType
 )
 
 const (
@@ -145,6 +152,47 @@ func encodeMessage(t messageType, msg interface{}) ([]byte, error) {
 	return buf.Bytes(), err
 }
 
+// compressMessage wraps an encoded message in the messageCompressType,
+// deflating it along with its type. The message is returned unchanged if
+// compressing it doesn't make it any smaller.
+func compressMessage(msg []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(uint8(messageCompressType))
+
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return msg
+	}
+	if _, err := w.Write(msg); err != nil {
+		return msg
+	}
+	if err := w.Close(); err != nil {
+		return msg
+	}
+	if buf.Len() >= len(msg) {
+		return msg
+	}
+	return buf.Bytes()
+}
+
+// decompressMessage unwraps a message from the messageCompressType. The buf
+// should not include the compress type byte.
+func decompressMessage(buf []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(buf))
+	defer r.Close()
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) == 0 {
+		return nil, fmt.Errorf("Compressed message is empty")
+	}
+	if messageType(msg[0]) == messageCompressType {
+		return nil, fmt.Errorf("Compressed message is compressed again")
+	}
+	return msg, nil
+}
+
 // relayHeader is used to store the end destination of a relayed message
 type relayHeader struct {
 	DestAddr net.UDPAddr
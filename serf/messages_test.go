@@ -5,6 +5,7 @@ package serf
 
 import (
 	"bytes"
+	"compress/flate"
 	"net"
 	"reflect"
 	"testing"
@@ -42,6 +43,48 @@ func TestEncodeMessage(t *testing.T) {
 	}
 }
 
+func TestCompressMessage(t *testing.T) {
+	in := &messageUserEvent{Name: "deploy", Payload: bytes.Repeat([]byte("abc"), 100)}
+	raw, err := encodeMessage(messageUserEventType, in)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	compressed := compressMessage(raw)
+	if compressed[0] != byte(messageCompressType) {
+		t.Fatal("should have compress type header")
+	}
+	if len(compressed) >= len(raw) {
+		t.Fatalf("should be smaller: %d >= %d", len(compressed), len(raw))
+	}
+
+	out, err := decompressMessage(compressed[1:])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, raw) {
+		t.Fatalf("mis-match")
+	}
+
+	// Messages that don't get any smaller are left alone
+	small := []byte{byte(messageLeaveType), 0x01}
+	if out := compressMessage(small); !bytes.Equal(out, small) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// A compressed message can't wrap another compressed message
+	var nested bytes.Buffer
+	w, err := flate.NewWriter(&nested, flate.DefaultCompression)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	w.Write(compressed)
+	w.Close()
+	if _, err := decompressMessage(nested.Bytes()); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
 func TestEncodeRelayMessage(t *testing.T) {
 	in := &messageLeave{Node: "foo"}
 	addr := net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 1234}
@@ -0,0 +1,144 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// partitionMonitor tracks how many members have failed and decides when a
+// PartitionEvent should be emitted. A partition is detected when at least
+// ratio of the members fail within the window, and ends once fewer than
+// that are still failed. Quorum is lost once no more than half of the
+// expected members are alive, but only after the cluster first had quorum,
+// so a node on its own before joining doesn't count as a loss.
+type partitionMonitor struct {
+	ratio    float64
+	window   time.Duration
+	expected int
+
+	partitioned bool
+	quorumLost  bool
+	hadQuorum   bool
+}
+
+// observe records the number of alive members and the times the failed
+// members failed at, sampled at the given time, and returns the event to
+// emit, or nil if nothing has changed.
+func (p *partitionMonitor) observe(alive int, failed []time.Time, now time.Time) *PartitionEvent {
+	members := alive + len(failed)
+
+	partitioned := p.partitioned
+	if p.ratio > 0 && members > 0 {
+		limit := p.ratio * float64(members)
+		if p.partitioned {
+			partitioned = float64(len(failed)) >= limit
+		} else {
+			var recent int
+			for _, t := range failed {
+				if now.Sub(t) <= p.window {
+					recent++
+				}
+			}
+			// A single failure is never a partition, however small the
+			// cluster is
+			partitioned = recent > 1 && float64(recent) >= limit
+		}
+	}
+
+	quorumLost := p.quorumLost
+	if p.expected > 0 {
+		quorum := alive > p.expected/2
+		if quorum {
+			p.hadQuorum = true
+		}
+		quorumLost = p.hadQuorum && !quorum
+	}
+
+	if partitioned == p.partitioned && quorumLost == p.quorumLost {
+		return nil
+	}
+	p.partitioned = partitioned
+	p.quorumLost = quorumLost
+	return &PartitionEvent{
+		Partitioned: partitioned,
+		QuorumLost:  quorumLost,
+		Alive:       alive,
+		Failed:      len(failed),
+		Expected:    p.expected,
+	}
+}
+
+// monitorPartitions periodically counts the alive and failed members and
+// delivers a PartitionEvent whenever a partition or loss of quorum is
+// detected, or ends.
+func (s *Serf) monitorPartitions() {
+	monitor := &partitionMonitor{
+		ratio:    s.config.PartitionFailureRatio,
+		window:   s.config.PartitionWindow,
+		expected: s.config.ExpectedClusterSize,
+	}
+	var last PartitionEvent
+	for {
+		select {
+		case <-time.After(s.config.HealthCheckInterval):
+			alive, failed := s.countFailures()
+			e := monitor.observe(alive, failed, time.Now())
+			if e == nil {
+				continue
+			}
+			s.logPartitionEvent(last, e)
+			last = *e
+			select {
+			case s.config.EventCh <- *e:
+			case <-s.shutdownCh:
+				return
+			}
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// countFailures returns the number of alive members, and the times each
+// failed member failed at.
+func (s *Serf) countFailures() (int, []time.Time) {
+	s.memberLock.RLock()
+	defer s.memberLock.RUnlock()
+
+	var alive int
+	for _, m := range s.members {
+		if m.Status == StatusAlive {
+			alive++
+		}
+	}
+	failed := make([]time.Time, 0, len(s.failedMembers))
+	for _, m := range s.failedMembers {
+		failed = append(failed, m.leaveTime)
+	}
+	return alive, failed
+}
+
+// logPartitionEvent logs the changes in partition and quorum state since
+// the last event, and counts each partition and loss of quorum.
+func (s *Serf) logPartitionEvent(last PartitionEvent, e *PartitionEvent) {
+	members := e.Alive + e.Failed
+	switch {
+	case e.Partitioned && !last.Partitioned:
+		metrics.IncrCounterWithLabels([]string{"serf", "partition", "detected"}, 1, s.metricLabels)
+		s.logger.Printf("[WARN] serf: Probable partition, %d of %d members failed", e.Failed, members)
+	case !e.Partitioned && last.Partitioned:
+		s.logger.Printf("[INFO] serf: Partition over, %d of %d members failed", e.Failed, members)
+	}
+
+	switch {
+	case e.QuorumLost && !last.QuorumLost:
+		metrics.IncrCounterWithLabels([]string{"serf", "quorum", "lost"}, 1, s.metricLabels)
+		s.logger.Printf("[WARN] serf: Quorum lost, %d of %d expected members alive", e.Alive, e.Expected)
+	case !e.QuorumLost && last.QuorumLost:
+		s.logger.Printf("[INFO] serf: Quorum regained, %d of %d expected members alive", e.Alive, e.Expected)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/testutil"
+)
+
+func TestPartitionMonitor_partition(t *testing.T) {
+	p := &partitionMonitor{ratio: 0.5, window: 10 * time.Second}
+	start := time.Now()
+
+	// A single failure is not a partition, even in a small cluster
+	if e := p.observe(1, []time.Time{start}, start); e != nil {
+		t.Fatalf("bad: %#v", e)
+	}
+
+	// Failures spread out over more than the window are not either
+	failed := []time.Time{start, start.Add(20 * time.Second)}
+	if e := p.observe(2, failed, start.Add(20*time.Second)); e != nil {
+		t.Fatalf("bad: %#v", e)
+	}
+
+	// Half of the members failing within the window is, counting only
+	// the failures within it
+	failed = append(failed, start.Add(25*time.Second))
+	e := p.observe(1, failed, start.Add(25*time.Second))
+	if e == nil || !e.Partitioned || e.QuorumLost || e.Failed != 3 || e.Alive != 1 {
+		t.Fatalf("bad: %#v", e)
+	}
+	if e.EventType() != EventPartition || e.EventType().String() != "partition" {
+		t.Fatalf("bad: %v", e.EventType())
+	}
+
+	// The partition holds after the window has passed, while the members
+	// are still failed
+	if e := p.observe(1, failed, start.Add(time.Minute)); e != nil {
+		t.Fatalf("bad: %#v", e)
+	}
+
+	// It is over once enough members are back
+	e = p.observe(3, failed[:1], start.Add(2*time.Minute))
+	if e == nil || e.Partitioned {
+		t.Fatalf("bad: %#v", e)
+	}
+}
+
+func TestPartitionMonitor_quorum(t *testing.T) {
+	p := &partitionMonitor{expected: 5}
+	now := time.Now()
+
+	// A node on its own before joining hasn't lost quorum
+	if e := p.observe(1, nil, now); e != nil {
+		t.Fatalf("bad: %#v", e)
+	}
+	if e := p.observe(3, nil, now); e != nil {
+		t.Fatalf("bad: %#v", e)
+	}
+
+	e := p.observe(2, nil, now)
+	if e == nil || !e.QuorumLost || e.Partitioned || e.Alive != 2 || e.Expected != 5 {
+		t.Fatalf("bad: %#v", e)
+	}
+	if e := p.observe(1, nil, now); e != nil {
+		t.Fatalf("bad: %#v", e)
+	}
+
+	e = p.observe(3, nil, now)
+	if e == nil || e.QuorumLost {
+		t.Fatalf("bad: %#v", e)
+	}
+}
+
+func TestSerf_partitionEvent(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	ip3, returnFn3 := testutil.TakeIP()
+	defer returnFn3()
+
+	eventCh := make(chan Event, 64)
+	s1Config := testConfig(t, ip1)
+	s1Config.EventCh = eventCh
+	s1Config.HealthCheckInterval = 10 * time.Millisecond
+	s1Config.PartitionFailureRatio = 0.5
+	s1Config.ExpectedClusterSize = 3
+	// Keep the failed members around long enough to count them
+	s1Config.ReconnectTimeout = time.Hour
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	var others []*Serf
+	for _, ip := range []net.IP{ip2, ip3} {
+		conf := testConfig(t, ip)
+		s, err := Create(conf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer s.Shutdown()
+		if _, err := s1.Join([]string{conf.NodeName + "/" + ip.String()}, false); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		others = append(others, s)
+	}
+	waitUntilNumNodes(t, 3, s1)
+
+	for _, s := range others {
+		if err := s.Shutdown(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-eventCh:
+			pe, ok := e.(PartitionEvent)
+			if !ok {
+				continue
+			}
+			if !pe.Partitioned || !pe.QuorumLost || pe.Alive != 1 || pe.Failed != 2 {
+				t.Fatalf("bad: %#v", pe)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("no partition event")
+		}
+	}
+}
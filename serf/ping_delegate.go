@@ -88,6 +88,20 @@ func (p *pingDelegate) NotifyPingComplete(other *memberlist.Node, rtt time.Durat
 	// more friendly.
 	p.serf.coordCacheLock.Lock()
 	p.serf.coordCache[other.Name] = &coord
-	p.serf.coordCache[p.serf.config.NodeName] = p.serf.coordClient.GetCoordinate()
+	p.serf.coordCache[p.serf.nodeName()] = p.serf.coordClient.GetCoordinate()
 	p.serf.coordCacheLock.Unlock()
+
+	if ch := p.serf.config.CoordinateUpdateCh; ch != nil {
+		p.notifyCoordinate(ch, CoordinateUpdate{Node: other.Name, Coord: coord.Clone()})
+		p.notifyCoordinate(ch, CoordinateUpdate{Node: p.serf.nodeName(), Coord: after})
+	}
+}
+
+// notifyCoordinate does a non-blocking send of a coordinate update.
+func (p *pingDelegate) notifyCoordinate(ch chan<- CoordinateUpdate, update CoordinateUpdate) {
+	select {
+	case ch <- update:
+	default:
+		metrics.IncrCounterWithLabels([]string{"serf", "coordinate", "dropped-update"}, 1, p.serf.metricLabels)
+	}
 }
@@ -45,7 +45,7 @@ type QueryParam struct {
 // DefaultQueryTimeout returns the default timeout value for a query
 // Computed as GossipInterval * QueryTimeoutMult * log(N+1)
 func (s *Serf) DefaultQueryTimeout() time.Duration {
-	n := s.memberlist.NumMembers()
+	n := s.Memberlist().NumMembers()
 	timeout := s.config.MemberlistConfig.GossipInterval
 	timeout *= time.Duration(s.config.QueryTimeoutMult)
 	timeout *= time.Duration(math.Ceil(math.Log10(float64(n + 1))))
@@ -188,7 +188,7 @@ func (r *QueryResponse) sendResponse(nr NodeResponse) error {
 	return nil
 }
 
-// sendResponse sends a response on the response channel ensuring the channel is not closed.
+// sendAck sends an ack on the ack channel ensuring the channel is not closed.
 func (r *QueryResponse) sendAck(nr *messageQueryResponse) error {
 	r.closeLock.Lock()
 	defer r.closeLock.Unlock()
@@ -199,7 +199,7 @@ func (r *QueryResponse) sendAck(nr *messageQueryResponse) error {
 	case r.ackCh <- nr.From:
 		r.acks[nr.From] = struct{}{}
 	default:
-		return errors.New("serf: Failed to deliver query response, dropping")
+		return errors.New("serf: Failed to deliver query ack, dropping")
 	}
 	return nil
 }
@@ -226,7 +226,7 @@ func (s *Serf) shouldProcessQuery(filters [][]byte) bool {
 			// Check if we are being targeted
 			found := false
 			for _, n := range nodes {
-				if n == s.config.NodeName {
+				if n == s.nodeName() {
 					found = true
 					break
 				}
@@ -291,36 +291,43 @@ func (s *Serf) relayResponse(
 		return fmt.Errorf("relayed response exceeds limit of %d bytes", s.config.QueryResponseSizeLimit)
 	}
 
-	// Relay to a random set of peers.
-	localName := s.LocalMember().Name
-	relayMembers := kRandomMembers(int(relayFactor), members, func(m Member) bool {
-		return m.Status != StatusAlive || m.ProtocolMax < 5 || m.Name == localName
-	})
-	for _, m := range relayMembers {
+	// Relay to a random set of peers. Keep going if one of them fails, the
+	// remaining copies are the point of relaying.
+	var firstErr error
+	for _, m := range relayMembers(relayFactor, members, s.nodeName(), nodeName) {
 		udpAddr := net.UDPAddr{IP: m.Addr, Port: int(m.Port)}
 		relayAddr := memberlist.Address{
 			Addr: udpAddr.String(),
 			Name: m.Name,
 		}
-		if err := s.memberlist.SendToAddress(relayAddr, raw); err != nil {
-			return fmt.Errorf("failed to send relay response: %v", err)
+		if err := s.Memberlist().SendToAddress(relayAddr, raw); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to send relay response: %v", err)
 		}
 	}
-	return nil
+	return firstErr
+}
+
+// relayMembers picks up to relayFactor alive members to relay a response
+// through. Neither the local node nor the node the response is destined to
+// are picked, since relaying through either of them adds nothing.
+func relayMembers(relayFactor uint8, members []Member, localName, destName string) []Member {
+	return kRandomMembers(int(relayFactor), members, func(m Member) bool {
+		return m.Status != StatusAlive || m.ProtocolMax < 5 ||
+			m.Name == localName || m.Name == destName
+	})
 }
 
 // kRandomMembers selects up to k members from a given list, optionally
 // filtering by the given filterFunc
 func kRandomMembers(k int, members []Member, filterFunc func(Member) bool) []Member {
-	n := len(members)
 	kMembers := make([]Member, 0, k)
 OUTER:
-	// Probe up to 3*n times, with large n this is not necessary
-	// since k << n, but with small n we want search to be
-	// exhaustive
-	for i := 0; i < 3*n && len(kMembers) < k; i++ {
-		// Get random member
-		idx := rand.Intn(n)
+	// Visit the members in a random order, so the search is exhaustive
+	// even when most of them are filtered out
+	for _, idx := range rand.Perm(len(members)) {
+		if len(kMembers) >= k {
+			break
+		}
 		member := members[idx]
 
 		// Give the filter a shot at it.
@@ -43,6 +43,54 @@ func TestDefaultQuery(t *testing.T) {
 	}
 }
 
+func TestQueryResponse_deliver(t *testing.T) {
+	q := &messageQuery{ID: 1, LTime: 2, Flags: queryFlagAck, Timeout: time.Minute}
+	resp := newQueryResponse(1, q)
+
+	if err := resp.sendAck(&messageQueryResponse{From: "foo"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := resp.sendResponse(NodeResponse{From: "foo"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The channels are sized for one node, so more are dropped
+	if err := resp.sendAck(&messageQueryResponse{From: "bar"}); err == nil {
+		t.Fatalf("should fail")
+	}
+	if err := resp.sendResponse(NodeResponse{From: "bar"}); err == nil {
+		t.Fatalf("should fail")
+	}
+	if _, ok := resp.acks["bar"]; ok {
+		t.Fatalf("bad: %v", resp.acks)
+	}
+	if _, ok := resp.responses["bar"]; ok {
+		t.Fatalf("bad: %v", resp.responses)
+	}
+
+	if resp.Finished() {
+		t.Fatalf("should not be finished")
+	}
+	resp.Close()
+	if !resp.Finished() {
+		t.Fatalf("should be finished")
+	}
+
+	// Once closed, deliveries are silently ignored
+	if err := resp.sendResponse(NodeResponse{From: "baz"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if from, ok := <-resp.AckCh(); !ok || from != "foo" {
+		t.Fatalf("bad: %v %v", from, ok)
+	}
+	if r, ok := <-resp.ResponseCh(); !ok || r.From != "foo" {
+		t.Fatalf("bad: %v %v", r, ok)
+	}
+	if _, ok := <-resp.ResponseCh(); ok {
+		t.Fatalf("should be closed")
+	}
+}
+
 func TestQueryParams_EncodeFilters(t *testing.T) {
 	q := &QueryParam{
 		FilterNodes: []string{"foo", "bar"},
@@ -204,3 +252,30 @@ func Test_kRandomMembers(t *testing.T) {
 		}
 	}
 }
+
+func Test_relayMembers(t *testing.T) {
+	nodes := []Member{
+		{Name: "local", Status: StatusAlive, ProtocolMax: 5},
+		{Name: "dest", Status: StatusAlive, ProtocolMax: 5},
+		{Name: "old", Status: StatusAlive, ProtocolMax: 4},
+		{Name: "failed", Status: StatusFailed, ProtocolMax: 5},
+		{Name: "relay1", Status: StatusAlive, ProtocolMax: 5},
+		{Name: "relay2", Status: StatusAlive, ProtocolMax: 5},
+	}
+
+	for i := 0; i < 10; i++ {
+		relays := relayMembers(3, nodes, "local", "dest")
+		if len(relays) != 2 {
+			t.Fatalf("bad: %v", relays)
+		}
+		for _, m := range relays {
+			if m.Name != "relay1" && m.Name != "relay2" {
+				t.Fatalf("bad relay: %s", m.Name)
+			}
+		}
+	}
+
+	if relays := relayMembers(0, nodes, "local", "dest"); len(relays) != 0 {
+		t.Fatalf("bad: %v", relays)
+	}
+}
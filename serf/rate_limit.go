@@ -0,0 +1,57 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter allows up to limit actions in each fixed window of interval.
+// A nil rateLimiter allows everything, so callers don't need to check
+// whether limiting is enabled.
+type rateLimiter struct {
+	limit    int
+	interval time.Duration
+
+	lock        sync.Mutex
+	windowStart time.Time
+	count       int
+}
+
+// newRateLimiter returns a rateLimiter allowing limit actions per interval,
+// or nil if limit is not positive. An interval of zero means one second.
+func newRateLimiter(limit int, interval time.Duration) *rateLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &rateLimiter{
+		limit:    limit,
+		interval: interval,
+	}
+}
+
+// allow checks if another action is allowed at the given time, and counts
+// it if so.
+func (r *rateLimiter) allow(now time.Time) bool {
+	if r == nil {
+		return true
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if now.Sub(r.windowStart) >= r.interval {
+		r.windowStart = now
+		r.count = 0
+	}
+	if r.count >= r.limit {
+		return false
+	}
+	r.count++
+	return true
+}
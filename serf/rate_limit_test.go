@@ -0,0 +1,36 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if r := newRateLimiter(0, time.Second); r != nil || !r.allow(time.Now()) {
+		t.Fatalf("a zero limit should allow everything")
+	}
+
+	r := newRateLimiter(2, time.Second)
+	now := time.Now()
+	if !r.allow(now) || !r.allow(now.Add(100*time.Millisecond)) {
+		t.Fatalf("should allow up to the limit")
+	}
+	if r.allow(now.Add(900 * time.Millisecond)) {
+		t.Fatalf("should not allow past the limit")
+	}
+
+	// A new window starts once the interval has passed
+	if !r.allow(now.Add(time.Second)) || !r.allow(now.Add(1500*time.Millisecond)) {
+		t.Fatalf("should allow in the next window")
+	}
+	if r.allow(now.Add(1999 * time.Millisecond)) {
+		t.Fatalf("should not allow past the limit")
+	}
+
+	if r := newRateLimiter(1, 0); r.interval != time.Second {
+		t.Fatalf("bad: %v", r.interval)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// reachIndirectChecks is the number of other members asked to probe a
+	// member that didn't answer our direct ping, as memberlist does before
+	// suspecting a node.
+	reachIndirectChecks = 3
+
+	// reachRelayFactor is the relay factor used for reach queries, so
+	// that the answers still make it back to us over a broken path.
+	reachRelayFactor = 2
+)
+
+// reachRequest asks a member to ping another member on our behalf
+type reachRequest struct {
+	Node string
+	Addr []byte
+	Port uint16
+}
+
+// nodeReachResponse is the answer from a single member to a reach query
+type nodeReachResponse struct {
+	// Reachable is true if the member could ping the requested node
+	Reachable bool
+}
+
+// ReachabilityResponse is used to relay the results of a reachability check
+type ReachabilityResponse struct {
+	// NumNodes is the number of members that were probed
+	NumNodes int
+
+	// Reachable holds the sorted names of the members that answered a
+	// direct ping. Unreachable holds the members that didn't, but that
+	// other members could reach, so the path between us and them is
+	// broken in at least one direction.
+	Reachable   []string
+	Unreachable []string
+}
+
+// Asymmetric returns true if some members can reach us directly and
+// others can't.
+func (r *ReachabilityResponse) Asymmetric() bool {
+	return len(r.Reachable) > 0 && len(r.Unreachable) > 0
+}
+
+// CheckReachability pings every other alive member directly. A member
+// that doesn't answer is probed indirectly through other members, and is
+// reported as unreachable if any of them could reach it. Members that no
+// one could reach are likely down, and are not included in either list.
+func (s *Serf) CheckReachability() (*ReachabilityResponse, error) {
+	localName := s.nodeName()
+	members := s.Members()
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	resp := &ReachabilityResponse{}
+	for _, m := range members {
+		if m.Status != StatusAlive || m.Name == localName {
+			continue
+		}
+		resp.NumNodes++
+
+		wg.Add(1)
+		go func(m Member) {
+			defer wg.Done()
+			addr := &net.UDPAddr{IP: m.Addr, Port: int(m.Port)}
+			if _, err := s.Memberlist().Ping(m.Name, addr); err == nil {
+				lock.Lock()
+				resp.Reachable = append(resp.Reachable, m.Name)
+				lock.Unlock()
+				return
+			}
+
+			reachable, err := s.probeIndirect(m, members)
+			if err != nil {
+				s.logger.Printf("[ERR] serf: Failed to probe %s indirectly: %v", m.Name, err)
+				return
+			}
+			if reachable {
+				lock.Lock()
+				resp.Unreachable = append(resp.Unreachable, m.Name)
+				lock.Unlock()
+			}
+		}(m)
+	}
+	wg.Wait()
+
+	sort.Strings(resp.Reachable)
+	sort.Strings(resp.Unreachable)
+	return resp, nil
+}
+
+// probeIndirect asks up to reachIndirectChecks other members to ping the
+// given member, and returns true if any of them could.
+func (s *Serf) probeIndirect(target Member, members []Member) (bool, error) {
+	localName := s.nodeName()
+	peers := kRandomMembers(reachIndirectChecks, members, func(m Member) bool {
+		return m.Status != StatusAlive || m.Name == localName || m.Name == target.Name
+	})
+	if len(peers) == 0 {
+		return false, nil
+	}
+
+	req := reachRequest{
+		Node: target.Name,
+		Addr: target.Addr,
+		Port: target.Port,
+	}
+	buf, err := encodeMessage(messageReachRequestType, &req)
+	if err != nil {
+		return false, err
+	}
+
+	params := s.DefaultQueryParams()
+	params.RelayFactor = reachRelayFactor
+	for _, m := range peers {
+		params.FilterNodes = append(params.FilterNodes, m.Name)
+	}
+
+	// Leave time for the ping on top of the usual query timeout
+	params.Timeout += s.config.MemberlistConfig.ProbeTimeout
+
+	queryResp, err := s.Query(internalQueryName(reachQuery), buf, params)
+	if err != nil {
+		return false, err
+	}
+	defer queryResp.Close()
+
+	numResp := 0
+	for r := range queryResp.respCh {
+		var reach nodeReachResponse
+		if len(r.Payload) < 1 || messageType(r.Payload[0]) != messageReachResponseType {
+			s.logger.Printf("[ERR] serf: Invalid reach query response type from %s", r.From)
+			continue
+		}
+		if err := decodeMessage(r.Payload[1:], &reach); err != nil {
+			s.logger.Printf("[ERR] serf: Failed to decode reach query response from %s: %v", r.From, err)
+			continue
+		}
+		if reach.Reachable {
+			return true, nil
+		}
+
+		// Return early if all peers have responded
+		numResp++
+		if numResp == len(peers) {
+			break
+		}
+	}
+	return false, nil
+}
+
+// checkReachability periodically checks which members we can reach
+// directly, and warns if only some of them can.
+func (s *Serf) checkReachability() {
+	for {
+		select {
+		case <-time.After(s.config.ReachabilityCheckInterval):
+			resp, err := s.CheckReachability()
+			if err != nil {
+				s.logger.Printf("[DEBUG] serf: Reachability check failed: %v", err)
+				continue
+			}
+
+			if resp.Asymmetric() {
+				s.logger.Printf("[WARN] serf: Asymmetric connectivity: reachable from %v but not from %v",
+					resp.Reachable, resp.Unreachable)
+			} else if len(resp.Unreachable) > 0 {
+				s.logger.Printf("[WARN] serf: Not directly reachable from any of %v", resp.Unreachable)
+			}
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"log"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
+)
+
+// oneWayTransport is a mock transport that silently drops every packet
+// sent to a single address, so the node using it can be reached from
+// that address but can't send packets back to it.
+type oneWayTransport struct {
+	memberlist.NodeAwareTransport
+	blocked string
+}
+
+func (t *oneWayTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	if addr == t.blocked {
+		return time.Now(), nil
+	}
+	return t.NodeAwareTransport.WriteTo(b, addr)
+}
+
+func (t *oneWayTransport) WriteToAddress(b []byte, addr memberlist.Address) (time.Time, error) {
+	if addr.Addr == t.blocked {
+		return time.Now(), nil
+	}
+	return t.NodeAwareTransport.WriteToAddress(b, addr)
+}
+
+func TestSerf_CheckReachability_asymmetric(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	ip3, returnFn3 := testutil.TakeIP()
+	defer returnFn3()
+
+	logs := &syncBuffer{}
+	s1Config := testConfig(t, ip1)
+	s1Config.ReachabilityCheckInterval = 200 * time.Millisecond
+	s1Config.Logger = log.New(logs, "", log.LstdFlags)
+
+	// s2 can't send packets to s1, so it can't answer s1's pings and s1 can
+	// only reach it indirectly through s3
+	s2Config := testConfig(t, ip2)
+	port := s2Config.MemberlistConfig.BindPort
+	nt, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+		BindAddrs: []string{ip2.String()},
+		BindPort:  port,
+		Logger:    s2Config.Logger,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s2Config.MemberlistConfig.Transport = &oneWayTransport{
+		NodeAwareTransport: nt,
+		blocked:            net.JoinHostPort(ip1.String(), strconv.Itoa(s1Config.MemberlistConfig.BindPort)),
+	}
+
+	s3Config := testConfig(t, ip3)
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	s3, err := Create(s3Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s3.Shutdown()
+
+	_, err = s1.Join([]string{
+		s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr,
+		s3Config.NodeName + "/" + s3Config.MemberlistConfig.BindAddr,
+	}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 3, s1, s2, s3)
+
+	retry.Run(t, func(r *retry.R) {
+		resp, err := s1.CheckReachability()
+		if err != nil {
+			r.Fatalf("err: %v", err)
+		}
+		if !resp.Asymmetric() {
+			r.Fatalf("bad: %#v", resp)
+		}
+		if !reflect.DeepEqual(resp.Reachable, []string{s3Config.NodeName}) {
+			r.Fatalf("bad: %#v", resp)
+		}
+		if !reflect.DeepEqual(resp.Unreachable, []string{s2Config.NodeName}) {
+			r.Fatalf("bad: %#v", resp)
+		}
+	})
+
+	expected := "[WARN] serf: Asymmetric connectivity: reachable from [" +
+		s3Config.NodeName + "] but not from [" + s2Config.NodeName + "]"
+	retry.Run(t, func(r *retry.R) {
+		if !strings.Contains(logs.String(), expected) {
+			r.Fatalf("missing warning in logs")
+		}
+	})
+
+	// Fully connected nodes see no asymmetry
+	resp, err := s3.CheckReachability()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Asymmetric() || len(resp.Unreachable) != 0 {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
@@ -8,13 +8,14 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"os"
+	"reflect"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -30,7 +31,7 @@ import (
 // version to memberlist below.
 const (
 	ProtocolVersionMin uint8 = 2
-	ProtocolVersionMax       = 5
+	ProtocolVersionMax       = 6
 )
 
 const (
@@ -58,6 +59,21 @@ type ReconnectTimeoutOverrider interface {
 	ReconnectTimeout(member *Member, timeout time.Duration) time.Duration
 }
 
+// Reconnecter is an interface that can be implemented to customize or observe
+// the attempts to reconnect to failed members, such as to look up the new
+// address of a member whose address changed after it failed.
+type Reconnecter interface {
+	// Reconnect is called before an attempt to reconnect to a failed member,
+	// with the address it was last known at and the number of the attempt,
+	// starting at 1. It returns the address to try, which may be a host
+	// name, or false to skip the attempt.
+	Reconnect(member *Member, addr string, attempt int) (string, bool)
+
+	// ReconnectResult is called after an attempt, with the address that was
+	// tried and the error if the member couldn't be reached.
+	ReconnectResult(member *Member, addr string, err error)
+}
+
 // Serf is a single node that is part of a single cluster that gets
 // events about joins/leaves/failures/etc. It is created with the Create
 // method.
@@ -74,10 +90,18 @@ type Serf struct {
 	config        *Config
 	failedMembers []*memberState
 	leftMembers   []*memberState
-	memberlist    *memberlist.Memberlist
+	memberlist    atomic.Value // *memberlist.Memberlist, replaced by Rename and Pause
+	name          atomic.Value // string, the node name, replaced by Rename
+	transport     *sharedTransport
 	memberLock    sync.RWMutex
 	members       map[string]*memberState
 
+	// memberSubs are the subscribers to member events, see
+	// SubscribeMembers. The memberLock protects this structure, and
+	// memberSubsClosed, which is set once Serf is shut down.
+	memberSubs       map[*MemberSubscription]struct{}
+	memberSubsClosed bool
+
 	// recentIntents the lamport time and type of intent for a given node in
 	// case we get an intent before the relevant memberlist event. This is
 	// indexed by node, and always store the latest lamport time / intent
@@ -87,14 +111,17 @@ type Serf struct {
 	eventBroadcasts *memberlist.TransmitLimitedQueue
 	eventBuffer     []*userEvents
 	eventJoinIgnore atomic.Value
+	paused          atomic.Value
 	eventMinTime    LamportTime
 	eventLock       sync.RWMutex
+	eventLimiter    *rateLimiter
 
 	queryBroadcasts *memberlist.TransmitLimitedQueue
 	queryBuffer     []*queries
 	queryMinTime    LamportTime
 	queryResponse   map[LamportTime]*QueryResponse
 	queryLock       sync.RWMutex
+	queryLimiter    *rateLimiter
 
 	logger     *log.Logger
 	joinLock   sync.Mutex
@@ -105,6 +132,10 @@ type Serf struct {
 	snapshotter *Snapshotter
 	keyManager  *KeyManager
 
+	// conflictResolving is set while a name conflict resolution query is
+	// running, so repeated conflict notifications don't start more.
+	conflictResolving int32
+
 	coordClient    *coordinate.Client
 	coordCache     map[string]*coordinate.Coordinate
 	coordCacheLock sync.RWMutex
@@ -192,6 +223,18 @@ type memberState struct {
 	Member
 	statusLTime LamportTime // lamport clock time of last received message
 	leaveTime   time.Time   // wall clock time of leave
+	statusTime  time.Time   // wall clock time of last status change
+
+	reconnectAttempts int // attempts to reconnect since the member failed
+}
+
+// setStatus updates the status of the member, recording the time of the
+// change if it is a new status.
+func (m *memberState) setStatus(status MemberStatus) {
+	if m.Status != status {
+		m.Status = status
+		m.statusTime = time.Now()
+	}
 }
 
 // nodeIntent is used to buffer intents for out-of-order deliveries.
@@ -239,6 +282,8 @@ type queries struct {
 const (
 	snapshotSizeLimit  = 128 * 1024 // Maximum 128 KB snapshot
 	UserEventSizeLimit = 9 * 1024   // Maximum 9KB for event name and payload
+
+	MaxLeaveBroadcastRepeat = 5 // Maximum extra leave intent broadcasts
 )
 
 // Create creates a new Serf instance, starting all the background tasks
@@ -260,6 +305,10 @@ func Create(conf *Config) (*Serf, error) {
 		return nil, fmt.Errorf("user event size limit exceeds limit of %d bytes", UserEventSizeLimit)
 	}
 
+	if conf.EventBuffer <= 0 || conf.QueryBuffer <= 0 {
+		return nil, fmt.Errorf("EventBuffer and QueryBuffer must be positive")
+	}
+
 	logger := conf.Logger
 	if logger == nil {
 		logOutput := conf.LogOutput
@@ -277,12 +326,16 @@ func Create(conf *Config) (*Serf, error) {
 		shutdownCh:    make(chan struct{}),
 		state:         SerfAlive,
 		metricLabels:  conf.MetricLabels,
+		eventLimiter:  newRateLimiter(conf.UserEventRateLimit, conf.RateLimitInterval),
+		queryLimiter:  newRateLimiter(conf.QueryRateLimit, conf.RateLimitInterval),
 	}
 	serf.eventJoinIgnore.Store(false)
+	serf.paused.Store(false)
+	serf.name.Store(conf.NodeName)
 
 	// Check that the meta data length is okay
-	if len(serf.encodeTags(conf.Tags)) > memberlist.MetaMaxSize {
-		return nil, fmt.Errorf("Encoded length of tags exceeds limit of %d bytes", memberlist.MetaMaxSize)
+	if err := serf.ValidateTags(conf.Tags); err != nil {
+		return nil, err
 	}
 	if err := serf.ValidateNodeNames(); err != nil {
 		return nil, err
@@ -332,9 +385,14 @@ func Create(conf *Config) (*Serf, error) {
 	var oldClock, oldEventClock, oldQueryClock LamportTime
 	var prev []*PreviousNode
 	if conf.SnapshotPath != "" {
-		eventCh, snap, err := NewSnapshotter(
+		compactSize := conf.SnapshotCompactionThreshold
+		if compactSize <= 0 {
+			compactSize = snapshotSizeLimit
+		}
+		eventCh, snap, err := NewSnapshotterWithCompactInterval(
 			conf.SnapshotPath,
-			snapshotSizeLimit,
+			compactSize,
+			conf.SnapshotMinCompactionInterval,
 			conf.RejoinAfterLeave,
 			serf.logger,
 			&serf.clock,
@@ -346,7 +404,13 @@ func Create(conf *Config) (*Serf, error) {
 		snap.metricLabels = serf.metricLabels
 		serf.snapshotter = snap
 		conf.EventCh = eventCh
-		prev = snap.AliveNodes()
+		if limit := conf.SnapshotReplayLimit; limit > 0 && snap.NumAliveNodes() > limit {
+			serf.logger.Printf("[WARN] serf: Snapshot has %d alive members, only replaying the %d most recent",
+				snap.NumAliveNodes(), limit)
+			prev = snap.RecentAliveNodes(limit)
+		} else {
+			prev = snap.AliveNodes()
+		}
 		oldClock = snap.LastClock()
 		oldEventClock = snap.LastEventClock()
 		oldQueryClock = snap.LastQueryClock()
@@ -416,14 +480,23 @@ func Create(conf *Config) (*Serf, error) {
 
 	conf.MemberlistConfig.MetricLabels = conf.MetricLabels
 
+	// Keep hold of the transport so it survives swapping out the memberlist
+	transport, err := newSharedTransport(conf.MemberlistConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create memberlist: %v", err)
+	}
+	serf.transport = transport
+	conf.MemberlistConfig.Transport = transport
+
 	// Create the underlying memberlist that will manage membership
 	// and failure detection for the Serf instance.
 	memberlist, err := memberlist.Create(conf.MemberlistConfig)
 	if err != nil {
+		transport.close()
 		return nil, fmt.Errorf("Failed to create memberlist: %v", err)
 	}
 
-	serf.memberlist = memberlist
+	serf.memberlist.Store(memberlist)
 
 	// Create a key manager for handling all encryption key changes
 	serf.keyManager = &KeyManager{serf: serf}
@@ -435,6 +508,18 @@ func Create(conf *Config) (*Serf, error) {
 	go serf.checkQueueDepth("Intent", serf.broadcasts)
 	go serf.checkQueueDepth("Event", serf.eventBroadcasts)
 	go serf.checkQueueDepth("Query", serf.queryBroadcasts)
+	if conf.HealthScoreThreshold > 0 && conf.EventCh != nil {
+		go serf.monitorHealthScore()
+	}
+	if (conf.PartitionFailureRatio > 0 || conf.ExpectedClusterSize > 0) && conf.EventCh != nil {
+		go serf.monitorPartitions()
+	}
+	if conf.VersionCheckInterval > 0 {
+		go serf.checkVersionDrift()
+	}
+	if conf.ReachabilityCheckInterval > 0 {
+		go serf.checkReachability()
+	}
 
 	// Attempt to re-join the cluster if we have known nodes
 	if len(prev) != 0 {
@@ -521,11 +606,23 @@ func (s *Serf) UserEvent(name string, payload []byte, coalesce bool) error {
 	s.handleUserEvent(&msg)
 
 	s.eventBroadcasts.QueueBroadcast(&broadcast{
-		msg: raw,
+		msg: s.compressMessage(raw),
 	})
 	return nil
 }
 
+// compressMessage compresses an encoded message if it is larger than the
+// CompressionThreshold. Only protocol version 6 and newer understand
+// compressed messages, so nothing is compressed when speaking an older
+// version.
+func (s *Serf) compressMessage(raw []byte) []byte {
+	if s.ProtocolVersion() < 6 || s.config.CompressionThreshold <= 0 ||
+		len(raw) <= s.config.CompressionThreshold {
+		return raw
+	}
+	return compressMessage(raw)
+}
+
 // Query is used to broadcast a new query. The query must be fairly small,
 // and an error will be returned if the size limit is exceeded. This is only
 // available with protocol version 4 and newer. Query parameters are optional,
@@ -544,7 +641,7 @@ func (s *Serf) Query(name string, payload []byte, params *QueryParam) (*QueryRes
 	}
 
 	// Get the local node
-	local := s.memberlist.LocalNode()
+	local := s.Memberlist().LocalNode()
 
 	// Encode the filters
 	filters, err := params.encodeFilters()
@@ -585,7 +682,7 @@ func (s *Serf) Query(name string, payload []byte, params *QueryParam) (*QueryRes
 	}
 
 	// Register QueryResponse to track acks and responses
-	resp := newQueryResponse(s.memberlist.NumMembers(), &q)
+	resp := newQueryResponse(s.Memberlist().NumMembers(), &q)
 	s.registerQueryResponse(params.Timeout, resp)
 
 	// Process query locally
@@ -622,22 +719,24 @@ func (s *Serf) registerQueryResponse(timeout time.Duration, resp *QueryResponse)
 // the cluster. Blocks until a the message is broadcast out.
 func (s *Serf) SetTags(tags map[string]string) error {
 	// Check that the meta data length is okay
-	if len(s.encodeTags(tags)) > memberlist.MetaMaxSize {
-		return fmt.Errorf("Encoded length of tags exceeds limit of %d bytes",
-			memberlist.MetaMaxSize)
+	if err := s.ValidateTags(tags); err != nil {
+		return err
 	}
 
 	// Update the config
 	s.config.Tags = tags
 
 	// Trigger a memberlist update
-	return s.memberlist.UpdateNode(s.config.BroadcastTimeout)
+	return s.Memberlist().UpdateNode(s.config.BroadcastTimeout)
 }
 
 // Join joins an existing Serf cluster. Returns the number of nodes
 // successfully contacted. The returned error will be non-nil only in the
 // case that no nodes could be contacted. If ignoreOld is true, then any
-// user messages sent prior to the join will be ignored.
+// user messages sent prior to the join will be ignored. Otherwise the
+// user events still buffered by the contacted nodes are replayed, which
+// is rarely wanted by nodes that rejoin without a snapshot, since they
+// would handle the same events again.
 func (s *Serf) Join(existing []string, ignoreOld bool) (int, error) {
 	// Do a quick state check
 	if s.State() != SerfAlive {
@@ -658,7 +757,7 @@ func (s *Serf) Join(existing []string, ignoreOld bool) (int, error) {
 	}
 
 	// Have memberlist attempt to join
-	num, err := s.memberlist.Join(existing)
+	num, err := s.Memberlist().Join(existing)
 
 	// If we joined any nodes, broadcast the join message
 	if num > 0 {
@@ -679,7 +778,7 @@ func (s *Serf) broadcastJoin(ltime LamportTime) error {
 	// Construct message to update our lamport clock
 	msg := messageJoin{
 		LTime: ltime,
-		Node:  s.config.NodeName,
+		Node:  s.nodeName(),
 	}
 	s.clock.Witness(ltime)
 
@@ -713,15 +812,34 @@ func (s *Serf) Leave() error {
 	s.state = SerfLeaving
 	s.stateLock.Unlock()
 
+	// Our leave intent has to be gossiped out
+	s.paused.Store(false)
+
 	// If we have a snapshot, mark we are leaving
 	if s.snapshotter != nil {
 		s.snapshotter.Leave()
 	}
 
+	if err := s.leaveCluster(); err != nil {
+		return err
+	}
+
+	// Transition to Left only if we not already shutdown
+	s.stateLock.Lock()
+	if s.state != SerfShutdown {
+		s.state = SerfLeft
+	}
+	s.stateLock.Unlock()
+	return nil
+}
+
+// leaveCluster gracefully leaves the cluster under the current node name,
+// broadcasting our leave intent and waiting for it to propagate.
+func (s *Serf) leaveCluster() error {
 	// Construct the message for the graceful leave
 	msg := messageLeave{
 		LTime: s.clock.Time(),
-		Node:  s.config.NodeName,
+		Node:  s.nodeName(),
 	}
 	s.clock.Increment()
 
@@ -741,10 +859,14 @@ func (s *Serf) Leave() error {
 		case <-time.After(s.config.BroadcastTimeout):
 			s.logger.Printf("[WARN] serf: timeout while waiting for graceful leave")
 		}
+
+		if err := s.repeatLeaveBroadcast(&msg); err != nil {
+			return err
+		}
 	}
 
 	// Attempt the memberlist leave
-	err := s.memberlist.Leave(s.config.BroadcastTimeout)
+	err := s.Memberlist().Leave(s.config.BroadcastTimeout)
 	if err != nil {
 		s.logger.Printf("[WARN] serf: timeout waiting for leave broadcast: %s", err.Error())
 	}
@@ -755,16 +877,229 @@ func (s *Serf) Leave() error {
 	// cluster. In particular, we want to stay up long enough to service
 	// any probes from other nodes before they learn about us leaving.
 	time.Sleep(s.config.LeavePropagateDelay)
+	return nil
+}
+
+// Rename changes the name of the local node while it is running. Node
+// names are the identity used by the gossip layer, so this is done by
+// gracefully leaving the cluster under the old name and then rejoining
+// the members we currently know about under the new name, keeping our
+// tags and Lamport clocks. For a time both names will be visible to the
+// cluster: the old name shows up as left until it is reaped after the
+// TombstoneTimeout, while the new name shows up as a freshly joined member.
+func (s *Serf) Rename(newName string) error {
+	if newName == "" {
+		return fmt.Errorf("Node name cannot be empty")
+	}
+	if err := s.validateNodeName(newName); err != nil {
+		return err
+	}
+	// Hold the joinLock so we don't race with a Join, or another Rename
+	s.joinLock.Lock()
+	defer s.joinLock.Unlock()
+
+	if newName == s.nodeName() {
+		return nil
+	}
 
-	// Transition to Left only if we not already shutdown
 	s.stateLock.Lock()
-	if s.state != SerfShutdown {
-		s.state = SerfLeft
+	if s.state != SerfAlive {
+		s.stateLock.Unlock()
+		return fmt.Errorf("Serf can't Rename after Leave or Shutdown")
+	}
+	s.state = SerfLeaving
+	s.stateLock.Unlock()
+
+	// Snag the members we should rejoin under the new name
+	oldName := s.nodeName()
+	existing := s.aliveMemberAddrs()
+
+	if err := s.leaveCluster(); err != nil {
+		s.stateLock.Lock()
+		if s.state == SerfLeaving {
+			s.state = SerfAlive
+		}
+		s.stateLock.Unlock()
+		return err
+	}
+
+	// Swap out the memberlist for one using the new name. The old one must
+	// be shutdown first so that it stops reading from the transport.
+	if err := s.Memberlist().Shutdown(); err != nil {
+		s.stateLock.Lock()
+		if s.state == SerfLeaving {
+			s.state = SerfAlive
+		}
+		s.stateLock.Unlock()
+		return fmt.Errorf("Failed to shutdown memberlist: %v", err)
+	}
+
+	mlConfig := s.memberlistConfig()
+	mlConfig.Name = newName
+	ml, err := memberlist.Create(mlConfig)
+	if err != nil {
+		s.stateLock.Lock()
+		if s.state == SerfLeaving {
+			s.state = SerfLeft
+		}
+		s.stateLock.Unlock()
+		return fmt.Errorf("Failed to create memberlist: %v", err)
+	}
+	s.name.Store(newName)
+	s.memberlist.Store(ml)
+
+	// Carry our coordinate over to the new name
+	s.coordCacheLock.Lock()
+	if coord, ok := s.coordCache[oldName]; ok {
+		delete(s.coordCache, oldName)
+		s.coordCache[newName] = coord
+	}
+	s.coordCacheLock.Unlock()
+	s.logger.Printf("[INFO] serf: Renamed node '%s' to '%s'", oldName, newName)
+
+	s.stateLock.Lock()
+	if s.state == SerfLeaving {
+		s.state = SerfAlive
 	}
 	s.stateLock.Unlock()
+
+	// Rejoin the cluster under the new name
+	if len(existing) == 0 {
+		return nil
+	}
+	if _, err := ml.Join(existing); err != nil {
+		return fmt.Errorf("Failed to rejoin after rename: %v", err)
+	}
+	return nil
+}
+
+// Pause stops this node from actively spreading gossip without leaving
+// the cluster, which is useful to reduce its load during maintenance.
+// While paused:
+//
+//   - Serf broadcasts are no longer piggybacked onto outgoing messages:
+//     our own user events, queries and join and leave intents as well as
+//     those we would relay for others. Anything queued is sent once Resume
+//     is called.
+//   - We don't start any memberlist probes, gossip or push/pull state
+//     syncs of our own, and we stop attempting to reconnect to failed
+//     members. This node won't notice failed members until it resumes.
+//   - Push/pull state syncs started by others leave out our buffered user
+//     events, so peers can't pick them up that way either.
+//
+// The following carry on as usual, so the rest of the cluster still
+// considers this node healthy:
+//
+//   - Acks for probes sent to us, and refuting suspicions about us.
+//   - Push/pull state syncs of the member list started by others.
+//   - Handling gossip, events and queries we receive, including sending
+//     query responses and acks, which go directly to the querying node.
+//
+// Memberlist can't stop its probes and gossip once started, so Pause and
+// Resume replace it with a new one, quietly rejoining the members we know
+// about.
+func (s *Serf) Pause() error {
+	s.joinLock.Lock()
+	defer s.joinLock.Unlock()
+
+	if s.State() != SerfAlive {
+		return fmt.Errorf("Serf can't Pause after Leave or Shutdown")
+	}
+	if s.Paused() {
+		return nil
+	}
+	s.logger.Printf("[INFO] serf: Pausing gossip")
+	s.paused.Store(true)
+	return s.restartMemberlist()
+}
+
+// Resume undoes a Pause, restarting our gossip participation
+func (s *Serf) Resume() {
+	s.joinLock.Lock()
+	defer s.joinLock.Unlock()
+
+	if !s.Paused() {
+		return
+	}
+	s.logger.Printf("[INFO] serf: Resuming gossip")
+	s.paused.Store(false)
+	if s.State() != SerfAlive {
+		return
+	}
+	if err := s.restartMemberlist(); err != nil {
+		s.logger.Printf("[ERR] serf: Failed to resume gossip: %v", err)
+	}
+}
+
+// restartMemberlist replaces the running memberlist with a new one so it
+// picks up whether we are paused, and rejoins the members we know about.
+// The joinLock must be held.
+func (s *Serf) restartMemberlist() error {
+	existing := s.aliveMemberAddrs()
+	if err := s.Memberlist().Shutdown(); err != nil {
+		return fmt.Errorf("Failed to shutdown memberlist: %v", err)
+	}
+	ml, err := memberlist.Create(s.memberlistConfig())
+	if err != nil {
+		s.stateLock.Lock()
+		if s.state == SerfAlive {
+			s.state = SerfLeft
+		}
+		s.stateLock.Unlock()
+		return fmt.Errorf("Failed to create memberlist: %v", err)
+	}
+	s.memberlist.Store(ml)
+
+	if len(existing) == 0 {
+		return nil
+	}
+	if _, err := ml.Join(existing); err != nil {
+		s.logger.Printf("[WARN] serf: Failed to rejoin members: %v", err)
+	}
 	return nil
 }
 
+// memberlistConfig returns a copy of the memberlist config to create a
+// replacement memberlist from, since the running one keeps a pointer to
+// its config. While paused, the copy has probes, gossip and push/pull
+// syncs turned off.
+func (s *Serf) memberlistConfig() *memberlist.Config {
+	conf := *s.config.MemberlistConfig
+	conf.Name = s.nodeName()
+
+	// The keyring was set up by the first memberlist and may have been
+	// changed since, so don't have memberlist add the key back in
+	conf.SecretKey = nil
+	if s.Paused() {
+		conf.ProbeInterval = 0
+		conf.GossipInterval = 0
+		conf.PushPullInterval = 0
+	}
+	return &conf
+}
+
+// aliveMemberAddrs returns the other alive members in the "name/addr"
+// form Join takes, for rejoining them with a new memberlist.
+func (s *Serf) aliveMemberAddrs() []string {
+	self := s.nodeName()
+	var addrs []string
+	s.memberLock.RLock()
+	defer s.memberLock.RUnlock()
+	for name, m := range s.members {
+		if name == self || m.Status != StatusAlive {
+			continue
+		}
+		addr := net.JoinHostPort(m.Addr.String(), strconv.Itoa(int(m.Port)))
+		addrs = append(addrs, m.Name+"/"+addr)
+	}
+	return addrs
+}
+
+// Paused returns true if gossip has been paused with Pause
+func (s *Serf) Paused() bool {
+	return s.paused.Load().(bool)
+}
+
 // hasAliveMembers is called to check for any alive members other than
 // ourself.
 func (s *Serf) hasAliveMembers() bool {
@@ -774,7 +1109,7 @@ func (s *Serf) hasAliveMembers() bool {
 	hasAlive := false
 	for _, m := range s.members {
 		// Skip ourself, we want to know if OTHER members are alive
-		if m.Name == s.config.NodeName {
+		if m.Name == s.nodeName() {
 			continue
 		}
 
@@ -790,24 +1125,57 @@ func (s *Serf) hasAliveMembers() bool {
 func (s *Serf) LocalMember() Member {
 	s.memberLock.RLock()
 	defer s.memberLock.RUnlock()
-	return s.members[s.config.NodeName].Member
+	return copyMember(s.members[s.nodeName()].Member)
 }
 
 // Members returns a point-in-time snapshot of the members of this cluster.
+// The members are copies, so callers are free to modify them.
 func (s *Serf) Members() []Member {
 	s.memberLock.RLock()
 	defer s.memberLock.RUnlock()
 
 	members := make([]Member, 0, len(s.members))
 	for _, m := range s.members {
-		members = append(members, m.Member)
+		members = append(members, copyMember(m.Member))
 	}
 
 	return members
 }
 
+// copyMember returns a copy of m that shares no memory with it.
+func copyMember(m Member) Member {
+	if m.Addr != nil {
+		m.Addr = append(net.IP(nil), m.Addr...)
+	}
+	if m.Tags != nil {
+		tags := make(map[string]string, len(m.Tags))
+		for k, v := range m.Tags {
+			tags[k] = v
+		}
+		m.Tags = tags
+	}
+	return m
+}
+
+// MemberStatusTimes returns the wall clock time at which each known
+// member last changed status, as seen by this node, keyed by member
+// name. A member that has not changed status since it was first seen
+// reports the time it was first seen.
+func (s *Serf) MemberStatusTimes() map[string]time.Time {
+	s.memberLock.RLock()
+	defer s.memberLock.RUnlock()
+
+	times := make(map[string]time.Time, len(s.members))
+	for name, m := range s.members {
+		times[name] = m.statusTime
+	}
+	return times
+}
+
 // RemoveFailedNode is a backwards compatible form
-// of forceleave
+// of forceleave. The removal is broadcast to the cluster, so it propagates
+// even if this node goes away afterwards. The local node can't be removed
+// this way, use Leave instead.
 func (s *Serf) RemoveFailedNode(node string) error {
 	return s.forceLeave(node, false)
 }
@@ -816,11 +1184,20 @@ func (s *Serf) RemoveFailedNodePrune(node string) error {
 	return s.forceLeave(node, true)
 }
 
-// ForceLeave forcibly removes a failed node from the cluster
+// forceLeave forcibly removes a failed node from the cluster
 // immediately, instead of waiting for the reaper to eventually reclaim it.
 // This also has the effect that Serf will no longer attempt to reconnect
 // to this node.
 func (s *Serf) forceLeave(node string, prune bool) error {
+	if node == "" {
+		return fmt.Errorf("A node name is required to force leave")
+	}
+
+	// We would only refute our own leave intent, so don't send one
+	if node == s.nodeName() {
+		return fmt.Errorf("Can't force leave the local node %q, use Leave instead", node)
+	}
+
 	// Construct the message to broadcast
 	msg := messageLeave{
 		LTime: s.clock.Time(),
@@ -875,12 +1252,17 @@ func (s *Serf) Shutdown() error {
 
 	// Wait to close the shutdown channel until after we've shut down the
 	// memberlist and its associated network resources, since the shutdown
-	// channel signals that we are cleaned up outside of Serf.
+	// channel signals that we are cleaned up outside of Serf. The transport
+	// goes first, as memberlist would do if it owned it.
 	s.state = SerfShutdown
-	err := s.memberlist.Shutdown()
+	if err := s.transport.close(); err != nil {
+		s.logger.Printf("[ERR] serf: Failed to shutdown transport: %v", err)
+	}
+	err := s.Memberlist().Shutdown()
 	if err != nil {
 		return err
 	}
+	s.closeMemberSubs()
 	close(s.shutdownCh)
 
 	// Wait for the snapshoter to finish if we have one
@@ -899,7 +1281,17 @@ func (s *Serf) ShutdownCh() <-chan struct{} {
 
 // Memberlist is used to get access to the underlying Memberlist instance
 func (s *Serf) Memberlist() *memberlist.Memberlist {
-	return s.memberlist
+	ml, _ := s.memberlist.Load().(*memberlist.Memberlist)
+	return ml
+}
+
+// nodeName returns the current name of this node. It should be used
+// instead of reading config.NodeName, which is not updated by Rename.
+func (s *Serf) nodeName() string {
+	if name, ok := s.name.Load().(string); ok {
+		return name
+	}
+	return s.config.NodeName
 }
 
 // State is the current state of this Serf instance.
@@ -909,6 +1301,58 @@ func (s *Serf) State() SerfState {
 	return s.state
 }
 
+// MemberTime returns the current value of the Lamport clock used to order
+// membership intents.
+func (s *Serf) MemberTime() LamportTime {
+	return s.clock.Time()
+}
+
+// EventTime returns the current value of the Lamport clock used to order
+// user events. A UserEvent with an LTime below this was sent before the
+// most recent event this node has seen.
+func (s *Serf) EventTime() LamportTime {
+	return s.eventClock.Time()
+}
+
+// QueryTime returns the current value of the Lamport clock used to order
+// queries.
+func (s *Serf) QueryTime() LamportTime {
+	return s.queryClock.Time()
+}
+
+// repeatLeaveBroadcast sends the leave intent again as configured by
+// LeaveBroadcastRepeat, in case the first broadcast was lost. All of the
+// repeats together are bounded by the broadcast timeout.
+func (s *Serf) repeatLeaveBroadcast(msg *messageLeave) error {
+	repeats := s.config.LeaveBroadcastRepeat
+	if repeats > MaxLeaveBroadcastRepeat {
+		repeats = MaxLeaveBroadcastRepeat
+	}
+
+	deadline := time.Now().Add(s.config.BroadcastTimeout)
+	for i := 0; i < repeats; i++ {
+		wait := s.config.LeaveBroadcastInterval
+		if remaining := time.Until(deadline); wait > remaining {
+			s.logger.Printf("[WARN] serf: stopping leave broadcast repeats after %d of %d", i, repeats)
+			return nil
+		}
+		time.Sleep(wait)
+
+		notifyCh := make(chan struct{})
+		if err := s.broadcast(messageLeaveType, msg, notifyCh); err != nil {
+			return err
+		}
+
+		select {
+		case <-notifyCh:
+		case <-time.After(time.Until(deadline)):
+			s.logger.Printf("[WARN] serf: timeout while repeating graceful leave")
+			return nil
+		}
+	}
+	return nil
+}
+
 // broadcast takes a Serf message type, encodes it for the wire, and queues
 // the broadcast. If a notify channel is given, this channel will be closed
 // when the broadcast is sent.
@@ -937,6 +1381,18 @@ func (s *Serf) handleNodeJoin(n *memberlist.Node) {
 
 	var oldStatus MemberStatus
 	member, ok := s.members[n.Name]
+
+	// A memberlist replaced by Rename or Pause tells us about the members
+	// it rejoins, which we already know are alive, so this is an update at
+	// most rather than a join
+	if ok && member.Status == StatusAlive {
+		if !member.Addr.Equal(n.Addr) || member.Port != n.Port ||
+			!reflect.DeepEqual(member.Tags, s.decodeTags(n.Meta)) {
+			s.updateMember(member, n)
+		}
+		return
+	}
+
 	if !ok {
 		oldStatus = StatusNone
 		member = &memberState{
@@ -947,6 +1403,7 @@ func (s *Serf) handleNodeJoin(n *memberlist.Node) {
 				Tags:   s.decodeTags(n.Meta),
 				Status: StatusAlive,
 			},
+			statusTime: time.Now(),
 		}
 
 		// Check if we have a join or leave intent. The intent buffer
@@ -956,7 +1413,7 @@ func (s *Serf) handleNodeJoin(n *memberlist.Node) {
 			member.statusLTime = join
 		}
 		if leave, ok := recentIntent(s.recentIntents, n.Name, messageLeaveType); ok {
-			member.Status = StatusLeaving
+			member.setStatus(StatusLeaving)
 			member.statusLTime = leave
 		}
 
@@ -968,7 +1425,7 @@ func (s *Serf) handleNodeJoin(n *memberlist.Node) {
 			metrics.IncrCounterWithLabels([]string{"serf", "member", "flap"}, 1, s.metricLabels)
 		}
 
-		member.Status = StatusAlive
+		member.setStatus(StatusAlive)
 		member.leaveTime = time.Time{}
 		member.Addr = n.Addr
 		member.Port = n.Port
@@ -1003,6 +1460,7 @@ func (s *Serf) handleNodeJoin(n *memberlist.Node) {
 			Members: []Member{member.Member},
 		}
 	}
+	s.notifyMemberSubs(EventMemberJoin, member.Member)
 }
 
 // handleNodeLeave is called when a node leave event is received
@@ -1020,12 +1478,13 @@ func (s *Serf) handleNodeLeave(n *memberlist.Node) {
 
 	switch member.Status {
 	case StatusLeaving:
-		member.Status = StatusLeft
+		member.setStatus(StatusLeft)
 		member.leaveTime = time.Now()
 		s.leftMembers = append(s.leftMembers, member)
 	case StatusAlive:
-		member.Status = StatusFailed
+		member.setStatus(StatusFailed)
 		member.leaveTime = time.Now()
+		member.reconnectAttempts = 0
 		s.failedMembers = append(s.failedMembers, member)
 	default:
 		// Unknown state that it was in? Just don't do anything
@@ -1052,6 +1511,7 @@ func (s *Serf) handleNodeLeave(n *memberlist.Node) {
 			Members: []Member{member.Member},
 		}
 	}
+	s.notifyMemberSubs(event, member.Member)
 }
 
 // handleNodeUpdate is called when a node meta data update
@@ -1066,7 +1526,12 @@ func (s *Serf) handleNodeUpdate(n *memberlist.Node) {
 		// Just ignore it completely.
 		return
 	}
+	s.updateMember(member, n)
+}
 
+// updateMember applies an update from memberlist to a member we know
+// about. The memberLock must be held.
+func (s *Serf) updateMember(member *memberState, n *memberlist.Node) {
 	// Update the member attributes
 	member.Addr = n.Addr
 	member.Port = n.Port
@@ -1096,6 +1561,7 @@ func (s *Serf) handleNodeUpdate(n *memberlist.Node) {
 			Members: []Member{member.Member},
 		}
 	}
+	s.notifyMemberSubs(EventMemberUpdate, member.Member)
 }
 
 // handleNodeLeaveIntent is called when an intent to leave is received.
@@ -1121,7 +1587,7 @@ func (s *Serf) handleNodeLeaveIntent(leaveMsg *messageLeave) bool {
 
 	// Refute us leaving if we are in the alive state
 	// Must be done in another goroutine since we have the memberLock
-	if leaveMsg.Node == s.config.NodeName && state == SerfAlive {
+	if leaveMsg.Node == s.nodeName() && state == SerfAlive {
 		s.logger.Printf("[DEBUG] serf: Refuting an older leave intent")
 		go s.broadcastJoin(s.clock.Time())
 		return false
@@ -1147,14 +1613,15 @@ func (s *Serf) handleNodeLeaveIntent(leaveMsg *messageLeave) bool {
 	// State transition depends on current state
 	switch member.Status {
 	case StatusAlive:
-		member.Status = StatusLeaving
+		member.setStatus(StatusLeaving)
+		s.notifyMemberSubs(EventMemberUpdate, member.Member)
 
 		if leaveMsg.Prune {
 			s.handlePrune(member)
 		}
 		return true
 	case StatusFailed:
-		member.Status = StatusLeft
+		member.setStatus(StatusLeft)
 
 		// Remove from the failed list and add to the left list. We add
 		// to the left list so that when we do a sync, other nodes will
@@ -1174,6 +1641,7 @@ func (s *Serf) handleNodeLeaveIntent(leaveMsg *messageLeave) bool {
 				Members: []Member{member.Member},
 			}
 		}
+		s.notifyMemberSubs(EventMemberLeave, member.Member)
 
 		if leaveMsg.Prune {
 			s.handlePrune(member)
@@ -1234,7 +1702,8 @@ func (s *Serf) handleNodeJoinIntent(joinMsg *messageJoin) bool {
 	// If we are in the leaving state, we should go back to alive,
 	// since the leaving message must have been for an older time
 	if member.Status == StatusLeaving {
-		member.Status = StatusAlive
+		member.setStatus(StatusAlive)
+		s.notifyMemberSubs(EventMemberUpdate, member.Member)
 	}
 	return true
 }
@@ -1287,6 +1756,13 @@ func (s *Serf) handleUserEvent(eventMsg *messageUserEvent) bool {
 	metrics.IncrCounterWithLabels([]string{"serf", "events"}, 1, s.metricLabels)
 	metrics.IncrCounterWithLabels([]string{"serf", "events", eventMsg.Name}, 1, s.metricLabels)
 
+	// Keep gossiping the event even if we drop it here
+	if !s.eventLimiter.allow(time.Now()) {
+		metrics.IncrCounterWithLabels([]string{"serf", "rate_limited", "events"}, 1, s.metricLabels)
+		s.logger.Printf("[DEBUG] serf: rate limited user event: %s", eventMsg.Name)
+		return true
+	}
+
 	if s.config.EventCh != nil {
 		s.config.EventCh <- UserEvent{
 			LTime:    eventMsg.LTime,
@@ -1359,12 +1835,19 @@ func (s *Serf) handleQuery(query *messageQuery) bool {
 		return rebroadcast
 	}
 
+	// Like filtered queries, rate limited ones are still rebroadcast
+	if !strings.HasPrefix(query.Name, InternalQueryPrefix) && !s.queryLimiter.allow(time.Now()) {
+		metrics.IncrCounterWithLabels([]string{"serf", "rate_limited", "queries"}, 1, s.metricLabels)
+		s.logger.Printf("[DEBUG] serf: rate limited query: %s", query.Name)
+		return rebroadcast
+	}
+
 	// Send ack if requested, without waiting for client to Respond()
 	if query.Ack() {
 		ack := messageQueryResponse{
 			LTime: query.LTime,
 			ID:    query.ID,
-			From:  s.config.NodeName,
+			From:  s.nodeName(),
 			Flags: queryFlagAck,
 		}
 		raw, err := encodeMessage(messageQueryResponseType, &ack)
@@ -1376,7 +1859,7 @@ func (s *Serf) handleQuery(query *messageQuery) bool {
 				Addr: udpAddr.String(),
 				Name: query.SourceNode,
 			}
-			if err := s.memberlist.SendToAddress(addr, raw); err != nil {
+			if err := s.Memberlist().SendToAddress(addr, raw); err != nil {
 				s.logger.Printf("[ERR] serf: failed to send ack: %v", err)
 			}
 			if err := s.relayResponse(query.RelayFactor, udpAddr, query.SourceNode, &ack); err != nil {
@@ -1460,7 +1943,7 @@ func (s *Serf) handleQueryResponse(resp *messageQueryResponse) {
 // will reject the "new" node mapping, but we can still be notified.
 func (s *Serf) handleNodeConflict(existing, other *memberlist.Node) {
 	// Log a basic warning if the node is not us...
-	if existing.Name != s.config.NodeName {
+	if existing.Name != s.nodeName() {
 		s.logger.Printf("[WARN] serf: Name conflict for '%s' both %s:%d and %s:%d are claiming",
 			existing.Name, existing.Addr, existing.Port, other.Addr, other.Port)
 		return
@@ -1471,8 +1954,12 @@ func (s *Serf) handleNodeConflict(existing, other *memberlist.Node) {
 		other.Addr, other.Port, s.config.EnableNameConflictResolution)
 
 	// If automatic resolution is enabled, kick off the resolution
-	if s.config.EnableNameConflictResolution {
-		go s.resolveNodeConflict()
+	if s.config.EnableNameConflictResolution &&
+		atomic.CompareAndSwapInt32(&s.conflictResolving, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&s.conflictResolving, 0)
+			s.resolveNodeConflict()
+		}()
 	}
 }
 
@@ -1480,11 +1967,11 @@ func (s *Serf) handleNodeConflict(existing, other *memberlist.Node) {
 // a name conflict. This is done by running an internal query.
 func (s *Serf) resolveNodeConflict() {
 	// Get the local node
-	local := s.memberlist.LocalNode()
+	local := s.Memberlist().LocalNode()
 
 	// Start a name resolution query
 	qName := internalQueryName(conflictQuery)
-	payload := []byte(s.config.NodeName)
+	payload := []byte(s.nodeName())
 	resp, err := s.Query(qName, payload, nil)
 	if err != nil {
 		s.logger.Printf("[ERR] serf: Failed to start name resolution query: %v", err)
@@ -1516,21 +2003,30 @@ func (s *Serf) resolveNodeConflict() {
 	}
 
 	// Query over, determine if we should live
-	majority := (responses / 2) + 1
-	if matching >= majority {
+	if responses == 0 {
+		s.logger.Printf("[WARN] serf: no responses in name conflict resolution, not quitting")
+		return
+	}
+	if wonNameConflict(matching, responses) {
 		s.logger.Printf("[INFO] serf: majority in name conflict resolution [%d / %d]",
 			matching, responses)
 		return
 	}
 
 	// Since we lost the vote, we need to exit
-	s.logger.Printf("[WARN] serf: minority in name conflict resolution, quiting [%d / %d]",
+	s.logger.Printf("[WARN] serf: minority in name conflict resolution, quitting [%d / %d]",
 		matching, responses)
 	if err := s.Shutdown(); err != nil {
 		s.logger.Printf("[ERR] serf: Failed to shutdown: %v", err)
 	}
 }
 
+// wonNameConflict checks whether a strict majority of the responses to a
+// name conflict query named the local node as the owner of the name.
+func wonNameConflict(matching, responses int) bool {
+	return responses > 0 && matching >= (responses/2)+1
+}
+
 //eraseNode takes a node completely out of the member list
 func (s *Serf) eraseNode(m *memberState) {
 	// Delete from members
@@ -1553,6 +2049,7 @@ func (s *Serf) eraseNode(m *memberState) {
 			Members: []Member{m.Member},
 		}
 	}
+	s.notifyMemberSubs(EventMemberReap, m.Member)
 }
 
 // handleReap periodically reaps the list of failed and left members, as well
@@ -1621,12 +2118,26 @@ func (s *Serf) reap(old []*memberState, now time.Time, timeout time.Duration) []
 
 // reconnect attempts to reconnect to recently fail nodes.
 func (s *Serf) reconnect() {
-	s.memberLock.RLock()
+	// Don't reach out to failed members while paused
+	if s.Paused() {
+		return
+	}
+
+	s.memberLock.Lock()
 
-	// Nothing to do if there are no failed members
-	n := len(s.failedMembers)
+	// Nothing to do if there are no failed members we still try to reach
+	candidates := s.failedMembers
+	if max := s.config.ReconnectMaxAttempts; max > 0 {
+		candidates = nil
+		for _, m := range s.failedMembers {
+			if m.reconnectAttempts < max {
+				candidates = append(candidates, m)
+			}
+		}
+	}
+	n := len(candidates)
 	if n == 0 {
-		s.memberLock.RUnlock()
+		s.memberLock.Unlock()
 		return
 	}
 
@@ -1635,34 +2146,54 @@ func (s *Serf) reconnect() {
 	// This means that we probabilistically expect the cluster
 	// to attempt to connect to each failed member once per
 	// reconnect interval
-	numFailed := float32(len(s.failedMembers))
+	numFailed := float32(n)
 	numAlive := float32(len(s.members) - len(s.failedMembers) - len(s.leftMembers))
 	if numAlive == 0 {
 		numAlive = 1 // guard against zero divide
 	}
 	prob := numFailed / numAlive
 	if rand.Float32() > prob {
-		s.memberLock.RUnlock()
+		s.memberLock.Unlock()
 		s.logger.Printf("[DEBUG] serf: forgoing reconnect for random throttling")
 		return
 	}
 
 	// Select a random member to try and join
 	idx := rand.Int31n(int32(n))
-	mem := s.failedMembers[idx]
+	mem := candidates[idx]
+	mem.reconnectAttempts++
+	attempt := mem.reconnectAttempts
+	member := mem.Member
 
 	// Format the addr
 	addr := net.UDPAddr{IP: mem.Addr, Port: int(mem.Port)}
-	s.logger.Printf("[INFO] serf: attempting reconnect to %v %s", mem.Name, addr.String())
+	s.memberLock.Unlock()
+
+	// Let the application change the address first
+	target := addr.String()
+	if s.config.Reconnecter != nil {
+		var ok bool
+		target, ok = s.config.Reconnecter.Reconnect(&member, target, attempt)
+		if !ok {
+			s.logger.Printf("[DEBUG] serf: skipping reconnect to %v", member.Name)
+			return
+		}
+	}
+	s.logger.Printf("[INFO] serf: attempting reconnect to %v %s", member.Name, target)
 
-	joinAddr := addr.String()
-	if mem.Name != "" {
-		joinAddr = mem.Name + "/" + addr.String()
+	joinAddr := target
+	if member.Name != "" {
+		joinAddr = member.Name + "/" + target
 	}
-	s.memberLock.RUnlock()
 
 	// Attempt to join at the memberlist level
-	s.memberlist.Join([]string{joinAddr})
+	_, err := s.Memberlist().Join([]string{joinAddr})
+	if err != nil {
+		s.logger.Printf("[DEBUG] serf: failed to reconnect to %v: %v", member.Name, err)
+	}
+	if s.config.Reconnecter != nil {
+		s.config.Reconnecter.ReconnectResult(&member, target, err)
+	}
 }
 
 // getQueueMax will get the maximum queue depth, which might be dynamic depending
@@ -1761,11 +2292,13 @@ func recentIntent(intents map[string]nodeIntent, node string, itype messageType)
 
 // handleRejoin attempts to reconnect to previously known alive nodes
 func (s *Serf) handleRejoin(previous []*PreviousNode) {
+	attempted := false
 	for _, prev := range previous {
 		// Do not attempt to join ourself
-		if prev.Name == s.config.NodeName {
+		if prev.Name == s.nodeName() {
 			continue
 		}
+		attempted = true
 
 		joinAddr := prev.Addr
 		if prev.Name != "" {
@@ -1773,13 +2306,33 @@ func (s *Serf) handleRejoin(previous []*PreviousNode) {
 		}
 
 		s.logger.Printf("[INFO] serf: Attempting re-join to previously known node: %s", prev)
-		_, err := s.memberlist.Join([]string{joinAddr})
+		_, err := s.Memberlist().Join([]string{joinAddr})
 		if err == nil {
 			s.logger.Printf("[INFO] serf: Re-joined to previously known node: %s", prev)
 			return
 		}
 	}
-	s.logger.Printf("[WARN] serf: Failed to re-join any previously known node")
+
+	// A snapshot that only knows of ourselves has nothing to rejoin
+	if attempted {
+		s.logger.Printf("[WARN] serf: Failed to re-join any previously known node")
+	}
+}
+
+// ValidateTags checks that the given tags are within the configured
+// tag count limit and that their encoded length fits in the node meta data.
+// SetTags makes the same check, this lets callers check before acting on
+// the tags.
+func (s *Serf) ValidateTags(tags map[string]string) error {
+	if s.config.MaxTags > 0 && len(tags) > s.config.MaxTags {
+		return fmt.Errorf("Number of tags (%d) exceeds limit of %d tags",
+			len(tags), s.config.MaxTags)
+	}
+	if len(s.encodeTags(tags)) > memberlist.MetaMaxSize {
+		return fmt.Errorf("Encoded length of tags exceeds limit of %d bytes",
+			memberlist.MetaMaxSize)
+	}
+	return nil
 }
 
 // encodeTags is used to encode a tag map
@@ -1819,30 +2372,41 @@ func (s *Serf) decodeTags(buf []byte) map[string]string {
 	return tags
 }
 
-// Stats is used to provide operator debugging information
+// Stats is used to provide operator debugging information. Members counts
+// every member Serf knows of, including the failed and left members that
+// are also counted on their own.
 func (s *Serf) Stats() map[string]string {
 	toString := func(v uint64) string {
 		return strconv.FormatUint(v, 10)
 	}
 	s.memberLock.RLock()
+	var numAlive uint64
+	for _, m := range s.members {
+		if m.Status == StatusAlive {
+			numAlive++
+		}
+	}
 	members := toString(uint64(len(s.members)))
+	alive := toString(numAlive)
 	failed := toString(uint64(len(s.failedMembers)))
 	left := toString(uint64(len(s.leftMembers)))
-	health_score := toString(uint64(s.memberlist.GetHealthScore()))
+	health_score := toString(uint64(s.Memberlist().GetHealthScore()))
 
 	s.memberLock.RUnlock()
 	stats := map[string]string{
 		"members":      members,
+		"alive":        alive,
 		"failed":       failed,
 		"left":         left,
 		"health_score": health_score,
-		"member_time":  toString(uint64(s.clock.Time())),
-		"event_time":   toString(uint64(s.eventClock.Time())),
-		"query_time":   toString(uint64(s.queryClock.Time())),
+		"member_time":  toString(uint64(s.MemberTime())),
+		"event_time":   toString(uint64(s.EventTime())),
+		"query_time":   toString(uint64(s.QueryTime())),
 		"intent_queue": toString(uint64(s.broadcasts.NumQueued())),
 		"event_queue":  toString(uint64(s.eventBroadcasts.NumQueued())),
 		"query_queue":  toString(uint64(s.queryBroadcasts.NumQueued())),
 		"encrypted":    fmt.Sprintf("%v", s.EncryptionEnabled()),
+		"paused":       fmt.Sprintf("%v", s.Paused()),
 	}
 	if !s.config.DisableCoordinates {
 		stats["coordinate_resets"] = toString(uint64(s.coordClient.Stats().Resets))
@@ -1850,7 +2414,9 @@ func (s *Serf) Stats() map[string]string {
 	return stats
 }
 
-// WriteKeyringFile will serialize the current keyring and save it to a file.
+// writeKeyringFile will serialize the current keyring and save it to a file.
+// The keys are written to a temporary file which is then renamed over the
+// keyring file, so a crash mid-write can't leave a truncated keyring behind.
 func (s *Serf) writeKeyringFile() error {
 	if len(s.config.KeyringFile) == 0 {
 		return nil
@@ -1869,8 +2435,26 @@ func (s *Serf) writeKeyringFile() error {
 		return fmt.Errorf("Failed to encode keys: %s", err)
 	}
 
-	// Use 0600 for permissions because key data is sensitive
-	if err = ioutil.WriteFile(s.config.KeyringFile, encodedKeys, 0600); err != nil {
+	// Use 0600 for permissions because key data is sensitive. The keys are
+	// synced to disk before the rename, or a crash can leave an empty file
+	// in place of the keyring.
+	tmpPath := s.config.KeyringFile + ".tmp"
+	fh, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write keyring file: %s", err)
+	}
+	if _, err = fh.Write(encodedKeys); err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Failed to write keyring file: %s", err)
+	}
+	if err = os.Rename(tmpPath, s.config.KeyringFile); err != nil {
+		os.Remove(tmpPath)
 		return fmt.Errorf("Failed to write keyring file: %s", err)
 	}
 
@@ -1878,6 +2462,13 @@ func (s *Serf) writeKeyringFile() error {
 	return nil
 }
 
+// CoordinateUpdate is sent on Config.CoordinateUpdateCh when the
+// network coordinate of a node is refined.
+type CoordinateUpdate struct {
+	Node  string
+	Coord *coordinate.Coordinate
+}
+
 // GetCoordinate returns the network coordinate of the local node.
 func (s *Serf) GetCoordinate() (*coordinate.Coordinate, error) {
 	if !s.config.DisableCoordinates {
@@ -1888,13 +2479,14 @@ func (s *Serf) GetCoordinate() (*coordinate.Coordinate, error) {
 }
 
 // GetCachedCoordinate returns the network coordinate for the node with the given
-// name. This will only be valid if DisableCoordinates is set to false.
+// name. This will only be valid if DisableCoordinates is set to false. The
+// coordinate is a copy, so callers are free to modify it.
 func (s *Serf) GetCachedCoordinate(name string) (coord *coordinate.Coordinate, ok bool) {
 	if !s.config.DisableCoordinates {
 		s.coordCacheLock.RLock()
 		defer s.coordCacheLock.RUnlock()
 		if coord, ok = s.coordCache[name]; ok {
-			return coord, true
+			return coord.Clone(), true
 		}
 
 		return nil, false
@@ -1916,7 +2508,7 @@ func (s *Serf) NumNodes() (numNodes int) {
 // ValidateNodeNames verifies the NodeName contains
 // only alphanumeric, -, or . and is under 128 chracters
 func (s *Serf) ValidateNodeNames() error {
-	return s.validateNodeName(s.config.NodeName)
+	return s.validateNodeName(s.nodeName())
 }
 
 func (s *Serf) validateNodeName(name string) error {
@@ -145,6 +145,22 @@ func TestCreate_badProtocolVersion(t *testing.T) {
 	}
 }
 
+func TestCreate_badBuffers(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	for _, set := range []func(c *Config){
+		func(c *Config) { c.EventBuffer = 0 },
+		func(c *Config) { c.QueryBuffer = -1 },
+	} {
+		c := testConfig(t, ip1)
+		set(c)
+		if _, err := Create(c); err == nil || !strings.Contains(err.Error(), "must be positive") {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
 func TestSerf_eventsFailed(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -231,6 +247,44 @@ func TestSerf_eventsJoin(t *testing.T) {
 		[]EventType{EventMemberJoin})
 }
 
+func TestSerf_eventsJoin_unreadEventCh(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	// An unbuffered event channel that isn't read until after the join
+	eventCh := make(chan Event)
+	s1Config := testConfig(t, ip1)
+	s1Config.EventCh = eventCh
+
+	s2Config := testConfig(t, ip2)
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The internal queue absorbs the events, so state updates continue
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	testEvents(t, eventCh, s2Config.NodeName,
+		[]EventType{EventMemberJoin})
+}
+
 func TestSerf_eventsLeave(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -283,6 +337,95 @@ func TestSerf_eventsLeave(t *testing.T) {
 		[]EventType{EventMemberJoin, EventMemberLeave})
 }
 
+// leaveOverLossyLink has one node leave a two node cluster while the
+// other drops every leave intent that arrives within a short window after
+// the first one, and returns the event type the observer saw for the
+// leaving node.
+func leaveOverLossyLink(t *testing.T, repeat int) EventType {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	s1Config := testConfig(t, ip1)
+	s1Config.LeaveBroadcastRepeat = repeat
+	s1Config.LeaveBroadcastInterval = 400 * time.Millisecond
+
+	var lock sync.Mutex
+	var lossStart time.Time
+	eventCh := make(chan Event, 16)
+	s2Config := testConfig(t, ip2)
+	s2Config.EventCh = eventCh
+	s2Config.ReapInterval = 30 * time.Second
+	s2Config.ReconnectInterval = 30 * time.Second
+	s2Config.messageDropper = func(typ messageType) bool {
+		if typ != messageLeaveType {
+			return false
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if lossStart.IsZero() {
+			lossStart = time.Now()
+		}
+		return time.Since(lossStart) < 150*time.Millisecond
+	}
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	if err := s1.Leave(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-eventCh:
+			me, ok := e.(MemberEvent)
+			if !ok || me.Type == EventMemberJoin {
+				continue
+			}
+			for _, m := range me.Members {
+				if m.Name == s1Config.NodeName {
+					return me.Type
+				}
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for s1 to leave")
+		}
+	}
+}
+
+func TestSerf_Leave_repeatBroadcast(t *testing.T) {
+	// With a single broadcast every copy lands in the lossy window, so
+	// the observer only hears from memberlist that the node is gone.
+	if typ := leaveOverLossyLink(t, 0); typ != EventMemberFailed {
+		t.Fatalf("bad: %v", typ)
+	}
+
+	// A repeated broadcast arrives after the window and is seen.
+	if typ := leaveOverLossyLink(t, 2); typ != EventMemberLeave {
+		t.Fatalf("bad: %v", typ)
+	}
+}
+
 func TestSerf_eventsLeave_avoidInfiniteLeaveRebroadcast(t *testing.T) {
 	// This test is a variation of the normal leave test that is crafted
 	// specifically to handle a situation where two unique leave events for the
@@ -560,6 +703,123 @@ func TestSerf_eventsUser_sizeLimit(t *testing.T) {
 	}
 }
 
+func TestSerf_eventsUser_compressed(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	// s1 compresses, s2 speaks an older protocol but can still read it
+	s1Config := testConfig(t, ip1)
+	s1Config.ProtocolVersion = 6
+	s1Config.CompressionThreshold = 64
+	eventCh := make(chan Event, 4)
+	s2Config := testConfig(t, ip2)
+	s2Config.ProtocolVersion = 5
+	s2Config.EventCh = eventCh
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	payload := bytes.Repeat([]byte("compress me "), 20)
+	if err := s1.UserEvent("big", payload, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testUserEvents(t, eventCh, []string{"big"}, [][]byte{payload})
+
+	// The push/pull state carries the buffered events, so it is compressed
+	// as well and merges as usual
+	buf := s1Config.MemberlistConfig.Delegate.LocalState(false)
+	if messageType(buf[0]) != messageCompressType {
+		t.Fatalf("bad message type: %d", buf[0])
+	}
+	s2Config.MemberlistConfig.Delegate.MergeRemoteState(buf, false)
+	if s2.EventTime() < s1.EventTime() {
+		t.Fatalf("bad event time: %d < %d", s2.EventTime(), s1.EventTime())
+	}
+
+	// s2 doesn't compress while speaking protocol version 5
+	buf = s2Config.MemberlistConfig.Delegate.LocalState(false)
+	if messageType(buf[0]) != messagePushPullType {
+		t.Fatalf("bad message type: %d", buf[0])
+	}
+}
+
+func TestSerf_eventsUser_rateLimit(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	eventCh := make(chan Event, 4)
+	s1Config := testConfig(t, ip1)
+	s1Config.EventCh = eventCh
+	s1Config.UserCoalescePeriod = 0
+	s1Config.UserEventRateLimit = 1
+	s1Config.QueryRateLimit = 1
+	s1Config.RateLimitInterval = time.Hour
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	for _, name := range []string{"first", "second"} {
+		if err := s1.UserEvent(name, nil, false); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := s1.Query(name, nil, nil); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Internal queries are not limited
+	resp, err := s1.Query(PingQueryName, nil, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var pings int
+	for range resp.ResponseCh() {
+		pings++
+	}
+	if pings != 1 {
+		t.Fatalf("bad: %d", pings)
+	}
+
+	var delivered []string
+	timeout := time.After(50 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case e := <-eventCh:
+			switch e := e.(type) {
+			case UserEvent:
+				delivered = append(delivered, "event "+e.Name)
+			case *Query:
+				delivered = append(delivered, "query "+e.Name)
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	if !reflect.DeepEqual(delivered, []string{"event first", "query first"}) {
+		t.Fatalf("bad: %v", delivered)
+	}
+}
+
 func TestSerf_getQueueMax(t *testing.T) {
 	s := &Serf{
 		config: DefaultConfig(),
@@ -788,6 +1048,30 @@ func TestSerf_forceLeaveFailed(t *testing.T) {
 	waitUntilNumNodes(t, 2, s1, s3)
 }
 
+func TestSerf_forceLeaveLocal(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	s1Config := testConfig(t, ip1)
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	err = s1.RemoveFailedNode(s1Config.NodeName)
+	if err == nil || !strings.Contains(err.Error(), "use Leave instead") {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.RemoveFailedNodePrune(""); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	if status := s1.LocalMember().Status; status != StatusAlive {
+		t.Fatalf("bad: %v", status)
+	}
+}
+
 func TestSerf_forceLeaveLeaving(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -1052,19 +1336,51 @@ func TestSerf_reconnect_sameIP(t *testing.T) {
 		[]EventType{EventMemberJoin, EventMemberFailed, EventMemberJoin})
 }
 
-func TestSerf_update(t *testing.T) {
+// testReconnecter records the reconnect attempts it is told about, and
+// replaces the address tried with addr if it is set
+type testReconnecter struct {
+	sync.Mutex
+	addr     string
+	attempts []int
+	results  []error
+}
+
+func (r *testReconnecter) Reconnect(member *Member, addr string, attempt int) (string, bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.attempts = append(r.attempts, attempt)
+	if r.addr != "" {
+		return r.addr, true
+	}
+	return addr, true
+}
+
+func (r *testReconnecter) ReconnectResult(member *Member, addr string, err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.results = append(r.results, err)
+}
+
+func TestSerf_reconnect_changedAddr(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
 
 	ip2, returnFn2 := testutil.TakeIP()
 	defer returnFn2()
 
-	eventCh := make(chan Event, 64)
+	ip3, returnFn3 := testutil.TakeIP()
+	defer returnFn3()
+
+	reconnecter := new(testReconnecter)
 	s1Config := testConfig(t, ip1)
-	s1Config.EventCh = eventCh
+	s1Config.ReconnectTimeout = time.Minute
+	s1Config.Reconnecter = reconnecter
+
+	// Memberlist only takes a new address for a dead node once it has
+	// been dead for this long
+	s1Config.MemberlistConfig.DeadNodeReclaimTime = time.Nanosecond
 
 	s2Config := testConfig(t, ip2)
-	s2Addr := s2Config.MemberlistConfig.BindAddr
 	s2Name := s2Config.NodeName
 
 	s1, err := Create(s1Config)
@@ -1079,85 +1395,217 @@ func TestSerf_update(t *testing.T) {
 	}
 	defer s2.Shutdown()
 
-	waitUntilNumNodes(t, 1, s1, s2)
-
-	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	_, err = s1.Join([]string{s2Name + "/" + s2Config.MemberlistConfig.BindAddr}, false)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-
 	waitUntilNumNodes(t, 2, s1, s2)
 
-	// Now force the shutdown of s2 so it appears to fail.
 	if err := s2.Shutdown(); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-
-	// Don't wait for a failure to be detected. Bring back s2 immediately
-	// by mimicking its name and address.
-	s2Config = testConfig(t, ip2)
-	s2Config.MemberlistConfig.BindAddr = s2Addr
-	s2Config.NodeName = s2Name
-
-	// Add a tag to force an update event, and add a version downgrade as
-	// well (that alone won't trigger an update).
-	s2Config.ProtocolVersion--
-	s2Config.Tags["foo"] = "bar"
-
-	// We try for a little while to wait for s2 to fully shutdown since the
-	// shutdown method doesn't block until that's done.
-	start := time.Now()
-	for {
-		s2, err = Create(s2Config)
-		if err == nil {
-			defer s2.Shutdown()
-			break
-		} else if !strings.Contains(err.Error(), "address already in use") {
-			t.Fatalf("err: %v", err)
-		}
-
-		if time.Now().Sub(start) > 2*time.Second {
-			t.Fatalf("timed out trying to restart")
+	retry.Run(t, func(r *retry.R) {
+		if n := s1.Stats()["failed"]; n != "1" {
+			r.Fatalf("bad: %s", n)
 		}
-	}
+	})
 
-	_, err = s2.Join([]string{s1Config.NodeName + "/" + s1Config.MemberlistConfig.BindAddr}, false)
+	// Bring back s2 at another address, which only the reconnecter knows
+	s2Config = testConfig(t, ip3)
+	s2Config.NodeName = s2Name
+	s2, err = Create(s2Config)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	defer s2.Shutdown()
 
-	waitUntilNumNodes(t, 2, s1, s2)
-
-	testEvents(t, eventCh, s2Name,
-		[]EventType{EventMemberJoin, EventMemberUpdate})
+	reconnecter.Lock()
+	reconnecter.addr = net.JoinHostPort(ip3.String(), strconv.Itoa(s2Config.MemberlistConfig.BindPort))
+	reconnecter.Unlock()
 
-	// Verify that the member data got updated.
-	found := false
-	members := s1.Members()
-	for _, member := range members {
-		if member.Name == s2Name {
-			found = true
-			if member.Tags["foo"] != "bar" || member.DelegateCur != s2Config.ProtocolVersion {
-				t.Fatalf("bad: %#v", member)
+	retry.Run(t, func(r *retry.R) {
+		for _, m := range s1.Members() {
+			if m.Name == s2Name && (m.Status != StatusAlive || !m.Addr.Equal(ip3)) {
+				r.Fatalf("bad: %v %v", m.Status, m.Addr)
 			}
 		}
-	}
-	if !found {
-		t.Fatalf("didn't find s2 in members")
+	})
+
+	reconnecter.Lock()
+	defer reconnecter.Unlock()
+	if n := len(reconnecter.results); n == 0 || reconnecter.results[n-1] != nil {
+		t.Fatalf("bad: %v", reconnecter.results)
 	}
 }
 
-func TestSerf_role(t *testing.T) {
+func TestSerf_reconnect_maxAttempts(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
 
 	ip2, returnFn2 := testutil.TakeIP()
 	defer returnFn2()
 
+	reconnecter := new(testReconnecter)
 	s1Config := testConfig(t, ip1)
+	s1Config.ReconnectTimeout = time.Minute
+	s1Config.ReconnectInterval = 10 * time.Millisecond
+	s1Config.ReconnectMaxAttempts = 2
+	s1Config.Reconnecter = reconnecter
+
 	s2Config := testConfig(t, ip2)
 
-	s1Config.Tags["role"] = "web"
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	if err := s2.Shutdown(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	retry.Run(t, func(r *retry.R) {
+		reconnecter.Lock()
+		defer reconnecter.Unlock()
+		if len(reconnecter.results) != 2 {
+			r.Fatalf("bad: %v", reconnecter.attempts)
+		}
+	})
+
+	// No more attempts are made, but the member is still kept as failed
+	time.Sleep(20 * s1Config.ReconnectInterval)
+	reconnecter.Lock()
+	defer reconnecter.Unlock()
+	if !reflect.DeepEqual(reconnecter.attempts, []int{1, 2}) {
+		t.Fatalf("bad: %v", reconnecter.attempts)
+	}
+	for _, err := range reconnecter.results {
+		if err == nil {
+			t.Fatalf("bad: %v", reconnecter.results)
+		}
+	}
+	if n := s1.Stats()["failed"]; n != "1" {
+		t.Fatalf("bad: %s", n)
+	}
+}
+
+func TestSerf_update(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	eventCh := make(chan Event, 64)
+	s1Config := testConfig(t, ip1)
+	s1Config.EventCh = eventCh
+
+	s2Config := testConfig(t, ip2)
+	s2Addr := s2Config.MemberlistConfig.BindAddr
+	s2Name := s2Config.NodeName
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	waitUntilNumNodes(t, 1, s1, s2)
+
+	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	// Now force the shutdown of s2 so it appears to fail.
+	if err := s2.Shutdown(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Don't wait for a failure to be detected. Bring back s2 immediately
+	// by mimicking its name and address.
+	s2Config = testConfig(t, ip2)
+	s2Config.MemberlistConfig.BindAddr = s2Addr
+	s2Config.NodeName = s2Name
+
+	// Add a tag to force an update event, and add a version downgrade as
+	// well (that alone won't trigger an update).
+	s2Config.ProtocolVersion--
+	s2Config.Tags["foo"] = "bar"
+
+	// We try for a little while to wait for s2 to fully shutdown since the
+	// shutdown method doesn't block until that's done.
+	start := time.Now()
+	for {
+		s2, err = Create(s2Config)
+		if err == nil {
+			defer s2.Shutdown()
+			break
+		} else if !strings.Contains(err.Error(), "address already in use") {
+			t.Fatalf("err: %v", err)
+		}
+
+		if time.Now().Sub(start) > 2*time.Second {
+			t.Fatalf("timed out trying to restart")
+		}
+	}
+
+	_, err = s2.Join([]string{s1Config.NodeName + "/" + s1Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	testEvents(t, eventCh, s2Name,
+		[]EventType{EventMemberJoin, EventMemberUpdate})
+
+	// Verify that the member data got updated.
+	found := false
+	members := s1.Members()
+	for _, member := range members {
+		if member.Name == s2Name {
+			found = true
+			if member.Tags["foo"] != "bar" || member.DelegateCur != s2Config.ProtocolVersion {
+				t.Fatalf("bad: %#v", member)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("didn't find s2 in members")
+	}
+}
+
+func TestSerf_role(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	s1Config := testConfig(t, ip1)
+	s2Config := testConfig(t, ip2)
+
+	s1Config.Tags["role"] = "web"
 	s2Config.Tags["role"] = "lb"
 
 	s1, err := Create(s1Config)
@@ -1447,9 +1895,9 @@ func TestSerf_ReapHandler(t *testing.T) {
 
 	m := Member{}
 	s.leftMembers = []*memberState{
-		{m, 0, time.Now()},
-		{m, 0, time.Now().Add(-5 * time.Second)},
-		{m, 0, time.Now().Add(-10 * time.Second)},
+		{Member: m, leaveTime: time.Now()},
+		{Member: m, leaveTime: time.Now().Add(-5 * time.Second)},
+		{Member: m, leaveTime: time.Now().Add(-10 * time.Second)},
 	}
 
 	upsertIntent(s.recentIntents, "alice", messageJoinType, 1, time.Now)
@@ -1497,9 +1945,9 @@ func TestSerf_Reap(t *testing.T) {
 
 	m := Member{}
 	old := []*memberState{
-		&memberState{m, 0, time.Now()},
-		&memberState{m, 0, time.Now().Add(-5 * time.Second)},
-		&memberState{m, 0, time.Now().Add(-10 * time.Second)},
+		&memberState{Member: m, leaveTime: time.Now()},
+		&memberState{Member: m, leaveTime: time.Now().Add(-5 * time.Second)},
+		&memberState{Member: m, leaveTime: time.Now().Add(-10 * time.Second)},
 	}
 
 	old = s.reap(old, time.Now(), time.Second*6)
@@ -1766,6 +2214,58 @@ func TestSerf_Join_IgnoreOld(t *testing.T) {
 	testUserEvents(t, eventCh, []string{}, [][]byte{})
 }
 
+func TestSerf_Join_Replay(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	eventCh := make(chan Event, 4)
+	s1Config := testConfig(t, ip1)
+	s2Config := testConfig(t, ip2)
+	s2Config.EventCh = eventCh
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	waitUntilNumNodes(t, 1, s1, s2)
+
+	if err := s1.UserEvent("deploy", []byte("v1"), false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Without ignoreOld, the events sent before the join are replayed
+	_, err = s2.Join([]string{s1Config.NodeName + "/" + s1Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-eventCh:
+			if u, ok := e.(UserEvent); ok {
+				if u.Name != "deploy" || string(u.Payload) != "v1" {
+					t.Fatalf("bad: %#v", u)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no replayed event")
+		}
+	}
+}
+
 func TestSerf_SnapshotRecovery(t *testing.T) {
 	td, err := ioutil.TempDir("", "serf")
 	if err != nil {
@@ -1848,94 +2348,422 @@ func TestSerf_SnapshotRecovery(t *testing.T) {
 		if len(members) == 2 && members[0].Status == StatusAlive && members[1].Status == StatusAlive {
 			break
 		}
-		time.Sleep(10 * time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Verify that s2 is "alive"
+	testMember(t, s1.Members(), s2Config.NodeName, StatusAlive)
+	testMember(t, s2.Members(), s1Config.NodeName, StatusAlive)
+
+	// Check the events to make sure we got nothing
+	testUserEvents(t, eventCh, []string{}, [][]byte{})
+}
+
+func TestSerf_Leave_SnapshotRecovery(t *testing.T) {
+	if race.Enabled {
+		t.Skip("test contains a data race")
+	}
+
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	// Use a longer reap interval to allow the leave intent to propagate before the node is reaped
+	s1Config := testConfig(t, ip1)
+	s1Config.ReapInterval = 30 * time.Second
+	s2Config := testConfig(t, ip2)
+	s2Config.SnapshotPath = td + "snap"
+	s2Config.ReapInterval = 30 * time.Second
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	waitUntilNumNodes(t, 1, s1, s2)
+
+	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	if err := s2.Leave(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s2.Shutdown(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	time.Sleep(s2Config.MemberlistConfig.ProbeInterval * 5)
+
+	// Verify that s2 is "left"
+	retry.Run(t, func(r *retry.R) {
+		testMember(r, s1.Members(), s2Config.NodeName, StatusLeft)
+	})
+
+	// Restart s2 from the snapshot now!
+	s2Config.EventCh = nil
+	s2, err = Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	// Wait for the node to auto rejoin
+
+	// Verify that s2 is didn't join
+	retry.Run(t, func(r *retry.R) {
+		if s2.NumNodes() != 1 {
+			r.Fatalf("bad members: %#v", s2.Members())
+		}
+
+		testMember(r, s1.Members(), s2Config.NodeName, StatusLeft)
+	})
+}
+
+func TestSerf_Rename(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	s1Config := testConfig(t, ip1)
+	s1Config.Tags = map[string]string{"role": "web"}
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2Config := testConfig(t, ip2)
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	oldName := s1Config.NodeName
+	oldTime := s1.clock.Time()
+	if err := s1.Rename("renamed"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if s1.State() != SerfAlive {
+		t.Fatalf("bad state: %v", s1.State())
+	}
+	if s1.clock.Time() <= oldTime {
+		t.Fatalf("clock went backwards: %d <= %d", s1.clock.Time(), oldTime)
+	}
+
+	// Both sides should see the new name alive with our tags. The old name
+	// may already have been reaped given the short tombstone timeout.
+	retry.Run(t, func(r *retry.R) {
+		for _, s := range []*Serf{s1, s2} {
+			statuses := make(map[string]MemberStatus)
+			for _, m := range s.Members() {
+				statuses[m.Name] = m.Status
+				if m.Name == "renamed" && m.Tags["role"] != "web" {
+					r.Fatalf("bad tags: %v", m.Tags)
+				}
+			}
+			if statuses["renamed"] != StatusAlive {
+				r.Fatalf("bad: %v", statuses)
+			}
+			if status, ok := statuses[oldName]; ok && status != StatusLeft {
+				r.Fatalf("bad: %v", statuses)
+			}
+		}
+	})
+
+	if s1.LocalMember().Name != "renamed" {
+		t.Fatalf("bad: %#v", s1.LocalMember())
+	}
+
+	// Renames should be rejected after leaving
+	if err := s1.Leave(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s1.Rename("again"); err == nil {
+		t.Fatalf("should not rename after leave")
+	}
+}
+
+func TestSerf_PauseResume(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	s1Config := testConfig(t, ip1)
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	eventCh := make(chan Event, 64)
+	s2Config := testConfig(t, ip2)
+	s2Config.EventCh = eventCh
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	if err := s1.Pause(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !s1.Paused() || s1.Stats()["paused"] != "true" {
+		t.Fatalf("should be paused")
+	}
+
+	// Our event should not be gossiped while paused
+	if err := s1.UserEvent("deploy", nil, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	timeout := time.After(500 * time.Millisecond)
+WAIT:
+	for {
+		select {
+		case e := <-eventCh:
+			if e.EventType() == EventUser {
+				t.Fatalf("should not get event while paused: %v", e)
+			}
+		case <-timeout:
+			break WAIT
+		}
+	}
+
+	// We should still look healthy to the other side
+	if m := s2.Members(); len(m) != 2 || m[0].Status != StatusAlive || m[1].Status != StatusAlive {
+		t.Fatalf("bad: %v", m)
+	}
+
+	s1.Resume()
+	if s1.Paused() {
+		t.Fatalf("should not be paused")
+	}
+
+	// The queued event should go out now
+	timeout = time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-eventCh:
+			if e.EventType() == EventUser {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for event after resume")
+		}
 	}
+}
 
-	// Verify that s2 is "alive"
-	testMember(t, s1.Members(), s2Config.NodeName, StatusAlive)
-	testMember(t, s2.Members(), s1Config.NodeName, StatusAlive)
+// countingTransport is a mock transport that counts the packets it sends
+// and the streams it opens.
+type countingTransport struct {
+	memberlist.NodeAwareTransport
+	packets int32
+	streams int32
+}
 
-	// Check the events to make sure we got nothing
-	testUserEvents(t, eventCh, []string{}, [][]byte{})
+func (t *countingTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	atomic.AddInt32(&t.packets, 1)
+	return t.NodeAwareTransport.WriteTo(b, addr)
 }
 
-func TestSerf_Leave_SnapshotRecovery(t *testing.T) {
-	if race.Enabled {
-		t.Skip("test contains a data race")
-	}
+func (t *countingTransport) WriteToAddress(b []byte, addr memberlist.Address) (time.Time, error) {
+	atomic.AddInt32(&t.packets, 1)
+	return t.NodeAwareTransport.WriteToAddress(b, addr)
+}
 
-	td, err := ioutil.TempDir("", "serf")
-	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	defer os.RemoveAll(td)
+func (t *countingTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	atomic.AddInt32(&t.streams, 1)
+	return t.NodeAwareTransport.DialTimeout(addr, timeout)
+}
+
+func (t *countingTransport) DialAddressTimeout(addr memberlist.Address, timeout time.Duration) (net.Conn, error) {
+	atomic.AddInt32(&t.streams, 1)
+	return t.NodeAwareTransport.DialAddressTimeout(addr, timeout)
+}
+
+func (t *countingTransport) reset() {
+	atomic.StoreInt32(&t.packets, 0)
+	atomic.StoreInt32(&t.streams, 0)
+}
+
+func (t *countingTransport) sent() (int32, int32) {
+	return atomic.LoadInt32(&t.packets), atomic.LoadInt32(&t.streams)
+}
 
+func TestSerf_Pause_peers(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
 
 	ip2, returnFn2 := testutil.TakeIP()
 	defer returnFn2()
 
-	// Use a longer reap interval to allow the leave intent to propagate before the node is reaped
 	s1Config := testConfig(t, ip1)
-	s1Config.ReapInterval = 30 * time.Second
-	s2Config := testConfig(t, ip2)
-	s2Config.SnapshotPath = td + "snap"
-	s2Config.ReapInterval = 30 * time.Second
-
+	nt, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+		BindAddrs: []string{ip1.String()},
+		BindPort:  s1Config.MemberlistConfig.BindPort,
+		Logger:    s1Config.Logger,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	transport := &countingTransport{NodeAwareTransport: nt}
+	s1Config.MemberlistConfig.Transport = transport
 	s1, err := Create(s1Config)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	defer s1.Shutdown()
 
+	// s2 doesn't probe or gossip on its own, so anything s1 sends was
+	// started by s1 rather than sent in reply
+	eventCh := make(chan Event, 64)
+	s2Config := testConfig(t, ip2)
+	s2Config.EventCh = eventCh
+	s2Config.MemberlistConfig.ProbeInterval = time.Hour
+	s2Config.MemberlistConfig.GossipInterval = time.Hour
+	s2Config.MemberlistConfig.PushPullInterval = 0
 	s2, err := Create(s2Config)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 	defer s2.Shutdown()
 
-	waitUntilNumNodes(t, 1, s1, s2)
-
 	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-
 	waitUntilNumNodes(t, 2, s1, s2)
 
-	if err := s2.Leave(); err != nil {
+	if err := s1.Pause(); err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	if err := s2.Shutdown(); err != nil {
+	if err := s1.UserEvent("deploy", nil, false); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	time.Sleep(s2Config.MemberlistConfig.ProbeInterval * 5)
-
-	// Verify that s2 is "left"
-	retry.Run(t, func(r *retry.R) {
-		testMember(r, s1.Members(), s2Config.NodeName, StatusLeft)
-	})
+	// Let any probe the old memberlist had in flight time out
+	time.Sleep(250 * time.Millisecond)
+	transport.reset()
 
-	// Restart s2 from the snapshot now!
-	s2Config.EventCh = nil
-	s2, err = Create(s2Config)
+	// A push/pull with the paused node syncs membership but doesn't hand
+	// over its events
+	_, err = s2.Join([]string{s1Config.NodeName + "/" + s1Config.MemberlistConfig.BindAddr}, false)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	defer s2.Shutdown()
+	timeout := time.After(500 * time.Millisecond)
+WAIT:
+	for {
+		select {
+		case e := <-eventCh:
+			if e.EventType() == EventUser {
+				t.Fatalf("should not get event while paused: %v", e)
+			}
+		case <-timeout:
+			break WAIT
+		}
+	}
+	if m := s2.Members(); len(m) != 2 || m[0].Status != StatusAlive || m[1].Status != StatusAlive {
+		t.Fatalf("bad: %v", m)
+	}
 
-	// Wait for the node to auto rejoin
+	// The paused node doesn't probe, gossip or push/pull on its own
+	if packets, streams := transport.sent(); packets != 0 || streams != 0 {
+		t.Fatalf("paused node sent %d packets and opened %d streams", packets, streams)
+	}
 
-	// Verify that s2 is didn't join
+	// Once resumed it probes again and notices a failed peer
+	s1.Resume()
 	retry.Run(t, func(r *retry.R) {
-		if s2.NumNodes() != 1 {
-			r.Fatalf("bad members: %#v", s2.Members())
+		if packets, _ := transport.sent(); packets == 0 {
+			r.Fatalf("resumed node should send packets")
 		}
-
-		testMember(r, s1.Members(), s2Config.NodeName, StatusLeft)
 	})
+	s2.Shutdown()
+	retry.Run(t, func(r *retry.R) {
+		if s1.Stats()["failed"] != "1" {
+			r.Fatalf("bad: %v", s1.Members())
+		}
+	})
+}
+
+func TestSerf_MaxTags(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	tags := map[string]string{
+		"role": "web",
+		"dc":   "east",
+		"rack": "12",
+	}
+
+	// Too many tags at startup
+	s1Config := testConfig(t, ip1)
+	s1Config.MaxTags = 2
+	s1Config.Tags = tags
+	_, err := Create(s1Config)
+	if err == nil || !strings.Contains(err.Error(), "exceeds limit of 2 tags") {
+		t.Fatalf("should get tag count error: %v", err)
+	}
+
+	// Within the limit, then too many at runtime
+	s1Config = testConfig(t, ip1)
+	s1Config.MaxTags = 2
+	s1Config.Tags = map[string]string{"role": "web"}
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	err = s1.SetTags(tags)
+	if err == nil || !strings.Contains(err.Error(), "exceeds limit of 2 tags") {
+		t.Fatalf("should get tag count error: %v", err)
+	}
+	if len(s1.LocalMember().Tags) != 1 {
+		t.Fatalf("tags should be unchanged: %v", s1.LocalMember().Tags)
+	}
+
+	if err := s1.SetTags(map[string]string{"role": "web", "dc": "east"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
 }
 
 func TestSerf_SetTags(t *testing.T) {
@@ -2404,6 +3232,129 @@ func TestSerf_NameResolution(t *testing.T) {
 	})
 }
 
+func TestWonNameConflict(t *testing.T) {
+	cases := []struct {
+		matching, responses int
+		won                 bool
+	}{
+		{0, 0, false},
+		{1, 1, true},
+		{0, 1, false},
+		{1, 2, false},
+		{2, 3, true},
+		{2, 4, false},
+		{3, 4, true},
+	}
+	for _, tc := range cases {
+		if won := wonNameConflict(tc.matching, tc.responses); won != tc.won {
+			t.Fatalf("%d / %d: got %v", tc.matching, tc.responses, won)
+		}
+	}
+}
+
+func TestSerf_LamportTimes(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	eventCh := make(chan Event, 4)
+	s1Config := testConfig(t, ip1)
+	s1Config.EventCh = eventCh
+	s1Config.UserCoalescePeriod = 0
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	if s1.MemberTime() == 0 {
+		t.Fatalf("joining should advance the member clock")
+	}
+
+	eventTime := s1.EventTime()
+	if err := s1.UserEvent("first", nil, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if s1.EventTime() <= eventTime {
+		t.Fatalf("bad: %d <= %d", s1.EventTime(), eventTime)
+	}
+
+	// Skip the local join event
+	for {
+		select {
+		case e := <-eventCh:
+			ue, ok := e.(UserEvent)
+			if !ok {
+				continue
+			}
+			if ue.LTime != eventTime || ue.LTime >= s1.EventTime() {
+				t.Fatalf("bad: %#v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no user event")
+		}
+		break
+	}
+
+	queryTime := s1.QueryTime()
+	if _, err := s1.Query("query", nil, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if s1.QueryTime() <= queryTime {
+		t.Fatalf("bad: %d <= %d", s1.QueryTime(), queryTime)
+	}
+
+	stats := s1.Stats()
+	if stats["event_time"] != fmt.Sprintf("%d", s1.EventTime()) {
+		t.Fatalf("bad: %v", stats)
+	}
+}
+
+func TestSerf_PingQuery(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	s1Config := testConfig(t, ip1)
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2Config := testConfig(t, ip2)
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	// Every member answers with its name, without any handler installed
+	resp, err := s2.Query(PingQueryName, nil, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	names := make(map[string]string)
+	for r := range resp.ResponseCh() {
+		names[r.From] = string(r.Payload)
+	}
+	expected := map[string]string{
+		s1Config.NodeName: s1Config.NodeName,
+		s2Config.NodeName: s2Config.NodeName,
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("bad: %v", names)
+	}
+}
+
 func TestSerf_LocalMember(t *testing.T) {
 	ip1, returnFn1 := testutil.TakeIP()
 	defer returnFn1()
@@ -2439,6 +3390,15 @@ func TestSerf_LocalMember(t *testing.T) {
 	if !reflect.DeepEqual(m.Tags, newTags) {
 		t.Fatalf("bad: %v", m)
 	}
+
+	// Changing the returned members doesn't change our state
+	m.Tags["foo"] = "baz"
+	m.Addr[0] = 0
+	members := s1.Members()
+	members[0].Tags["test"] = "changed"
+	if m := s1.LocalMember(); !reflect.DeepEqual(m.Tags, newTags) || !m.Addr.Equal(ip1) {
+		t.Fatalf("bad: %v", m)
+	}
 }
 
 func TestSerf_WriteKeyringFile(t *testing.T) {
@@ -2549,6 +3509,11 @@ func TestSerf_WriteKeyringFile(t *testing.T) {
 	if !strings.Contains(lines[1], newKey) {
 		t.Fatalf("expected key to be primary: %s", newKey)
 	}
+
+	// The temporary file is renamed over the keyring file, never left behind
+	if _, err := os.Stat(keyringFile + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary keyring file left behind: %v", err)
+	}
 }
 
 func TestSerfStats(t *testing.T) {
@@ -2573,9 +3538,11 @@ func TestSerfStats(t *testing.T) {
 		"health_score": "0",
 		"member_time":  "1",
 		"members":      "1",
+		"alive":        "1",
 		"query_queue":  "0",
 		"query_time":   "1",
 		"encrypted":    "false",
+		"paused":       "false",
 	}
 
 	for key, val := range expected {
@@ -2584,11 +3551,53 @@ func TestSerfStats(t *testing.T) {
 			t.Fatalf("key not found in stats: %s", key)
 		}
 		if v != val {
-			t.Fatalf("bad: %s = %s", key, val)
+			t.Fatalf("bad: %s = %s, expected %s", key, v, val)
 		}
 	}
 }
 
+func TestSerfStats_memberCounts(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	// Keep left members around so they are counted
+	s1Config := testConfig(t, ip1)
+	s1Config.TombstoneTimeout = time.Hour
+	s2Config := testConfig(t, ip2)
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	if err := s2.Leave(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	retry.Run(t, func(r *retry.R) {
+		stats := s1.Stats()
+		if stats["members"] != "2" || stats["alive"] != "1" || stats["left"] != "1" {
+			r.Fatalf("bad: %v", stats)
+		}
+	})
+}
+
 type CancelMergeDelegate struct {
 	invoked bool
 }
@@ -2733,6 +3742,16 @@ func TestSerf_Coordinates(t *testing.T) {
 		}
 	})
 
+	// Changing a returned coordinate must not change the cache.
+	c2c, ok := s1.GetCachedCoordinate(s2.config.NodeName)
+	if !ok {
+		t.Fatalf("s1 didn't cache coordinate for s2")
+	}
+	c2c.Vec[0] += 1.0
+	if again, _ := s1.GetCachedCoordinate(s2.config.NodeName); again.Vec[0] == c2c.Vec[0] {
+		t.Fatalf("cached coordinate was modified through the returned copy")
+	}
+
 	// Break up the cluster and make sure the coordinates get removed by
 	// the reaper.
 	if err := s2.Leave(); err != nil {
@@ -3091,3 +4110,55 @@ func TestSerf_perNodeReconnectTimeout(t *testing.T) {
 		t.Fatalf("The reconnect override was not used")
 	}
 }
+
+func TestSerf_MemberStatusTimes(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	s1Config := testConfig(t, ip1)
+	s1Config.ReconnectTimeout = time.Hour
+	s2Config := testConfig(t, ip2)
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	start := time.Now()
+	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	joined := s1.MemberStatusTimes()[s2Config.NodeName]
+	if joined.Before(start) {
+		t.Fatalf("bad: %v", joined)
+	}
+
+	// A status change moves the time forward
+	if err := s2.Shutdown(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	retry.Run(t, func(r *retry.R) {
+		for _, m := range s1.Members() {
+			if m.Name == s2Config.NodeName && m.Status != StatusFailed {
+				r.Fatalf("bad status: %v", m.Status)
+			}
+		}
+	})
+	failed := s1.MemberStatusTimes()[s2Config.NodeName]
+	if !failed.After(joined) {
+		t.Fatalf("bad: %v %v", joined, failed)
+	}
+}
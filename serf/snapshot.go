@@ -6,10 +6,12 @@ package serf
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -61,6 +63,8 @@ const (
 // them to disk, and providing a recovery mechanism at start time.
 type Snapshotter struct {
 	aliveNodes              map[string]string
+	aliveSeen               map[string]uint64 // Order nodes were last seen alive
+	aliveSeq                uint64
 	clock                   *LamportClock
 	fh                      *os.File
 	buffered                *bufio.Writer
@@ -81,6 +85,8 @@ type Snapshotter struct {
 	shutdownCh              <-chan struct{}
 	waitCh                  chan struct{}
 	lastAttemptedCompaction time.Time
+	lastCompaction          time.Time
+	minCompactInterval      time.Duration
 	metricLabels            []metrics.Label
 }
 
@@ -107,6 +113,22 @@ func NewSnapshotter(path string,
 	clock *LamportClock,
 	outCh chan<- Event,
 	shutdownCh <-chan struct{}) (chan<- Event, *Snapshotter, error) {
+	return NewSnapshotterWithCompactInterval(path, minCompactSize, 0, rejoinAfterLeave,
+		logger, clock, outCh, shutdownCh)
+}
+
+// NewSnapshotterWithCompactInterval creates a new Snapshotter like
+// NewSnapshotter, with consecutive compactions spaced at least
+// minCompactInterval apart. A zero interval compacts as soon as the size
+// threshold is crossed.
+func NewSnapshotterWithCompactInterval(path string,
+	minCompactSize int,
+	minCompactInterval time.Duration,
+	rejoinAfterLeave bool,
+	logger *log.Logger,
+	clock *LamportClock,
+	outCh chan<- Event,
+	shutdownCh <-chan struct{}) (chan<- Event, *Snapshotter, error) {
 	inCh := make(chan Event, eventChSize)
 	streamCh := make(chan Event, eventChSize)
 
@@ -126,31 +148,36 @@ func NewSnapshotter(path string,
 
 	// Create the snapshotter
 	snap := &Snapshotter{
-		aliveNodes:       make(map[string]string),
-		clock:            clock,
-		fh:               fh,
-		buffered:         bufio.NewWriter(fh),
-		inCh:             inCh,
-		streamCh:         streamCh,
-		lastClock:        0,
-		lastEventClock:   0,
-		lastQueryClock:   0,
-		leaveCh:          make(chan struct{}),
-		logger:           logger,
-		minCompactSize:   int64(minCompactSize),
-		path:             path,
-		offset:           offset,
-		outCh:            outCh,
-		rejoinAfterLeave: rejoinAfterLeave,
-		shutdownCh:       shutdownCh,
-		waitCh:           make(chan struct{}),
+		aliveNodes:         make(map[string]string),
+		aliveSeen:          make(map[string]uint64),
+		clock:              clock,
+		fh:                 fh,
+		buffered:           bufio.NewWriter(fh),
+		inCh:               inCh,
+		streamCh:           streamCh,
+		lastClock:          0,
+		lastEventClock:     0,
+		lastQueryClock:     0,
+		leaveCh:            make(chan struct{}),
+		logger:             logger,
+		minCompactSize:     int64(minCompactSize),
+		minCompactInterval: minCompactInterval,
+		path:               path,
+		offset:             offset,
+		outCh:              outCh,
+		rejoinAfterLeave:   rejoinAfterLeave,
+		shutdownCh:         shutdownCh,
+		waitCh:             make(chan struct{}),
 	}
 
 	// Recover the last known state
+	start := time.Now()
 	if err := snap.replay(); err != nil {
 		fh.Close()
 		return nil, nil, err
 	}
+	logger.Printf("[INFO] serf: Replayed snapshot of %d bytes with %d alive members in %v",
+		offset, len(snap.aliveNodes), time.Since(start))
 
 	// Start handling new commands
 	go snap.teeStream()
@@ -189,6 +216,59 @@ func (s *Snapshotter) AliveNodes() []*PreviousNode {
 	return previous
 }
 
+// NumAliveNodes returns the number of last known alive nodes
+func (s *Snapshotter) NumAliveNodes() int {
+	return len(s.aliveNodes)
+}
+
+// RecentAliveNodes returns up to limit of the last known alive nodes,
+// starting with the ones that were most recently seen alive since those
+// are the most likely to still be around.
+func (s *Snapshotter) RecentAliveNodes(limit int) []*PreviousNode {
+	names := s.aliveByRecency()
+	if limit < len(names) {
+		names = names[:limit]
+	}
+
+	previous := make([]*PreviousNode, 0, len(names))
+	for _, name := range names {
+		previous = append(previous, &PreviousNode{name, s.aliveNodes[name]})
+	}
+	return previous
+}
+
+// aliveByRecency returns the names of the alive nodes, most recently
+// seen first
+func (s *Snapshotter) aliveByRecency() []string {
+	names := make([]string, 0, len(s.aliveNodes))
+	for name := range s.aliveNodes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return s.aliveSeen[names[i]] > s.aliveSeen[names[j]]
+	})
+	return names
+}
+
+// setAlive records a node as alive, tracking the order it was seen in
+func (s *Snapshotter) setAlive(name, addr string) {
+	s.aliveSeq++
+	s.aliveNodes[name] = addr
+	s.aliveSeen[name] = s.aliveSeq
+}
+
+// setNotAlive removes a node from the alive nodes
+func (s *Snapshotter) setNotAlive(name string) {
+	delete(s.aliveNodes, name)
+	delete(s.aliveSeen, name)
+}
+
+// clearAlive forgets all of the alive nodes
+func (s *Snapshotter) clearAlive() {
+	s.aliveNodes = make(map[string]string)
+	s.aliveSeen = make(map[string]uint64)
+}
+
 // Wait is used to wait until the snapshotter finishes shut down
 func (s *Snapshotter) Wait() {
 	<-s.waitCh
@@ -261,6 +341,10 @@ func (s *Snapshotter) stream() {
 			s.processUserEvent(typed)
 		case *Query:
 			s.processQuery(typed)
+		case HealthEvent, *HealthEvent:
+			// Health is local and recomputed after a restart
+		case PartitionEvent, *PartitionEvent:
+			// Partitions are detected again from the members after a restart
 		default:
 			s.logger.Printf("[ERR] serf: Unknown event to snapshot: %#v", e)
 		}
@@ -273,7 +357,7 @@ func (s *Snapshotter) stream() {
 
 			// If we plan to re-join, keep our state
 			if !s.rejoinAfterLeave {
-				s.aliveNodes = make(map[string]string)
+				s.clearAlive()
 			}
 			s.tryAppend("leave\n")
 			if err := s.buffered.Flush(); err != nil {
@@ -328,7 +412,7 @@ func (s *Snapshotter) processMemberEvent(e MemberEvent) {
 	case EventMemberJoin:
 		for _, mem := range e.Members {
 			addr := net.TCPAddr{IP: mem.Addr, Port: int(mem.Port)}
-			s.aliveNodes[mem.Name] = addr.String()
+			s.setAlive(mem.Name, addr.String())
 			s.tryAppend(fmt.Sprintf("alive: %s %s\n", mem.Name, addr.String()))
 		}
 
@@ -336,7 +420,7 @@ func (s *Snapshotter) processMemberEvent(e MemberEvent) {
 		fallthrough
 	case EventMemberFailed:
 		for _, mem := range e.Members {
-			delete(s.aliveNodes, mem.Name)
+			s.setNotAlive(mem.Name)
 			s.tryAppend(fmt.Sprintf("not-alive: %s\n", mem.Name))
 		}
 	}
@@ -410,9 +494,10 @@ func (s *Snapshotter) appendLine(l string) error {
 		}
 	}
 
-	// Check if a compaction is necessary
+	// Check if a compaction is necessary, but avoid thrashing by
+	// honoring the minimum interval between compactions
 	s.offset += int64(n)
-	if s.offset > s.snapshotMaxSize() {
+	if s.offset > s.snapshotMaxSize() && now.Sub(s.lastCompaction) >= s.minCompactInterval {
 		return s.compact()
 	}
 	return nil
@@ -434,6 +519,7 @@ func (s *Snapshotter) snapshotMaxSize() int64 {
 // Compact is used to compact the snapshot once it is too large
 func (s *Snapshotter) compact() error {
 	defer metrics.MeasureSinceWithLabels([]string{"serf", "snapshot", "compact"}, time.Now(), s.metricLabels)
+	oldOffset := s.offset
 
 	// Try to open the file to new fiel
 	newPath := s.path + tmpExt
@@ -445,10 +531,12 @@ func (s *Snapshotter) compact() error {
 	// Create a buffered writer
 	buf := bufio.NewWriter(fh)
 
-	// Write out the live nodes
+	// Write out the live nodes, least recently seen first so that the
+	// order is preserved when the new snapshot is replayed
 	var offset int64
-	for name, addr := range s.aliveNodes {
-		line := fmt.Sprintf("alive: %s %s\n", name, addr)
+	names := s.aliveByRecency()
+	for i := len(names) - 1; i >= 0; i-- {
+		line := fmt.Sprintf("alive: %s %s\n", names[i], s.aliveNodes[names[i]])
 		n, err := buf.WriteString(line)
 		if err != nil {
 			fh.Close()
@@ -486,6 +574,7 @@ func (s *Snapshotter) compact() error {
 	err = buf.Flush()
 
 	if err != nil {
+		fh.Close()
 		return fmt.Errorf("failed to flush new snapshot: %v", err)
 	}
 
@@ -536,6 +625,8 @@ func (s *Snapshotter) compact() error {
 	s.buffered = buf
 	s.offset = offset
 	s.lastFlush = time.Now()
+	s.lastCompaction = s.lastFlush
+	s.logger.Printf("[INFO] serf: Compacted snapshot from %d to %d bytes", oldOffset, offset)
 	return nil
 }
 
@@ -550,11 +641,24 @@ func (s *Snapshotter) replay() error {
 
 	// Read each line
 	reader := bufio.NewReader(s.fh)
+	var offset int64
 	for {
 		line, err := reader.ReadString('\n')
-		if err != nil {
+		if err == io.EOF && line != "" {
+			// A crash mid-write can leave a partial last line. Drop it, or
+			// the next line we append would be glued onto it.
+			s.logger.Printf("[WARN] serf: Dropping partial line at the end of snapshot: %q", line)
+			if err := s.fh.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate snapshot: %v", err)
+			}
+			s.offset = offset
+			break
+		} else if err == io.EOF {
 			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read snapshot: %v", err)
 		}
+		offset += int64(len(line))
 
 		// Skip the newline
 		line = line[:len(line)-1]
@@ -569,11 +673,11 @@ func (s *Snapshotter) replay() error {
 			}
 			addr := info[addrIdx+1:]
 			name := info[:addrIdx]
-			s.aliveNodes[name] = addr
+			s.setAlive(name, addr)
 
 		} else if strings.HasPrefix(line, "not-alive: ") {
 			name := strings.TrimPrefix(line, "not-alive: ")
-			delete(s.aliveNodes, name)
+			s.setNotAlive(name)
 
 		} else if strings.HasPrefix(line, "clock: ") {
 			timeStr := strings.TrimPrefix(line, "clock: ")
@@ -610,7 +714,7 @@ func (s *Snapshotter) replay() error {
 				s.logger.Printf("[INFO] serf: Ignoring previous leave in snapshot")
 				continue
 			}
-			s.aliveNodes = make(map[string]string)
+			s.clearAlive()
 			s.lastClock = 0
 			s.lastEventClock = 0
 			s.lastQueryClock = 0
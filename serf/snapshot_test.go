@@ -4,11 +4,14 @@
 package serf
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -167,6 +170,50 @@ func TestSnapshotter(t *testing.T) {
 	snap.Wait()
 }
 
+func TestSnapshotter_localEvents(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	clock := new(LamportClock)
+	outCh := make(chan Event, 64)
+	stopCh := make(chan struct{})
+	logs := &syncBuffer{}
+	logger := log.New(logs, "", log.LstdFlags)
+	inCh, snap, err := NewSnapshotter(td+"snap", snapshotSizeLimit, false,
+		logger, clock, outCh, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Health and partition events are passed through but not recorded
+	events := []Event{
+		&HealthEvent{Score: 3, Threshold: 2, Degraded: true},
+		&PartitionEvent{Partitioned: true, Alive: 1, Failed: 2},
+	}
+	for _, e := range events {
+		inCh <- e
+	}
+	for _, want := range events {
+		select {
+		case e := <-outCh:
+			if !reflect.DeepEqual(e, want) {
+				t.Fatalf("bad: %#v", e)
+			}
+		case <-time.After(200 * time.Millisecond):
+			t.Fatalf("timeout")
+		}
+	}
+
+	close(stopCh)
+	snap.Wait()
+	if strings.Contains(logs.String(), "[ERR]") {
+		t.Fatalf("bad: %s", logs.String())
+	}
+}
+
 func TestSnapshotter_forceCompact(t *testing.T) {
 	td, err := ioutil.TempDir("", "serf")
 	if err != nil {
@@ -231,6 +278,178 @@ func TestSnapshotter_forceCompact(t *testing.T) {
 	snap.Wait()
 }
 
+func TestSnapshotter_recentAliveNodes(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	// Write out a large synthetic snapshot, where every tenth node
+	// has since failed
+	path := filepath.Join(td, "snap")
+	var buf bytes.Buffer
+	for i := 0; i < 10000; i++ {
+		buf.WriteString(fmt.Sprintf("alive: node-%d 127.0.0.1:%d\n", i, i))
+	}
+	for i := 0; i < 10000; i += 10 {
+		buf.WriteString(fmt.Sprintf("not-alive: node-%d\n", i))
+	}
+	// A node seen again moves to the front
+	buf.WriteString("alive: node-5 127.0.0.1:5\n")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	clock := new(LamportClock)
+	stopCh := make(chan struct{})
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	_, snap, err := NewSnapshotter(path, snapshotSizeLimit, false,
+		logger, clock, nil, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer func() {
+		close(stopCh)
+		snap.Wait()
+	}()
+
+	if n := snap.NumAliveNodes(); n != 9000 {
+		t.Fatalf("bad: %d", n)
+	}
+	if n := len(snap.AliveNodes()); n != 9000 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// Only the most recent nodes are replayed, most recent first
+	prev := snap.RecentAliveNodes(4)
+	expected := []*PreviousNode{
+		{"node-5", "127.0.0.1:5"},
+		{"node-9999", "127.0.0.1:9999"},
+		{"node-9998", "127.0.0.1:9998"},
+		{"node-9997", "127.0.0.1:9997"},
+	}
+	if !reflect.DeepEqual(prev, expected) {
+		t.Fatalf("bad: %v", prev)
+	}
+}
+
+func TestSnapshotter_partialLine(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	// Simulate a crash in the middle of writing the last line
+	path := filepath.Join(td, "snap")
+	complete := "alive: foo 127.0.0.1:5000\nclock: 5\n"
+	if err := ioutil.WriteFile(path, []byte(complete+"alive: bar 127.0"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	clock := new(LamportClock)
+	stopCh := make(chan struct{})
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	inCh, snap, err := NewSnapshotter(path, snapshotSizeLimit, false,
+		logger, clock, nil, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := snap.NumAliveNodes(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if snap.LastClock() != 5 {
+		t.Fatalf("bad: %d", snap.LastClock())
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(raw) != complete {
+		t.Fatalf("bad: %q", raw)
+	}
+
+	// New lines are appended cleanly after the dropped one
+	inCh <- MemberEvent{
+		Type:    EventMemberJoin,
+		Members: []Member{{Name: "baz", Addr: []byte{127, 0, 0, 1}, Port: 5001}},
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(stopCh)
+	snap.Wait()
+
+	stopCh = make(chan struct{})
+	_, snap, err = NewSnapshotter(path, snapshotSizeLimit, false,
+		logger, clock, nil, stopCh)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer func() {
+		close(stopCh)
+		snap.Wait()
+	}()
+
+	expected := []*PreviousNode{
+		{"baz", "127.0.0.1:5001"},
+		{"foo", "127.0.0.1:5000"},
+	}
+	if prev := snap.RecentAliveNodes(10); !reflect.DeepEqual(prev, expected) {
+		t.Fatalf("bad: %v", prev)
+	}
+}
+
+func TestSnapshotter_compactionThreshold(t *testing.T) {
+	td, err := ioutil.TempDir("", "serf")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	// writeEvents writes enough user events to blow well past the
+	// threshold, then shuts down the snapshotter and returns the size of
+	// the file left on disk.
+	writeEvents := func(path string, threshold int, interval time.Duration) int64 {
+		clock := new(LamportClock)
+		stopCh := make(chan struct{})
+		logger := log.New(os.Stderr, "", log.LstdFlags)
+		inCh, snap, err := NewSnapshotterWithCompactInterval(path, threshold, interval, false,
+			logger, clock, nil, stopCh)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		for i := 1; i <= 1024; i++ {
+			inCh <- UserEvent{LTime: LamportTime(i)}
+		}
+		for len(inCh) > 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		close(stopCh)
+		snap.Wait()
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return fi.Size()
+	}
+
+	// With no interval, compaction keeps the file near the threshold
+	size := writeEvents(td+"snap", 1024, 0)
+	if size > 1024+64 {
+		t.Fatalf("snapshot was not compacted at threshold, size: %d", size)
+	}
+
+	// With a long interval, only the first compaction happens and the
+	// file is allowed to grow past the threshold afterwards
+	size = writeEvents(td+"snap-interval", 1024, time.Hour)
+	if size <= 4*1024 {
+		t.Fatalf("snapshot compacted more than once, size: %d", size)
+	}
+}
+
 func TestSnapshotter_leave(t *testing.T) {
 	td, err := ioutil.TempDir("", "serf")
 	if err != nil {
@@ -0,0 +1,102 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// sharedTransport wraps the memberlist transport so that it outlives the
+// memberlist using it. Pause, Resume and Rename replace the memberlist,
+// and the new one picks up the same sockets instead of having to bind
+// them again. The transport is only shut down along with Serf.
+type sharedTransport struct {
+	memberlist.NodeAwareTransport
+}
+
+// newSharedTransport wraps the transport from the memberlist config, or
+// sets up a network transport the same way memberlist would if none was
+// given. Like memberlist, it fills in the bind port picked by the OS if
+// port 0 was configured.
+func newSharedTransport(conf *memberlist.Config) (*sharedTransport, error) {
+	if conf.Transport != nil {
+		if nat, ok := conf.Transport.(memberlist.NodeAwareTransport); ok {
+			return &sharedTransport{nat}, nil
+		}
+		return &sharedTransport{&addressTransport{conf.Transport}}, nil
+	}
+
+	logger := conf.Logger
+	if logger == nil {
+		logOutput := conf.LogOutput
+		if logOutput == nil {
+			logOutput = os.Stderr
+		}
+		logger = log.New(logOutput, "", log.LstdFlags)
+	}
+	nc := &memberlist.NetTransportConfig{
+		BindAddrs:    []string{conf.BindAddr},
+		BindPort:     conf.BindPort,
+		Logger:       logger,
+		MetricLabels: conf.MetricLabels,
+	}
+
+	// Binding the same dynamic port for both TCP and UDP is racy, so give
+	// it a few tries when the OS is picking the port
+	limit := 1
+	if conf.BindPort == 0 {
+		limit = 10
+	}
+	var nt *memberlist.NetTransport
+	var err error
+	for try := 0; try < limit; try++ {
+		if nt, err = memberlist.NewNetTransport(nc); err == nil {
+			break
+		}
+		if !strings.Contains(err.Error(), "address already in use") {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not set up network transport: %v", err)
+	}
+	if conf.BindPort == 0 {
+		port := nt.GetAutoBindPort()
+		conf.BindPort = port
+		conf.AdvertisePort = port
+	}
+	return &sharedTransport{nt}, nil
+}
+
+// Shutdown is called by memberlist when it shuts down, and is ignored so
+// the transport can be handed to the next memberlist.
+func (t *sharedTransport) Shutdown() error {
+	return nil
+}
+
+// close shuts down the underlying transport.
+func (t *sharedTransport) close() error {
+	return t.NodeAwareTransport.Shutdown()
+}
+
+// addressTransport adapts a plain memberlist Transport, which only knows
+// about addresses, to the NodeAwareTransport interface.
+type addressTransport struct {
+	memberlist.Transport
+}
+
+func (t *addressTransport) WriteToAddress(b []byte, addr memberlist.Address) (time.Time, error) {
+	return t.WriteTo(b, addr.Addr)
+}
+
+func (t *addressTransport) DialAddressTimeout(addr memberlist.Address, timeout time.Duration) (net.Conn, error) {
+	return t.DialTimeout(addr.Addr, timeout)
+}
@@ -0,0 +1,157 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// NodeVersion is the version information reported by a single member in
+// response to QueryVersions.
+type NodeVersion struct {
+	// Version is the BuildVersion configured on the member
+	Version string
+
+	// Protocol is the Serf protocol version the member speaks, along
+	// with the range of protocol versions it understands
+	Protocol    uint8
+	ProtocolMin uint8
+	ProtocolMax uint8
+
+	// GoVersion is the Go runtime the member was built with
+	GoVersion string
+}
+
+// VersionResponse is used to relay the results of a version query
+type VersionResponse struct {
+	// NumNodes is the number of members we expected to respond
+	NumNodes int
+
+	// NumResp is the number of members that responded
+	NumResp int
+
+	// Versions maps the name of each member that responded to the
+	// versions it reported
+	Versions map[string]NodeVersion
+
+	// Messages holds an error message for any member whose response
+	// could not be decoded
+	Messages map[string]string
+}
+
+// QueryVersions sends a query to all members asking which versions they
+// are running, and collects the responses. This is useful to confirm that
+// the whole cluster has been upgraded before raising the protocol version.
+func (s *Serf) QueryVersions() (*VersionResponse, error) {
+	resp := &VersionResponse{
+		Versions: make(map[string]NodeVersion),
+		Messages: make(map[string]string),
+	}
+
+	queryResp, err := s.Query(internalQueryName(versionQuery), nil, s.DefaultQueryParams())
+	if err != nil {
+		return resp, err
+	}
+
+	resp.NumNodes = s.Memberlist().NumMembers()
+	for r := range queryResp.respCh {
+		resp.NumResp++
+
+		var version NodeVersion
+		if len(r.Payload) < 1 || messageType(r.Payload[0]) != messageVersionResponseType {
+			resp.Messages[r.From] = fmt.Sprintf(
+				"Invalid version query response type: %v", r.Payload)
+		} else if err := decodeMessage(r.Payload[1:], &version); err != nil {
+			resp.Messages[r.From] = fmt.Sprintf(
+				"Failed to decode version query response: %v", err)
+		} else {
+			resp.Versions[r.From] = version
+		}
+
+		// Return early if all nodes have responded
+		if resp.NumResp == resp.NumNodes {
+			break
+		}
+	}
+
+	if resp.NumResp != resp.NumNodes {
+		return resp, fmt.Errorf("%d/%d nodes reported their version",
+			resp.NumResp, resp.NumNodes)
+	}
+	return resp, nil
+}
+
+// checkVersionDrift periodically queries the versions of all members and
+// warns about any that speak a different protocol version than we do.
+// Members that don't answer the query, such as nodes running a release
+// from before it existed, are checked against the protocol versions they
+// advertise in gossip instead.
+func (s *Serf) checkVersionDrift() {
+	for {
+		select {
+		case <-time.After(s.config.VersionCheckInterval):
+			resp, err := s.QueryVersions()
+			if err != nil {
+				s.logger.Printf("[DEBUG] serf: Version check incomplete: %v", err)
+			}
+
+			members := s.Members()
+			versions := memberVersions(resp.Versions, members)
+			drifted := protocolDrift(s.config.ProtocolVersion, versions)
+			metrics.SetGaugeWithLabels([]string{"serf", "version", "drift"}, float32(len(drifted)), s.metricLabels)
+			for _, name := range drifted {
+				s.logger.Printf("[WARN] serf: Member %s uses protocol version %d, local node uses %d",
+					name, versions[name].Protocol, s.config.ProtocolVersion)
+			}
+
+			mlVersion := s.config.MemberlistConfig.ProtocolVersion
+			for _, m := range members {
+				if m.Status == StatusAlive && m.ProtocolCur != mlVersion {
+					s.logger.Printf("[WARN] serf: Member %s uses memberlist protocol version %d, local node uses %d",
+						m.Name, m.ProtocolCur, mlVersion)
+				}
+			}
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// memberVersions returns the versions reported to a version query, filled
+// in for every alive member that didn't respond from the Serf protocol
+// versions it advertises in gossip.
+func memberVersions(reported map[string]NodeVersion, members []Member) map[string]NodeVersion {
+	versions := make(map[string]NodeVersion, len(members))
+	for _, m := range members {
+		if m.Status != StatusAlive {
+			continue
+		}
+		versions[m.Name] = NodeVersion{
+			Protocol:    m.DelegateCur,
+			ProtocolMin: m.DelegateMin,
+			ProtocolMax: m.DelegateMax,
+		}
+	}
+	for name, v := range reported {
+		versions[name] = v
+	}
+	return versions
+}
+
+// protocolDrift returns the sorted names of the members whose protocol
+// version differs from the local one.
+func protocolDrift(local uint8, versions map[string]NodeVersion) []string {
+	var drifted []string
+	for name, v := range versions {
+		if v.Protocol != local {
+			drifted = append(drifted, name)
+		}
+	}
+	sort.Strings(drifted)
+	return drifted
+}
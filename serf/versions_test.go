@@ -0,0 +1,191 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package serf
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/testutil"
+	"github.com/hashicorp/serf/testutil/retry"
+)
+
+func TestSerf_QueryVersions(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	ip3, returnFn3 := testutil.TakeIP()
+	defer returnFn3()
+
+	// Build a cluster mid-upgrade, with one node on an older release
+	versions := []struct {
+		ip       net.IP
+		version  string
+		protocol uint8
+	}{
+		{ip1, "0.9.0", 5},
+		{ip2, "0.8.2", 4},
+		{ip3, "0.9.0", 5},
+	}
+
+	var members []*Serf
+	for _, v := range versions {
+		conf := testConfig(t, v.ip)
+		conf.BuildVersion = v.version
+		conf.ProtocolVersion = v.protocol
+		s, err := Create(conf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer s.Shutdown()
+		members = append(members, s)
+	}
+	s1 := members[0]
+
+	for _, s := range members[1:] {
+		addr := s.config.NodeName + "/" + s.config.MemberlistConfig.BindAddr
+		if _, err := s1.Join([]string{addr}, false); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	waitUntilNumNodes(t, 3, members...)
+
+	resp, err := s1.QueryVersions()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.NumNodes != 3 || resp.NumResp != 3 || len(resp.Messages) != 0 {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	for i, v := range versions {
+		name := members[i].config.NodeName
+		got, ok := resp.Versions[name]
+		if !ok {
+			t.Fatalf("missing %s: %#v", name, resp.Versions)
+		}
+		expected := NodeVersion{
+			Version:     v.version,
+			Protocol:    v.protocol,
+			ProtocolMin: ProtocolVersionMin,
+			ProtocolMax: ProtocolVersionMax,
+			GoVersion:   runtime.Version(),
+		}
+		if got != expected {
+			t.Fatalf("bad: %#v", got)
+		}
+	}
+}
+
+func TestProtocolDrift(t *testing.T) {
+	versions := map[string]NodeVersion{
+		"a": {Protocol: 5},
+		"b": {Protocol: 4},
+		"c": {Protocol: 5},
+		"d": {Protocol: 3},
+	}
+	drifted := protocolDrift(5, versions)
+	if !reflect.DeepEqual(drifted, []string{"b", "d"}) {
+		t.Fatalf("bad: %#v", drifted)
+	}
+	if drifted := protocolDrift(5, nil); len(drifted) != 0 {
+		t.Fatalf("bad: %#v", drifted)
+	}
+}
+
+func TestMemberVersions(t *testing.T) {
+	reported := map[string]NodeVersion{
+		"a": {Version: "0.9.0", Protocol: 5},
+	}
+	members := []Member{
+		{Name: "a", Status: StatusAlive, DelegateCur: 5},
+		{Name: "b", Status: StatusAlive, DelegateMin: 2, DelegateCur: 4, DelegateMax: 4},
+		{Name: "c", Status: StatusFailed, DelegateCur: 3},
+	}
+	versions := memberVersions(reported, members)
+	expected := map[string]NodeVersion{
+		"a": {Version: "0.9.0", Protocol: 5},
+		"b": {Protocol: 4, ProtocolMin: 2, ProtocolMax: 4},
+	}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Fatalf("bad: %#v", versions)
+	}
+	if drifted := protocolDrift(5, versions); !reflect.DeepEqual(drifted, []string{"b"}) {
+		t.Fatalf("bad: %#v", drifted)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe to log to from the
+// background goroutines while a test reads it.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestSerf_checkVersionDrift(t *testing.T) {
+	ip1, returnFn1 := testutil.TakeIP()
+	defer returnFn1()
+
+	ip2, returnFn2 := testutil.TakeIP()
+	defer returnFn2()
+
+	logs := &syncBuffer{}
+	s1Config := testConfig(t, ip1)
+	s1Config.ProtocolVersion = 5
+	s1Config.VersionCheckInterval = 100 * time.Millisecond
+	s1Config.Logger = log.New(logs, "", log.LstdFlags)
+
+	s2Config := testConfig(t, ip2)
+	s2Config.ProtocolVersion = 4
+
+	s1, err := Create(s1Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s1.Shutdown()
+
+	s2, err := Create(s2Config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s2.Shutdown()
+
+	_, err = s1.Join([]string{s2Config.NodeName + "/" + s2Config.MemberlistConfig.BindAddr}, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitUntilNumNodes(t, 2, s1, s2)
+
+	expected := "[WARN] serf: Member " + s2Config.NodeName + " uses protocol version 4, local node uses 5"
+	retry.Run(t, func(r *retry.R) {
+		if !strings.Contains(logs.String(), expected) {
+			r.Fatalf("missing warning in logs")
+		}
+	})
+	if strings.Contains(logs.String(), "Member "+s1Config.NodeName+" uses") {
+		t.Fatalf("bad: %s", logs.String())
+	}
+}